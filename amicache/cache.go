@@ -9,14 +9,18 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"sort"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
@@ -29,6 +33,9 @@ import (
 // The minimum time allowed between cache updates.
 const minCacheTTL = 5 * time.Minute
 
+// The default region used to make ec2:DescribeRegions API requests.
+const defaultDiscoveryRegion = "us-east-1"
+
 // Option is the option interface. It has private methods to prevent its use
 // from outside of this package.
 type Option interface {
@@ -65,6 +72,37 @@ func Regions(regions ...string) Option {
 			for _, region := range regions {
 				c.regions[region] = struct{}{}
 			}
+			c.regionsConfigured = true
+		}
+	})
+}
+
+// DiscoverRegions determines if the regions enabled in each owner's account
+// should be discovered using ec2:DescribeRegions. If Regions is also set, it
+// is used to restrict the discovered regions.
+func DiscoverRegions(discover bool) Option {
+	return optionFunc(func(c *Cache) {
+		c.discoverRegions = discover
+	})
+}
+
+// RegionDiscoveryTTL sets the duration between refreshes of the discovered
+// regions.
+func RegionDiscoveryTTL(ttl time.Duration) Option {
+	return optionFunc(func(c *Cache) {
+		if ttl > 0 {
+			c.regionTTL = ttl
+		}
+	})
+}
+
+// DiscoveryRegion sets the region used to make the ec2:DescribeRegions API
+// requests of region discovery, which must be in the owners' partition, e.g.
+// "us-gov-west-1" for GovCloud. The default is "us-east-1".
+func DiscoveryRegion(region string) Option {
+	return optionFunc(func(c *Cache) {
+		if region != "" {
+			c.discoveryRegion = region
 		}
 	})
 }
@@ -109,6 +147,29 @@ func MaxRequestRetries(max int) Option {
 	})
 }
 
+// RequestRate sets the sustained number of DescribeImageAttributes API
+// requests per second allowed for a given Owner in a region.
+//
+// This is used to control RequestLimitExceed errors.
+// http://docs.aws.amazon.com/AWSEC2/latest/APIReference/query-api-troubleshooting.html#api-request-rate
+func RequestRate(rate float64) Option {
+	return optionFunc(func(c *Cache) {
+		if rate > 0 {
+			c.requestRate = rate
+		}
+	})
+}
+
+// RequestBurst sets the number of DescribeImageAttributes API requests
+// allowed to exceed the RequestRate for a given Owner in a region.
+func RequestBurst(burst int) Option {
+	return optionFunc(func(c *Cache) {
+		if burst > 0 {
+			c.requestBurst = burst
+		}
+	})
+}
+
 // CollectLaunchPermissions determines if launch permissions should be
 // collected for each AMI.
 func CollectLaunchPermissions(collect bool) Option {
@@ -117,6 +178,26 @@ func CollectLaunchPermissions(collect bool) Option {
 	})
 }
 
+// PermissionTTL sets the duration launch permissions are reused for an AMI
+// that has not changed since they were collected. A ttl of zero collects the
+// launch permissions of every AMI on every cache update.
+func PermissionTTL(ttl time.Duration) Option {
+	return optionFunc(func(c *Cache) {
+		if ttl >= 0 {
+			c.permTTL = ttl
+		}
+	})
+}
+
+// RefreshCooldown sets the minimum duration between on-demand refreshes.
+func RefreshCooldown(cooldown time.Duration) Option {
+	return optionFunc(func(c *Cache) {
+		if cooldown >= 0 {
+			c.refreshCooldown = cooldown
+		}
+	})
+}
+
 // HTTPClient sets the http.Client used for communicating with the AWS APIs.
 func HTTPClient(client *http.Client) Option {
 	return optionFunc(func(c *Cache) {
@@ -126,6 +207,52 @@ func HTTPClient(client *http.Client) Option {
 	})
 }
 
+// EC2Endpoint sets the endpoint URL of the EC2 API, e.g. a VPC endpoint or a
+// local emulator. Any "{region}" in the URL is replaced with the region of the
+// requests. The default AWS endpoints are used if it isn't set.
+func EC2Endpoint(endpoint string) Option {
+	return optionFunc(func(c *Cache) {
+		c.ec2Endpoint = endpoint
+	})
+}
+
+// EC2RegionEndpoints sets the endpoint URLs of the EC2 API in specific regions,
+// keyed by region. They take precedence over EC2Endpoint.
+func EC2RegionEndpoints(endpoints map[string]string) Option {
+	return optionFunc(func(c *Cache) {
+		if c.ec2RegionEndpoints == nil {
+			c.ec2RegionEndpoints = map[string]string{}
+		}
+		for region, endpoint := range endpoints {
+			c.ec2RegionEndpoints[region] = endpoint
+		}
+	})
+}
+
+// OwnerAliases sets human-readable aliases for owner IDs, keyed by owner ID.
+func OwnerAliases(aliases map[string]string) Option {
+	return optionFunc(func(c *Cache) {
+		for owner, alias := range aliases {
+			c.ownerAliases[owner] = alias
+		}
+	})
+}
+
+// AddSource adds a source of images, which are cached along with the images
+// from EC2. The source is updated every ttl, or every cache TTL if ttl is
+// zero, and as soon as it changes if it's a Watcher. The name identifies the
+// source in the status of its partitions and must be unique.
+func AddSource(name string, source ImageSource, ttl time.Duration) Option {
+	return optionFunc(func(c *Cache) {
+		c.sources = append(c.sources, &sourceState{
+			name:   name,
+			source: source,
+			ttl:    ttl,
+			status: map[Partition]PartitionStatus{},
+		})
+	})
+}
+
 // Logger sets the go-kit logger.
 func Logger(logger log.Logger) Option {
 	return optionFunc(func(c *Cache) {
@@ -137,58 +264,134 @@ func Logger(logger log.Logger) Option {
 
 // Cache manages the images polled from AWS.
 type Cache struct {
-	svc                stsiface.STSAPI     // The AWS STS service API client
-	roleName           string              // The role assumed in targeted accounts
-	ownerIDs           []string            // Owner IDs used to filter AMI results
-	cache              map[string]Image    // The cache of AMIs
-	regionIndex        map[string][]string // Image IDs index by region
-	mu                 sync.RWMutex        // guards cache and regionIndex
-	regions            map[string]struct{} // The list of regions polled for AMIs
-	tagFilter          string              // The name of a tag used to filter ec2:DescribeImages
-	stateTag           string              // The name of a tag used to determine the state of an AMI
-	ttl                time.Duration       // Duration between updates to the cache (default: 15m)
-	maxRequests        int                 // Max number of goroutines used for DescribeImageAttributes API requests.
-	maxRetries         int                 // Max number of retries for DescribeImageAttributes API requests.
-	collectLaunchPerms bool                // If launch permissions should be collected for the AMIs
-	httpClient         *http.Client        // HTTP client used to communicate with AWS
-	logger             log.Logger          // go-kit logger
-	quitCh             chan chan struct{}  // Used to signal stopping the cache
-	running            int32               // accessed atomically (non-zero means it's running)
+	svc                stsiface.STSAPI                 // The AWS STS service API client
+	roleName           string                          // The role assumed in targeted accounts
+	ownerIDs           []string                        // Owner IDs used to filter AMI results
+	ownerAliases       map[string]string               // Human-readable aliases for owner IDs
+	cache              map[string]Image                // The cache of AMIs
+	regionIndex        map[string][]string             // Image IDs index by region
+	status             map[Partition]PartitionStatus   // Status of the last update by partition
+	ownerErrs          map[string]error                // Errors assuming role by owner
+	generation         uint64                          // Incremented every time the cached images change
+	changes            []ChangeSet                     // Recent change sets, oldest first
+	changed            chan struct{}                   // Closed when a change set is recorded
+	modified           time.Time                       // When the cached images last changed
+	nextUpdate         time.Time                       // When the next scheduled cache update starts
+	warm               bool                            // If the first cache update completed
+	updating           int                             // Number of cache updates running
+	eventUpdates       map[string]time.Time            // When images were updated or removed by events during cache updates, by ID
+	mu                 sync.RWMutex                    // guards cache, regionIndex, status, ownerErrs, ownerRegions, generation, changes, changed, modified, nextUpdate, warm, updating, eventUpdates, done and the sources' status
+	regions            map[string]struct{}             // The list of regions polled for AMIs
+	regionsConfigured  bool                            // If the regions were set with the Regions option
+	discoverRegions    bool                            // If regions are discovered with ec2:DescribeRegions
+	regionTTL          time.Duration                   // Duration between region discoveries
+	discoveryRegion    string                          // The region used to discover regions
+	ownerRegions       map[string]discoveredRegions    // Discovered regions indexed by owner
+	tagFilter          string                          // The name of a tag used to filter ec2:DescribeImages
+	stateTag           string                          // The name of a tag used to determine the state of an AMI
+	ttl                time.Duration                   // Duration between updates to the cache (default: 15m)
+	maxRequests        int                             // Max number of concurrent DescribeImageAttributes API requests.
+	maxRetries         int                             // Max number of retries for DescribeImageAttributes API requests.
+	requestRate        float64                         // Requests per second allowed for DescribeImageAttributes API requests.
+	requestBurst       int                             // Burst of requests allowed for DescribeImageAttributes API requests.
+	backoffBase        time.Duration                   // Base delay used to back off throttled requests
+	backoffMax         time.Duration                   // Max delay used to back off throttled requests
+	limiters           map[Partition]*partitionLimiter // Request limiters by partition
+	limitersMu         sync.Mutex                      // guards limiters
+	collectLaunchPerms bool                            // If launch permissions should be collected for the AMIs
+	permTTL            time.Duration                   // Duration launch permissions are reused for unchanged AMIs
+	httpClient         *http.Client                    // HTTP client used to communicate with AWS
+	ec2Endpoint        string                          // Endpoint URL of the EC2 API, empty for the default
+	ec2RegionEndpoints map[string]string               // Endpoint URLs of the EC2 API by region
+	sources            []*sourceState                  // Sources of images other than EC2
+	logger             log.Logger                      // go-kit logger
+	quitCh             chan struct{}                   // Used to signal stopping the cache
+	done               chan struct{}                   // Closed when the last Run returns
+	refreshCh          chan struct{}                   // Used to signal a pending on-demand refresh
+	refreshCooldown    time.Duration                   // Minimum duration between on-demand refreshes
+	pending            *RefreshStatus                  // The pending on-demand refresh
+	refreshes          map[string]*RefreshStatus       // Recent on-demand refreshes by ID
+	refreshOrder       []string                        // Recent on-demand refresh IDs, oldest first
+	refreshSeq         uint64                          // The last on-demand refresh ID
+	lastRefresh        time.Time                       // When the last on-demand refresh was requested
+	refreshMu          sync.Mutex                      // guards pending, refreshes, refreshOrder, refreshSeq and lastRefresh
+	running            int32                           // accessed atomically (non-zero means it's running)
 
 	// Used to mock out creating an ec2 service for testing.
 	ec2Svc func(*session.Session, string, int) ec2iface.EC2API
 }
 
-// New returns a Cache with sensible defaults if none are provided.
+// New returns a Cache with sensible defaults if none are provided. If svc is
+// nil, EC2 is disabled and the images are only read from the sources added
+// with AddSource.
 func New(svc stsiface.STSAPI, roleName string, ownerIDs []string, options ...Option) *Cache {
 	c := Cache{
-		svc:         svc,
-		roleName:    roleName,
-		ownerIDs:    ownerIDs,
-		cache:       map[string]Image{},
-		regionIndex: map[string][]string{},
-		regions:     awsStdRegions(),
-		stateTag:    DefaultStateTag,
-		ttl:         15 * time.Minute,
-		maxRequests: 15,
-		maxRetries:  5,
-		httpClient:  http.DefaultClient,
-		logger:      log.NewNopLogger(),
-		quitCh:      make(chan chan struct{}),
-		ec2Svc: func(sess *session.Session, region string, maxRetries int) ec2iface.EC2API {
-			return ec2.New(sess, aws.NewConfig().
-				WithRegion(region).
-				WithMaxRetries(maxRetries),
-			)
-		},
+		svc:             svc,
+		roleName:        roleName,
+		ownerIDs:        ownerIDs,
+		ownerAliases:    map[string]string{},
+		cache:           map[string]Image{},
+		regionIndex:     map[string][]string{},
+		status:          map[Partition]PartitionStatus{},
+		ownerErrs:       map[string]error{},
+		eventUpdates:    map[string]time.Time{},
+		changed:         make(chan struct{}),
+		regions:         awsStdRegions(),
+		regionTTL:       time.Hour,
+		discoveryRegion: defaultDiscoveryRegion,
+		ownerRegions:    map[string]discoveredRegions{},
+		stateTag:        DefaultStateTag,
+		ttl:             15 * time.Minute,
+		maxRequests:     15,
+		maxRetries:      5,
+		requestRate:     10,
+		requestBurst:    20,
+		backoffBase:     250 * time.Millisecond,
+		backoffMax:      20 * time.Second,
+		limiters:        map[Partition]*partitionLimiter{},
+		httpClient:      http.DefaultClient,
+		logger:          log.NewNopLogger(),
+		quitCh:          make(chan struct{}),
+		refreshCh:       make(chan struct{}, 1),
+		refreshes:       map[string]*RefreshStatus{},
+		refreshCooldown: time.Minute,
+		permTTL:         time.Hour,
 	}
+	c.ec2Svc = c.newEC2Svc
 	c.setOptions(options)
 	return &c
 }
 
+// newEC2Svc returns an EC2 API client for the region, using the configured
+// endpoint if there is one.
+func (c *Cache) newEC2Svc(sess *session.Session, region string, maxRetries int) ec2iface.EC2API {
+	cfg := aws.NewConfig().
+		WithRegion(region).
+		WithMaxRetries(maxRetries)
+	if endpoint := c.endpointFor(region); endpoint != "" {
+		cfg = cfg.WithEndpoint(endpoint)
+	}
+	return ec2.New(sess, cfg)
+}
+
+// endpointFor returns the EC2 endpoint URL of the region, or an empty string
+// if the default endpoint is used.
+func (c *Cache) endpointFor(region string) string {
+	if endpoint, ok := c.ec2RegionEndpoints[region]; ok {
+		return endpoint
+	}
+	return strings.Replace(c.ec2Endpoint, "{region}", region, -1)
+}
+
 var (
 	errCacheRunning = errors.New("cache running")
 	errCacheStopped = errors.New("cache stopped")
+
+	// ErrUnknownRegion is returned for regions that aren't being cached.
+	ErrUnknownRegion = errors.New("unknown or unsupported region")
+
+	// ErrUnknownOwner is returned for owners that aren't being cached.
+	ErrUnknownOwner = errors.New("unknown owner")
 )
 
 // Run starts the cache and keeps it up to date. It closes warmed after the
@@ -198,41 +401,96 @@ func (c *Cache) Run(ctx context.Context, warmed chan struct{}) error {
 		return errCacheRunning
 	}
 
+	done := make(chan struct{})
+	c.mu.Lock()
+	c.done = done
+	c.mu.Unlock()
+	defer close(done)
+
 	atomic.AddInt32(&c.running, 1)
 	defer atomic.AddInt32(&c.running, -1)
 
+	// The image sources are stopped with the cache.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
 	// Use a separate warmed channel in case the provided one is nil.
 	isWarmed := make(chan struct{})
 
+	// Sources are watched before they're first read so no changes are missed.
+	for _, s := range c.sources {
+		var changed <-chan struct{}
+		if w, ok := s.source.(Watcher); ok {
+			changed = w.Watch(ctx)
+		}
+		go c.runSource(ctx, s, changed, isWarmed)
+	}
+
 	go func() {
-		c.updateCache(ctx)
+		var wg sync.WaitGroup
+		for _, s := range c.sources {
+			wg.Add(1)
+			go func(s *sourceState) {
+				defer wg.Done()
+				c.updateSource(ctx, s, allPartitions)
+			}(s)
+		}
+		c.updateCache(ctx, allPartitionsFull)
+		wg.Wait()
+		c.mu.Lock()
+		c.warm = true
+		c.mu.Unlock()
 		close(isWarmed)
 		if warmed != nil {
 			close(warmed)
 		}
 	}()
 
+	// On-demand refreshes don't delay the scheduled updates, so the partitions
+	// outside of their scopes don't go stale.
+	timer := time.NewTimer(c.ttl)
+	defer timer.Stop()
+
+	c.mu.Lock()
+	c.nextUpdate = time.Now().Add(c.ttl)
+	c.mu.Unlock()
+
 	for {
 		select {
-		case <-time.After(c.ttl):
+		case <-timer.C:
 			<-isWarmed // wait just in case the initial update is taking awhile
-			c.updateCache(ctx)
+			c.updateCache(ctx, allPartitions)
+			timer.Reset(c.ttl)
+			c.mu.Lock()
+			c.nextUpdate = time.Now().Add(c.ttl)
+			c.mu.Unlock()
+		case <-c.refreshCh:
+			<-isWarmed
+			c.runRefresh(ctx)
 		case <-ctx.Done():
 			return ctx.Err()
-		case q := <-c.quitCh:
-			close(q)
+		case <-c.quitCh:
 			return errCacheStopped
 		}
 	}
 }
 
-// Stop stops the cache.
+// Stop stops the cache and waits for Run to return. It doesn't block if Run
+// already returned, e.g. because its context was canceled.
 func (c *Cache) Stop() {
-	if c.isRunning() {
-		quit := make(chan struct{})
-		c.quitCh <- quit
-		<-quit
+	c.mu.RLock()
+	done := c.done
+	c.mu.RUnlock()
+
+	if done == nil {
+		return
 	}
+
+	select {
+	case c.quitCh <- struct{}{}:
+	case <-done:
+	}
+	<-done
 }
 
 // Images returns the cached images from the provided region.
@@ -259,12 +517,33 @@ func (c *Cache) FilterImages(region string, filter *Filter) ([]Image, error) {
 	return filter.Apply(images), nil
 }
 
-// Regions returns the list of AWS regions being cached.
+// Regions returns the list of AWS regions being cached. When region discovery
+// is enabled, this is the set of regions discovered across all owners.
 func (c *Cache) Regions() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	regions := []string{}
+	for region := range c.activeRegions() {
+		regions = append(regions, region)
+	}
+	return regions
+}
+
+// OwnerIDs returns the list of owner IDs being cached.
+func (c *Cache) OwnerIDs() []string {
+	return append([]string{}, c.ownerIDs...)
+}
+
+// OwnerRegions returns the sorted list of regions cached for the provided
+// owner.
+func (c *Cache) OwnerRegions(owner string) []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 	regions := []string{}
-	for region := range c.regions {
+	for region := range c.regionsForOwner(owner) {
 		regions = append(regions, region)
 	}
+	sort.Strings(regions)
 	return regions
 }
 
@@ -291,19 +570,43 @@ func (c *Cache) isRunning() bool {
 	return atomic.LoadInt32(&c.running) != 0
 }
 
-// updateCache iterates over AWS accounts and regions to cache the images.
-func (c *Cache) updateCache(ctx context.Context) {
+// updateCache iterates over AWS accounts and regions to cache the images in
+// the provided scope. Images outside of the scope, images from other sources
+// and the images of partitions or owners that fail to update are kept as they
+// are. It does nothing if EC2 is disabled.
+func (c *Cache) updateCache(ctx context.Context, scope updateScope) {
+	if c.svc == nil {
+		return
+	}
+
+	c.mu.Lock()
+	c.updating++
+	c.mu.Unlock()
+
 	var (
-		newCache = map[string]Image{}
-		newIndex = map[string][]string{}
-		doneCh   = make(chan struct{})
-		mu       = sync.Mutex{}
-		wg       = sync.WaitGroup{}
+		started   = time.Now()
+		full      = scope.full()
+		owners    = []string{}
+		newCache  = map[string]Image{}
+		newIndex  = map[string][]string{}
+		newStatus = map[Partition]PartitionStatus{}
+		failed    = map[Partition]struct{}{}
+		ownerErrs = map[string]error{}
+		skipped   = int64(0)
+		doneCh    = make(chan struct{})
+		mu        = sync.Mutex{}
+		wg        = sync.WaitGroup{}
 	)
 
-	wg.Add(len(c.ownerIDs))
-
 	for _, owner := range c.ownerIDs {
+		if scope.matchesOwner(owner) {
+			owners = append(owners, owner)
+		}
+	}
+
+	wg.Add(len(owners))
+
+	for _, owner := range owners {
 		go func(owner string) {
 			defer wg.Done()
 			logger := log.With(c.logger, "owner_id", owner)
@@ -311,27 +614,63 @@ func (c *Cache) updateCache(ctx context.Context) {
 			sess, err := c.assumeRole(owner)
 			if err != nil {
 				level.Warn(logger).Log("cache_update", "failed", "error", awsError(err))
+				mu.Lock()
+				ownerErrs[owner] = awsError(err)
+				mu.Unlock()
 				return
 			}
 
-			wg.Add(len(c.regions))
+			regions := []string{}
+			for region := range c.discoverOwnerRegions(sess, logger, owner) {
+				if scope.matches(Partition{owner, region}) {
+					regions = append(regions, region)
+				}
+			}
+
+			wg.Add(len(regions))
 
-			for region := range c.regions {
+			for _, region := range regions {
 				go func(region string) {
 					defer wg.Done()
 					logger := log.With(logger, "region", region)
 
-					svc := c.ec2Svc(sess, region, c.maxRetries)
-					images, index := getImagesFromOwner(svc, logger, owner, region, c.tagFilter, c.maxRequests, c.collectLaunchPerms)
+					var (
+						svc   = c.ec2Svc(sess, region, c.maxRetries)
+						stats = &updateStats{}
+					)
+
+					images, index, err := c.getImagesFromOwner(ctx, svc, logger, owner, region, full, stats)
+					atomic.AddInt64(&skipped, stats.skipped)
 
 					mu.Lock()
+					if err != nil {
+						failed[Partition{owner, region}] = struct{}{}
+					}
 					newIndex[region] = append(newIndex[region], index...)
 					for _, image := range images {
 						newCache[*image.Image.ImageId] = image
 					}
+					newStatus[Partition{owner, region}] = PartitionStatus{
+						Partition:   Partition{owner, region},
+						ImageCount:  len(images),
+						Throttles:   int(stats.throttles),
+						LastUpdated: time.Now(),
+						Err:         err,
+					}
 					mu.Unlock()
 
-					level.Info(logger).Log("cache_update", "completed", "count", len(images))
+					if err != nil {
+						level.Warn(logger).Log("cache_update", "failed", "error", err)
+						return
+					}
+
+					level.Info(logger).Log(
+						"cache_update", "completed",
+						"count", len(images),
+						"throttled", stats.throttles,
+						"perms_skipped", stats.skipped,
+						"concurrency", c.limiter(Partition{owner, region}).concurrency.current(),
+					)
 				}(region)
 			}
 		}(owner)
@@ -345,13 +684,53 @@ func (c *Cache) updateCache(ctx context.Context) {
 	select {
 	case <-doneCh:
 	case <-ctx.Done():
+		c.mu.Lock()
+		c.endUpdate()
+		c.mu.Unlock()
 		return
 	}
 
 	c.mu.Lock()
+	evented := c.withoutEventUpdates(started, newCache, newIndex, newStatus)
+	c.commitImages(func(image Image) bool {
+		p := Partition{image.OwnerID, image.Region}
+		_, failed := failed[p]
+		_, ownerFailed := ownerErrs[p.OwnerID]
+		_, updated := evented[*image.Image.ImageId]
+		return image.source != "" || !scope.matches(p) || failed || ownerFailed || updated
+	}, newCache, newIndex)
+	c.status = c.mergeStatus(scope, newStatus, ownerErrs)
+	for _, owner := range owners {
+		if err, ok := ownerErrs[owner]; ok {
+			c.ownerErrs[owner] = err
+		} else {
+			delete(c.ownerErrs, owner)
+		}
+	}
+	c.endUpdate()
+	c.mu.Unlock()
+
+	level.Info(c.logger).Log(
+		"cache_update", "finished",
+		"count", len(newCache),
+		"perms_skipped", skipped,
+		"full_refresh", full,
+	)
+}
+
+// commitImages replaces the cached images with the updated images, keeping
+// the cached images that keep returns true for. An updated image takes the
+// place of a kept image with the same ID. The caller must hold c.mu.
+func (c *Cache) commitImages(keep func(Image) bool, newCache map[string]Image, newIndex map[string][]string) {
+	for id, image := range c.cache {
+		if _, updated := newCache[id]; !updated && keep(image) {
+			newCache[id] = image
+			newIndex[image.Region] = append(newIndex[image.Region], id)
+		}
+	}
+	c.recordChanges(diffImages(c.stateTag, c.cache, newCache))
 	c.cache = newCache
 	c.regionIndex = newIndex
-	c.mu.Unlock()
 }
 
 // getImage gets returns an image from the cache if it exists.
@@ -367,8 +746,8 @@ func (c *Cache) idsFromRegion(region string) ([]string, error) {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 
-	if _, ok := c.regions[region]; !ok {
-		return nil, fmt.Errorf("unknown or unsupported region: %s", region)
+	if _, ok := c.activeRegions()[region]; !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownRegion, region)
 	}
 
 	ids, ok := c.regionIndex[region]
@@ -379,6 +758,92 @@ func (c *Cache) idsFromRegion(region string) ([]string, error) {
 	return ids, nil
 }
 
+// A set of AWS regions.
+type regionSet map[string]struct{}
+
+// The regions discovered in an owner's account.
+type discoveredRegions struct {
+	regions regionSet
+	updated time.Time
+}
+
+// activeRegions returns the set of regions cached across all owners. The
+// caller must hold c.mu.
+func (c *Cache) activeRegions() regionSet {
+	if !c.discoverRegions || c.svc == nil {
+		return c.regions
+	}
+	regions := regionSet{}
+	for _, discovered := range c.ownerRegions {
+		for region := range discovered.regions {
+			regions[region] = struct{}{}
+		}
+	}
+	return regions
+}
+
+// regionsForOwner returns the set of regions cached for an owner. The caller
+// must hold c.mu.
+func (c *Cache) regionsForOwner(owner string) regionSet {
+	if !c.discoverRegions || c.svc == nil {
+		return c.regions
+	}
+	if discovered, ok := c.ownerRegions[owner]; ok {
+		return discovered.regions
+	}
+	return regionSet{}
+}
+
+// discoverOwnerRegions returns the regions to poll for an owner. If region
+// discovery is enabled and the owner's regions are older than the region TTL,
+// they are refreshed with ec2:DescribeRegions. On failure the previously
+// discovered regions are kept, or the configured regions are used if they
+// haven't been discovered yet.
+func (c *Cache) discoverOwnerRegions(sess *session.Session, logger log.Logger, owner string) regionSet {
+	if !c.discoverRegions {
+		return c.regions
+	}
+
+	c.mu.RLock()
+	discovered, ok := c.ownerRegions[owner]
+	c.mu.RUnlock()
+
+	if ok && time.Since(discovered.updated) < c.regionTTL {
+		return discovered.regions
+	}
+
+	svc := c.ec2Svc(sess, c.discoveryRegion, c.maxRetries)
+	rsp, err := svc.DescribeRegions(&ec2.DescribeRegionsInput{})
+	if err != nil {
+		level.Warn(logger).Log("region_discovery", "failed", "error", awsError(err))
+		if !ok {
+			// Use the configured regions until discovery succeeds, which is
+			// retried by the next update since they're never fresh.
+			discovered.regions = c.regions
+			c.mu.Lock()
+			c.ownerRegions[owner] = discovered
+			c.mu.Unlock()
+		}
+		return discovered.regions
+	}
+
+	regions := regionSet{}
+	for _, region := range rsp.Regions {
+		name := aws.StringValue(region.RegionName)
+		if _, ok := c.regions[name]; ok || !c.regionsConfigured {
+			regions[name] = struct{}{}
+		}
+	}
+
+	level.Info(logger).Log("region_discovery", "completed", "count", len(regions))
+
+	c.mu.Lock()
+	c.ownerRegions[owner] = discoveredRegions{regions: regions, updated: time.Now()}
+	c.mu.Unlock()
+
+	return regions
+}
+
 // Create a session in the targeted account using a service role.
 func (c *Cache) assumeRole(account string) (*session.Session, error) {
 	rsp, err := c.svc.AssumeRole(&sts.AssumeRoleInput{
@@ -400,25 +865,36 @@ func (c *Cache) assumeRole(account string) (*session.Session, error) {
 	)
 }
 
+// updateStats are the counters collected while updating a Partition. They are
+// accessed atomically.
+type updateStats struct {
+	throttles int64 // Number of throttled API requests
+	skipped   int64 // Number of launch permission requests skipped
+}
+
 // getImagesFromOwner gets the images and assoicated launch permissions from the
 // provided owner. In accounts with a large number of AMIs (~150 or more), this
-// may hit RequestLimitExeeded and trigger retries.
-func getImagesFromOwner(svc ec2iface.EC2API, logger log.Logger, owner, region, tagFilter string, maxReq int, collectLaunch bool) ([]Image, []string) {
+// may hit RequestLimitExeeded, in which case requests are retried with
+// exponential backoff and the number of concurrent requests is reduced.
+//
+// Unless full is true, the launch permissions of an AMI are reused from the
+// cache if the AMI has not changed and they are younger than the permission
+// TTL.
+func (c *Cache) getImagesFromOwner(ctx context.Context, svc ec2iface.EC2API, logger log.Logger, owner, region string, full bool, stats *updateStats) ([]Image, []string, error) {
 	input := &ec2.DescribeImagesInput{
 		Owners: []*string{aws.String(owner)},
 	}
 
-	if tagFilter != "" {
+	if c.tagFilter != "" {
 		input.Filters = []*ec2.Filter{{
 			Name:   aws.String("tag-key"),
-			Values: []*string{aws.String(tagFilter)},
+			Values: []*string{aws.String(c.tagFilter)},
 		}}
 	}
 
 	rsp, err := svc.DescribeImages(input)
 	if err != nil {
-		level.Warn(logger).Log("cache_update", "failed", "error", awsError(err))
-		return []Image{}, []string{}
+		return []Image{}, []string{}, awsError(err)
 	}
 
 	var (
@@ -426,7 +902,7 @@ func getImagesFromOwner(svc ec2iface.EC2API, logger log.Logger, owner, region, t
 		images = []Image{}
 	)
 
-	if !collectLaunch {
+	if !c.collectLaunchPerms {
 		for _, image := range rsp.Images {
 			index = append(index, *image.ImageId)
 			images = append(images, Image{
@@ -435,13 +911,14 @@ func getImagesFromOwner(svc ec2iface.EC2API, logger log.Logger, owner, region, t
 				Region:  region,
 			})
 		}
-		return images, index
+		return images, index, nil
 	}
 
 	var (
 		mu       = sync.Mutex{}
 		wg       = sync.WaitGroup{}
 		workerCh = make(chan *ec2.Image)
+		limiter  = c.limiter(Partition{owner, region})
 	)
 
 	// Get the Launch Permissions for an AMI.
@@ -450,48 +927,135 @@ func getImagesFromOwner(svc ec2iface.EC2API, logger log.Logger, owner, region, t
 		for image := range workerCh {
 			logger := log.With(logger, "image_id", *image.ImageId)
 
-			rsp, err := svc.DescribeImageAttribute(&ec2.DescribeImageAttributeInput{
-				ImageId:   image.ImageId,
-				Attribute: aws.String("launchPermission"),
-			})
+			newImage := Image{Image: image, OwnerID: owner, Region: region}
+
+			// The image is kept with its previous launch permissions, if any,
+			// when they can't be collected, and they're collected again on the
+			// next update.
+			perms, err := c.launchPermissions(ctx, svc, limiter, image.ImageId, stats)
 			if err != nil {
 				level.Warn(logger).Log("cache_update", "failed", "error", awsError(err))
-				continue
+				if cached, ok := c.getImage(*image.ImageId); ok {
+					newImage.launchPerms = cached.launchPerms
+				}
+			} else {
+				level.Debug(logger).Log("perm_count", len(perms))
+				newImage.launchPerms = perms
+				newImage.fingerprint = fingerprint(image)
+				newImage.permsUpdated = time.Now()
 			}
 
-			perms := []string{}
-			for _, perm := range rsp.LaunchPermissions {
-				perms = append(perms, *perm.UserId)
-			}
-
-			level.Debug(logger).Log("perm_count", len(perms))
-
 			mu.Lock()
+			index = append(index, *image.ImageId)
+			images = append(images, newImage)
+			mu.Unlock()
+		}
+	}
+
+	// Reuse the launch permissions of unchanged AMIs.
+	queue := []*ec2.Image{}
+	for _, image := range rsp.Images {
+		if cached, ok := c.getImage(*image.ImageId); ok && !full && c.permsValid(cached, image) {
 			index = append(index, *image.ImageId)
 			images = append(images, Image{
-				Image:       image,
-				OwnerID:     owner,
-				Region:      region,
-				launchPerms: perms,
+				Image:        image,
+				OwnerID:      owner,
+				Region:       region,
+				launchPerms:  cached.launchPerms,
+				fingerprint:  cached.fingerprint,
+				permsUpdated: cached.permsUpdated,
 			})
-			mu.Unlock()
+			continue
 		}
+		queue = append(queue, image)
 	}
 
-	// Allow for a percentage of concurrent API requests.
-	for i := 0; i < poolSize(maxReq, len(rsp.Images), 0.05); i++ {
+	atomic.AddInt64(&stats.skipped, int64(len(images)))
+
+	// The number of requests actually in flight is controlled by the
+	// partition's adaptive limit.
+	for i := 0; i < c.maxRequests && i < len(queue); i++ {
 		wg.Add(1)
 		go worker()
 	}
 
-	for _, image := range rsp.Images {
+	for _, image := range queue {
 		workerCh <- image
 	}
 
 	close(workerCh)
 	wg.Wait()
 
-	return images, index
+	return images, index, nil
+}
+
+// permsValid returns whether the launch permissions of a cached image can be
+// reused for the current version of the image.
+func (c *Cache) permsValid(cached Image, image *ec2.Image) bool {
+	return !cached.permsUpdated.IsZero() &&
+		cached.fingerprint == fingerprint(image) &&
+		time.Since(cached.permsUpdated) < c.permTTL
+}
+
+// Used to disable the SDK's retryer for requests that are retried by the
+// cache.
+func withoutRetries(r *request.Request) {
+	r.Retryer = client.NoOpRetryer{}
+}
+
+// retryable returns whether a failed request should be retried, which are the
+// same requests the SDK's default retryer retries.
+func retryable(err error) bool {
+	if reqErr, ok := err.(awserr.RequestFailure); ok && reqErr.StatusCode() >= 500 {
+		return true
+	}
+	return request.IsErrorRetryable(err) || request.IsErrorThrottle(err)
+}
+
+// launchPermissions returns the account IDs with permission to launch the
+// provided image. Throttled requests, and requests that failed with other
+// retryable errors, are retried up to maxRetries times. Every attempt waits
+// for the partition's limiter.
+func (c *Cache) launchPermissions(ctx context.Context, svc ec2iface.EC2API, limiter *partitionLimiter, id *string, stats *updateStats) ([]string, error) {
+	for attempt := 0; ; attempt++ {
+		if err := limiter.bucket.wait(ctx); err != nil {
+			return nil, err
+		}
+
+		limiter.concurrency.acquire()
+		rsp, err := svc.DescribeImageAttributeWithContext(ctx, &ec2.DescribeImageAttributeInput{
+			ImageId:   id,
+			Attribute: aws.String("launchPermission"),
+		}, withoutRetries)
+		throttled := request.IsErrorThrottle(err)
+		limiter.concurrency.release(throttled)
+
+		if err == nil {
+			perms := []string{}
+			for _, perm := range rsp.LaunchPermissions {
+				perms = append(perms, *perm.UserId)
+			}
+			return perms, nil
+		}
+
+		if !retryable(err) {
+			return nil, err
+		}
+
+		if throttled {
+			atomic.AddInt64(&stats.throttles, 1)
+		}
+
+		if attempt >= c.maxRetries {
+			return nil, err
+		}
+
+		select {
+		case <-time.After(backoff(attempt, c.backoffBase, c.backoffMax)):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
 }
 
 // AWS standard regions provided as a map for fast look-ups.
@@ -513,17 +1077,6 @@ func awsError(err error) error {
 	return err
 }
 
-// A helper function used for getting launch permissions from AMIs.
-func poolSize(max, queue int, percent float64) int {
-	size := int(float64(queue) * percent)
-	if size < 1 {
-		return 1
-	} else if size > max {
-		return max
-	}
-	return size
-}
-
 // The access policy required by ami-query.
 const policyDoc = `{
 	"Version": "2012-10-17",
@@ -531,7 +1084,8 @@ const policyDoc = `{
 		"Effect": "Allow",
 		"Action": [
 			"ec2:DescribeImageAttribute",
-			"ec2:DescribeImages"
+			"ec2:DescribeImages",
+			"ec2:DescribeRegions"
 		],
 		"Resource": "*"
 	}]
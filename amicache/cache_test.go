@@ -6,13 +6,21 @@ package amicache
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
+	"fmt"
 	"net/http"
 	"reflect"
+	"sort"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/intuit/ami-query/awstest"
+
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
@@ -46,6 +54,7 @@ type mockEC2Client struct {
 	// The default implementations return empty values and nil errors.
 	describeImages         func(*ec2.DescribeImagesInput) (*ec2.DescribeImagesOutput, error)
 	describeImageAttribute func(*ec2.DescribeImageAttributeInput) (*ec2.DescribeImageAttributeOutput, error)
+	describeRegions        func(*ec2.DescribeRegionsInput) (*ec2.DescribeRegionsOutput, error)
 }
 
 // DescribeImages mock.
@@ -64,6 +73,19 @@ func (m *mockEC2Client) DescribeImageAttribute(input *ec2.DescribeImageAttribute
 	return m.describeImageAttribute(input)
 }
 
+// DescribeImageAttributeWithContext mock.
+func (m *mockEC2Client) DescribeImageAttributeWithContext(_ aws.Context, input *ec2.DescribeImageAttributeInput, _ ...request.Option) (*ec2.DescribeImageAttributeOutput, error) {
+	return m.DescribeImageAttribute(input)
+}
+
+// DescribeRegions mock.
+func (m *mockEC2Client) DescribeRegions(input *ec2.DescribeRegionsInput) (*ec2.DescribeRegionsOutput, error) {
+	if m.describeRegions == nil {
+		return &ec2.DescribeRegionsOutput{}, nil
+	}
+	return m.describeRegions(input)
+}
+
 // Creates a new cache with a single AMI.
 func newMockCache(opts ...Option) *Cache {
 	svc := &mockSTSClient{
@@ -107,6 +129,15 @@ func newMockCache(opts ...Option) *Cache {
 					},
 				}, nil
 			},
+			describeRegions: func(*ec2.DescribeRegionsInput) (*ec2.DescribeRegionsOutput, error) {
+				return &ec2.DescribeRegionsOutput{
+					Regions: []*ec2.Region{
+						{RegionName: aws.String("us-west-1")},
+						{RegionName: aws.String("us-west-2")},
+						{RegionName: aws.String("ap-east-1")},
+					},
+				}, nil
+			},
 		}
 	}
 
@@ -238,6 +269,36 @@ func TestCacheStopped(t *testing.T) {
 	}
 }
 
+func TestCacheStopAfterCancel(t *testing.T) {
+	var (
+		c           = newMockCache()
+		ctx, cancel = context.WithCancel(context.Background())
+		errCh       = make(chan error)
+		warmed      = make(chan struct{})
+	)
+
+	go func() { errCh <- c.Run(ctx, warmed) }()
+
+	<-warmed
+	cancel()
+
+	stopped := make(chan struct{})
+	go func() {
+		c.Stop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the cache to stop")
+	}
+
+	if want, got := context.Canceled, <-errCh; want != got {
+		t.Errorf("want: %s, got: %s", want, got)
+	}
+}
+
 func TestCacheContextCanceled(t *testing.T) {
 	var (
 		c           = newMockCache()
@@ -267,7 +328,7 @@ func TestImages(t *testing.T) {
 	}{
 		{"no_errors_with_perms", true, "us-west-1", 1, 2, nil},
 		{"no_errors_without_perms", false, "us-west-1", 1, 0, nil},
-		{"invalid_region", false, "us-foo-1", 0, 2, errors.New("unknown or unsupported region: us-foo-1")},
+		{"invalid_region", false, "us-foo-1", 0, 2, fmt.Errorf("%w: us-foo-1", ErrUnknownRegion)},
 	}
 
 	for _, tt := range tests {
@@ -302,6 +363,194 @@ func TestImages(t *testing.T) {
 	}
 }
 
+func TestDiscoverRegions(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+		want []string
+	}{
+		{"all_discovered", []Option{DiscoverRegions(true)}, []string{"ap-east-1", "us-west-1", "us-west-2"}},
+		{"restricted", []Option{DiscoverRegions(true), Regions("us-west-1", "us-east-1")}, []string{"us-west-1"}},
+		{"disabled", []Option{Regions("us-west-1", "us-east-1")}, []string{"us-east-1", "us-west-1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newMockCache(tt.opts...)
+			warmed := make(chan struct{})
+
+			go func() { c.Run(context.Background(), warmed) }()
+
+			defer c.Stop()
+			<-warmed
+
+			got := c.Regions()
+			sort.Strings(got)
+
+			if !reflect.DeepEqual(tt.want, got) {
+				t.Errorf("want: %v, got: %v", tt.want, got)
+			}
+
+			if got := c.OwnerRegions("111122223333"); !reflect.DeepEqual(tt.want, got) {
+				t.Errorf("want: %v, got: %v", tt.want, got)
+			}
+
+			if _, err := c.Images("us-west-1"); err != nil {
+				t.Errorf("want: <nil>, got: %v", err)
+			}
+		})
+	}
+}
+
+func TestDiscoverRegionsFailure(t *testing.T) {
+	tests := []struct {
+		name       string
+		discovered regionSet
+		want       []string
+	}{
+		// The previously discovered regions are kept.
+		{"kept", regionSet{"us-west-2": struct{}{}}, []string{"us-west-2"}},
+		// The configured regions are used until discovery succeeds.
+		{"configured", nil, []string{"us-east-1", "us-west-1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newMockCache(DiscoverRegions(true), Regions("us-west-1", "us-east-1"))
+			if tt.discovered != nil {
+				c.ownerRegions["111122223333"] = discoveredRegions{regions: tt.discovered}
+			}
+
+			fail := true
+			newSvc := c.ec2Svc
+			c.ec2Svc = func(sess *session.Session, region string, retries int) ec2iface.EC2API {
+				svc := newSvc(sess, region, retries).(*mockEC2Client)
+				if fail {
+					svc.describeRegions = func(*ec2.DescribeRegionsInput) (*ec2.DescribeRegionsOutput, error) {
+						return nil, errors.New("UnauthorizedOperation")
+					}
+				}
+				return svc
+			}
+
+			c.updateCache(context.Background(), allPartitions)
+
+			got := c.Regions()
+			sort.Strings(got)
+			if !reflect.DeepEqual(tt.want, got) {
+				t.Errorf("want: %v, got: %v", tt.want, got)
+			}
+
+			// Discovery is retried by the next update.
+			fail = false
+			c.updateCache(context.Background(), allPartitions)
+
+			if want, got := []string{"us-west-1"}, c.Regions(); !reflect.DeepEqual(want, got) {
+				t.Errorf("want: %v, got: %v", want, got)
+			}
+		})
+	}
+}
+
+func TestDiscoveryRegion(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+		want string
+	}{
+		{"default", []Option{DiscoverRegions(true)}, "us-east-1"},
+		{"configured", []Option{DiscoverRegions(true), DiscoveryRegion("us-gov-west-1")}, "us-gov-west-1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newMockCache(tt.opts...)
+
+			var got string
+			newSvc := c.ec2Svc
+			c.ec2Svc = func(sess *session.Session, region string, retries int) ec2iface.EC2API {
+				svc := newSvc(sess, region, retries).(*mockEC2Client)
+				describeRegions := svc.describeRegions
+				svc.describeRegions = func(input *ec2.DescribeRegionsInput) (*ec2.DescribeRegionsOutput, error) {
+					got = region
+					return describeRegions(input)
+				}
+				return svc
+			}
+
+			c.updateCache(context.Background(), allPartitions)
+
+			if tt.want != got {
+				t.Errorf("want: %s, got: %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestUpdateCacheFailure(t *testing.T) {
+	c := newMockCache(Regions("us-west-1", "us-west-2"))
+
+	// Each region has its own image, and DescribeImages fails in the regions
+	// in failing.
+	failing := map[string]bool{}
+	newSvc := c.ec2Svc
+	c.ec2Svc = func(sess *session.Session, region string, retries int) ec2iface.EC2API {
+		svc := newSvc(sess, region, retries).(*mockEC2Client)
+		describeImages := svc.describeImages
+		svc.describeImages = func(input *ec2.DescribeImagesInput) (*ec2.DescribeImagesOutput, error) {
+			if failing[region] {
+				return nil, errors.New("RequestLimitExceeded")
+			}
+			rsp, err := describeImages(input)
+			rsp.Images[0].ImageId = aws.String("ami-" + region)
+			return rsp, err
+		}
+		return svc
+	}
+
+	c.updateCache(context.Background(), allPartitions)
+	generation := c.Generation()
+
+	// The images of a partition that failed to update are kept.
+	failing["us-west-2"] = true
+	c.updateCache(context.Background(), allPartitions)
+
+	// As are the images of an owner whose role can't be assumed.
+	assumeRole := c.svc
+	c.svc = &mockSTSClient{
+		assumeRole: func(*sts.AssumeRoleInput) (*sts.AssumeRoleOutput, error) {
+			return nil, errors.New("AccessDenied")
+		},
+	}
+	c.updateCache(context.Background(), allPartitions)
+
+	if sets, _, _ := c.ChangesSince(generation); len(sets) != 0 {
+		t.Errorf("want: no changes, got: %+v", sets)
+	}
+
+	for _, region := range []string{"us-west-1", "us-west-2"} {
+		if images, _ := c.Images(region); len(images) != 1 {
+			t.Errorf("want: 1 image in %s, got: %d image(s)", region, len(images))
+		}
+	}
+
+	if want, got := 2, c.Status()[0].ImageCount(); want != got {
+		t.Errorf("want: %d image(s), got: %d image(s)", want, got)
+	}
+
+	// Images are removed once the partition updates successfully.
+	c.svc = assumeRole
+	c.ec2Svc = func(*session.Session, string, int) ec2iface.EC2API {
+		return &mockEC2Client{}
+	}
+	c.updateCache(context.Background(), allPartitions)
+
+	sets, _, _ := c.ChangesSince(generation)
+	if want, got := 1, len(sets); want != got {
+		t.Fatalf("want: %d change set(s), got: %d change set(s)", want, got)
+	}
+	if want, got := 2, len(sets[0].Changes); want != got {
+		t.Errorf("want: %d removal(s), got: %d change(s)", want, got)
+	}
+}
+
 func TestFilteredImages(t *testing.T) {
 	c := newMockCache(Regions("us-west-1"))
 	warmed := make(chan struct{})
@@ -336,28 +585,6 @@ func TestFilteredImages(t *testing.T) {
 	}
 }
 
-func TestPoolSize(t *testing.T) {
-	tests := []struct {
-		name    string
-		max     int
-		queue   int
-		percent float64
-		want    int
-	}{
-		{"min_workers", 10, 1, 0.05, 1},
-		{"2_workers", 10, 42, 0.05, 2},
-		{"5_workers", 10, 108, 0.05, 5},
-		{"max_workers", 2, 1000, 0.05, 2},
-	}
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			if got := poolSize(tt.max, tt.queue, tt.percent); tt.want != got {
-				t.Errorf("want: %d, got: %d", tt.want, got)
-			}
-		})
-	}
-}
-
 type mockAWSErr struct{}
 
 func (mockAWSErr) Error() string   { return "foo" }
@@ -382,3 +609,169 @@ func TestAWSError(t *testing.T) {
 		})
 	}
 }
+
+func TestPermissionReuse(t *testing.T) {
+	tests := []struct {
+		name      string
+		ttl       time.Duration
+		full      bool
+		changed   bool
+		failed    bool
+		wantCalls int
+	}{
+		{"reused", time.Hour, false, false, false, 1},
+		{"full_refresh", time.Hour, true, false, false, 2},
+		{"expired", 0, false, false, false, 2},
+		{"changed", time.Hour, false, true, false, 2},
+		{"failed", 0, false, false, true, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newMockCache(Regions("us-west-1"), CollectLaunchPermissions(true), PermissionTTL(tt.ttl))
+
+			var (
+				calls   int32
+				newSvc  = c.ec2Svc
+				created = "2017-11-29T16:00:00.000Z"
+			)
+
+			c.ec2Svc = func(sess *session.Session, region string, retries int) ec2iface.EC2API {
+				svc := newSvc(sess, region, retries).(*mockEC2Client)
+				describeImages, describeAttr := svc.describeImages, svc.describeImageAttribute
+				svc.describeImages = func(input *ec2.DescribeImagesInput) (*ec2.DescribeImagesOutput, error) {
+					rsp, err := describeImages(input)
+					rsp.Images[0].CreationDate = aws.String(created)
+					return rsp, err
+				}
+				svc.describeImageAttribute = func(input *ec2.DescribeImageAttributeInput) (*ec2.DescribeImageAttributeOutput, error) {
+					if atomic.AddInt32(&calls, 1) > 1 && tt.failed {
+						return nil, awserr.New("UnauthorizedOperation", "You are not authorized to perform this operation.", nil)
+					}
+					return describeAttr(input)
+				}
+				return svc
+			}
+
+			c.updateCache(context.Background(), allPartitions)
+			generation := c.Generation()
+
+			if tt.changed {
+				created = "2017-11-30T16:00:00.000Z"
+			}
+
+			c.updateCache(context.Background(), updateScope{{Full: tt.full}})
+
+			// The image keeps its launch permissions if they can't be
+			// collected.
+			if sets, _, _ := c.ChangesSince(generation); tt.failed && len(sets) != 0 {
+				t.Errorf("want: no changes, got: %+v", sets)
+			}
+
+			if want, got := tt.wantCalls, int(atomic.LoadInt32(&calls)); want != got {
+				t.Errorf("want: %d call(s), got: %d call(s)", want, got)
+			}
+
+			images, err := c.Images("us-west-1")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if want, got := 2, len(images[0].launchPerms); want != got {
+				t.Errorf("want: %d perms, got: %d perms", want, got)
+			}
+		})
+	}
+}
+
+func TestLaunchPermissionsFailure(t *testing.T) {
+	c := newMockCache(Regions("us-west-1"), CollectLaunchPermissions(true))
+	newSvc := c.ec2Svc
+	c.ec2Svc = func(sess *session.Session, region string, retries int) ec2iface.EC2API {
+		svc := newSvc(sess, region, retries).(*mockEC2Client)
+		svc.describeImageAttribute = func(*ec2.DescribeImageAttributeInput) (*ec2.DescribeImageAttributeOutput, error) {
+			return nil, awserr.New("UnauthorizedOperation", "You are not authorized to perform this operation.", nil)
+		}
+		return svc
+	}
+
+	c.updateCache(context.Background(), allPartitions)
+
+	// The image is cached without launch permissions.
+	images, err := c.Images("us-west-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want, got := 1, len(images); want != got {
+		t.Fatalf("want: %d image(s), got: %d image(s)", want, got)
+	}
+
+	if got := images[0].LaunchPermissions(); len(got) != 0 {
+		t.Errorf("want: no perms, got: %v", got)
+	}
+}
+
+func TestEC2Endpoints(t *testing.T) {
+	c := New(nil, "foo", []string{"foo"},
+		EC2Endpoint("https://vpce-1.ec2.{region}.vpce.amazonaws.com"),
+		EC2RegionEndpoints(map[string]string{"us-east-1": "https://ec2.example.com"}),
+	)
+
+	tests := []struct {
+		region string
+		want   string
+	}{
+		{"us-west-2", "https://vpce-1.ec2.us-west-2.vpce.amazonaws.com"},
+		{"us-east-1", "https://ec2.example.com"},
+	}
+	for _, tt := range tests {
+		if got := c.endpointFor(tt.region); tt.want != got {
+			t.Errorf("%s: want: %s, got: %s", tt.region, tt.want, got)
+		}
+	}
+
+	if want, got := "", New(nil, "foo", []string{"foo"}).endpointFor("us-west-2"); want != got {
+		t.Errorf("want: default endpoint, got: %s", got)
+	}
+
+	// The requests are sent to the endpoints, which are both stand-ins for
+	// EC2 with different images in us-east-1.
+	var (
+		defaultSrv = awstest.NewServer()
+		regionSrv  = awstest.NewServer()
+	)
+	defer defaultSrv.Close()
+	defer regionSrv.Close()
+
+	defaultSrv.AddImage("us-west-2", awstest.Image{ID: "ami-1", OwnerID: "111122223333"})
+	defaultSrv.AddImage("us-east-1", awstest.Image{ID: "ami-2", OwnerID: "111122223333"})
+	regionSrv.AddImage("us-east-1", awstest.Image{ID: "ami-3", OwnerID: "111122223333"})
+
+	c = New(newMockCache().svc, "foo", []string{"111122223333"},
+		Regions("us-west-2", "us-east-1"),
+		EC2Endpoint(defaultSrv.URL),
+		EC2RegionEndpoints(map[string]string{"us-east-1": regionSrv.URL}),
+		HTTPClient(&http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}}),
+	)
+	c.updateCache(context.Background(), allPartitions)
+
+	for region, want := range map[string][]string{"us-west-2": {"ami-1"}, "us-east-1": {"ami-3"}} {
+		images, err := c.Images(region)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := []string{}
+		for _, image := range images {
+			got = append(got, aws.StringValue(image.Image.ImageId))
+		}
+		if !reflect.DeepEqual(want, got) {
+			t.Errorf("%s: want: %v, got: %v", region, want, got)
+		}
+	}
+
+	if want, got := 1, defaultSrv.Calls(awstest.ActionDescribeImages); want != got {
+		t.Errorf("want: %d calls, got: %d calls", want, got)
+	}
+}
@@ -0,0 +1,204 @@
+// Copyright 2020 Intuit, Inc.  All rights reserved.
+// Use of this source code is governed the MIT license
+// that can be found in the LICENSE file.
+
+package amicache
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// The maximum number of change sets kept for ChangesSince.
+const maxChangeSets = 1000
+
+// ChangeType is the type of change made to a cached image.
+type ChangeType string
+
+// The types of changes made to cached images.
+const (
+	ImageAdded        ChangeType = "added"
+	ImageRemoved      ChangeType = "removed"
+	ImageTagsChanged  ChangeType = "tags_changed"
+	ImageStateChanged ChangeType = "state_changed"
+	ImageUpdated      ChangeType = "updated"
+)
+
+// Change is a change made to a cached image. Image is the image after the
+// change, or the last cached version of a removed image. Previous is the image
+// before a tag, state or other change. An ImageUpdated change is a change to
+// the name, description, virtualization type, creation date or launch
+// permissions of an image.
+type Change struct {
+	Type     ChangeType
+	Image    Image
+	Previous *Image
+}
+
+// ChangeSet is the set of changes between two cache generations. Warmup is
+// true for the change sets recorded while the cache is first warming up, whose
+// added images were already there rather than new.
+type ChangeSet struct {
+	Generation uint64
+	Time       time.Time
+	Changes    []Change
+	Warmup     bool
+}
+
+// Generation returns the current cache generation. It's incremented every time
+// the cached images change.
+func (c *Cache) Generation() uint64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.generation
+}
+
+// LastModified returns when the cached images last changed. It's zero if no
+// images have been cached.
+func (c *Cache) LastModified() time.Time {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.modified
+}
+
+// NextUpdate returns when the next scheduled cache update starts. It's zero if
+// the cache isn't running.
+func (c *Cache) NextUpdate() time.Time {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.nextUpdate
+}
+
+// ChangesSince returns the change sets recorded after the provided generation.
+// complete is false if some of those change sets are no longer available, or
+// the generation is unknown to the cache, in which case the caller needs to
+// resynchronize. The returned channel is closed when the next change set is
+// recorded.
+func (c *Cache) ChangesSince(generation uint64) (sets []ChangeSet, complete bool, changed <-chan struct{}) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if generation > c.generation {
+		return nil, false, c.changed
+	}
+
+	sets = []ChangeSet{}
+	oldest := c.generation - uint64(len(c.changes))
+	if generation < oldest {
+		return sets, false, c.changed
+	}
+
+	return append(sets, c.changes[generation-oldest:]...), true, c.changed
+}
+
+// ChangeSets returns the recorded change sets, oldest first. Only the most
+// recent change sets are kept.
+func (c *Cache) ChangeSets() []ChangeSet {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return append([]ChangeSet{}, c.changes...)
+}
+
+// recordChanges adds a change set to the history and notifies anyone waiting
+// on changes. The caller must hold c.mu.
+func (c *Cache) recordChanges(changes []Change) {
+	if len(changes) == 0 {
+		return
+	}
+
+	c.generation++
+	c.modified = time.Now()
+	c.changes = append(c.changes, ChangeSet{
+		Generation: c.generation,
+		Time:       c.modified,
+		Changes:    changes,
+		Warmup:     !c.warm,
+	})
+
+	if len(c.changes) > maxChangeSets {
+		c.changes = append([]ChangeSet{}, c.changes[len(c.changes)-maxChangeSets:]...)
+	}
+
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// diffImages returns the changes between two sets of cached images, sorted by
+// image ID.
+func diffImages(stateTag string, old, new map[string]Image) []Change {
+	ids := []string{}
+	for id := range old {
+		ids = append(ids, id)
+	}
+	for id := range new {
+		if _, ok := old[id]; !ok {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	changes := []Change{}
+	for _, id := range ids {
+		var oldImage, newImage *Image
+		if image, ok := old[id]; ok {
+			oldImage = &image
+		}
+		if image, ok := new[id]; ok {
+			newImage = &image
+		}
+		changes = append(changes, diffImage(stateTag, oldImage, newImage)...)
+	}
+	return changes
+}
+
+// diffImage returns the changes between two versions of an image. A nil image
+// means the image isn't cached.
+func diffImage(stateTag string, old, new *Image) []Change {
+	switch {
+	case old == nil && new == nil:
+		return nil
+	case old == nil:
+		return []Change{{Type: ImageAdded, Image: *new}}
+	case new == nil:
+		return []Change{{Type: ImageRemoved, Image: *old}}
+	}
+
+	changes := []Change{}
+	oldTags, newTags := old.Tags(), new.Tags()
+
+	if oldTags[stateTag] != newTags[stateTag] {
+		changes = append(changes, Change{Type: ImageStateChanged, Image: *new, Previous: old})
+	}
+
+	delete(oldTags, stateTag)
+	delete(newTags, stateTag)
+
+	if !reflect.DeepEqual(oldTags, newTags) {
+		changes = append(changes, Change{Type: ImageTagsChanged, Image: *new, Previous: old})
+	}
+
+	if attributes(old) != attributes(new) {
+		changes = append(changes, Change{Type: ImageUpdated, Image: *new, Previous: old})
+	}
+
+	return changes
+}
+
+// attributes returns the attributes of an image other than its ID, owner,
+// region and tags, for comparing versions of the image. The order of the launch
+// permissions doesn't matter.
+func attributes(image *Image) string {
+	perms := append([]string{}, image.launchPerms...)
+	sort.Strings(perms)
+	return strings.Join([]string{
+		aws.StringValue(image.Image.Name),
+		aws.StringValue(image.Image.Description),
+		aws.StringValue(image.Image.VirtualizationType),
+		aws.StringValue(image.Image.CreationDate),
+		strings.Join(perms, ","),
+	}, "\x00")
+}
@@ -0,0 +1,199 @@
+// Copyright 2020 Intuit, Inc.  All rights reserved.
+// Use of this source code is governed the MIT license
+// that can be found in the LICENSE file.
+
+package amicache
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+// Returns a cached image with the provided tags.
+func newTaggedImage(id string, tags map[string]string) Image {
+	image := Image{
+		Image:   &ec2.Image{ImageId: aws.String(id)},
+		OwnerID: "111122223333",
+		Region:  "us-west-1",
+	}
+	for k, v := range tags {
+		image.Image.Tags = append(image.Image.Tags, &ec2.Tag{Key: aws.String(k), Value: aws.String(v)})
+	}
+	return image
+}
+
+func TestDiffImages(t *testing.T) {
+	old := map[string]Image{
+		"ami-1": newTaggedImage("ami-1", map[string]string{"status": "available"}),
+		"ami-2": newTaggedImage("ami-2", map[string]string{"status": "available"}),
+		"ami-3": newTaggedImage("ami-3", map[string]string{"status": "available", "foo": "bar"}),
+		"ami-4": newTaggedImage("ami-4", map[string]string{"status": "available", "foo": "bar"}),
+	}
+	new := map[string]Image{
+		"ami-2": newTaggedImage("ami-2", map[string]string{"status": "available"}),
+		"ami-3": newTaggedImage("ami-3", map[string]string{"status": "deprecated", "foo": "bar"}),
+		"ami-4": newTaggedImage("ami-4", map[string]string{"status": "deprecated", "foo": "baz"}),
+		"ami-5": newTaggedImage("ami-5", map[string]string{"status": "development"}),
+	}
+
+	// ami-6 is renamed, and only the order of the launch permissions of ami-7
+	// changes.
+	old["ami-6"] = NewImage(&ec2.Image{ImageId: aws.String("ami-6"), Name: aws.String("old")}, "111122223333", "us-west-1", nil)
+	new["ami-6"] = NewImage(&ec2.Image{ImageId: aws.String("ami-6"), Name: aws.String("new")}, "111122223333", "us-west-1", nil)
+	old["ami-7"] = NewImage(&ec2.Image{ImageId: aws.String("ami-7")}, "111122223333", "us-west-1", []string{"111111111111", "111111111112"})
+	new["ami-7"] = NewImage(&ec2.Image{ImageId: aws.String("ami-7")}, "111122223333", "us-west-1", []string{"111111111112", "111111111111"})
+
+	want := []struct {
+		typ ChangeType
+		id  string
+	}{
+		{ImageRemoved, "ami-1"},
+		{ImageStateChanged, "ami-3"},
+		{ImageStateChanged, "ami-4"},
+		{ImageTagsChanged, "ami-4"},
+		{ImageAdded, "ami-5"},
+		{ImageUpdated, "ami-6"},
+	}
+
+	got := diffImages("status", old, new)
+	if len(want) != len(got) {
+		t.Fatalf("want: %d changes, got: %d changes", len(want), len(got))
+	}
+
+	for i := range want {
+		if want[i].typ != got[i].Type || want[i].id != *got[i].Image.Image.ImageId {
+			t.Errorf("want: %s %s, got: %s %s", want[i].typ, want[i].id, got[i].Type, *got[i].Image.Image.ImageId)
+		}
+		if hasPrevious := got[i].Previous != nil; hasPrevious != (got[i].Type != ImageAdded && got[i].Type != ImageRemoved) {
+			t.Errorf("%s %s: unexpected previous image: %v", got[i].Type, want[i].id, got[i].Previous)
+		}
+	}
+}
+
+func TestChangesSince(t *testing.T) {
+	c := newMockCache()
+
+	c.mu.Lock()
+	for i := 0; i < maxChangeSets+5; i++ {
+		c.recordChanges([]Change{{Type: ImageAdded}})
+	}
+	c.recordChanges(nil) // ignored
+	c.mu.Unlock()
+
+	if want, got := uint64(maxChangeSets+5), c.Generation(); want != got {
+		t.Fatalf("want: %d, got: %d", want, got)
+	}
+
+	if sets := c.ChangeSets(); !sets[len(sets)-1].Time.Equal(c.LastModified()) {
+		t.Errorf("want: %s, got: %s", sets[len(sets)-1].Time, c.LastModified())
+	}
+
+	tests := []struct {
+		name       string
+		generation uint64
+		count      int
+		complete   bool
+	}{
+		{"current", maxChangeSets + 5, 0, true},
+		{"recent", maxChangeSets + 2, 3, true},
+		{"oldest", 5, maxChangeSets, true},
+		{"expired", 4, 0, false},
+		{"unknown", maxChangeSets + 6, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sets, complete, _ := c.ChangesSince(tt.generation)
+			if tt.complete != complete {
+				t.Errorf("want: %t, got: %t", tt.complete, complete)
+			}
+			if tt.count != len(sets) {
+				t.Errorf("want: %d change sets, got: %d", tt.count, len(sets))
+			}
+			if len(sets) > 0 && sets[0].Generation != tt.generation+1 {
+				t.Errorf("want: %d, got: %d", tt.generation+1, sets[0].Generation)
+			}
+		})
+	}
+}
+
+func TestUpdateCacheChanges(t *testing.T) {
+	c := newMockCache(Regions("us-west-1"))
+
+	state := "available"
+	newSvc := c.ec2Svc
+	c.ec2Svc = func(sess *session.Session, region string, retries int) ec2iface.EC2API {
+		svc := newSvc(sess, region, retries).(*mockEC2Client)
+		describeImages := svc.describeImages
+		svc.describeImages = func(input *ec2.DescribeImagesInput) (*ec2.DescribeImagesOutput, error) {
+			rsp, err := describeImages(input)
+			rsp.Images[0].Tags[0].Value = aws.String(state)
+			return rsp, err
+		}
+		return svc
+	}
+
+	_, _, changed := c.ChangesSince(0)
+
+	c.updateCache(context.Background(), allPartitions)
+
+	select {
+	case <-changed:
+	default:
+		t.Fatal("changed channel not closed")
+	}
+
+	// An update without changes doesn't create a change set.
+	c.updateCache(context.Background(), allPartitions)
+
+	state = "deprecated"
+	c.updateCache(context.Background(), allPartitions)
+
+	sets, complete, _ := c.ChangesSince(0)
+	if !complete {
+		t.Fatal("want: complete change sets")
+	}
+
+	got := []ChangeType{}
+	for _, set := range sets {
+		for _, change := range set.Changes {
+			got = append(got, change.Type)
+		}
+	}
+
+	if want := []ChangeType{ImageAdded, ImageStateChanged}; !reflect.DeepEqual(want, got) {
+		t.Errorf("want: %v, got: %v", want, got)
+	}
+}
+
+func TestWarmupChanges(t *testing.T) {
+	c := newMockCache(Regions("us-west-1"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	warmed := make(chan struct{})
+	go c.Run(ctx, warmed)
+	<-warmed
+
+	// The cache is warm once the first update completes.
+	c.ec2Svc = func(*session.Session, string, int) ec2iface.EC2API {
+		return &mockEC2Client{}
+	}
+	c.updateCache(ctx, allPartitions)
+
+	got := []bool{}
+	for _, set := range c.ChangeSets() {
+		got = append(got, set.Warmup)
+	}
+
+	if want := []bool{true, false}; !reflect.DeepEqual(want, got) {
+		t.Errorf("want: %v, got: %v", want, got)
+	}
+}
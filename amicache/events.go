@@ -0,0 +1,348 @@
+// Copyright 2020 Intuit, Inc.  All rights reserved.
+// Use of this source code is governed the MIT license
+// that can be found in the LICENSE file.
+
+package amicache
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// The time to wait before receiving messages again after a failure.
+const eventRetryDelay = 5 * time.Second
+
+// EventConsumer applies EC2 image events read from an SQS queue to a Cache.
+// The events are CloudTrail "AWS API Call via CloudTrail" events delivered to
+// the queue by an EventBridge rule. Scheduled cache updates still run and
+// reconcile anything the events missed.
+type EventConsumer struct {
+	cache    *Cache
+	svc      sqsiface.SQSAPI
+	queueURL string
+	logger   log.Logger
+}
+
+// NewEventConsumer returns an EventConsumer that reads events from the SQS
+// queue at queueURL.
+func NewEventConsumer(cache *Cache, svc sqsiface.SQSAPI, queueURL string) *EventConsumer {
+	return &EventConsumer{
+		cache:    cache,
+		svc:      svc,
+		queueURL: queueURL,
+		logger:   log.With(cache.logger, "queue_url", queueURL),
+	}
+}
+
+// Run reads and applies events until the context is done. Messages are
+// deleted from the queue once they are applied or found to be irrelevant.
+// Messages that fail to apply are left for redelivery.
+func (e *EventConsumer) Run(ctx context.Context) error {
+	for {
+		rsp, err := e.svc.ReceiveMessageWithContext(ctx, &sqs.ReceiveMessageInput{
+			QueueUrl:            aws.String(e.queueURL),
+			MaxNumberOfMessages: aws.Int64(10),
+			WaitTimeSeconds:     aws.Int64(20),
+		})
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			level.Warn(e.logger).Log("event_receive", "failed", "error", awsError(err))
+			select {
+			case <-time.After(eventRetryDelay):
+				continue
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		for _, msg := range rsp.Messages {
+			logger := log.With(e.logger, "message_id", aws.StringValue(msg.MessageId))
+
+			if err := e.apply(ctx, logger, aws.StringValue(msg.Body)); err != nil {
+				level.Warn(logger).Log("event_update", "failed", "error", awsError(err))
+				continue
+			}
+
+			_, err := e.svc.DeleteMessageWithContext(ctx, &sqs.DeleteMessageInput{
+				QueueUrl:      aws.String(e.queueURL),
+				ReceiptHandle: msg.ReceiptHandle,
+			})
+			if err != nil {
+				level.Warn(logger).Log("event_delete", "failed", "error", awsError(err))
+			}
+		}
+	}
+}
+
+// apply updates the cache from the event in body.
+func (e *EventConsumer) apply(ctx context.Context, logger log.Logger, body string) error {
+	var event imageEvent
+	if err := json.Unmarshal([]byte(body), &event); err != nil {
+		level.Debug(logger).Log("event_update", "ignored", "reason", "invalid event", "error", err)
+		return nil
+	}
+
+	var (
+		p   = Partition{OwnerID: event.Account, Region: event.Region}
+		ids = event.imageIDs()
+	)
+
+	if len(ids) == 0 || !e.cache.cachesPartition(p) {
+		level.Debug(logger).Log("event_update", "ignored", "event", event.Detail.EventName)
+		return nil
+	}
+
+	logger = log.With(logger, "event", event.Detail.EventName, "owner_id", p.OwnerID, "region", p.Region)
+
+	if event.Detail.EventName == "DeregisterImage" {
+		for _, id := range ids {
+			e.cache.removeImage(id)
+		}
+		level.Info(logger).Log("event_update", "completed", "removed", len(ids))
+		return nil
+	}
+
+	sess, err := e.cache.assumeRole(p.OwnerID)
+	if err != nil {
+		return err
+	}
+
+	svc := e.cache.ec2Svc(sess, p.Region, e.cache.maxRetries)
+	for _, id := range ids {
+		if err := e.cache.updateImage(ctx, svc, p, id); err != nil {
+			return err
+		}
+	}
+
+	level.Info(logger).Log("event_update", "completed", "updated", len(ids))
+	return nil
+}
+
+// imageEvent is an EC2 API call recorded by CloudTrail and delivered by
+// EventBridge.
+type imageEvent struct {
+	Account string `json:"account"`
+	Region  string `json:"region"`
+	Detail  struct {
+		EventName         string `json:"eventName"`
+		RequestParameters struct {
+			ImageID      string `json:"imageId"`
+			ResourcesSet struct {
+				Items []struct {
+					ResourceID string `json:"resourceId"`
+				} `json:"items"`
+			} `json:"resourcesSet"`
+		} `json:"requestParameters"`
+		ResponseElements struct {
+			ImageID string `json:"imageId"`
+		} `json:"responseElements"`
+	} `json:"detail"`
+}
+
+// imageIDs returns the IDs of the images affected by the event.
+func (e *imageEvent) imageIDs() []string {
+	ids := []string{}
+	switch e.Detail.EventName {
+	case "CreateImage", "RegisterImage", "CopyImage":
+		if id := e.Detail.ResponseElements.ImageID; id != "" {
+			ids = append(ids, id)
+		}
+	case "DeregisterImage", "ModifyImageAttribute", "ResetImageAttribute":
+		if id := e.Detail.RequestParameters.ImageID; id != "" {
+			ids = append(ids, id)
+		}
+	case "CreateTags", "DeleteTags":
+		for _, item := range e.Detail.RequestParameters.ResourcesSet.Items {
+			if strings.HasPrefix(item.ResourceID, "ami-") {
+				ids = append(ids, item.ResourceID)
+			}
+		}
+	}
+	return ids
+}
+
+// cachesPartition returns whether the partition's images are being cached.
+func (c *Cache) cachesPartition(p Partition) bool {
+	found := false
+	for _, owner := range c.ownerIDs {
+		found = found || owner == p.OwnerID
+	}
+	if !found {
+		return false
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	_, ok := c.regionsForOwner(p.OwnerID)[p.Region]
+	return ok
+}
+
+// updateImage fetches an image and its launch permissions and stores it in
+// the cache. The image is removed from the cache if it no longer exists or no
+// longer matches the tag filter.
+func (c *Cache) updateImage(ctx context.Context, svc ec2iface.EC2API, p Partition, id string) error {
+	input := &ec2.DescribeImagesInput{
+		Owners:   []*string{aws.String(p.OwnerID)},
+		ImageIds: []*string{aws.String(id)},
+	}
+
+	if c.tagFilter != "" {
+		input.Filters = []*ec2.Filter{{
+			Name:   aws.String("tag-key"),
+			Values: []*string{aws.String(c.tagFilter)},
+		}}
+	}
+
+	rsp, err := svc.DescribeImages(input)
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == "InvalidAMIID.NotFound" {
+		c.removeImage(id)
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if len(rsp.Images) == 0 {
+		c.removeImage(id)
+		return nil
+	}
+
+	image := Image{
+		Image:   rsp.Images[0],
+		OwnerID: p.OwnerID,
+		Region:  p.Region,
+	}
+
+	if c.collectLaunchPerms {
+		perms, err := c.launchPermissions(ctx, svc, c.limiter(p), image.Image.ImageId, &updateStats{})
+		if err != nil {
+			return err
+		}
+		image.launchPerms = perms
+		image.fingerprint = fingerprint(image.Image)
+		image.permsUpdated = time.Now()
+	}
+
+	c.putImage(image)
+	return nil
+}
+
+// putImage adds an image to the cache or replaces it.
+func (c *Cache) putImage(image Image) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	id := *image.Image.ImageId
+	c.recordEventUpdate(id)
+	if old, ok := c.cache[id]; ok {
+		c.recordChanges(diffImage(c.stateTag, &old, &image))
+	} else {
+		ids := c.regionIndex[image.Region]
+		c.regionIndex[image.Region] = append(ids[:len(ids):len(ids)], id)
+		c.adjustImageCount(Partition{image.OwnerID, image.Region}, 1)
+		c.recordChanges(diffImage(c.stateTag, nil, &image))
+	}
+	c.cache[id] = image
+}
+
+// removeImage removes an image from the cache.
+func (c *Cache) removeImage(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.recordEventUpdate(id)
+	image, ok := c.cache[id]
+	if !ok {
+		return
+	}
+
+	ids := []string{}
+	for _, iid := range c.regionIndex[image.Region] {
+		if iid != id {
+			ids = append(ids, iid)
+		}
+	}
+
+	delete(c.cache, id)
+	c.regionIndex[image.Region] = ids
+	c.adjustImageCount(Partition{image.OwnerID, image.Region}, -1)
+	c.recordChanges(diffImage(c.stateTag, &image, nil))
+}
+
+// recordEventUpdate records when an image was updated or removed by an event,
+// if a cache update is running. The caller must hold c.mu.
+func (c *Cache) recordEventUpdate(id string) {
+	if c.updating > 0 {
+		c.eventUpdates[id] = time.Now()
+	}
+}
+
+// endUpdate records the end of a cache update. The event updates are forgotten
+// once no update is running, since later updates see their results. The
+// caller must hold c.mu.
+func (c *Cache) endUpdate() {
+	c.updating--
+	if c.updating == 0 {
+		c.eventUpdates = map[string]time.Time{}
+	}
+}
+
+// withoutEventUpdates removes the images updated or removed by events since a
+// cache update started from its results, since they may be older than the
+// events. It returns their IDs so the cached images are kept instead, and
+// adjusts the image counts of the updated partitions to match. The caller must
+// hold c.mu.
+func (c *Cache) withoutEventUpdates(started time.Time, newCache map[string]Image, newIndex map[string][]string, newStatus map[Partition]PartitionStatus) map[string]struct{} {
+	adjust := func(image Image, n int) {
+		p := Partition{image.OwnerID, image.Region}
+		if status, ok := newStatus[p]; ok {
+			status.ImageCount += n
+			newStatus[p] = status
+		}
+	}
+
+	evented := map[string]struct{}{}
+	for id, updated := range c.eventUpdates {
+		if updated.Before(started) {
+			continue
+		}
+		evented[id] = struct{}{}
+
+		if image, ok := newCache[id]; ok {
+			delete(newCache, id)
+			ids := []string{}
+			for _, iid := range newIndex[image.Region] {
+				if iid != id {
+					ids = append(ids, iid)
+				}
+			}
+			newIndex[image.Region] = ids
+			adjust(image, -1)
+		}
+		if image, ok := c.cache[id]; ok {
+			adjust(image, 1)
+		}
+	}
+
+	return evented
+}
+
+// adjustImageCount adds n to the image count of a partition's status. The
+// caller must hold c.mu.
+func (c *Cache) adjustImageCount(p Partition, n int) {
+	if status, ok := c.status[p]; ok {
+		status.ImageCount += n
+		c.status[p] = status
+	}
+}
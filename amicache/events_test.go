@@ -0,0 +1,388 @@
+// Copyright 2020 Intuit, Inc.  All rights reserved.
+// Use of this source code is governed the MIT license
+// that can be found in the LICENSE file.
+
+package amicache
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/intuit/ami-query/awstest"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// mockSQSQueue is an in-memory stand-in for an SQS queue.
+type mockSQSQueue struct {
+	sqsiface.SQSAPI
+
+	mu       sync.Mutex
+	messages []*sqs.Message
+	inflight map[string]*sqs.Message
+	seq      int
+}
+
+func newMockSQSQueue() *mockSQSQueue {
+	return &mockSQSQueue{inflight: map[string]*sqs.Message{}}
+}
+
+// send adds a message to the queue.
+func (q *mockSQSQueue) send(body string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.seq++
+	q.messages = append(q.messages, &sqs.Message{
+		MessageId:     aws.String(fmt.Sprintf("msg-%d", q.seq)),
+		ReceiptHandle: aws.String(fmt.Sprintf("rh-%d", q.seq)),
+		Body:          aws.String(body),
+	})
+}
+
+// pending returns the number of messages that have not been deleted.
+func (q *mockSQSQueue) pending() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.messages) + len(q.inflight)
+}
+
+// ReceiveMessageWithContext mock.
+func (q *mockSQSQueue) ReceiveMessageWithContext(ctx aws.Context, input *sqs.ReceiveMessageInput, _ ...request.Option) (*sqs.ReceiveMessageOutput, error) {
+	q.mu.Lock()
+	messages := q.messages
+	q.messages = nil
+	for _, msg := range messages {
+		q.inflight[*msg.ReceiptHandle] = msg
+	}
+	q.mu.Unlock()
+
+	if len(messages) == 0 {
+		select {
+		case <-time.After(10 * time.Millisecond):
+		case <-ctx.Done():
+			return nil, awserr.New(request.CanceledErrorCode, "canceled", ctx.Err())
+		}
+	}
+
+	return &sqs.ReceiveMessageOutput{Messages: messages}, nil
+}
+
+// DeleteMessageWithContext mock.
+func (q *mockSQSQueue) DeleteMessageWithContext(_ aws.Context, input *sqs.DeleteMessageInput, _ ...request.Option) (*sqs.DeleteMessageOutput, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.inflight, *input.ReceiptHandle)
+	return &sqs.DeleteMessageOutput{}, nil
+}
+
+// Returns an EventBridge CloudTrail event for an image.
+func imageEventBody(name, owner, region, id string) string {
+	return fmt.Sprintf(`{
+		"detail-type": "AWS API Call via CloudTrail",
+		"source": "aws.ec2",
+		"account": %q,
+		"region": %q,
+		"detail": {
+			"eventName": %q,
+			"requestParameters": {
+				"imageId": %[4]q,
+				"resourcesSet": {"items": [{"resourceId": %[4]q}, {"resourceId": "snap-1a2b3c4d"}]}
+			},
+			"responseElements": {"imageId": %[4]q}
+		}
+	}`, owner, region, name, id)
+}
+
+func TestImageEventIDs(t *testing.T) {
+	tests := []struct {
+		name string
+		want int
+	}{
+		{"CreateImage", 1},
+		{"RegisterImage", 1},
+		{"DeregisterImage", 1},
+		{"ModifyImageAttribute", 1},
+		{"CreateTags", 1},
+		{"DeleteTags", 1},
+		{"RunInstances", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var event imageEvent
+			if err := json.Unmarshal([]byte(imageEventBody(tt.name, "111122223333", "us-west-1", "ami-1a2b3c4d")), &event); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := event.imageIDs(); tt.want != len(got) {
+				t.Errorf("want: %d id(s), got: %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestEventConsumer(t *testing.T) {
+	c := newMockCache(Regions("us-west-1"), CollectLaunchPermissions(true))
+
+	// The image exists once it's created, then its tags are changed.
+	var (
+		mu    sync.Mutex
+		state = "development"
+	)
+	newSvc := c.ec2Svc
+	c.ec2Svc = func(sess *session.Session, region string, retries int) ec2iface.EC2API {
+		svc := newSvc(sess, region, retries).(*mockEC2Client)
+		svc.describeImages = func(input *ec2.DescribeImagesInput) (*ec2.DescribeImagesOutput, error) {
+			if len(input.ImageIds) == 0 {
+				return &ec2.DescribeImagesOutput{}, nil
+			}
+			if *input.ImageIds[0] != "ami-2a2b3c4d" {
+				return nil, awserr.New("InvalidAMIID.NotFound", "not found", nil)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			return &ec2.DescribeImagesOutput{
+				Images: []*ec2.Image{{
+					ImageId:      input.ImageIds[0],
+					CreationDate: aws.String("2017-11-29T16:00:00.000Z"),
+					Tags: []*ec2.Tag{{
+						Key:   aws.String(DefaultStateTag),
+						Value: aws.String(state),
+					}},
+				}},
+			}, nil
+		}
+		return svc
+	}
+
+	c.updateCache(context.Background(), allPartitions)
+
+	var (
+		queue       = newMockSQSQueue()
+		e           = NewEventConsumer(c, queue, "https://sqs.us-west-1.amazonaws.com/111122223333/foo")
+		ctx, cancel = context.WithCancel(context.Background())
+		errCh       = make(chan error)
+	)
+
+	go func() { errCh <- e.Run(ctx) }()
+
+	// Waits for the image to be in the provided state, "" meaning not cached.
+	waitFor := func(want string) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			images, _ := c.Images("us-west-1")
+			got := ""
+			for _, image := range images {
+				if *image.Image.ImageId == "ami-2a2b3c4d" {
+					got = image.Tag(DefaultStateTag)
+				}
+			}
+			if want == got && queue.pending() == 0 {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("want: %q, got: %q", want, got)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	queue.send(imageEventBody("CreateImage", "111122223333", "us-west-1", "ami-2a2b3c4d"))
+	waitFor("development")
+
+	mu.Lock()
+	state = "available"
+	mu.Unlock()
+
+	queue.send(imageEventBody("CreateTags", "111122223333", "us-west-1", "ami-2a2b3c4d"))
+	waitFor("available")
+
+	// Events for unknown owners and regions, and invalid events are ignored.
+	queue.send(imageEventBody("CreateImage", "444455556666", "us-west-1", "ami-3a2b3c4d"))
+	queue.send(imageEventBody("CreateImage", "111122223333", "us-east-1", "ami-3a2b3c4d"))
+	queue.send(`foo`)
+	waitFor("available")
+
+	if status := c.Status()[0].Partitions[0]; status.ImageCount != 1 {
+		t.Errorf("want: 1 image, got: %d image(s)", status.ImageCount)
+	}
+
+	queue.send(imageEventBody("DeregisterImage", "111122223333", "us-west-1", "ami-2a2b3c4d"))
+	waitFor("")
+
+	cancel()
+
+	if want, got := context.Canceled, <-errCh; want != got {
+		t.Errorf("want: %v, got: %v", want, got)
+	}
+}
+
+func TestEventsDuringCacheUpdate(t *testing.T) {
+	c := newMockCache(Regions("us-west-1"))
+
+	// ami-1 and ami-2 are cached, then the update's snapshot is taken before
+	// events change the state of ami-1, remove ami-2 and add ami-3.
+	var (
+		snapshot = []*ec2.Image{newEventTestImage("ami-1", "available"), newEventTestImage("ami-2", "available")}
+		events   func()
+	)
+	newSvc := c.ec2Svc
+	c.ec2Svc = func(sess *session.Session, region string, retries int) ec2iface.EC2API {
+		svc := newSvc(sess, region, retries).(*mockEC2Client)
+		svc.describeImages = func(*ec2.DescribeImagesInput) (*ec2.DescribeImagesOutput, error) {
+			if events != nil {
+				events()
+			}
+			return &ec2.DescribeImagesOutput{Images: snapshot}, nil
+		}
+		return svc
+	}
+
+	c.updateCache(context.Background(), allPartitions)
+
+	events = func() {
+		c.putImage(Image{Image: newEventTestImage("ami-1", "deprecated"), OwnerID: "111122223333", Region: "us-west-1"})
+		c.removeImage("ami-2")
+		c.putImage(Image{Image: newEventTestImage("ami-3", "available"), OwnerID: "111122223333", Region: "us-west-1"})
+	}
+	c.updateCache(context.Background(), allPartitions)
+
+	images, err := c.Images("us-west-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	for _, image := range images {
+		got[*image.Image.ImageId] = image.Tag(DefaultStateTag)
+	}
+	want := map[string]string{"ami-1": "deprecated", "ami-3": "available"}
+	if !reflect.DeepEqual(want, got) {
+		t.Errorf("want: %v, got: %v", want, got)
+	}
+
+	if status := c.Status()[0].Partitions[0]; status.ImageCount != 2 {
+		t.Errorf("want: 2 images, got: %d image(s)", status.ImageCount)
+	}
+
+	// The events are forgotten once the update finishes, so the next update
+	// isn't affected by them.
+	events = nil
+	c.updateCache(context.Background(), allPartitions)
+
+	got = map[string]string{}
+	images, _ = c.Images("us-west-1")
+	for _, image := range images {
+		got[*image.Image.ImageId] = image.Tag(DefaultStateTag)
+	}
+	want = map[string]string{"ami-1": "available", "ami-2": "available"}
+	if !reflect.DeepEqual(want, got) {
+		t.Errorf("want: %v, got: %v", want, got)
+	}
+}
+
+// Returns an image in the provided state.
+func newEventTestImage(id, state string) *ec2.Image {
+	return &ec2.Image{
+		ImageId:      aws.String(id),
+		CreationDate: aws.String("2017-11-29T16:00:00.000Z"),
+		Tags: []*ec2.Tag{{
+			Key:   aws.String(DefaultStateTag),
+			Value: aws.String(state),
+		}},
+	}
+}
+
+func TestEventConsumerSQS(t *testing.T) {
+	srv := awstest.NewServer()
+	defer srv.Close()
+
+	// Undeleted messages are redelivered quickly.
+	srv.SetVisibilityTimeout(50 * time.Millisecond)
+
+	sess, err := session.NewSession(aws.NewConfig().
+		WithHTTPClient(srv.Client()).
+		WithRegion("us-west-1").
+		WithCredentials(credentials.NewStaticCredentials("id", "secret", "")),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := New(sts.New(sess), "foo", []string{"111122223333"}, Regions("us-west-1"), HTTPClient(srv.Client()))
+	c.updateCache(context.Background(), allPartitions)
+
+	// The image is created while the region's EC2 requests fail, so its event
+	// can't be applied until they succeed again.
+	srv.AddImage("us-west-1", awstest.Image{
+		ID:      "ami-2a2b3c4d",
+		OwnerID: "111122223333",
+		Tags:    map[string]string{DefaultStateTag: "available"},
+	})
+	srv.DisableRegion("us-west-1", true)
+	srv.SendMessage(imageEventBody("CreateImage", "111122223333", "us-west-1", "ami-2a2b3c4d"))
+	srv.SendMessage(imageEventBody("CreateImage", "444455556666", "us-west-1", "ami-3a2b3c4d"))
+
+	var (
+		e           = NewEventConsumer(c, sqs.New(sess), srv.URL+"/111122223333/ami-events")
+		ctx, cancel = context.WithCancel(context.Background())
+		errCh       = make(chan error)
+	)
+
+	go func() { errCh <- e.Run(ctx) }()
+
+	// Waits for cond to be true.
+	waitFor := func(what string, cond func() bool) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for !cond() {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s", what)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	cached := func() bool {
+		images, _ := c.Images("us-west-1")
+		return len(images) == 1 && *images[0].Image.ImageId == "ami-2a2b3c4d"
+	}
+
+	// The cache update made the first DescribeImages request, and the
+	// event's failed requests are made every time it's delivered.
+	waitFor("redelivery", func() bool { return srv.Calls(awstest.ActionDescribeImages) >= 3 })
+
+	if cached() {
+		t.Error("want: image not cached, got: cached")
+	}
+	// Only the ignored event was deleted.
+	if want, got := 1, srv.Messages(); want != got {
+		t.Errorf("want: %d message(s), got: %d message(s)", want, got)
+	}
+
+	srv.DisableRegion("us-west-1", false)
+	waitFor("the event", func() bool { return cached() && srv.Messages() == 0 })
+
+	if want, got := 2, srv.Calls(awstest.ActionDeleteMessage); want != got {
+		t.Errorf("want: %d calls, got: %d calls", want, got)
+	}
+
+	cancel()
+
+	if want, got := context.Canceled, <-errCh; want != got {
+		t.Errorf("want: %v, got: %v", want, got)
+	}
+}
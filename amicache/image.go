@@ -5,10 +5,12 @@
 package amicache
 
 import (
+	"fmt"
 	"sort"
 	"strings"
 	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/ec2"
 )
 
@@ -40,10 +42,13 @@ var stateWeight = map[string]uint64{
 
 // Image represents an Amazon Machine Image.
 type Image struct {
-	Image       *ec2.Image
-	OwnerID     string
-	Region      string
-	launchPerms []string
+	Image        *ec2.Image
+	OwnerID      string
+	Region       string
+	launchPerms  []string
+	fingerprint  string    // fingerprint of Image when launchPerms were collected
+	permsUpdated time.Time // when launchPerms were collected
+	source       string    // name of the ImageSource it was read from, empty for EC2
 }
 
 // NewImage returns a new Image from the provided ec2.Image and region.
@@ -56,6 +61,17 @@ func NewImage(image *ec2.Image, ownerID, region string, perms []string) Image {
 	}
 }
 
+// fingerprint returns a value that changes when the attributes of an image
+// that are related to its launch permissions change.
+func fingerprint(image *ec2.Image) string {
+	return fmt.Sprintf("%s|%s|%s|%t",
+		aws.StringValue(image.ImageId),
+		aws.StringValue(image.CreationDate),
+		aws.StringValue(image.State),
+		aws.BoolValue(image.Public),
+	)
+}
+
 // Tag returns the value of the provided tag key. An empty string is returned if
 // there is no matching key.
 func (i *Image) Tag(key string) string {
@@ -67,6 +83,12 @@ func (i *Image) Tag(key string) string {
 	return ""
 }
 
+// LaunchPermissions returns the account IDs allowed to launch the image. It's
+// empty unless the cache is collecting launch permissions.
+func (i *Image) LaunchPermissions() []string {
+	return i.launchPerms
+}
+
 // Tags is a convenience function that returns ec2.Image.Tags as a
 // map[string]string
 func (i *Image) Tags() map[string]string {
@@ -79,7 +101,8 @@ func (i *Image) Tags() map[string]string {
 
 // SortByState sorts by taking the CreationDate attribute, converting it to
 // UNIX epoch, and adds it to the weighted value of the status tag. It sorts
-// from newest to oldest AMIs.
+// from newest to oldest AMIs. AMIs with the same weight are sorted by ID so the
+// order is stable.
 func SortByState(state string, images []Image) {
 	sort.Slice(images, func(i, j int) bool {
 		var dateFmt = "2006-01-02T15:04:05.000Z"
@@ -104,6 +127,9 @@ func SortByState(state string, images []Image) {
 			jstate = stateWeight[strings.ToLower(state)]
 		}
 
-		return icdate+istate > jcdate+jstate
+		if iweight, jweight := icdate+istate, jcdate+jstate; iweight != jweight {
+			return iweight > jweight
+		}
+		return aws.StringValue(images[i].Image.ImageId) < aws.StringValue(images[j].Image.ImageId)
 	})
 }
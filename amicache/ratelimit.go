@@ -0,0 +1,155 @@
+// Copyright 2020 Intuit, Inc.  All rights reserved.
+// Use of this source code is governed the MIT license
+// that can be found in the LICENSE file.
+
+package amicache
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// partitionLimiter limits the rate and concurrency of the API requests made
+// for a Partition. It is shared between cache updates so throttling seen in
+// one update carries over to the next.
+type partitionLimiter struct {
+	bucket      *tokenBucket
+	concurrency *adaptiveLimit
+}
+
+// limiter returns the partitionLimiter for the provided partition, creating
+// it if needed.
+func (c *Cache) limiter(p Partition) *partitionLimiter {
+	c.limitersMu.Lock()
+	defer c.limitersMu.Unlock()
+	l, ok := c.limiters[p]
+	if !ok {
+		l = &partitionLimiter{
+			bucket:      newTokenBucket(c.requestRate, c.requestBurst),
+			concurrency: newAdaptiveLimit(c.maxRequests),
+		}
+		c.limiters[p] = l
+	}
+	return l
+}
+
+// tokenBucket is a token bucket rate limiter. A rate of zero or less disables
+// rate limiting.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64 // tokens added per second
+	burst  float64 // maximum number of tokens
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// wait blocks until a token is available or the context is done.
+func (b *tokenBucket) wait(ctx context.Context) error {
+	if b.rate <= 0 {
+		return nil
+	}
+	for {
+		b.mu.Lock()
+		now := time.Now()
+		b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+		b.last = now
+		if b.tokens >= 1 {
+			b.tokens--
+			b.mu.Unlock()
+			return nil
+		}
+		delay := time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+		b.mu.Unlock()
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// The number of consecutive successful requests required before an
+// adaptiveLimit is raised.
+const limitIncreaseAfter = 10
+
+// adaptiveLimit limits the number of concurrent requests. The limit is halved
+// whenever a request is throttled and raised by one after a run of successful
+// requests, up to max.
+type adaptiveLimit struct {
+	mu        sync.Mutex
+	cond      *sync.Cond
+	limit     int
+	max       int
+	active    int
+	successes int
+}
+
+func newAdaptiveLimit(max int) *adaptiveLimit {
+	if max < 1 {
+		max = 1
+	}
+	l := &adaptiveLimit{limit: max, max: max}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+// acquire blocks until a request is allowed to start.
+func (l *adaptiveLimit) acquire() {
+	l.mu.Lock()
+	for l.active >= l.limit {
+		l.cond.Wait()
+	}
+	l.active++
+	l.mu.Unlock()
+}
+
+// release marks a request as finished and adjusts the limit based on whether
+// or not it was throttled.
+func (l *adaptiveLimit) release(throttled bool) {
+	l.mu.Lock()
+	l.active--
+	if throttled {
+		l.successes = 0
+		if l.limit = l.limit / 2; l.limit < 1 {
+			l.limit = 1
+		}
+	} else if l.successes++; l.successes >= limitIncreaseAfter && l.limit < l.max {
+		l.successes = 0
+		l.limit++
+	}
+	l.mu.Unlock()
+	l.cond.Broadcast()
+}
+
+// current returns the current concurrency limit.
+func (l *adaptiveLimit) current() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limit
+}
+
+// backoff returns the delay before retrying a request using exponential
+// backoff with full jitter.
+func backoff(attempt int, base, max time.Duration) time.Duration {
+	d := base << uint(attempt)
+	if d > max || d <= 0 {
+		d = max
+	}
+	return time.Duration(rand.Int63n(int64(d)) + 1)
+}
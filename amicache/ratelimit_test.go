@@ -0,0 +1,179 @@
+// Copyright 2020 Intuit, Inc.  All rights reserved.
+// Use of this source code is governed the MIT license
+// that can be found in the LICENSE file.
+
+package amicache
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+func TestTokenBucket(t *testing.T) {
+	b := newTokenBucket(100, 2)
+	start := time.Now()
+
+	// The burst is available immediately, the third token needs ~10ms.
+	for i := 0; i < 3; i++ {
+		if err := b.wait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if elapsed := time.Since(start); elapsed < 5*time.Millisecond {
+		t.Errorf("want: wait for a token, got: %s", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	b = newTokenBucket(0.001, 1)
+	b.wait(ctx)
+
+	if want, got := context.Canceled, b.wait(ctx); want != got {
+		t.Errorf("want: %v, got: %v", want, got)
+	}
+}
+
+func TestAdaptiveLimit(t *testing.T) {
+	l := newAdaptiveLimit(8)
+
+	l.acquire()
+	l.release(true)
+
+	if want, got := 4, l.current(); want != got {
+		t.Errorf("want: %d, got: %d", want, got)
+	}
+
+	for i := 0; i < limitIncreaseAfter; i++ {
+		l.acquire()
+		l.release(false)
+	}
+
+	if want, got := 5, l.current(); want != got {
+		t.Errorf("want: %d, got: %d", want, got)
+	}
+
+	for i := 0; i < 5; i++ {
+		l.acquire()
+		l.release(true)
+	}
+
+	if want, got := 1, l.current(); want != got {
+		t.Errorf("want: %d, got: %d", want, got)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for attempt := 0; attempt < 10; attempt++ {
+		if d := backoff(attempt, 10*time.Millisecond, 50*time.Millisecond); d <= 0 || d > 50*time.Millisecond {
+			t.Errorf("attempt %d: want: (0, 50ms], got: %s", attempt, d)
+		}
+	}
+}
+
+func TestLaunchPermissionsThrottled(t *testing.T) {
+	var (
+		throttle    = awserr.New("RequestLimitExceeded", "Request limit exceeded.", nil)
+		serverErr   = awserr.NewRequestFailure(awserr.New("InternalError", "An internal error has occurred.", nil), 500, "")
+		requestErr  = awserr.New("RequestError", "send request failed", nil)
+		notFoundErr = awserr.NewRequestFailure(awserr.New("InvalidAMIID.NotFound", "The image id does not exist.", nil), 400, "")
+	)
+
+	tests := []struct {
+		name       string
+		err        error
+		failures   int
+		wantErr    bool
+		wantCalls  int
+		wantCount  int64
+		maxRetries int
+	}{
+		{"recovered", throttle, 2, false, 3, 2, 3},
+		{"exhausted", throttle, 5, true, 3, 3, 2},
+		{"server_error", serverErr, 2, false, 3, 0, 3},
+		{"request_error", requestErr, 1, false, 2, 0, 3},
+		{"not_retryable", notFoundErr, 1, true, 1, 0, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := New(nil, "foo", []string{}, MaxRequestRetries(tt.maxRetries))
+			c.backoffBase = time.Millisecond
+			c.backoffMax = time.Millisecond
+
+			calls := 0
+			svc := &mockEC2Client{
+				describeImageAttribute: func(*ec2.DescribeImageAttributeInput) (*ec2.DescribeImageAttributeOutput, error) {
+					if calls++; calls <= tt.failures {
+						return nil, tt.err
+					}
+					return &ec2.DescribeImageAttributeOutput{
+						LaunchPermissions: []*ec2.LaunchPermission{{UserId: aws.String("111111111111")}},
+					}, nil
+				},
+			}
+
+			stats := &updateStats{}
+			limiter := c.limiter(Partition{"foo", "us-west-2"})
+			perms, err := c.launchPermissions(context.Background(), svc, limiter, aws.String("ami-1a2b3c4d"), stats)
+
+			if tt.wantErr != (err != nil) {
+				t.Errorf("want err: %t, got: %v", tt.wantErr, err)
+			}
+
+			if !tt.wantErr && len(perms) != 1 {
+				t.Errorf("want: 1 perm, got: %d perms", len(perms))
+			}
+
+			if want, got := tt.wantCalls, calls; want != got {
+				t.Errorf("want: %d call(s), got: %d call(s)", want, got)
+			}
+
+			if want, got := tt.wantCount, stats.throttles; want != got {
+				t.Errorf("want: %d throttles, got: %d throttles", want, got)
+			}
+
+			if want, got := 1, limiter.concurrency.current(); want > got {
+				t.Errorf("want: at least %d, got: %d", want, got)
+			}
+		})
+	}
+}
+
+func TestUpdateCacheThrottleStatus(t *testing.T) {
+	c := newMockCache(Regions("us-west-1"), CollectLaunchPermissions(true))
+	c.backoffBase = time.Millisecond
+	c.backoffMax = time.Millisecond
+
+	throttled := false
+	c.ec2Svc = func(sess *session.Session, region string, retries int) ec2iface.EC2API {
+		svc := newMockCache().ec2Svc(sess, region, retries).(*mockEC2Client)
+		describe := svc.describeImageAttribute
+		svc.describeImageAttribute = func(input *ec2.DescribeImageAttributeInput) (*ec2.DescribeImageAttributeOutput, error) {
+			if !throttled {
+				throttled = true
+				return nil, awserr.New("RequestLimitExceeded", "Request limit exceeded.", nil)
+			}
+			return describe(input)
+		}
+		return svc
+	}
+
+	c.updateCache(context.Background(), allPartitions)
+
+	p := c.Status()[0].Partitions[0]
+	if want, got := 1, p.Throttles; want != got {
+		t.Errorf("want: %d throttles, got: %d throttles", want, got)
+	}
+
+	if want, got := 1, p.ImageCount; want != got {
+		t.Errorf("want: %d image(s), got: %d image(s)", want, got)
+	}
+}
@@ -0,0 +1,217 @@
+// Copyright 2020 Intuit, Inc.  All rights reserved.
+// Use of this source code is governed the MIT license
+// that can be found in the LICENSE file.
+
+package amicache
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The number of on-demand refreshes kept for status look-ups.
+const maxRefreshHistory = 100
+
+// RefreshScope selects the partitions updated by an on-demand refresh. An
+// empty OwnerID or Region matches every owner or region.
+type RefreshScope struct {
+	OwnerID string
+	Region  string
+	Full    bool // Collect the launch permissions of every AMI
+}
+
+// RefreshState is the state of an on-demand refresh.
+type RefreshState string
+
+// On-demand refresh states. A refresh is canceled if the cache is stopped
+// before it finishes, and failed if it times out.
+const (
+	RefreshPending   RefreshState = "pending"
+	RefreshRunning   RefreshState = "running"
+	RefreshCompleted RefreshState = "completed"
+	RefreshCanceled  RefreshState = "canceled"
+	RefreshFailed    RefreshState = "failed"
+)
+
+// RefreshStatus describes an on-demand refresh.
+type RefreshStatus struct {
+	ID        string
+	Scopes    []RefreshScope // The scopes coalesced into the refresh
+	State     RefreshState
+	Requested time.Time
+	Started   time.Time
+	Completed time.Time // When it finished, in any state
+}
+
+// CooldownError is returned by Refresh when an on-demand refresh was started
+// too recently.
+type CooldownError struct {
+	RetryAfter time.Duration
+}
+
+func (e *CooldownError) Error() string {
+	return fmt.Sprintf("refresh cooldown, retry after %s", e.RetryAfter)
+}
+
+// Refresh requests an on-demand cache update of the partitions selected by
+// scope and returns the ID of the refresh. Requests made while a refresh is
+// pending are coalesced into it. A CooldownError is returned if a new refresh
+// is requested before the refresh cooldown has passed.
+func (c *Cache) Refresh(scope RefreshScope) (string, error) {
+	if err := c.validScope(scope); err != nil {
+		return "", err
+	}
+
+	c.refreshMu.Lock()
+	defer c.refreshMu.Unlock()
+
+	if c.pending != nil {
+		c.pending.Scopes = append(c.pending.Scopes, scope)
+		return c.pending.ID, nil
+	}
+
+	if wait := c.refreshCooldown - time.Since(c.lastRefresh); wait > 0 {
+		return "", &CooldownError{RetryAfter: wait}
+	}
+
+	c.refreshSeq++
+	c.lastRefresh = time.Now()
+	c.pending = &RefreshStatus{
+		ID:        strconv.FormatUint(c.refreshSeq, 10),
+		Scopes:    []RefreshScope{scope},
+		State:     RefreshPending,
+		Requested: c.lastRefresh,
+	}
+
+	c.refreshes[c.pending.ID] = c.pending
+	c.refreshOrder = append(c.refreshOrder, c.pending.ID)
+	if len(c.refreshOrder) > maxRefreshHistory {
+		delete(c.refreshes, c.refreshOrder[0])
+		c.refreshOrder = c.refreshOrder[1:]
+	}
+
+	select {
+	case c.refreshCh <- struct{}{}:
+	default:
+	}
+
+	return c.pending.ID, nil
+}
+
+// RefreshStatus returns the status of an on-demand refresh.
+func (c *Cache) RefreshStatus(id string) (RefreshStatus, bool) {
+	c.refreshMu.Lock()
+	defer c.refreshMu.Unlock()
+	r, ok := c.refreshes[id]
+	if !ok {
+		return RefreshStatus{}, false
+	}
+	status := *r
+	status.Scopes = append([]RefreshScope{}, r.Scopes...)
+	return status, true
+}
+
+// Returns an error if the scope's owner or region isn't being cached.
+func (c *Cache) validScope(scope RefreshScope) error {
+	if scope.OwnerID != "" {
+		found := false
+		for _, owner := range c.ownerIDs {
+			found = found || owner == scope.OwnerID
+		}
+		if !found {
+			return fmt.Errorf("%w: %s", ErrUnknownOwner, scope.OwnerID)
+		}
+	}
+	if scope.Region != "" {
+		c.mu.RLock()
+		_, ok := c.activeRegions()[scope.Region]
+		c.mu.RUnlock()
+		if !ok {
+			return fmt.Errorf("%w: %s", ErrUnknownRegion, scope.Region)
+		}
+	}
+	return nil
+}
+
+// runRefresh runs the pending on-demand refresh, if any.
+func (c *Cache) runRefresh(ctx context.Context) {
+	c.refreshMu.Lock()
+	r := c.pending
+	c.pending = nil
+	if r != nil {
+		r.State = RefreshRunning
+		r.Started = time.Now()
+	}
+	c.refreshMu.Unlock()
+
+	if r == nil {
+		return
+	}
+
+	var wg sync.WaitGroup
+	for _, s := range c.sources {
+		wg.Add(1)
+		go func(s *sourceState) {
+			defer wg.Done()
+			c.updateSource(ctx, s, updateScope(r.Scopes))
+		}(s)
+	}
+	c.updateCache(ctx, updateScope(r.Scopes))
+	wg.Wait()
+
+	c.refreshMu.Lock()
+	switch err := ctx.Err(); {
+	case err == context.Canceled:
+		r.State = RefreshCanceled
+	case err != nil:
+		r.State = RefreshFailed
+	default:
+		r.State = RefreshCompleted
+	}
+	r.Completed = time.Now()
+	c.refreshMu.Unlock()
+}
+
+// updateScope is the set of partitions updated by updateCache and
+// updateSource.
+type updateScope []RefreshScope
+
+// The scope of the scheduled cache updates.
+var (
+	allPartitions     = updateScope{{}}
+	allPartitionsFull = updateScope{{Full: true}}
+)
+
+// matches returns whether the partition is in scope.
+func (s updateScope) matches(p Partition) bool {
+	for _, scope := range s {
+		if (scope.OwnerID == "" || scope.OwnerID == p.OwnerID) &&
+			(scope.Region == "" || scope.Region == p.Region) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesOwner returns whether any of the owner's partitions are in scope.
+func (s updateScope) matchesOwner(owner string) bool {
+	for _, scope := range s {
+		if scope.OwnerID == "" || scope.OwnerID == owner {
+			return true
+		}
+	}
+	return false
+}
+
+// full returns whether the launch permissions of every AMI are collected.
+func (s updateScope) full() bool {
+	for _, scope := range s {
+		if scope.Full {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,223 @@
+// Copyright 2020 Intuit, Inc.  All rights reserved.
+// Use of this source code is governed the MIT license
+// that can be found in the LICENSE file.
+
+package amicache
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+func TestRefreshCoalesce(t *testing.T) {
+	c := newMockCache(Regions("us-west-1", "us-west-2"))
+
+	id1, err := c.Refresh(RefreshScope{Region: "us-west-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id2, err := c.Refresh(RefreshScope{Region: "us-west-2", Full: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if id1 != id2 {
+		t.Errorf("want: %s, got: %s", id1, id2)
+	}
+
+	status, ok := c.RefreshStatus(id1)
+	if !ok {
+		t.Fatalf("want: refresh %s, got: none", id1)
+	}
+
+	if want, got := RefreshPending, status.State; want != got {
+		t.Errorf("want: %s, got: %s", want, got)
+	}
+
+	if want, got := 2, len(status.Scopes); want != got {
+		t.Errorf("want: %d scopes, got: %d scopes", want, got)
+	}
+}
+
+func TestRefreshCooldown(t *testing.T) {
+	c := newMockCache(Regions("us-west-1"), RefreshCooldown(time.Hour))
+
+	if _, err := c.Refresh(RefreshScope{}); err != nil {
+		t.Fatal(err)
+	}
+
+	c.runRefresh(context.Background())
+
+	_, err := c.Refresh(RefreshScope{})
+
+	var cooldown *CooldownError
+	if !errors.As(err, &cooldown) {
+		t.Fatalf("want: *CooldownError, got: %v", err)
+	}
+
+	if cooldown.RetryAfter <= 0 || cooldown.RetryAfter > time.Hour {
+		t.Errorf("want: (0, 1h], got: %s", cooldown.RetryAfter)
+	}
+}
+
+func TestRefreshInterrupted(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	expired, cancel := context.WithDeadline(context.Background(), time.Now())
+	defer cancel()
+
+	tests := []struct {
+		name string
+		ctx  context.Context
+		want RefreshState
+	}{
+		{"completed", context.Background(), RefreshCompleted},
+		{"canceled", canceled, RefreshCanceled},
+		{"failed", expired, RefreshFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Without owners, the interrupted updates don't leave any requests
+			// running.
+			c := newMockCache(Regions("us-west-1"))
+			c.ownerIDs = nil
+
+			id, err := c.Refresh(RefreshScope{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c.runRefresh(tt.ctx)
+
+			status, _ := c.RefreshStatus(id)
+			if want, got := tt.want, status.State; want != got {
+				t.Errorf("want: %s, got: %s", want, got)
+			}
+			if status.Completed.IsZero() {
+				t.Error("want: completed time, got: zero time")
+			}
+		})
+	}
+}
+
+func TestRefreshUnknownScope(t *testing.T) {
+	c := newMockCache(Regions("us-west-1"))
+
+	tests := []struct {
+		name  string
+		scope RefreshScope
+		want  string
+	}{
+		{"owner", RefreshScope{OwnerID: "foo"}, "unknown owner: foo"},
+		{"region", RefreshScope{Region: "us-foo-1"}, "unknown or unsupported region: us-foo-1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := c.Refresh(tt.scope); err == nil || err.Error() != tt.want {
+				t.Errorf("want: %s, got: %v", tt.want, err)
+			}
+		})
+	}
+
+	if _, ok := c.RefreshStatus("foo"); ok {
+		t.Error("want: no refresh, got: refresh")
+	}
+}
+
+func TestRefreshScoped(t *testing.T) {
+	c := newMockCache(Regions("us-west-1", "us-west-2"))
+
+	// Each region has an image with a name that changes with every update.
+	c.ec2Svc = func(_ *session.Session, region string, _ int) ec2iface.EC2API {
+		return &mockEC2Client{
+			describeImages: func(*ec2.DescribeImagesInput) (*ec2.DescribeImagesOutput, error) {
+				return &ec2.DescribeImagesOutput{
+					Images: []*ec2.Image{{
+						ImageId:      aws.String("ami-" + region),
+						Name:         aws.String(time.Now().String()),
+						CreationDate: aws.String("2017-11-29T16:00:00.000Z"),
+					}},
+				}, nil
+			},
+		}
+	}
+
+	warmed := make(chan struct{})
+	go func() { c.Run(context.Background(), warmed) }()
+	defer c.Stop()
+	<-warmed
+
+	before := map[string]string{}
+	for _, region := range []string{"us-west-1", "us-west-2"} {
+		images, _ := c.Images(region)
+		before[region] = *images[0].Image.Name
+	}
+
+	id, err := c.Refresh(RefreshScope{Region: "us-west-2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if status, _ := c.RefreshStatus(id); status.State == RefreshCompleted {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("want: completed refresh, got: timeout")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for region, changed := range map[string]bool{"us-west-1": false, "us-west-2": true} {
+		images, err := c.Images(region)
+		if err != nil || len(images) != 1 {
+			t.Fatalf("want: 1 image, got: %d image(s), err: %v", len(images), err)
+		}
+		if got := *images[0].Image.Name != before[region]; changed != got {
+			t.Errorf("%s: want changed: %t, got: %t", region, changed, got)
+		}
+	}
+}
+
+func TestRefreshDoesNotDelayUpdates(t *testing.T) {
+	c := newMockCache(Regions("us-west-1", "us-west-2"), RefreshCooldown(0))
+	c.ttl = 200 * time.Millisecond
+
+	warmed := make(chan struct{})
+	go func() { c.Run(context.Background(), warmed) }()
+	defer c.Stop()
+	<-warmed
+
+	// Returns when us-west-2 was last updated.
+	lastUpdated := func() time.Time {
+		for _, p := range c.Status()[0].Partitions {
+			if p.Region == "us-west-2" {
+				return p.LastUpdated
+			}
+		}
+		return time.Time{}
+	}
+	warmedAt := lastUpdated()
+
+	// Refreshes of us-west-1 are requested more often than the TTL, and the
+	// scheduled update of every partition still runs.
+	deadline := time.Now().Add(5 * time.Second)
+	for !lastUpdated().After(warmedAt) {
+		if time.Now().After(deadline) {
+			t.Fatal("want: scheduled update, got: timeout")
+		}
+		if _, err := c.Refresh(RefreshScope{Region: "us-west-1"}); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
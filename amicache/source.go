@@ -0,0 +1,401 @@
+// Copyright 2020 Intuit, Inc.  All rights reserved.
+// Use of this source code is governed the MIT license
+// that can be found in the LICENSE file.
+
+package amicache
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"gopkg.in/yaml.v2"
+)
+
+// ImageSource provides images from a backend other than EC2, such as a file
+// or another ami-query instance.
+type ImageSource interface {
+	// Partitions returns the partitions the source has images for.
+	Partitions(ctx context.Context) ([]Partition, error)
+
+	// Images returns the images of a partition with their launch permissions.
+	Images(ctx context.Context, p Partition) ([]Image, error)
+}
+
+// Watcher is implemented by an ImageSource that can tell when its images
+// change, so the cache is updated without waiting for the source's TTL.
+type Watcher interface {
+	// Watch returns a channel that receives a value when the images change,
+	// until the context is done.
+	Watch(ctx context.Context) <-chan struct{}
+}
+
+// The state of an ImageSource added to a Cache.
+type sourceState struct {
+	name   string
+	source ImageSource
+	ttl    time.Duration
+	status map[Partition]PartitionStatus // guarded by the cache's mu
+}
+
+// runSource updates the images of a source on its own schedule, or when they
+// change, once the cache is warmed.
+func (c *Cache) runSource(ctx context.Context, s *sourceState, changed <-chan struct{}, warmed <-chan struct{}) {
+	ttl := s.ttl
+	if ttl <= 0 {
+		ttl = c.ttl
+	}
+
+	select {
+	case <-warmed:
+	case <-ctx.Done():
+		return
+	}
+
+	timer := time.NewTimer(ttl)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+		case <-changed:
+			if !timer.Stop() {
+				<-timer.C
+			}
+		case <-ctx.Done():
+			return
+		}
+		c.updateSource(ctx, s, allPartitions)
+		timer.Reset(ttl)
+	}
+}
+
+// updateSource replaces the cached images of a source in the provided scope.
+// Partitions that aren't cached are ignored. If a partition fails to update,
+// its cached images are kept and the error is reported in its status. If the
+// source's partitions can't be listed, every partition in scope is marked
+// with the error.
+func (c *Cache) updateSource(ctx context.Context, s *sourceState, scope updateScope) {
+	logger := log.With(c.logger, "source", s.name)
+
+	partitions, err := s.source.Partitions(ctx)
+	if err != nil {
+		level.Warn(logger).Log("cache_update", "failed", "error", err)
+		c.mu.Lock()
+		for p, status := range s.status {
+			if scope.matches(p) {
+				status.Err = err
+				s.status[p] = status
+			}
+		}
+		c.mu.Unlock()
+		return
+	}
+
+	var (
+		newCache  = map[string]Image{}
+		newIndex  = map[string][]string{}
+		newStatus = map[Partition]PartitionStatus{}
+		failed    = map[Partition]struct{}{}
+		ignored   = 0
+	)
+
+	for _, p := range partitions {
+		if !scope.matches(p) {
+			continue
+		}
+		if !c.cachesPartition(p) {
+			level.Debug(logger).Log("cache_update", "ignored", "owner_id", p.OwnerID, "region", p.Region, "reason", "uncached partition")
+			ignored++
+			continue
+		}
+
+		images, err := s.source.Images(ctx, p)
+		if err != nil {
+			level.Warn(logger).Log("cache_update", "failed", "owner_id", p.OwnerID, "region", p.Region, "error", err)
+			failed[p] = struct{}{}
+			newStatus[p] = PartitionStatus{Partition: p, Source: s.name, Err: err}
+			continue
+		}
+
+		status := PartitionStatus{Partition: p, Source: s.name, LastUpdated: time.Now()}
+		for _, image := range images {
+			// The first of any images with the same ID is kept.
+			id := aws.StringValue(image.Image.ImageId)
+			if _, dup := newCache[id]; dup || image.OwnerID != p.OwnerID || image.Region != p.Region {
+				ignored++
+				continue
+			}
+			image.source = s.name
+			image.permsUpdated = status.LastUpdated
+			newCache[id] = image
+			newIndex[p.Region] = append(newIndex[p.Region], id)
+			status.ImageCount++
+		}
+		newStatus[p] = status
+	}
+
+	c.mu.Lock()
+	c.commitImages(func(image Image) bool {
+		p := Partition{image.OwnerID, image.Region}
+		_, failed := failed[p]
+		return image.source != s.name || !scope.matches(p) || failed
+	}, newCache, newIndex)
+
+	// The status of partitions the source no longer has is dropped, unless
+	// they weren't in scope.
+	for p, status := range s.status {
+		if _, ok := newStatus[p]; !ok && !scope.matches(p) {
+			newStatus[p] = status
+		}
+	}
+	for p := range failed {
+		status := newStatus[p]
+		status.ImageCount = s.status[p].ImageCount
+		status.LastUpdated = s.status[p].LastUpdated
+		newStatus[p] = status
+	}
+	s.status = newStatus
+	count := len(newStatus)
+	c.mu.Unlock()
+
+	level.Info(logger).Log(
+		"cache_update", "finished",
+		"partitions", count,
+		"count", len(newCache),
+		"ignored", ignored,
+	)
+}
+
+// catalog holds the images of an ImageSource read by the last call to its
+// Partitions method, indexed by partition.
+type catalog struct {
+	mu     sync.Mutex
+	images map[Partition][]Image
+}
+
+// set replaces the images of the catalog and returns their partitions.
+func (c *catalog) set(images []Image) []Partition {
+	index := map[Partition][]Image{}
+	for _, image := range images {
+		p := Partition{image.OwnerID, image.Region}
+		index[p] = append(index[p], image)
+	}
+
+	partitions := []Partition{}
+	for p := range index {
+		partitions = append(partitions, p)
+	}
+	sort.Slice(partitions, func(i, j int) bool {
+		if partitions[i].OwnerID != partitions[j].OwnerID {
+			return partitions[i].OwnerID < partitions[j].OwnerID
+		}
+		return partitions[i].Region < partitions[j].Region
+	})
+
+	c.mu.Lock()
+	c.images = index
+	c.mu.Unlock()
+
+	return partitions
+}
+
+// Images returns the images of a partition.
+func (c *catalog) Images(ctx context.Context, p Partition) ([]Image, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]Image{}, c.images[p]...), nil
+}
+
+// The format of an image in a catalog.
+type catalogImage struct {
+	ID                 string            `json:"id" yaml:"id"`
+	OwnerID            string            `json:"owner_id" yaml:"owner_id"`
+	Region             string            `json:"region" yaml:"region"`
+	Name               string            `json:"name" yaml:"name"`
+	Description        string            `json:"description" yaml:"description"`
+	VirtualizationType string            `json:"virtualizationtype" yaml:"virtualizationtype"`
+	CreationDate       string            `json:"creationdate" yaml:"creationdate"`
+	Tags               map[string]string `json:"tags" yaml:"tags"`
+	LaunchPermissions  []string          `json:"launch_permissions" yaml:"launch_permissions"`
+}
+
+// decodeCatalog decodes a JSON or YAML list of catalog images. Unknown fields
+// are rejected in both formats.
+func decodeCatalog(data []byte, isYAML bool) ([]Image, error) {
+	var (
+		entries = []catalogImage{}
+		err     error
+	)
+	if isYAML {
+		err = yaml.UnmarshalStrict(data, &entries)
+	} else {
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&entries)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	images := []Image{}
+	for i, entry := range entries {
+		if entry.ID == "" || entry.OwnerID == "" || entry.Region == "" {
+			return nil, fmt.Errorf("image %d: id, owner_id and region are required", i)
+		}
+
+		image := &ec2.Image{
+			ImageId:            aws.String(entry.ID),
+			OwnerId:            aws.String(entry.OwnerID),
+			Name:               aws.String(entry.Name),
+			Description:        aws.String(entry.Description),
+			VirtualizationType: aws.String(entry.VirtualizationType),
+			CreationDate:       aws.String(entry.CreationDate),
+			State:              aws.String(ec2.ImageStateAvailable),
+		}
+		for key, value := range entry.Tags {
+			image.Tags = append(image.Tags, &ec2.Tag{Key: aws.String(key), Value: aws.String(value)})
+		}
+
+		images = append(images, NewImage(image, entry.OwnerID, entry.Region, entry.LaunchPermissions))
+	}
+
+	return images, nil
+}
+
+// The default interval between checks for changes to a FileSource.
+const defaultPollInterval = 2 * time.Second
+
+// FileSource reads images from a catalog file. The file contains a JSON or
+// YAML list of images in the format of the query API results, with their
+// launch permissions in an optional launch_permissions field. Files with a
+// .yaml or .yml extension are read as YAML.
+type FileSource struct {
+	catalog
+	path         string
+	pollInterval time.Duration
+}
+
+// NewFileSource returns a FileSource that reads the catalog file at path.
+func NewFileSource(path string) *FileSource {
+	return &FileSource{path: path, pollInterval: defaultPollInterval}
+}
+
+// Partitions reads the catalog file.
+func (f *FileSource) Partitions(ctx context.Context) ([]Partition, error) {
+	data, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return nil, err
+	}
+
+	ext := strings.ToLower(filepath.Ext(f.path))
+	images, err := decodeCatalog(data, ext == ".yaml" || ext == ".yml")
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", f.path, err)
+	}
+
+	return f.set(images), nil
+}
+
+// Watch polls the catalog file's modification time and size for changes.
+func (f *FileSource) Watch(ctx context.Context) <-chan struct{} {
+	changed := make(chan struct{}, 1)
+
+	stat := func() (time.Time, int64) {
+		info, err := os.Stat(f.path)
+		if err != nil {
+			return time.Time{}, -1
+		}
+		return info.ModTime(), info.Size()
+	}
+
+	modTime, size := stat()
+
+	go func() {
+		ticker := time.NewTicker(f.pollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if t, s := stat(); !t.Equal(modTime) || s != size {
+					modTime, size = t, s
+					select {
+					case changed <- struct{}{}:
+					default: // an update is already pending
+					}
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return changed
+}
+
+// The media type of the version 1 query API results, which is the same as
+// query.MediaTypeV1. It's repeated here since the query package imports this
+// one.
+const catalogMediaType = "application/vnd.ami-query-v1+json"
+
+// URLSource reads images from a JSON catalog served over HTTP, in the same
+// format as a FileSource. The query API results of another ami-query
+// instance can be used as a catalog, e.g. https://ami-query.example.com/amis.
+type URLSource struct {
+	catalog
+	url    string
+	client *http.Client
+}
+
+// NewURLSource returns a URLSource that reads the catalog at url. The default
+// HTTP client is used if client is nil.
+func NewURLSource(url string, client *http.Client) *URLSource {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &URLSource{url: url, client: client}
+}
+
+// Partitions fetches the catalog.
+func (u *URLSource) Partitions(ctx context.Context) ([]Partition, error) {
+	req, err := http.NewRequest(http.MethodGet, u.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", catalogMediaType)
+
+	rsp, err := u.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: unexpected response: %s", u.url, rsp.Status)
+	}
+
+	data, err := ioutil.ReadAll(rsp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	images, err := decodeCatalog(data, false)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", u.url, err)
+	}
+
+	return u.set(images), nil
+}
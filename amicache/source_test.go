@@ -0,0 +1,432 @@
+// Copyright 2020 Intuit, Inc.  All rights reserved.
+// Use of this source code is governed the MIT license
+// that can be found in the LICENSE file.
+
+package amicache
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+const catalogJSON = `[
+ {
+  "id": "ami-1",
+  "owner_id": "123456789012",
+  "region": "us-west-2",
+  "name": "rhel-1",
+  "creationdate": "2020-06-01T00:00:00.000Z",
+  "tags": {"state": "available"},
+  "launch_permissions": ["111111111111"]
+ },
+ {
+  "id": "ami-2",
+  "owner_id": "123456789012",
+  "region": "us-east-1",
+  "name": "rhel-2",
+  "tags": {"state": "development"}
+ },
+ {
+  "id": "ami-3",
+  "owner_id": "210987654321",
+  "region": "us-west-2",
+  "name": "other-owner"
+ },
+ {
+  "id": "ami-4",
+  "owner_id": "123456789012",
+  "region": "eu-west-1",
+  "name": "other-region"
+ }
+]`
+
+const catalogYAML = `
+- id: ami-1
+  owner_id: "123456789012"
+  region: us-west-2
+  name: rhel-1
+  creationdate: "2020-06-01T00:00:00.000Z"
+  tags:
+    state: available
+  launch_permissions:
+    - "111111111111"
+`
+
+// Writes a catalog file to a temporary directory and returns its path.
+func writeCatalog(t *testing.T, dir, name, data string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// mockImageSource mock.
+type mockImageSource struct {
+	mu         sync.Mutex
+	partitions []Partition
+	images     map[Partition][]Image
+	err        error               // returned by Partitions
+	errs       map[Partition]error // returned by Images
+	calls      int
+}
+
+// Partitions mock.
+func (m *mockImageSource) Partitions(context.Context) ([]Partition, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.calls++
+	return m.partitions, m.err
+}
+
+// Images mock.
+func (m *mockImageSource) Images(_ context.Context, p Partition) ([]Image, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.images[p], m.errs[p]
+}
+
+func (m *mockImageSource) set(f func(m *mockImageSource)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f(m)
+}
+
+func (m *mockImageSource) callCount() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.calls
+}
+
+// Returns the IDs of the images of a source, in the order of its partitions.
+func sourceIDs(t *testing.T, src ImageSource) []string {
+	t.Helper()
+	partitions, err := src.Partitions(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := []string{}
+	for _, p := range partitions {
+		images, err := src.Images(context.Background(), p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, image := range images {
+			ids = append(ids, aws.StringValue(image.Image.ImageId))
+		}
+	}
+	return ids
+}
+
+// Returns the IDs of the cached images of a region.
+func cachedIDs(t *testing.T, c *Cache, region string) []string {
+	t.Helper()
+	images, err := c.Images(region)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := []string{}
+	for _, image := range images {
+		ids = append(ids, aws.StringValue(image.Image.ImageId))
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func TestFileSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "catalog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name    string
+		file    string
+		data    string
+		want    []string
+		wantErr bool
+	}{
+		{"json", "catalog.json", catalogJSON, []string{"ami-4", "ami-2", "ami-1", "ami-3"}, false},
+		{"yaml", "catalog.yaml", catalogYAML, []string{"ami-1"}, false},
+		{"yml", "catalog.yml", catalogYAML, []string{"ami-1"}, false},
+		{"bad_json", "bad.json", catalogYAML, nil, true},
+		{"bad_yaml", "bad.yaml", "- id: ami-1\n  tags: foo\n", nil, true},
+		{"unknown_json_field", "unknown.json", `[{"id":"ami-1","owner_id":"123456789012","region":"us-west-2","foo":"bar"}]`, nil, true},
+		{"unknown_yaml_field", "unknown.yaml", "- id: ami-1\n  owner_id: \"123456789012\"\n  region: us-west-2\n  foo: bar\n", nil, true},
+		{"missing_region", "missing.json", `[{"id":"ami-1","owner_id":"123456789012"}]`, nil, true},
+		{"missing_file", "", "", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, "missing")
+			if tt.file != "" {
+				path = writeCatalog(t, dir, tt.file, tt.data)
+			}
+			src := NewFileSource(path)
+
+			_, err := src.Partitions(context.Background())
+			if tt.wantErr != (err != nil) {
+				t.Fatalf("want: error %t, got: %v", tt.wantErr, err)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			if got := sourceIDs(t, src); !reflect.DeepEqual(tt.want, got) {
+				t.Errorf("want: %v, got: %v", tt.want, got)
+			}
+		})
+	}
+
+	// The first image is decoded the same from both formats.
+	p := Partition{"123456789012", "us-west-2"}
+	images := map[string][]Image{}
+	for _, file := range []string{"catalog.json", "catalog.yaml"} {
+		src := NewFileSource(filepath.Join(dir, file))
+		if _, err := src.Partitions(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		images[file], _ = src.Images(context.Background(), p)
+	}
+	fromJSON, fromYAML := images["catalog.json"], images["catalog.yaml"]
+	if !reflect.DeepEqual(fromJSON[0], fromYAML[0]) {
+		t.Errorf("\n\twant: %+v\n\t got: %+v", fromJSON[0], fromYAML[0])
+	}
+	if want, got := "available", fromJSON[0].Tag("state"); want != got {
+		t.Errorf("want: %s, got: %s", want, got)
+	}
+	if want, got := []string{"111111111111"}, fromJSON[0].launchPerms; !reflect.DeepEqual(want, got) {
+		t.Errorf("want: %v, got: %v", want, got)
+	}
+}
+
+func TestCacheSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "catalog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := writeCatalog(t, dir, "catalog.json", catalogJSON)
+	src := NewFileSource(path)
+	src.pollInterval = 10 * time.Millisecond
+
+	c := New(nil, "", []string{"123456789012"},
+		Regions("us-west-2", "us-east-1"),
+		DiscoverRegions(true), // ignored without EC2
+		CollectLaunchPermissions(true),
+		AddSource("catalog", src, time.Hour),
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	warmed := make(chan struct{})
+	go c.Run(ctx, warmed)
+	<-warmed
+
+	// Images of other owners and regions are ignored.
+	if want, got := []string{"ami-1"}, cachedIDs(t, c, "us-west-2"); !reflect.DeepEqual(want, got) {
+		t.Errorf("want: %v, got: %v", want, got)
+	}
+	if want, got := []string{"ami-2"}, cachedIDs(t, c, "us-east-1"); !reflect.DeepEqual(want, got) {
+		t.Errorf("want: %v, got: %v", want, got)
+	}
+	if _, err := c.Images("eu-west-1"); !errors.Is(err, ErrUnknownRegion) {
+		t.Errorf("want: %v, got: %v", ErrUnknownRegion, err)
+	}
+
+	images, _ := c.FilterImages("us-west-2", NewFilter(FilterByLaunchPermission("111111111111")))
+	if want, got := 1, len(images); want != got {
+		t.Errorf("want: %d images, got: %d images", want, got)
+	}
+
+	status := c.Status()
+	if want, got := 2, len(status[0].Partitions); want != got {
+		t.Fatalf("want: %d partitions, got: %d partitions", want, got)
+	}
+	for _, p := range status[0].Partitions {
+		if p.ImageCount != 1 || p.Err != nil || p.LastUpdated.IsZero() || p.Source != "catalog" {
+			t.Errorf("want: 1 image from catalog, got: %+v", p)
+		}
+	}
+
+	// The cache is updated when the file changes.
+	generation := c.Generation()
+	writeCatalog(t, dir, "catalog.json", `[{"id":"ami-5","owner_id":"123456789012","region":"us-west-2"}]`)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for c.Generation() == generation && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if want, got := []string{"ami-5"}, cachedIDs(t, c, "us-west-2"); !reflect.DeepEqual(want, got) {
+		t.Errorf("want: %v, got: %v", want, got)
+	}
+	if want, got := []string{}, cachedIDs(t, c, "us-east-1"); !reflect.DeepEqual(want, got) {
+		t.Errorf("want: %v, got: %v", want, got)
+	}
+	if want, got := 1, len(c.Status()[0].Partitions); want != got {
+		t.Errorf("want: %d partitions, got: %d partitions", want, got)
+	}
+
+	// The cached images are kept if the file can't be read.
+	generation = c.Generation()
+	writeCatalog(t, dir, "catalog.json", "[")
+	c.updateSource(ctx, c.sources[0], allPartitions)
+
+	if want, got := generation, c.Generation(); want != got {
+		t.Errorf("want: generation %d, got: generation %d", want, got)
+	}
+	if want, got := []string{"ami-5"}, cachedIDs(t, c, "us-west-2"); !reflect.DeepEqual(want, got) {
+		t.Errorf("want: %v, got: %v", want, got)
+	}
+	for _, p := range c.Status()[0].Partitions {
+		if p.Err == nil || p.ImageCount != 1 {
+			t.Errorf("want: error with 1 image, got: %+v", p)
+		}
+	}
+}
+
+func TestCacheSourceAggregation(t *testing.T) {
+	var (
+		owner  = "111122223333"
+		west   = Partition{owner, "us-west-1"}
+		east   = Partition{owner, "us-east-1"}
+		errSrc = errors.New("source failed")
+		image  = func(id string, p Partition) Image {
+			return NewImage(&ec2.Image{ImageId: aws.String(id)}, p.OwnerID, p.Region, nil)
+		}
+	)
+
+	src := &mockImageSource{
+		partitions: []Partition{west, east, {"999999999999", "us-west-1"}},
+		images: map[Partition][]Image{
+			west: {image("ami-src-1", west)},
+			east: {image("ami-src-2", east)},
+		},
+	}
+	other := &mockImageSource{
+		partitions: []Partition{west},
+		images:     map[Partition][]Image{west: {image("ami-other-1", west)}},
+	}
+
+	c := newMockCache(
+		Regions("us-west-1", "us-east-1"),
+		TTL(time.Hour),
+		AddSource("src", src, time.Hour),
+		AddSource("other", other, 10*time.Millisecond),
+	)
+
+	// Every region has its own image in EC2.
+	c.ec2Svc = func(_ *session.Session, region string, _ int) ec2iface.EC2API {
+		return &mockEC2Client{
+			describeImages: func(*ec2.DescribeImagesInput) (*ec2.DescribeImagesOutput, error) {
+				return &ec2.DescribeImagesOutput{
+					Images: []*ec2.Image{{ImageId: aws.String("ami-ec2-" + region)}},
+				}, nil
+			},
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	warmed := make(chan struct{})
+	go c.Run(ctx, warmed)
+	<-warmed
+
+	// The images from EC2 and every source are cached together.
+	if want, got := []string{"ami-ec2-us-west-1", "ami-other-1", "ami-src-1"}, cachedIDs(t, c, "us-west-1"); !reflect.DeepEqual(want, got) {
+		t.Errorf("want: %v, got: %v", want, got)
+	}
+	if want, got := []string{"ami-ec2-us-east-1", "ami-src-2"}, cachedIDs(t, c, "us-east-1"); !reflect.DeepEqual(want, got) {
+		t.Errorf("want: %v, got: %v", want, got)
+	}
+
+	// Every source has its own partition status.
+	got := map[string]int{}
+	for _, p := range c.Status()[0].Partitions {
+		got[p.Region+"/"+p.Source] = p.ImageCount
+	}
+	want := map[string]int{
+		"us-east-1/":      1,
+		"us-east-1/src":   1,
+		"us-west-1/":      1,
+		"us-west-1/other": 1,
+		"us-west-1/src":   1,
+	}
+	if !reflect.DeepEqual(want, got) {
+		t.Errorf("want: %v, got: %v", want, got)
+	}
+
+	// A source is updated on its own schedule.
+	calls := other.callCount()
+	deadline := time.Now().Add(5 * time.Second)
+	for other.callCount() < calls+2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if other.callCount() < calls+2 {
+		t.Errorf("want: at least %d calls, got: %d calls", calls+2, other.callCount())
+	}
+	if want, got := 1, src.callCount(); want != got {
+		t.Errorf("want: %d calls, got: %d calls", want, got)
+	}
+
+	// A failed partition of a source keeps its images, and doesn't affect
+	// other partitions, sources or EC2.
+	src.set(func(m *mockImageSource) {
+		m.images[east] = []Image{image("ami-src-3", east)}
+		m.errs = map[Partition]error{west: errSrc}
+	})
+	c.updateSource(ctx, c.sources[0], allPartitions)
+
+	if want, got := []string{"ami-ec2-us-west-1", "ami-other-1", "ami-src-1"}, cachedIDs(t, c, "us-west-1"); !reflect.DeepEqual(want, got) {
+		t.Errorf("want: %v, got: %v", want, got)
+	}
+	if want, got := []string{"ami-ec2-us-east-1", "ami-src-3"}, cachedIDs(t, c, "us-east-1"); !reflect.DeepEqual(want, got) {
+		t.Errorf("want: %v, got: %v", want, got)
+	}
+	for _, p := range c.Status()[0].Partitions {
+		wantErr := p.Source == "src" && p.Region == "us-west-1"
+		if wantErr != (p.Err != nil) || p.ImageCount != 1 {
+			t.Errorf("want: error %t with 1 image, got: %+v", wantErr, p)
+		}
+		if wantErr && p.LastUpdated.IsZero() {
+			t.Errorf("want: last update kept, got: %+v", p)
+		}
+	}
+
+	// An EC2 update keeps the images of the sources.
+	c.updateCache(ctx, allPartitions)
+	if want, got := []string{"ami-ec2-us-west-1", "ami-other-1", "ami-src-1"}, cachedIDs(t, c, "us-west-1"); !reflect.DeepEqual(want, got) {
+		t.Errorf("want: %v, got: %v", want, got)
+	}
+
+	// A source that fails entirely keeps its images.
+	src.set(func(m *mockImageSource) { m.err = errSrc })
+	c.updateSource(ctx, c.sources[0], allPartitions)
+	if want, got := []string{"ami-ec2-us-east-1", "ami-src-3"}, cachedIDs(t, c, "us-east-1"); !reflect.DeepEqual(want, got) {
+		t.Errorf("want: %v, got: %v", want, got)
+	}
+	for _, p := range c.Status()[0].Partitions {
+		if wantErr := p.Source == "src"; wantErr != (p.Err != nil) {
+			t.Errorf("want: error %t, got: %+v", wantErr, p)
+		}
+	}
+}
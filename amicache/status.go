@@ -0,0 +1,121 @@
+// Copyright 2020 Intuit, Inc.  All rights reserved.
+// Use of this source code is governed the MIT license
+// that can be found in the LICENSE file.
+
+package amicache
+
+import (
+	"sort"
+	"time"
+)
+
+// Partition identifies the images owned by an account in a region.
+type Partition struct {
+	OwnerID string
+	Region  string
+}
+
+// PartitionStatus describes the last update of a Partition.
+type PartitionStatus struct {
+	Partition
+	Source      string    // Name of the ImageSource, empty for EC2
+	ImageCount  int       // Number of images cached
+	Throttles   int       // Number of throttled API requests during the last update
+	LastUpdated time.Time // Time of the last successful update
+	Err         error     // Error from the last update, nil if it succeeded
+}
+
+// OwnerStatus describes the last update of an owner's partitions.
+type OwnerStatus struct {
+	OwnerID    string
+	Alias      string
+	Partitions []PartitionStatus // Sorted by region, then source
+	Err        error             // Error from the last attempt to assume role
+}
+
+// ImageCount returns the number of images cached for the owner.
+func (o OwnerStatus) ImageCount() int {
+	count := 0
+	for _, p := range o.Partitions {
+		count += p.ImageCount
+	}
+	return count
+}
+
+// Status returns the status of every owner, sorted by owner ID.
+func (c *Cache) Status() []OwnerStatus {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	owners := map[string]*OwnerStatus{}
+	for _, owner := range c.ownerIDs {
+		owners[owner] = &OwnerStatus{
+			OwnerID:    owner,
+			Alias:      c.ownerAliases[owner],
+			Partitions: []PartitionStatus{},
+			Err:        c.ownerErrs[owner],
+		}
+	}
+
+	for _, status := range c.status {
+		if owner, ok := owners[status.OwnerID]; ok {
+			owner.Partitions = append(owner.Partitions, status)
+		}
+	}
+	for _, s := range c.sources {
+		for _, status := range s.status {
+			if owner, ok := owners[status.OwnerID]; ok {
+				owner.Partitions = append(owner.Partitions, status)
+			}
+		}
+	}
+
+	statuses := []OwnerStatus{}
+	for _, owner := range owners {
+		sort.Slice(owner.Partitions, func(i, j int) bool {
+			if owner.Partitions[i].Region != owner.Partitions[j].Region {
+				return owner.Partitions[i].Region < owner.Partitions[j].Region
+			}
+			return owner.Partitions[i].Source < owner.Partitions[j].Source
+		})
+		statuses = append(statuses, *owner)
+	}
+
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].OwnerID < statuses[j].OwnerID
+	})
+
+	return statuses
+}
+
+// mergeStatus returns the partition statuses after an update of the provided
+// scope. Partitions that failed keep the image count and time of their last
+// successful update, since their images are kept, and the partitions of owners
+// that could not be accessed are marked with the owner's error. The caller must
+// hold c.mu.
+func (c *Cache) mergeStatus(scope updateScope, updated map[Partition]PartitionStatus, ownerErrs map[string]error) map[Partition]PartitionStatus {
+	status := map[Partition]PartitionStatus{}
+
+	for p, s := range c.status {
+		if !scope.matches(p) {
+			status[p] = s
+		}
+	}
+
+	for p, s := range updated {
+		if s.Err != nil {
+			s.ImageCount = c.status[p].ImageCount
+			s.LastUpdated = c.status[p].LastUpdated
+		}
+		status[p] = s
+	}
+
+	for p, s := range c.status {
+		if err, ok := ownerErrs[p.OwnerID]; ok && scope.matches(p) {
+			s.Err = err
+			status[p] = s
+		}
+	}
+
+	return status
+}
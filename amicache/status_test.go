@@ -0,0 +1,82 @@
+// Copyright 2020 Intuit, Inc.  All rights reserved.
+// Use of this source code is governed the MIT license
+// that can be found in the LICENSE file.
+
+package amicache
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+func TestStatus(t *testing.T) {
+	c := newMockCache(Regions("us-west-1"), OwnerAliases(map[string]string{"111122223333": "foo"}))
+	c.updateCache(context.Background(), allPartitions)
+
+	status := c.Status()
+	if want, got := 1, len(status); want != got {
+		t.Fatalf("want: %d owner(s), got: %d owner(s)", want, got)
+	}
+
+	owner := status[0]
+	if want, got := "foo", owner.Alias; want != got {
+		t.Errorf("want: %q, got: %q", want, got)
+	}
+
+	if want, got := 1, owner.ImageCount(); want != got {
+		t.Errorf("want: %d image(s), got: %d image(s)", want, got)
+	}
+
+	if want, got := 1, len(owner.Partitions); want != got {
+		t.Fatalf("want: %d partition(s), got: %d partition(s)", want, got)
+	}
+
+	p := owner.Partitions[0]
+	if p.Err != nil || p.LastUpdated.IsZero() {
+		t.Errorf("want: successful update, got: %+v", p)
+	}
+
+	// A failed partition keeps the time of the last successful update.
+	lastUpdated := p.LastUpdated
+	c.ec2Svc = func(*session.Session, string, int) ec2iface.EC2API {
+		return &mockEC2Client{
+			describeImages: func(*ec2.DescribeImagesInput) (*ec2.DescribeImagesOutput, error) {
+				return nil, errors.New("foo")
+			},
+		}
+	}
+	c.updateCache(context.Background(), allPartitions)
+
+	p = c.Status()[0].Partitions[0]
+	if want, got := "foo", p.Err.Error(); want != got {
+		t.Errorf("want: %q, got: %q", want, got)
+	}
+
+	if want, got := lastUpdated, p.LastUpdated; !want.Equal(got) {
+		t.Errorf("want: %s, got: %s", want, got)
+	}
+
+	// A failure to assume role is reported on the owner and its partitions.
+	c.svc = &mockSTSClient{
+		assumeRole: func(*sts.AssumeRoleInput) (*sts.AssumeRoleOutput, error) {
+			return nil, errors.New("bar")
+		},
+	}
+	c.updateCache(context.Background(), allPartitions)
+
+	owner = c.Status()[0]
+	if owner.Err == nil || owner.Partitions[0].Err != owner.Err {
+		t.Errorf("want: owner error on partitions, got: %+v", owner)
+	}
+
+	// The owner's images are kept until it can be accessed again.
+	if want, got := 1, owner.ImageCount(); want != got {
+		t.Errorf("want: %d image(s), got: %d image(s)", want, got)
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright 2020 Intuit, Inc.  All rights reserved.
+// Use of this source code is governed the MIT license
+// that can be found in the LICENSE file.
+
+package amicache_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/intuit/ami-query/amicache"
+	"github.com/intuit/ami-query/api/query"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+const upstreamCatalog = `[
+ {"id": "ami-1", "owner_id": "123456789012", "region": "us-west-2", "name": "rhel-1", "creationdate": "2020-06-01T00:00:00.000Z", "tags": {"state": "available"}},
+ {"id": "ami-2", "owner_id": "123456789012", "region": "us-east-1", "name": "rhel-2", "creationdate": "2020-06-02T00:00:00.000Z", "tags": {"state": "development"}}
+]`
+
+// The results of the query API of another ami-query instance are read by a
+// URLSource.
+func TestURLSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "catalog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "catalog.json")
+	if err := ioutil.WriteFile(path, []byte(upstreamCatalog), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	upstream := amicache.New(nil, "", []string{"123456789012"},
+		amicache.Regions("us-west-2", "us-east-1"),
+		amicache.AddSource("catalog", amicache.NewFileSource(path), time.Hour),
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	warmed := make(chan struct{})
+	go upstream.Run(ctx, warmed)
+	<-warmed
+
+	status := http.StatusOK
+	api := query.NewAPI(upstream)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if want, got := query.MediaTypeV1, r.Header.Get("Accept"); want != got {
+			t.Errorf("want: %s, got: %s", want, got)
+		}
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+		api.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	src := amicache.NewURLSource(srv.URL+query.APIPathQuery, nil)
+	partitions, err := src.Partitions(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := []string{}
+	for _, p := range partitions {
+		images, err := src.Images(ctx, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, image := range images {
+			got = append(got, p.Region+":"+aws.StringValue(image.Image.ImageId)+":"+image.Tag(amicache.DefaultStateTag))
+		}
+	}
+	sort.Strings(got)
+
+	if want := []string{"us-east-1:ami-2:development", "us-west-2:ami-1:available"}; !reflect.DeepEqual(want, got) {
+		t.Errorf("want: %v, got: %v", want, got)
+	}
+
+	status = http.StatusServiceUnavailable
+	if _, err := src.Partitions(ctx); err == nil {
+		t.Error("want: error, got: nil")
+	}
+}
@@ -0,0 +1,42 @@
+// Copyright 2020 Intuit, Inc.  All rights reserved.
+// Use of this source code is governed the MIT license
+// that can be found in the LICENSE file.
+
+package admin
+
+import (
+	"net/http"
+
+	"github.com/intuit/ami-query/api/ratelimit"
+)
+
+// APIPathRateLimit is the url path for the rate limiting stats API.
+const APIPathRateLimit = "/admin/ratelimit"
+
+// RateLimitAPI serves the numbers of requests allowed and rejected by the
+// rate limiter of the query APIs.
+type RateLimitAPI struct {
+	limiter statser
+	token   string
+}
+
+// NewRateLimitAPI returns a usable rate limit API. Requests must provide token
+// as a bearer token.
+func NewRateLimitAPI(limiter *ratelimit.Limiter, token string) *RateLimitAPI {
+	return &RateLimitAPI{limiter: limiter, token: token}
+}
+
+func (a *RateLimitAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !authorized(r, a.token) {
+		unauthorized(w, r)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, a.limiter.Stats())
+}
+
+// statser is used to represent a ratelimit.Limiter. Used to mock the limiter
+// in tests.
+type statser interface {
+	Stats() ratelimit.Stats
+}
@@ -0,0 +1,71 @@
+// Copyright 2020 Intuit, Inc.  All rights reserved.
+// Use of this source code is governed the MIT license
+// that can be found in the LICENSE file.
+
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/intuit/ami-query/api/ratelimit"
+)
+
+type mockLimiter struct{}
+
+func (mockLimiter) Stats() ratelimit.Stats {
+	return ratelimit.Stats{
+		Allowed:  10,
+		Rejected: 2,
+		Clients:  []ratelimit.ClientStats{{Client: "principal:ci", Rejected: 2}},
+	}
+}
+
+func TestRateLimitHandler(t *testing.T) {
+	tests := []struct {
+		name       string
+		token      string
+		statusCode int
+	}{
+		{"stats", "foo", http.StatusOK},
+		{"bad_token", "bar", http.StatusUnauthorized},
+	}
+
+	ts := httptest.NewServer(&RateLimitAPI{limiter: mockLimiter{}, token: "foo"})
+	defer ts.Close()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest("GET", ts.URL+APIPathRateLimit, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+
+			rsp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rsp.Body.Close()
+
+			if rsp.StatusCode != tt.statusCode {
+				t.Fatalf("want: status %d, got: status %d", tt.statusCode, rsp.StatusCode)
+			}
+
+			if tt.statusCode != http.StatusOK {
+				return
+			}
+
+			var got ratelimit.Stats
+			if err := json.NewDecoder(rsp.Body).Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+			if want := (mockLimiter{}).Stats(); !reflect.DeepEqual(want, got) {
+				t.Errorf("want: %+v, got: %+v", want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,166 @@
+// Copyright 2020 Intuit, Inc.  All rights reserved.
+// Use of this source code is governed the MIT license
+// that can be found in the LICENSE file.
+
+// Package admin provides the authenticated administrative API.
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/intuit/ami-query/amicache"
+	"github.com/intuit/ami-query/api/query"
+
+	"github.com/gorilla/mux"
+)
+
+// APIPathRefresh is the url path for the on-demand refresh API. The status of
+// a refresh is served from APIPathRefresh/{id}.
+const APIPathRefresh = "/admin/refresh"
+
+// RefreshAPI triggers on-demand cache refreshes and serves their status.
+type RefreshAPI struct {
+	cache refresher
+	token string
+}
+
+// Refresh describes an on-demand refresh.
+type Refresh struct {
+	ID        string         `json:"id"`
+	State     string         `json:"state"`
+	Scopes    []RefreshScope `json:"scopes"`
+	Requested time.Time      `json:"requested"`
+	Started   *time.Time     `json:"started,omitempty"`
+	Completed *time.Time     `json:"completed,omitempty"`
+}
+
+// RefreshScope describes the partitions updated by an on-demand refresh.
+type RefreshScope struct {
+	OwnerID string `json:"owner_id,omitempty"`
+	Region  string `json:"region,omitempty"`
+	Full    bool   `json:"full,omitempty"`
+}
+
+// NewRefreshAPI returns a usable refresh API. Requests must provide token as
+// a bearer token.
+func NewRefreshAPI(cache *amicache.Cache, token string) *RefreshAPI {
+	return &RefreshAPI{cache: cache, token: token}
+}
+
+func (a *RefreshAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !authorized(r, a.token) {
+		unauthorized(w, r)
+		return
+	}
+
+	if id, ok := mux.Vars(r)["id"]; ok {
+		a.status(w, r, id)
+		return
+	}
+
+	a.refresh(w, r)
+}
+
+// Triggers an on-demand refresh.
+func (a *RefreshAPI) refresh(w http.ResponseWriter, r *http.Request) {
+	scope := amicache.RefreshScope{
+		OwnerID: r.FormValue("owner_id"),
+		Region:  r.FormValue("region"),
+	}
+
+	if full := r.FormValue("full"); full != "" {
+		var err error
+		if scope.Full, err = strconv.ParseBool(full); err != nil {
+			query.WriteError(w, r, query.NewError(http.StatusBadRequest, query.CodeInvalidValue, "full", "invalid full value: %s", full))
+			return
+		}
+	}
+
+	id, err := a.cache.Refresh(scope)
+	if err != nil {
+		var cooldown *amicache.CooldownError
+		switch {
+		case errors.As(err, &cooldown):
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(cooldown.RetryAfter.Seconds()))))
+			query.WriteError(w, r, query.NewError(http.StatusTooManyRequests, query.CodeRateLimited, "", "%v", err))
+		case errors.Is(err, amicache.ErrUnknownOwner):
+			query.WriteError(w, r, query.NewError(http.StatusBadRequest, query.CodeUnknownOwner, "owner_id", "%v", err))
+		case errors.Is(err, amicache.ErrUnknownRegion):
+			query.WriteError(w, r, query.NewError(http.StatusBadRequest, query.CodeUnknownRegion, "region", "%v", err))
+		default:
+			query.WriteError(w, r, query.NewError(http.StatusBadRequest, query.CodeBadRequest, "", "%v", err))
+		}
+		return
+	}
+
+	status, _ := a.cache.RefreshStatus(id)
+	w.Header().Set("Location", APIPathRefresh+"/"+id)
+	writeJSON(w, http.StatusAccepted, newRefresh(status))
+}
+
+// Writes the status of an on-demand refresh.
+func (a *RefreshAPI) status(w http.ResponseWriter, r *http.Request, id string) {
+	status, ok := a.cache.RefreshStatus(id)
+	if !ok {
+		query.WriteError(w, r, query.NewError(http.StatusNotFound, query.CodeNotFound, "", "unknown refresh: %s", id))
+		return
+	}
+	writeJSON(w, http.StatusOK, newRefresh(status))
+}
+
+// Returns a Refresh from an amicache.RefreshStatus.
+func newRefresh(status amicache.RefreshStatus) Refresh {
+	r := Refresh{
+		ID:        status.ID,
+		State:     string(status.State),
+		Scopes:    []RefreshScope{},
+		Requested: status.Requested,
+	}
+	for _, scope := range status.Scopes {
+		r.Scopes = append(r.Scopes, RefreshScope(scope))
+	}
+	if !status.Started.IsZero() {
+		r.Started = &status.Started
+	}
+	if !status.Completed.IsZero() {
+		r.Completed = &status.Completed
+	}
+	return r
+}
+
+// Returns whether the request has a valid bearer token.
+func authorized(r *http.Request, token string) bool {
+	const prefix = "Bearer "
+	auth := r.Header.Get("Authorization")
+	if token == "" || !strings.HasPrefix(auth, prefix) {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(auth[len(prefix):]), []byte(token)) == 1
+}
+
+// Writes the response to a request without a valid bearer token.
+func unauthorized(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="ami-query"`)
+	query.WriteError(w, r, query.NewError(http.StatusUnauthorized, query.CodeUnauthorized, "", "invalid or missing bearer token"))
+}
+
+// Writes v as JSON to the http.ResponseWriter with the provided status code.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// refresher is used to represent an amicache.Cache. Used to mock the cache in
+// tests.
+type refresher interface {
+	Refresh(amicache.RefreshScope) (string, error)
+	RefreshStatus(string) (amicache.RefreshStatus, bool)
+}
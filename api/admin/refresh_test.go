@@ -0,0 +1,130 @@
+// Copyright 2020 Intuit, Inc.  All rights reserved.
+// Use of this source code is governed the MIT license
+// that can be found in the LICENSE file.
+
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/intuit/ami-query/amicache"
+	"github.com/intuit/ami-query/api/query"
+
+	"github.com/gorilla/mux"
+)
+
+type mockCache struct {
+	scopes []amicache.RefreshScope
+	err    error
+}
+
+func (m *mockCache) Refresh(scope amicache.RefreshScope) (string, error) {
+	if m.err != nil {
+		return "", m.err
+	}
+	m.scopes = append(m.scopes, scope)
+	return "1", nil
+}
+
+func (m *mockCache) RefreshStatus(id string) (amicache.RefreshStatus, bool) {
+	if id != "1" {
+		return amicache.RefreshStatus{}, false
+	}
+	return amicache.RefreshStatus{
+		ID:        "1",
+		Scopes:    m.scopes,
+		State:     amicache.RefreshPending,
+		Requested: time.Now(),
+	}, true
+}
+
+func TestRefreshHandler(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		token      string
+		err        error
+		statusCode int
+		code       query.ErrorCode
+	}{
+		{"refresh", "POST", "/admin/refresh?owner_id=123456789012&region=us-west-2&full=true", "foo", nil, http.StatusAccepted, ""},
+		{"status", "GET", "/admin/refresh/1", "foo", nil, http.StatusOK, ""},
+		{"unknown_id", "GET", "/admin/refresh/2", "foo", nil, http.StatusNotFound, query.CodeNotFound},
+		{"bad_token", "POST", "/admin/refresh", "bar", nil, http.StatusUnauthorized, query.CodeUnauthorized},
+		{"no_token", "POST", "/admin/refresh", "", nil, http.StatusUnauthorized, query.CodeUnauthorized},
+		{"bad_full", "POST", "/admin/refresh?full=foo", "foo", nil, http.StatusBadRequest, query.CodeInvalidValue},
+		{"bad_scope", "POST", "/admin/refresh?region=us-foo-1", "foo", fmt.Errorf("%w: us-foo-1", amicache.ErrUnknownRegion), http.StatusBadRequest, query.CodeUnknownRegion},
+		{"cooldown", "POST", "/admin/refresh", "foo", &amicache.CooldownError{RetryAfter: 1500 * time.Millisecond}, http.StatusTooManyRequests, query.CodeRateLimited},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mc := &mockCache{err: tt.err}
+			api := &RefreshAPI{cache: mc, token: "foo"}
+
+			router := mux.NewRouter()
+			router.Handle(APIPathRefresh, api).Methods("POST")
+			router.Handle(APIPathRefresh+"/{id}", api).Methods("GET")
+
+			ts := httptest.NewServer(router)
+			defer ts.Close()
+
+			req, err := http.NewRequest(tt.method, ts.URL+tt.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+
+			rsp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rsp.Body.Close()
+
+			if rsp.StatusCode != tt.statusCode {
+				t.Errorf("want: status %d, got: status %d", tt.statusCode, rsp.StatusCode)
+			}
+
+			if want, got := "application/json; charset=utf-8", rsp.Header.Get("Content-Type"); want != got {
+				t.Errorf("want: %s, got: %s", want, got)
+			}
+
+			switch tt.statusCode {
+			case http.StatusAccepted:
+				var refresh Refresh
+				if err := json.NewDecoder(rsp.Body).Decode(&refresh); err != nil {
+					t.Fatal(err)
+				}
+				want := RefreshScope{OwnerID: "123456789012", Region: "us-west-2", Full: true}
+				if len(refresh.Scopes) != 1 || refresh.Scopes[0] != want {
+					t.Errorf("want: %+v, got: %+v", want, refresh.Scopes)
+				}
+				if want, got := "/admin/refresh/1", rsp.Header.Get("Location"); want != got {
+					t.Errorf("want: %s, got: %s", want, got)
+				}
+			case http.StatusTooManyRequests:
+				if want, got := "2", rsp.Header.Get("Retry-After"); want != got {
+					t.Errorf("want: %s, got: %s", want, got)
+				}
+			}
+
+			if tt.code != "" {
+				var apiErr query.Error
+				if err := json.NewDecoder(rsp.Body).Decode(&apiErr); err != nil {
+					t.Fatal(err)
+				}
+				if tt.code != apiErr.Code {
+					t.Errorf("want: %s, got: %s", tt.code, apiErr.Code)
+				}
+			}
+		})
+	}
+}
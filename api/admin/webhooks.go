@@ -0,0 +1,91 @@
+// Copyright 2020 Intuit, Inc.  All rights reserved.
+// Use of this source code is governed the MIT license
+// that can be found in the LICENSE file.
+
+package admin
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/intuit/ami-query/api/query"
+	"github.com/intuit/ami-query/webhook"
+)
+
+// APIPathWebhookDeliveries is the url path for the webhook delivery log API.
+const APIPathWebhookDeliveries = "/admin/webhooks/deliveries"
+
+// WebhooksAPI serves the webhook delivery log.
+type WebhooksAPI struct {
+	dispatcher deliverer
+	token      string
+}
+
+// Delivery describes a webhook delivery.
+type Delivery struct {
+	ID          string     `json:"id"`
+	HookID      string     `json:"hook_id"`
+	URL         string     `json:"url"`
+	Event       string     `json:"event"`
+	ImageID     string     `json:"image_id"`
+	State       string     `json:"state"`
+	Attempts    int        `json:"attempts"`
+	StatusCode  int        `json:"status_code,omitempty"`
+	Error       string     `json:"error,omitempty"`
+	Created     time.Time  `json:"created"`
+	Updated     time.Time  `json:"updated"`
+	NextAttempt *time.Time `json:"next_attempt,omitempty"`
+}
+
+// NewWebhooksAPI returns a usable webhooks API. Requests must provide token as
+// a bearer token.
+func NewWebhooksAPI(dispatcher *webhook.Dispatcher, token string) *WebhooksAPI {
+	return &WebhooksAPI{dispatcher: dispatcher, token: token}
+}
+
+func (a *WebhooksAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !authorized(r, a.token) {
+		unauthorized(w, r)
+		return
+	}
+
+	state := r.FormValue("state")
+	switch webhook.DeliveryState(state) {
+	case "", webhook.DeliveryPending, webhook.DeliveryDelivered, webhook.DeliveryFailed:
+	default:
+		query.WriteError(w, r, query.NewError(http.StatusBadRequest, query.CodeInvalidValue, "state", "invalid state value: %s", state))
+		return
+	}
+
+	deliveries := []Delivery{}
+	for _, d := range a.dispatcher.Deliveries() {
+		if state != "" && string(d.State) != state {
+			continue
+		}
+		delivery := Delivery{
+			ID:         d.ID,
+			HookID:     d.HookID,
+			URL:        d.URL,
+			Event:      d.Event,
+			ImageID:    d.ImageID,
+			State:      string(d.State),
+			Attempts:   d.Attempts,
+			StatusCode: d.StatusCode,
+			Error:      d.Error,
+			Created:    d.Created,
+			Updated:    d.Updated,
+		}
+		if d.State == webhook.DeliveryPending {
+			delivery.NextAttempt = &d.NextAttempt
+		}
+		deliveries = append(deliveries, delivery)
+	}
+
+	writeJSON(w, http.StatusOK, deliveries)
+}
+
+// deliverer is used to represent a webhook.Dispatcher. Used to mock the
+// dispatcher in tests.
+type deliverer interface {
+	Deliveries() []webhook.Delivery
+}
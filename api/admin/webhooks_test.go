@@ -0,0 +1,90 @@
+// Copyright 2020 Intuit, Inc.  All rights reserved.
+// Use of this source code is governed the MIT license
+// that can be found in the LICENSE file.
+
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/intuit/ami-query/webhook"
+)
+
+type mockDispatcher struct{}
+
+func (mockDispatcher) Deliveries() []webhook.Delivery {
+	now := time.Now()
+	return []webhook.Delivery{
+		{ID: "2", URL: "https://example.com", State: webhook.DeliveryPending, Attempts: 1, NextAttempt: now},
+		{ID: "1", URL: "https://example.com", State: webhook.DeliveryDelivered, Attempts: 1, StatusCode: 200},
+	}
+}
+
+func TestWebhooksHandler(t *testing.T) {
+	tests := []struct {
+		name       string
+		query      string
+		token      string
+		statusCode int
+		want       []string
+	}{
+		{"deliveries", "", "foo", http.StatusOK, []string{"2", "1"}},
+		{"pending", "?state=pending", "foo", http.StatusOK, []string{"2"}},
+		{"delivered", "?state=delivered", "foo", http.StatusOK, []string{"1"}},
+		{"bad_state", "?state=foo", "foo", http.StatusBadRequest, nil},
+		{"bad_token", "", "bar", http.StatusUnauthorized, nil},
+	}
+
+	ts := httptest.NewServer(&WebhooksAPI{dispatcher: mockDispatcher{}, token: "foo"})
+	defer ts.Close()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest("GET", ts.URL+APIPathWebhookDeliveries+tt.query, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+
+			rsp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rsp.Body.Close()
+
+			if rsp.StatusCode != tt.statusCode {
+				t.Fatalf("want: status %d, got: status %d", tt.statusCode, rsp.StatusCode)
+			}
+
+			if tt.statusCode != http.StatusOK {
+				return
+			}
+
+			var deliveries []Delivery
+			if err := json.NewDecoder(rsp.Body).Decode(&deliveries); err != nil {
+				t.Fatal(err)
+			}
+
+			got := []string{}
+			for _, delivery := range deliveries {
+				got = append(got, delivery.ID)
+				if (delivery.NextAttempt != nil) != (delivery.State == "pending") {
+					t.Errorf("%s: unexpected next_attempt: %v", delivery.ID, delivery.NextAttempt)
+				}
+			}
+
+			if len(tt.want) != len(got) {
+				t.Fatalf("want: %v, got: %v", tt.want, got)
+			}
+			for i := range tt.want {
+				if tt.want[i] != got[i] {
+					t.Errorf("want: %v, got: %v", tt.want, got)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright 2020 Intuit, Inc.  All rights reserved.
+// Use of this source code is governed the MIT license
+// that can be found in the LICENSE file.
+
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// HeaderAPIKey is the header API keys are sent in.
+const HeaderAPIKey = "X-Api-Key"
+
+// APIKeys authenticates requests with static API keys sent in the X-Api-Key
+// header. Only the SHA-256 hashes of the keys are kept, so they can be stored
+// in the configuration.
+type APIKeys struct {
+	hashes map[string][]byte // the key hashes by name
+}
+
+// NewAPIKeys returns an APIKeys for the hex encoded SHA-256 hashes of the
+// keys, by name. The name of a key is the name of its principal.
+func NewAPIKeys(hashes map[string]string) (*APIKeys, error) {
+	a := &APIKeys{hashes: map[string][]byte{}}
+	for name, hash := range hashes {
+		b, err := hex.DecodeString(strings.TrimSpace(hash))
+		if err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("api key %s: invalid sha256 hash", name)
+		}
+		a.hashes[name] = b
+	}
+	return a, nil
+}
+
+// HashAPIKey returns the hex encoded SHA-256 hash of an API key.
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// Authenticate returns the principal of the request's API key.
+func (a *APIKeys) Authenticate(r *http.Request) (*Principal, error) {
+	key := r.Header.Get(HeaderAPIKey)
+	if key == "" {
+		return nil, ErrNoCredentials
+	}
+
+	// Every hash is compared so the time taken doesn't depend on which key
+	// matched.
+	sum := sha256.Sum256([]byte(key))
+	name := ""
+	for n, hash := range a.hashes {
+		if subtle.ConstantTimeCompare(sum[:], hash) == 1 {
+			name = n
+		}
+	}
+	if name == "" {
+		return nil, errors.New("invalid api key")
+	}
+
+	return &Principal{Name: name, Method: MethodAPIKey}, nil
+}
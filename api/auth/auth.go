@@ -0,0 +1,185 @@
+// Copyright 2020 Intuit, Inc.  All rights reserved.
+// Use of this source code is governed the MIT license
+// that can be found in the LICENSE file.
+
+// Package auth authenticates requests to the query API.
+//
+//	keys, err := auth.NewAPIKeys(map[string]string{"ci": hash})
+//	if err != nil {
+//		return err
+//	}
+//	handler = auth.New([]auth.Authenticator{keys}, auth.AuditLogger(logger)).Wrap(handler)
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/intuit/ami-query/api/query"
+
+	"github.com/go-kit/kit/log"
+)
+
+// ErrNoCredentials is returned by an Authenticator when a request doesn't
+// have credentials it can check.
+var ErrNoCredentials = errors.New("no credentials")
+
+// The authentication methods of a Principal.
+const (
+	MethodAPIKey     = "api_key"
+	MethodJWT        = "jwt"
+	MethodClientCert = "client_cert"
+)
+
+// Principal is the authenticated identity of a client.
+type Principal struct {
+	Name   string // The name of the API key or certificate, or the token's subject
+	Method string // How the principal was authenticated
+}
+
+// Authenticator authenticates requests with one kind of credentials.
+type Authenticator interface {
+	// Authenticate returns the principal of a request. It returns
+	// ErrNoCredentials if the request doesn't have credentials of the
+	// authenticator's kind, or another error if they're invalid.
+	Authenticate(r *http.Request) (*Principal, error)
+}
+
+// Option configures a Middleware.
+type Option interface {
+	set(*Middleware)
+}
+
+// optionFunc is a function adapter that implements the Option interface.
+type optionFunc func(*Middleware)
+
+func (fn optionFunc) set(m *Middleware) { fn(m) }
+
+// AuditLogger sets the logger an entry is written to for every request,
+// including rejected ones. Audit entries aren't written if it isn't set.
+func AuditLogger(logger log.Logger) Option {
+	return optionFunc(func(m *Middleware) {
+		if logger != nil {
+			m.audit = logger
+		}
+	})
+}
+
+// Middleware rejects requests that can't be authenticated by any of its
+// authenticators.
+type Middleware struct {
+	authenticators []Authenticator
+	audit          log.Logger
+}
+
+// New returns a Middleware using the authenticators, which are tried in
+// order until one finds credentials in a request.
+func New(authenticators []Authenticator, options ...Option) *Middleware {
+	m := &Middleware{
+		authenticators: authenticators,
+		audit:          log.NewNopLogger(),
+	}
+	for _, opt := range options {
+		opt.set(m)
+	}
+	return m
+}
+
+// Wrap returns a handler that calls h with the principal of authenticated
+// requests in their context, and writes an unauthorized error otherwise.
+func (m *Middleware) Wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		principal, err := m.authenticate(r)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="ami-query"`)
+			query.WriteError(w, r, query.NewError(http.StatusUnauthorized, query.CodeUnauthorized, "", "%v", err))
+			m.log(r, nil, http.StatusUnauthorized, start, "error", err)
+			return
+		}
+
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(sw, r.WithContext(NewContext(r.Context(), principal)))
+		m.log(r, principal, sw.status, start)
+	})
+}
+
+// Returns the principal of the first authenticator that finds credentials in
+// the request.
+func (m *Middleware) authenticate(r *http.Request) (*Principal, error) {
+	for _, a := range m.authenticators {
+		principal, err := a.Authenticate(r)
+		if errors.Is(err, ErrNoCredentials) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return principal, nil
+	}
+	return nil, errors.New("missing credentials")
+}
+
+// Writes the audit entry of a request.
+func (m *Middleware) log(r *http.Request, principal *Principal, status int, start time.Time, keyvals ...interface{}) {
+	name, method := "", ""
+	if principal != nil {
+		name, method = principal.Name, principal.Method
+	}
+	m.audit.Log(append([]interface{}{
+		"request_id", query.RequestIDFromContext(r.Context()),
+		"principal", name,
+		"auth_method", method,
+		"remote_addr", r.RemoteAddr,
+		"method", r.Method,
+		"path", r.URL.Path,
+		"query", r.URL.RawQuery,
+		"status", status,
+		"duration", time.Since(start),
+	}, keyvals...)...)
+}
+
+// The context key of the principal.
+type principalKey struct{}
+
+// NewContext returns a copy of ctx with the principal.
+func NewContext(ctx context.Context, principal *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// FromContext returns the principal set by a Middleware, or nil if the
+// request wasn't authenticated.
+func FromContext(ctx context.Context) *Principal {
+	principal, _ := ctx.Value(principalKey{}).(*Principal)
+	return principal
+}
+
+// statusWriter records the status of a response. It supports flushing, which
+// is used by streaming responses.
+type statusWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status = status
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *statusWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
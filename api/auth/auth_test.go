@@ -0,0 +1,175 @@
+// Copyright 2020 Intuit, Inc.  All rights reserved.
+// Use of this source code is governed the MIT license
+// that can be found in the LICENSE file.
+
+package auth
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+)
+
+// mockAuthenticator authenticates requests with an X-Mock header.
+type mockAuthenticator struct{}
+
+func (mockAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	switch name := r.Header.Get("X-Mock"); name {
+	case "":
+		return nil, ErrNoCredentials
+	case "bad":
+		return nil, errors.New("bad mock")
+	default:
+		return &Principal{Name: name, Method: "mock"}, nil
+	}
+}
+
+func TestAPIKeys(t *testing.T) {
+	keys, err := NewAPIKeys(map[string]string{
+		"ci":     HashAPIKey("ci-key"),
+		"deploy": strings.ToUpper(HashAPIKey("deploy-key")),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		key     string
+		want    *Principal
+		wantErr error
+	}{
+		{"ci", "ci-key", &Principal{"ci", MethodAPIKey}, nil},
+		{"upper_case_hash", "deploy-key", &Principal{"deploy", MethodAPIKey}, nil},
+		{"no_key", "", nil, ErrNoCredentials},
+		{"unknown_key", "other-key", nil, errors.New("invalid api key")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/amis", nil)
+			if tt.key != "" {
+				r.Header.Set(HeaderAPIKey, tt.key)
+			}
+			got, err := keys.Authenticate(r)
+			if !reflect.DeepEqual(tt.wantErr, err) {
+				t.Errorf("want: %v, got: %v", tt.wantErr, err)
+			}
+			if !reflect.DeepEqual(tt.want, got) {
+				t.Errorf("want: %v, got: %v", tt.want, got)
+			}
+		})
+	}
+
+	if _, err := NewAPIKeys(map[string]string{"ci": "not-a-hash"}); err == nil {
+		t.Error("want: error, got: nil")
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	audit := &bytes.Buffer{}
+	m := New(
+		[]Authenticator{mockAuthenticator{}},
+		AuditLogger(log.NewLogfmtLogger(audit)),
+	)
+
+	h := m.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+		w.Write([]byte(FromContext(r.Context()).Name))
+	}))
+
+	tests := []struct {
+		name       string
+		mock       string
+		wantStatus int
+		wantBody   string
+		wantAudit  string
+	}{
+		{
+			name:       "authenticated",
+			mock:       "ci",
+			wantStatus: http.StatusTeapot,
+			wantBody:   "ci",
+			wantAudit:  `request_id= principal=ci auth_method=mock remote_addr=192.0.2.1:1234 method=GET path=/amis query="region=us-west-2" status=418`,
+		},
+		{
+			name:       "missing_credentials",
+			wantStatus: http.StatusUnauthorized,
+			wantBody:   `{"code":"unauthorized","message":"missing credentials"}`,
+			wantAudit:  `request_id= principal= auth_method= remote_addr=192.0.2.1:1234 method=GET path=/amis query="region=us-west-2" status=401`,
+		},
+		{
+			name:       "invalid_credentials",
+			mock:       "bad",
+			wantStatus: http.StatusUnauthorized,
+			wantBody:   `{"code":"unauthorized","message":"bad mock"}`,
+			wantAudit:  `request_id= principal= auth_method= remote_addr=192.0.2.1:1234 method=GET path=/amis query="region=us-west-2" status=401`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			audit.Reset()
+
+			r := httptest.NewRequest("GET", "/amis?region=us-west-2", nil)
+			if tt.mock != "" {
+				r.Header.Set("X-Mock", tt.mock)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			if want, got := tt.wantStatus, w.Code; want != got {
+				t.Errorf("want: %d, got: %d", want, got)
+			}
+			if want, got := tt.wantBody, strings.TrimSpace(w.Body.String()); want != got {
+				t.Errorf("want: %s, got: %s", want, got)
+			}
+			if got := audit.String(); !strings.HasPrefix(got, tt.wantAudit+" duration=") {
+				t.Errorf("\n\twant: %s\n\t got: %s", tt.wantAudit, got)
+			}
+
+			wantChallenge := ""
+			if tt.wantStatus == http.StatusUnauthorized {
+				wantChallenge = `Bearer realm="ami-query"`
+			}
+			if want, got := wantChallenge, w.Header().Get("WWW-Authenticate"); want != got {
+				t.Errorf("want: %s, got: %s", want, got)
+			}
+		})
+	}
+}
+
+func TestMiddlewareOrder(t *testing.T) {
+	keys, err := NewAPIKeys(map[string]string{"ci": HashAPIKey("ci-key")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first authenticator that finds credentials decides.
+	m := New([]Authenticator{keys, mockAuthenticator{}})
+
+	var got *Principal
+	h := m.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = FromContext(r.Context())
+	}))
+
+	r := httptest.NewRequest("GET", "/amis", nil)
+	r.Header.Set("X-Mock", "mock")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	if want := (&Principal{"mock", "mock"}); !reflect.DeepEqual(want, got) {
+		t.Errorf("want: %v, got: %v", want, got)
+	}
+
+	r.Header.Set(HeaderAPIKey, "bad-key")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if want, got := http.StatusUnauthorized, w.Code; want != got {
+		t.Errorf("want: %d, got: %d", want, got)
+	}
+}
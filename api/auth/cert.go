@@ -0,0 +1,47 @@
+// Copyright 2020 Intuit, Inc.  All rights reserved.
+// Use of this source code is governed the MIT license
+// that can be found in the LICENSE file.
+
+package auth
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// ClientCertificates authenticates requests with the TLS client certificate
+// verified by the server. It must only be used with a server that verifies
+// client certificates, since the certificate isn't verified again.
+type ClientCertificates struct {
+	principals map[string]string // principal names by subject
+}
+
+// NewClientCertificates returns a ClientCertificates that maps the subjects
+// of certificates to principal names. Subjects are in the RFC 2253 format,
+// e.g. "CN=ci.example.com,O=Example". Certificates with unmapped subjects are
+// rejected, unless there are no mappings, in which case the principal is the
+// subject's common name.
+func NewClientCertificates(principals map[string]string) *ClientCertificates {
+	return &ClientCertificates{principals: principals}
+}
+
+// Authenticate returns the principal of the request's client certificate.
+func (c *ClientCertificates) Authenticate(r *http.Request) (*Principal, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, ErrNoCredentials
+	}
+	subject := r.TLS.VerifiedChains[0][0].Subject
+
+	if len(c.principals) == 0 {
+		if subject.CommonName == "" {
+			return nil, fmt.Errorf("client certificate has no common name: %s", subject)
+		}
+		return &Principal{Name: subject.CommonName, Method: MethodClientCert}, nil
+	}
+
+	name, ok := c.principals[subject.String()]
+	if !ok {
+		return nil, fmt.Errorf("unknown client certificate subject: %s", subject)
+	}
+	return &Principal{Name: name, Method: MethodClientCert}, nil
+}
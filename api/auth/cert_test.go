@@ -0,0 +1,85 @@
+// Copyright 2020 Intuit, Inc.  All rights reserved.
+// Use of this source code is governed the MIT license
+// that can be found in the LICENSE file.
+
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestClientCertificates(t *testing.T) {
+	// Returns a TLS connection state with a verified certificate.
+	verified := func(subject pkix.Name) *tls.ConnectionState {
+		return &tls.ConnectionState{
+			VerifiedChains: [][]*x509.Certificate{{{Subject: subject}}},
+		}
+	}
+
+	ci := pkix.Name{CommonName: "ci.example.com", Organization: []string{"Example"}}
+	other := pkix.Name{CommonName: "other.example.com"}
+
+	tests := []struct {
+		name       string
+		principals map[string]string
+		tls        *tls.ConnectionState
+		want       *Principal
+		wantErr    string
+	}{
+		{
+			name:       "mapped",
+			principals: map[string]string{"CN=ci.example.com,O=Example": "ci"},
+			tls:        verified(ci),
+			want:       &Principal{"ci", MethodClientCert},
+		},
+		{
+			name:       "unmapped",
+			principals: map[string]string{"CN=ci.example.com,O=Example": "ci"},
+			tls:        verified(other),
+			wantErr:    "unknown client certificate subject: CN=other.example.com",
+		},
+		{
+			name: "common_name",
+			tls:  verified(ci),
+			want: &Principal{"ci.example.com", MethodClientCert},
+		},
+		{
+			name:    "no_common_name",
+			tls:     verified(pkix.Name{Organization: []string{"Example"}}),
+			wantErr: "client certificate has no common name: O=Example",
+		},
+		{
+			name:    "no_certificate",
+			tls:     &tls.ConnectionState{},
+			wantErr: ErrNoCredentials.Error(),
+		},
+		{
+			name:    "no_tls",
+			wantErr: ErrNoCredentials.Error(),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/amis", nil)
+			r.TLS = tt.tls
+
+			got, err := NewClientCertificates(tt.principals).Authenticate(r)
+			gotErr := ""
+			if err != nil {
+				gotErr = err.Error()
+			}
+			if want := tt.wantErr; want != gotErr {
+				t.Errorf("want: %s, got: %s", want, gotErr)
+			}
+			if !reflect.DeepEqual(tt.want, got) {
+				t.Errorf("want: %v, got: %v", tt.want, got)
+			}
+		})
+	}
+}
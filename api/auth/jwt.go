@@ -0,0 +1,322 @@
+// Copyright 2020 Intuit, Inc.  All rights reserved.
+// Use of this source code is governed the MIT license
+// that can be found in the LICENSE file.
+
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256" // registers the hashes of the signing algorithms
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The signing algorithms supported for JWTs, by name.
+var jwtAlgorithms = map[string]struct {
+	kty   string
+	hash  crypto.Hash
+	curve elliptic.Curve
+}{
+	"RS256": {"RSA", crypto.SHA256, nil},
+	"RS384": {"RSA", crypto.SHA384, nil},
+	"RS512": {"RSA", crypto.SHA512, nil},
+	"ES256": {"EC", crypto.SHA256, elliptic.P256()},
+	"ES384": {"EC", crypto.SHA384, elliptic.P384()},
+	"ES512": {"EC", crypto.SHA512, elliptic.P521()},
+}
+
+// The clock skew allowed when checking the time claims of a token.
+const jwtLeeway = time.Minute
+
+// JWT authenticates requests with JWT bearer tokens sent in the Authorization
+// header. Tokens must be signed with RSA or ECDSA by a key of a JSON Web Key
+// Set and have an expiration time. The principal is the subject of a token.
+type JWT struct {
+	keys     []jwtKey
+	issuer   string
+	audience string
+	now      func() time.Time
+}
+
+// A verification key of a JWKS.
+type jwtKey struct {
+	id  string
+	alg string // The algorithm the key is restricted to, if any
+	key crypto.PublicKey
+}
+
+// NewJWT returns a JWT that verifies tokens with the keys of a JWKS file. The
+// iss and aud claims of tokens are checked if issuer and audience are set.
+func NewJWT(jwksFile, issuer, audience string) (*JWT, error) {
+	data, err := ioutil.ReadFile(jwksFile)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", jwksFile, err)
+	}
+
+	return &JWT{keys: keys, issuer: issuer, audience: audience, now: time.Now}, nil
+}
+
+// Authenticate returns the principal of the request's bearer token.
+func (j *JWT) Authenticate(r *http.Request) (*Principal, error) {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return nil, ErrNoCredentials
+	}
+
+	c, err := j.verify(strings.TrimPrefix(header, "Bearer "))
+	if err != nil {
+		return nil, fmt.Errorf("invalid bearer token: %v", err)
+	}
+
+	return &Principal{Name: c.Subject, Method: MethodJWT}, nil
+}
+
+// The claims of a token that are checked.
+type jwtClaims struct {
+	Subject   string      `json:"sub"`
+	Issuer    string      `json:"iss"`
+	Audience  jwtAudience `json:"aud"`
+	ExpiresAt *float64    `json:"exp"`
+	NotBefore *float64    `json:"nbf"`
+}
+
+// jwtAudience is the aud claim, which is either a string or a list.
+type jwtAudience []string
+
+func (a *jwtAudience) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*a = jwtAudience{s}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(a))
+}
+
+func (a jwtAudience) contains(audience string) bool {
+	for _, aud := range a {
+		if aud == audience {
+			return true
+		}
+	}
+	return false
+}
+
+// Verifies the signature and claims of a token.
+func (j *JWT) verify(token string) (*jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, errors.New("malformed header")
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed signature")
+	}
+
+	if err := j.verifySignature(header.Alg, header.Kid, parts[0]+"."+parts[1], sig); err != nil {
+		return nil, err
+	}
+
+	c := &jwtClaims{}
+	if err := decodeSegment(parts[1], c); err != nil {
+		return nil, errors.New("malformed claims")
+	}
+
+	now := j.now()
+	switch {
+	case c.Subject == "":
+		return nil, errors.New("missing subject")
+	case c.ExpiresAt == nil:
+		return nil, errors.New("missing expiration time")
+	case now.Add(-jwtLeeway).After(unixTime(*c.ExpiresAt)):
+		return nil, errors.New("token is expired")
+	case c.NotBefore != nil && now.Add(jwtLeeway).Before(unixTime(*c.NotBefore)):
+		return nil, errors.New("token is not valid yet")
+	case j.issuer != "" && c.Issuer != j.issuer:
+		return nil, fmt.Errorf("unexpected issuer: %s", c.Issuer)
+	case j.audience != "" && !c.Audience.contains(j.audience):
+		return nil, errors.New("unexpected audience")
+	}
+
+	return c, nil
+}
+
+// Verifies the signature of a token with the keys that can be used with its
+// algorithm. If the token has a key ID, only the key with that ID is used.
+func (j *JWT) verifySignature(alg, kid, signed string, sig []byte) error {
+	algorithm, ok := jwtAlgorithms[alg]
+	if !ok {
+		return fmt.Errorf("unsupported algorithm: %s", alg)
+	}
+
+	h := algorithm.hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	for _, k := range j.keys {
+		if (kid != "" && k.id != kid) || (k.alg != "" && k.alg != alg) {
+			continue
+		}
+
+		switch key := k.key.(type) {
+		case *rsa.PublicKey:
+			if algorithm.kty == "RSA" && rsa.VerifyPKCS1v15(key, algorithm.hash, digest, sig) == nil {
+				return nil
+			}
+		case *ecdsa.PublicKey:
+			size := (key.Curve.Params().BitSize + 7) / 8
+			if algorithm.curve != key.Curve || len(sig) != 2*size {
+				continue
+			}
+			r := new(big.Int).SetBytes(sig[:size])
+			s := new(big.Int).SetBytes(sig[size:])
+			if ecdsa.Verify(key, digest, r, s) {
+				return nil
+			}
+		}
+	}
+
+	return errors.New("invalid signature")
+}
+
+// Decodes a base64url encoded JSON segment of a token.
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// Returns the time of a NumericDate claim.
+func unixTime(seconds float64) time.Time {
+	return time.Unix(0, int64(seconds*float64(time.Second)))
+}
+
+// A key of a JWKS. Only the parameters of RSA and EC public keys are used.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// Parses the signature verification keys of a JWKS. Encryption keys and keys
+// of unsupported types are skipped.
+func parseJWKS(data []byte) ([]jwtKey, error) {
+	var jwks struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &jwks); err != nil {
+		return nil, err
+	}
+
+	keys := []jwtKey{}
+	for i, k := range jwks.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		if _, ok := jwtAlgorithms[k.Alg]; k.Alg != "" && !ok {
+			continue
+		}
+
+		var (
+			key crypto.PublicKey
+			err error
+		)
+		switch k.Kty {
+		case "RSA":
+			key, err = parseRSAKey(k)
+		case "EC":
+			key, err = parseECKey(k)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("key %d: %v", i, err)
+		}
+
+		keys = append(keys, jwtKey{id: k.Kid, alg: k.Alg, key: key})
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("no signature verification keys")
+	}
+
+	return keys, nil
+}
+
+// Returns the RSA public key of a JWK.
+func parseRSAKey(k jwk) (*rsa.PublicKey, error) {
+	n, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil || len(n) == 0 {
+		return nil, errors.New("invalid modulus")
+	}
+	e, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil || len(e) == 0 || len(e) > 4 {
+		return nil, errors.New("invalid exponent")
+	}
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(n),
+		E: int(new(big.Int).SetBytes(e).Int64()),
+	}, nil
+}
+
+// Returns the ECDSA public key of a JWK.
+func parseECKey(k jwk) (*ecdsa.PublicKey, error) {
+	var curve elliptic.Curve
+	switch k.Crv {
+	case "P-256":
+		curve = elliptic.P256()
+	case "P-384":
+		curve = elliptic.P384()
+	case "P-521":
+		curve = elliptic.P521()
+	default:
+		return nil, fmt.Errorf("unsupported curve: %s", k.Crv)
+	}
+
+	x, err := base64.RawURLEncoding.DecodeString(k.X)
+	if err != nil {
+		return nil, errors.New("invalid x coordinate")
+	}
+	y, err := base64.RawURLEncoding.DecodeString(k.Y)
+	if err != nil {
+		return nil, errors.New("invalid y coordinate")
+	}
+
+	key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+	if !curve.IsOnCurve(key.X, key.Y) {
+		return nil, errors.New("point is not on the curve")
+	}
+	return key, nil
+}
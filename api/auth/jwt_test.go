@@ -0,0 +1,292 @@
+// Copyright 2020 Intuit, Inc.  All rights reserved.
+// Use of this source code is governed the MIT license
+// that can be found in the LICENSE file.
+
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Returns the base64url encoding of the JSON encoded value.
+func encodeSegment(t *testing.T, v interface{}) string {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// Returns a token signed with the key, which is an *rsa.PrivateKey for RS256
+// or an *ecdsa.PrivateKey for ES256.
+func signToken(t *testing.T, key interface{}, header, claims map[string]interface{}) string {
+	t.Helper()
+
+	signed := encodeSegment(t, header) + "." + encodeSegment(t, claims)
+	h := crypto.SHA256.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	var sig []byte
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		var err error
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest); err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// Writes a JWKS with the public keys to a temporary file, and returns its
+// path.
+func writeJWKS(t *testing.T, dir string, rsaKey *rsa.PrivateKey, ecKey *ecdsa.PrivateKey) string {
+	t.Helper()
+
+	encode := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+	jwks := map[string]interface{}{
+		"keys": []map[string]string{
+			{
+				"kty": "RSA",
+				"kid": "rsa",
+				"alg": "RS256",
+				"use": "sig",
+				"n":   encode(rsaKey.N.Bytes()),
+				"e":   encode(big.NewInt(int64(rsaKey.E)).Bytes()),
+			},
+			{
+				"kty": "EC",
+				"kid": "ec",
+				"crv": "P-256",
+				"x":   encode(ecKey.X.Bytes()),
+				"y":   encode(ecKey.Y.Bytes()),
+			},
+			{
+				"kty": "oct",
+				"kid": "secret",
+				"k":   "c2VjcmV0",
+			},
+		},
+	}
+
+	data, err := json.Marshal(jwks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "jwks.json")
+	if err := ioutil.WriteFile(file, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestJWT(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jwks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	j, err := NewJWT(writeJWKS(t, dir, rsaKey, ecKey), "https://issuer.example.com", "ami-query")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Unix(1600000000, 0)
+	j.now = func() time.Time { return now }
+
+	claims := func(overrides map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"sub": "team-a",
+			"iss": "https://issuer.example.com",
+			"aud": []string{"other", "ami-query"},
+			"exp": now.Add(time.Hour).Unix(),
+		}
+		for k, v := range overrides {
+			if v == nil {
+				delete(c, k)
+			} else {
+				c[k] = v
+			}
+		}
+		return c
+	}
+
+	rs256 := map[string]interface{}{"alg": "RS256", "kid": "rsa", "typ": "JWT"}
+	es256 := map[string]interface{}{"alg": "ES256", "kid": "ec", "typ": "JWT"}
+
+	tests := []struct {
+		name    string
+		header  string
+		want    *Principal
+		wantErr string
+	}{
+		{
+			name:   "rs256",
+			header: "Bearer " + signToken(t, rsaKey, rs256, claims(nil)),
+			want:   &Principal{"team-a", MethodJWT},
+		},
+		{
+			name:   "es256",
+			header: "Bearer " + signToken(t, ecKey, es256, claims(map[string]interface{}{"aud": "ami-query"})),
+			want:   &Principal{"team-a", MethodJWT},
+		},
+		{
+			name:   "no_kid",
+			header: "Bearer " + signToken(t, ecKey, map[string]interface{}{"alg": "ES256"}, claims(nil)),
+			want:   &Principal{"team-a", MethodJWT},
+		},
+		{
+			name:   "within_leeway",
+			header: "Bearer " + signToken(t, rsaKey, rs256, claims(map[string]interface{}{"exp": now.Add(-30 * time.Second).Unix()})),
+			want:   &Principal{"team-a", MethodJWT},
+		},
+		{
+			name:    "no_credentials",
+			header:  "",
+			wantErr: ErrNoCredentials.Error(),
+		},
+		{
+			name:    "basic_auth",
+			header:  "Basic dXNlcjpwYXNz",
+			wantErr: ErrNoCredentials.Error(),
+		},
+		{
+			name:    "malformed",
+			header:  "Bearer not-a-token",
+			wantErr: "invalid bearer token: malformed token",
+		},
+		{
+			name:    "unknown_key",
+			header:  "Bearer " + signToken(t, otherKey, es256, claims(nil)),
+			wantErr: "invalid bearer token: invalid signature",
+		},
+		{
+			name:    "wrong_kid",
+			header:  "Bearer " + signToken(t, ecKey, map[string]interface{}{"alg": "ES256", "kid": "rsa"}, claims(nil)),
+			wantErr: "invalid bearer token: invalid signature",
+		},
+		{
+			name:    "none_algorithm",
+			header:  "Bearer " + encodeSegment(t, map[string]string{"alg": "none"}) + "." + encodeSegment(t, claims(nil)) + ".",
+			wantErr: "invalid bearer token: unsupported algorithm: none",
+		},
+		{
+			name:    "hmac_algorithm",
+			header:  "Bearer " + signToken(t, rsaKey, map[string]interface{}{"alg": "HS256", "kid": "secret"}, claims(nil)),
+			wantErr: "invalid bearer token: unsupported algorithm: HS256",
+		},
+		{
+			name:    "expired",
+			header:  "Bearer " + signToken(t, rsaKey, rs256, claims(map[string]interface{}{"exp": now.Add(-2 * time.Minute).Unix()})),
+			wantErr: "invalid bearer token: token is expired",
+		},
+		{
+			name:    "no_expiration",
+			header:  "Bearer " + signToken(t, rsaKey, rs256, claims(map[string]interface{}{"exp": nil})),
+			wantErr: "invalid bearer token: missing expiration time",
+		},
+		{
+			name:    "not_before",
+			header:  "Bearer " + signToken(t, rsaKey, rs256, claims(map[string]interface{}{"nbf": now.Add(time.Hour).Unix()})),
+			wantErr: "invalid bearer token: token is not valid yet",
+		},
+		{
+			name:    "no_subject",
+			header:  "Bearer " + signToken(t, rsaKey, rs256, claims(map[string]interface{}{"sub": nil})),
+			wantErr: "invalid bearer token: missing subject",
+		},
+		{
+			name:    "wrong_issuer",
+			header:  "Bearer " + signToken(t, rsaKey, rs256, claims(map[string]interface{}{"iss": "https://other.example.com"})),
+			wantErr: "invalid bearer token: unexpected issuer: https://other.example.com",
+		},
+		{
+			name:    "wrong_audience",
+			header:  "Bearer " + signToken(t, rsaKey, rs256, claims(map[string]interface{}{"aud": "other"})),
+			wantErr: "invalid bearer token: unexpected audience",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/amis", nil)
+			if tt.header != "" {
+				r.Header.Set("Authorization", tt.header)
+			}
+
+			got, err := j.Authenticate(r)
+			gotErr := ""
+			if err != nil {
+				gotErr = err.Error()
+			}
+			if want := tt.wantErr; want != gotErr {
+				t.Errorf("want: %s, got: %s", want, gotErr)
+			}
+			if tt.want != nil && (got == nil || *tt.want != *got) {
+				t.Errorf("want: %v, got: %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestParseJWKS(t *testing.T) {
+	tests := []struct {
+		name    string
+		jwks    string
+		wantErr bool
+	}{
+		{"no_keys", `{"keys":[]}`, true},
+		{"only_encryption_keys", `{"keys":[{"kty":"RSA","use":"enc","n":"AQAB","e":"AQAB"}]}`, true},
+		{"invalid_modulus", `{"keys":[{"kty":"RSA","n":"!","e":"AQAB"}]}`, true},
+		{"unsupported_curve", `{"keys":[{"kty":"EC","crv":"P-224","x":"AQ","y":"AQ"}]}`, true},
+		{"not_on_curve", `{"keys":[{"kty":"EC","crv":"P-256","x":"AQ","y":"AQ"}]}`, true},
+		{"not_json", `keys`, true},
+		{"rsa", `{"keys":[{"kty":"RSA","n":"AQAB","e":"AQAB"}]}`, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseJWKS([]byte(tt.jwks))
+			if gotErr := err != nil; tt.wantErr != gotErr {
+				t.Errorf("want error: %t, got: %v", tt.wantErr, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2020 Intuit, Inc.  All rights reserved.
+// Use of this source code is governed the MIT license
+// that can be found in the LICENSE file.
+
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/intuit/ami-query/amicache"
+	"github.com/intuit/ami-query/api/query"
+)
+
+// DefaultRule is the name of the rule of principals that don't have their own.
+const DefaultRule = "*"
+
+// Rule limits the images a principal can see. An empty field doesn't limit
+// them.
+type Rule struct {
+	Owners  []string            `json:"owners,omitempty"`  // Owner IDs of the images
+	Regions []string            `json:"regions,omitempty"` // Regions of the images
+	Tags    map[string][]string `json:"tags,omitempty"`    // Images must have one of the values of every tag
+}
+
+// Returns the filters of the images the rule allows.
+func (r Rule) filters() []amicache.Filterer {
+	return []amicache.Filterer{
+		filterBy(r.Owners, func(p amicache.Partition) string { return p.OwnerID }),
+		filterBy(r.Regions, func(p amicache.Partition) string { return p.Region }),
+		amicache.FilterByTags(r.Tags),
+	}
+}
+
+// Returns a hash of the rule, which changes when the rule does.
+func (r Rule) hash() string {
+	b, _ := json.Marshal(r)
+	sum := sha256.Sum256(b)
+	return fmt.Sprintf("%x", sum[:8])
+}
+
+// Policy scopes the images principals can see by their rules.
+type Policy struct {
+	scopes map[string]scope // by principal name
+}
+
+// The filters of a rule, and its hash.
+type scope struct {
+	hash    string
+	filters []amicache.Filterer
+}
+
+// NewPolicy returns a Policy with the rules of principals by name. Principals
+// without a rule use the DefaultRule, and are forbidden if there isn't one.
+func NewPolicy(rules map[string]Rule) *Policy {
+	p := &Policy{scopes: map[string]scope{}}
+	for name, rule := range rules {
+		p.scopes[name] = scope{hash: rule.hash(), filters: rule.filters()}
+	}
+	return p
+}
+
+// Wrap returns a handler that calls h with the filters of the principal's
+// rule in the request's context, see query.WithScope, and writes a forbidden
+// error if it doesn't have one. The scope is identified by the principal and
+// its rule. It must be wrapped by a Middleware.
+func (p *Policy) Wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal := FromContext(r.Context())
+		if principal == nil {
+			query.WriteError(w, r, query.NewError(http.StatusForbidden, query.CodeForbidden, "", "request isn't authenticated"))
+			return
+		}
+
+		s, ok := p.scopes[principal.Name]
+		if !ok {
+			s, ok = p.scopes[DefaultRule]
+		}
+		if !ok {
+			query.WriteError(w, r, query.NewError(http.StatusForbidden, query.CodeForbidden, "", "principal %s isn't allowed by the policy", principal.Name))
+			return
+		}
+
+		id := principal.Name + ":" + s.hash
+		h.ServeHTTP(w, r.WithContext(query.WithScope(r.Context(), id, s.filters...)))
+	})
+}
+
+// Returns a filter of the images, and partitions, with one of the values of a
+// field of their partition. It doesn't filter anything if there are no values.
+func filterBy(values []string, field func(amicache.Partition) string) partitionFilter {
+	f := partitionFilter{field: field}
+	if len(values) > 0 {
+		f.allowed = map[string]struct{}{}
+		for _, value := range values {
+			f.allowed[value] = struct{}{}
+		}
+	}
+	return f
+}
+
+// A filter of the images in the partitions with one of the allowed values of a
+// field. It implements query.PartitionMatcher so the partitions outside of a
+// scope aren't listed either.
+type partitionFilter struct {
+	allowed map[string]struct{} // nil allows every value
+	field   func(amicache.Partition) string
+}
+
+func (f partitionFilter) Filter(images []amicache.Image) []amicache.Image {
+	if f.allowed == nil {
+		return images
+	}
+	newImages := []amicache.Image{}
+	for _, image := range images {
+		if f.MatchPartition(amicache.Partition{OwnerID: image.OwnerID, Region: image.Region}) {
+			newImages = append(newImages, image)
+		}
+	}
+	return newImages
+}
+
+// MatchPartition returns whether the partition's field has an allowed value.
+func (f partitionFilter) MatchPartition(p amicache.Partition) bool {
+	if f.allowed == nil {
+		return true
+	}
+	_, ok := f.allowed[f.field(p)]
+	return ok
+}
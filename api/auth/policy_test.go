@@ -0,0 +1,131 @@
+// Copyright 2020 Intuit, Inc.  All rights reserved.
+// Use of this source code is governed the MIT license
+// that can be found in the LICENSE file.
+
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/intuit/ami-query/amicache"
+	"github.com/intuit/ami-query/api/query"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// Returns a cached image with the tags, which are "key:value" pairs.
+func newTestImage(id, ownerID, region string, tags ...string) amicache.Image {
+	image := &ec2.Image{ImageId: aws.String(id)}
+	for _, tag := range tags {
+		kv := strings.SplitN(tag, ":", 2)
+		image.Tags = append(image.Tags, &ec2.Tag{Key: aws.String(kv[0]), Value: aws.String(kv[1])})
+	}
+	return amicache.NewImage(image, ownerID, region, nil)
+}
+
+func TestPolicy(t *testing.T) {
+	images := []amicache.Image{
+		newTestImage("ami-1", "111111111111", "us-west-2", "team:a"),
+		newTestImage("ami-2", "111111111111", "us-east-1", "team:b"),
+		newTestImage("ami-3", "222222222222", "us-west-2", "team:a", "tier:prod"),
+		newTestImage("ami-4", "222222222222", "us-east-1", "team:c"),
+	}
+
+	p := NewPolicy(map[string]Rule{
+		"all":    {},
+		"owner":  {Owners: []string{"111111111111"}},
+		"region": {Regions: []string{"us-east-1"}},
+		"tags":   {Tags: map[string][]string{"team": {"a", "b"}}},
+		"combined": {
+			Owners:  []string{"222222222222"},
+			Regions: []string{"us-west-2"},
+			Tags:    map[string][]string{"tier": {"prod"}},
+		},
+	})
+
+	// The handler responds with the IDs of the images in the request's scope.
+	h := p.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, image := range amicache.NewFilter(query.ScopeFromContext(r.Context())...).Apply(images) {
+			w.Write([]byte(aws.StringValue(image.Image.ImageId) + " "))
+		}
+	}))
+
+	tests := []struct {
+		name       string
+		principal  *Principal
+		statusCode int
+		want       string
+	}{
+		{"all", &Principal{"all", MethodAPIKey}, http.StatusOK, "ami-1 ami-2 ami-3 ami-4 "},
+		{"owner", &Principal{"owner", MethodAPIKey}, http.StatusOK, "ami-1 ami-2 "},
+		{"region", &Principal{"region", MethodJWT}, http.StatusOK, "ami-2 ami-4 "},
+		{"tags", &Principal{"tags", MethodClientCert}, http.StatusOK, "ami-1 ami-2 ami-3 "},
+		{"combined", &Principal{"combined", MethodAPIKey}, http.StatusOK, "ami-3 "},
+		{"unknown_principal", &Principal{"other", MethodAPIKey}, http.StatusForbidden, ""},
+		{"unauthenticated", nil, http.StatusForbidden, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/amis", nil)
+			if tt.principal != nil {
+				r = r.WithContext(NewContext(r.Context(), tt.principal))
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			if want, got := tt.statusCode, w.Code; want != got {
+				t.Errorf("want: status %d, got: status %d", want, got)
+			}
+			if got := w.Body.String(); tt.statusCode == http.StatusOK && tt.want != got {
+				t.Errorf("want: %s, got: %s", tt.want, got)
+			}
+		})
+	}
+
+	// Principals without a rule use the default one.
+	p = NewPolicy(map[string]Rule{DefaultRule: {Owners: []string{"222222222222"}}})
+	r := httptest.NewRequest("GET", "/amis", nil)
+	r = r.WithContext(NewContext(r.Context(), &Principal{"other", MethodAPIKey}))
+	var got []amicache.Image
+	p.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = amicache.NewFilter(query.ScopeFromContext(r.Context())...).Apply(images)
+	})).ServeHTTP(httptest.NewRecorder(), r)
+	if want := images[2:]; !reflect.DeepEqual(want, got) {
+		t.Errorf("want: %v, got: %v", want, got)
+	}
+}
+
+func TestRulePartitions(t *testing.T) {
+	rule := Rule{
+		Owners: []string{"111111111111"},
+		Tags:   map[string][]string{"team": {"a"}},
+	}
+
+	tests := []struct {
+		partition amicache.Partition
+		want      bool
+	}{
+		{amicache.Partition{OwnerID: "111111111111", Region: "us-west-2"}, true},
+		{amicache.Partition{OwnerID: "111111111111", Region: "us-east-1"}, true},
+		{amicache.Partition{OwnerID: "222222222222", Region: "us-west-2"}, false},
+	}
+
+	// Tags don't limit the partitions, only the images in them.
+	for _, tt := range tests {
+		got := true
+		for _, f := range rule.filters() {
+			if m, ok := f.(query.PartitionMatcher); ok && !m.MatchPartition(tt.partition) {
+				got = false
+			}
+		}
+		if tt.want != got {
+			t.Errorf("%+v: want: %t, got: %t", tt.partition, tt.want, got)
+		}
+	}
+}
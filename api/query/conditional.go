@@ -0,0 +1,122 @@
+// Copyright 2020 Intuit, Inc.  All rights reserved.
+// Use of this source code is governed the MIT license
+// that can be found in the LICENSE file.
+
+package query
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MaxAge sets the maximum duration clients may cache query results for without
+// revalidating them. It's limited to the time until the next cache update. A
+// max age of zero requires clients to always revalidate their cached results.
+func MaxAge(maxAge time.Duration) Option {
+	return optionFunc(func(a *API) {
+		if maxAge > 0 {
+			a.maxAge = maxAge
+		}
+	})
+}
+
+// epoch identifies the process in ETags and event IDs, since the cache
+// generation starts over when it's restarted.
+var epoch = newEpoch()
+
+// Returns a random epoch, or one based on the current time if there's no
+// randomness available.
+func newEpoch() string {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(b)
+}
+
+// Sets the ETag, Last-Modified and Cache-Control headers of the results of a
+// query.
+func (a *API) setCacheHeaders(w http.ResponseWriter, p *Params, tag string, modified time.Time) {
+	w.Header().Set("ETag", tag)
+	w.Header().Set("Vary", "Accept")
+
+	// Scoped results depend on the client, so shared caches can't store them.
+	cacheControl := a.cacheControl()
+	if len(p.scope) > 0 {
+		cacheControl += ", private"
+	}
+	w.Header().Set("Cache-Control", cacheControl)
+	if !modified.IsZero() {
+		w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+}
+
+// Returns true if the results cached by the client are still valid. If-Modified-
+// Since is ignored if If-None-Match is provided. See RFC 7232.
+func notModified(r *http.Request, tag string, modified time.Time) bool {
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		return etagMatches(match, tag)
+	}
+
+	if since, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !modified.IsZero() {
+		return !modified.Truncate(time.Second).After(since)
+	}
+
+	return false
+}
+
+// Returns the Cache-Control header value. The max age ends when the cache is
+// next updated, since the results may change then.
+func (a *API) cacheControl() string {
+	if a.maxAge <= 0 {
+		return "no-cache"
+	}
+
+	maxAge := a.maxAge
+	if next := a.cache.NextUpdate(); !next.IsZero() {
+		if untilNext := time.Until(next); untilNext < maxAge {
+			maxAge = untilNext
+		}
+	}
+	if maxAge < 0 {
+		maxAge = 0
+	}
+
+	return "max-age=" + strconv.Itoa(int(maxAge/time.Second))
+}
+
+// Returns a weak entity tag for the results of a query in a scope at a cache
+// generation of this process, in the media type of an API version. The query
+// is normalized so the order of its parameters doesn't matter.
+func etag(generation uint64, scopeID, mediaType string, query url.Values) string {
+	normalized := url.Values{}
+	for key, values := range query {
+		values = append([]string{}, values...)
+		sort.Strings(values)
+		normalized[key] = values
+	}
+
+	sum := sha256.Sum256([]byte(scopeID + "\x00" + mediaType + "?" + normalized.Encode()))
+	return fmt.Sprintf(`W/"%s-%d-%x"`, epoch, generation, sum[:8])
+}
+
+// Returns true if an If-None-Match header value matches the entity tag, using
+// the weak comparison function.
+func etagMatches(match, tag string) bool {
+	tag = strings.TrimPrefix(tag, "W/")
+	for _, m := range strings.Split(match, ",") {
+		m = strings.TrimSpace(m)
+		if m == "*" || strings.TrimPrefix(m, "W/") == tag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,136 @@
+// Copyright 2020 Intuit, Inc.  All rights reserved.
+// Use of this source code is governed the MIT license
+// that can be found in the LICENSE file.
+
+package query
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestHandlerConditional(t *testing.T) {
+	modified := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	mc := &mockCache{generation: 42, modified: modified}
+
+	ts := httptest.NewServer(&API{cache: mc})
+	defer ts.Close()
+
+	get := func(query string, headers map[string]string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest("GET", ts.URL+"/amis"+query, nil)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		rsp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("want: <nil>, got: %v", err)
+		}
+		rsp.Body.Close()
+		return rsp
+	}
+
+	rsp := get("?region=us-west-2&status=available", nil)
+	tag := rsp.Header.Get("ETag")
+	if tag == "" {
+		t.Fatal("want: ETag, got: none")
+	}
+	if want, got := "Mon, 01 Jun 2020 12:00:00 GMT", rsp.Header.Get("Last-Modified"); want != got {
+		t.Errorf("want: %s, got: %s", want, got)
+	}
+
+	tests := []struct {
+		name       string
+		query      string
+		headers    map[string]string
+		statusCode int
+	}{
+		{"unconditional", "?region=us-west-2&status=available", nil, http.StatusOK},
+		{"etag", "?region=us-west-2&status=available", map[string]string{"If-None-Match": tag}, http.StatusNotModified},
+		{"etag_reordered", "?status=available&region=us-west-2", map[string]string{"If-None-Match": tag}, http.StatusNotModified},
+		{"etag_list", "?region=us-west-2&status=available", map[string]string{"If-None-Match": `W/"foo", ` + tag}, http.StatusNotModified},
+		{"etag_any", "?region=us-west-2&status=available", map[string]string{"If-None-Match": "*"}, http.StatusNotModified},
+		{"etag_other_query", "?region=us-west-2", map[string]string{"If-None-Match": tag}, http.StatusOK},
+		{"modified_since", "", map[string]string{"If-Modified-Since": "Mon, 01 Jun 2020 12:00:00 GMT"}, http.StatusNotModified},
+		{"modified_since_before", "", map[string]string{"If-Modified-Since": "Mon, 01 Jun 2020 11:59:59 GMT"}, http.StatusOK},
+		{"etag_precedence", "?region=us-west-2", map[string]string{
+			"If-None-Match":     tag,
+			"If-Modified-Since": "Mon, 01 Jun 2020 12:00:00 GMT",
+		}, http.StatusOK},
+		{"bad_request", "?foo=bar", map[string]string{"If-None-Match": "*"}, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := get(tt.query, tt.headers); tt.statusCode != got.StatusCode {
+				t.Errorf("want: status %d, got: status %d", tt.statusCode, got.StatusCode)
+			}
+		})
+	}
+
+	// The images aren't read if the client's cached results are still valid.
+	mc.filterErr = errors.New("foo")
+	if rsp := get("?region=us-west-2&status=available", map[string]string{"If-None-Match": tag}); rsp.StatusCode != http.StatusNotModified {
+		t.Errorf("want: status %d, got: status %d", http.StatusNotModified, rsp.StatusCode)
+	}
+	mc.filterErr = nil
+
+	// The ETag changes with the cache generation.
+	mc.generation++
+	if rsp := get("?region=us-west-2&status=available", map[string]string{"If-None-Match": tag}); rsp.StatusCode != http.StatusOK {
+		t.Errorf("want: status %d, got: status %d", http.StatusOK, rsp.StatusCode)
+	}
+}
+
+func TestCacheControl(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxAge     time.Duration
+		nextUpdate time.Time
+		want       string
+	}{
+		{"no_max_age", 0, time.Now().Add(time.Hour), "no-cache"},
+		{"max_age", 5 * time.Minute, time.Now().Add(time.Hour), "max-age=300"},
+		{"next_update", time.Hour, time.Now().Add(90 * time.Second), "max-age=89"},
+		{"update_due", time.Hour, time.Now().Add(-time.Minute), "max-age=0"},
+		{"not_running", 5 * time.Minute, time.Time{}, "max-age=300"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &API{cache: &mockCache{nextUpdate: tt.nextUpdate}, maxAge: tt.maxAge}
+			if got := a.cacheControl(); tt.want != got {
+				t.Errorf("want: %s, got: %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestETag(t *testing.T) {
+	a := etag(1, "", MediaTypeV1, url.Values{"tag": {"b:2", "a:1"}, "region": {"us-west-2"}})
+	b := etag(1, "", MediaTypeV1, url.Values{"region": {"us-west-2"}, "tag": {"a:1", "b:2"}})
+	if a != b {
+		t.Errorf("want: %s, got: %s", a, b)
+	}
+	if c := etag(2, "", MediaTypeV1, url.Values{"region": {"us-west-2"}, "tag": {"a:1", "b:2"}}); a == c {
+		t.Errorf("want: different ETags, got: %s", c)
+	}
+	if d := etag(1, "", MediaTypeV2, url.Values{"region": {"us-west-2"}, "tag": {"a:1", "b:2"}}); a == d {
+		t.Errorf("want: different ETags, got: %s", d)
+	}
+	if e := etag(1, "ci", MediaTypeV1, url.Values{"region": {"us-west-2"}, "tag": {"a:1", "b:2"}}); a == e {
+		t.Errorf("want: different ETags, got: %s", e)
+	}
+
+	// The ETags of a restarted process are different, even though its cache
+	// generations start over.
+	defer func(e string) { epoch = e }(epoch)
+	epoch = newEpoch()
+	if f := etag(1, "", MediaTypeV1, url.Values{"region": {"us-west-2"}, "tag": {"a:1", "b:2"}}); a == f {
+		t.Errorf("want: different ETags, got: %s", f)
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright 2020 Intuit, Inc.  All rights reserved.
+// Use of this source code is governed the MIT license
+// that can be found in the LICENSE file.
+
+package query
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// HeaderRequestID is the header that identifies a request. It's set on every
+// response, reusing the client's value if it provided a valid one.
+const HeaderRequestID = "X-Request-Id"
+
+// The maximum length of a request ID provided by a client.
+const maxRequestIDLength = 128
+
+// ErrorCode identifies the cause of an API error. Codes are stable, so clients
+// can rely on them rather than on error messages.
+type ErrorCode string
+
+// The error codes returned by the API.
+const (
+	CodeBadRequest       ErrorCode = "bad_request"
+	CodeUnknownKey       ErrorCode = "unknown_key"
+	CodeInvalidTag       ErrorCode = "invalid_tag"
+	CodeInvalidValue     ErrorCode = "invalid_value"
+	CodeUnknownRegion    ErrorCode = "unknown_region"
+	CodeUnknownOwner     ErrorCode = "unknown_owner"
+	CodeMultipleMatches  ErrorCode = "multiple_matches"
+	CodeNotFound         ErrorCode = "not_found"
+	CodeMethodNotAllowed ErrorCode = "method_not_allowed"
+	CodeUnauthorized     ErrorCode = "unauthorized"
+	CodeForbidden        ErrorCode = "forbidden"
+	CodeRateLimited      ErrorCode = "rate_limited"
+	CodeInternal         ErrorCode = "internal_error"
+)
+
+// Error is an error returned by the API. It's written as the JSON body of the
+// response.
+type Error struct {
+	Status    int       `json:"-"`
+	Code      ErrorCode `json:"code"`
+	Message   string    `json:"message"`
+	Parameter string    `json:"parameter,omitempty"`
+	RequestID string    `json:"request_id,omitempty"`
+}
+
+// NewError returns an Error with a formatted message. parameter is the query
+// parameter or header that caused the error, if any.
+func NewError(status int, code ErrorCode, parameter, format string, a ...interface{}) *Error {
+	return &Error{
+		Status:    status,
+		Code:      code,
+		Message:   fmt.Sprintf(format, a...),
+		Parameter: parameter,
+	}
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// WriteError writes a JSON formatted error to the http.ResponseWriter. Errors
+// that aren't an *Error are written as internal errors.
+func WriteError(w http.ResponseWriter, r *http.Request, err error) {
+	var apiErr *Error
+	if !errors.As(err, &apiErr) {
+		apiErr = NewError(http.StatusInternalServerError, CodeInternal, "", "%v", err)
+	}
+
+	body := *apiErr
+	body.RequestID = RequestIDFromContext(r.Context())
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(body.Status)
+
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.Encode(body)
+}
+
+// NotFound writes a not_found error. It's used for unknown routes.
+func NotFound(w http.ResponseWriter, r *http.Request) {
+	WriteError(w, r, NewError(http.StatusNotFound, CodeNotFound, "", "not found: %s", r.URL.Path))
+}
+
+// MethodNotAllowed writes a method_not_allowed error. It's used for known
+// routes requested with an unsupported method.
+func MethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	WriteError(w, r, NewError(http.StatusMethodNotAllowed, CodeMethodNotAllowed, "", "method not allowed: %s", r.Method))
+}
+
+// The context key of the request ID.
+type requestIDKey struct{}
+
+// RequestID assigns an ID to every request handled by h. The ID is taken from
+// the request's X-Request-Id header, if it's valid, or generated. It's added
+// to the response headers and the request context.
+func RequestID(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(HeaderRequestID)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(HeaderRequestID, id)
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// RequestIDFromContext returns the request ID set by RequestID, if any.
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// Returns a random request ID.
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// Returns true if a client provided request ID is safe to log and echo back.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.', c == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
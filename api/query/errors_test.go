@@ -0,0 +1,142 @@
+// Copyright 2020 Intuit, Inc.  All rights reserved.
+// Use of this source code is governed the MIT license
+// that can be found in the LICENSE file.
+
+package query
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWriteError(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		statusCode int
+		want       Error
+	}{
+		{
+			name:       "api_error",
+			err:        NewError(http.StatusBadRequest, CodeInvalidTag, "tag", `invalid query tag value: "foo"`),
+			statusCode: http.StatusBadRequest,
+			want:       Error{Code: CodeInvalidTag, Message: `invalid query tag value: "foo"`, Parameter: "tag", RequestID: "req-1"},
+		},
+		{
+			name:       "internal_error",
+			err:        errors.New("foo"),
+			statusCode: http.StatusInternalServerError,
+			want:       Error{Code: CodeInternal, Message: "foo", RequestID: "req-1"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				WriteError(w, r, tt.err)
+			}))
+
+			req := httptest.NewRequest("GET", "/amis", nil)
+			req.Header.Set(HeaderRequestID, "req-1")
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if tt.statusCode != rec.Code {
+				t.Errorf("want: status %d, got: status %d", tt.statusCode, rec.Code)
+			}
+			if want, got := "application/json; charset=utf-8", rec.Header().Get("Content-Type"); want != got {
+				t.Errorf("want: %s, got: %s", want, got)
+			}
+
+			var got Error
+			if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+			if tt.want != got {
+				t.Errorf("\n\twant: %+v\n\t got: %+v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	tests := []struct {
+		name      string
+		requestID string
+		generated bool
+	}{
+		{"missing", "", true},
+		{"provided", "3f2b9c1e-6d0a-4c1b-9d6e-2a7f8b1c0d3e", false},
+		{"invalid", "foo\"bar", true},
+		{"too_long", strings.Repeat("a", maxRequestIDLength+1), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var fromContext string
+			h := RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fromContext = RequestIDFromContext(r.Context())
+			}))
+
+			req := httptest.NewRequest("GET", "/amis", nil)
+			if tt.requestID != "" {
+				req.Header.Set(HeaderRequestID, tt.requestID)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			got := rec.Header().Get(HeaderRequestID)
+			if got == "" || got != fromContext {
+				t.Errorf("want: %q, got: %q", got, fromContext)
+			}
+			if generated := got != tt.requestID; tt.generated != generated {
+				t.Errorf("want: generated %t, got: generated %t (%q)", tt.generated, generated, got)
+			}
+		})
+	}
+}
+
+func TestHandlerErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		query      string
+		statusCode int
+		code       ErrorCode
+		parameter  string
+	}{
+		{"unknown_key", "/amis?foo=bar", http.StatusBadRequest, CodeUnknownKey, "foo"},
+		{"invalid_tag", "/amis?tag=foobar", http.StatusBadRequest, CodeInvalidTag, "tag"},
+		{"unknown_region", "/amis?region=us-foo-1", http.StatusBadRequest, CodeUnknownRegion, "region"},
+		{"invalid_as_of", "/amis?as_of=foo", http.StatusBadRequest, CodeInvalidValue, "as_of"},
+		{"bad_query", "/amis?foo=%%bar", http.StatusBadRequest, CodeBadRequest, ""},
+	}
+
+	ts := httptest.NewServer(&API{cache: &mockCache{}})
+	defer ts.Close()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rsp, err := http.Get(ts.URL + tt.query)
+			if err != nil {
+				t.Fatalf("want: <nil>, got: %v", err)
+			}
+			defer rsp.Body.Close()
+
+			if tt.statusCode != rsp.StatusCode {
+				t.Errorf("want: status %d, got: status %d", tt.statusCode, rsp.StatusCode)
+			}
+
+			var got Error
+			if err := json.NewDecoder(rsp.Body).Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+			if tt.code != got.Code || tt.parameter != got.Parameter {
+				t.Errorf("want: %s %q, got: %s %q", tt.code, tt.parameter, got.Code, got.Parameter)
+			}
+		})
+	}
+}
@@ -0,0 +1,223 @@
+// Copyright 2020 Intuit, Inc.  All rights reserved.
+// Use of this source code is governed the MIT license
+// that can be found in the LICENSE file.
+
+package query
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/intuit/ami-query/amicache"
+)
+
+// APIPathEvents is the url path for the events API.
+const APIPathEvents = "/events"
+
+// The maximum time between heartbeats sent to idle event streams.
+const heartbeatInterval = 15 * time.Second
+
+// EventsAPI streams the changes made to the cached images as Server-Sent
+// Events. Each event's ID is the cache generation that follows the change set,
+// prefixed with the process epoch, which can be provided in the Last-Event-ID
+// header to resume a stream. Streams resumed from another process, e.g. before
+// a restart, start with a reset event since the cache generation starts over.
+type EventsAPI struct {
+	cache       changeCacher
+	maxDuration time.Duration
+}
+
+// ChangeSet is the set of changes made between two cache generations.
+type ChangeSet struct {
+	Generation uint64    `json:"generation"`
+	Time       time.Time `json:"time"`
+	Changes    []Change  `json:"changes"`
+}
+
+// Change is a change made to a cached image. Previous is set for tag, state
+// and other changes.
+type Change struct {
+	Type     amicache.ChangeType `json:"type"`
+	Image    Result              `json:"image"`
+	Previous *Result             `json:"previous,omitempty"`
+}
+
+// NewEventsAPI returns a usable events API. Streams are closed after
+// maxDuration, if it's greater than zero, and clients are expected to
+// reconnect with the Last-Event-ID header. Heartbeats are sent at least twice
+// per stream.
+func NewEventsAPI(cache *amicache.Cache, maxDuration time.Duration) *EventsAPI {
+	return &EventsAPI{cache: cache, maxDuration: maxDuration}
+}
+
+func (a *EventsAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		WriteError(w, r, errors.New("streaming unsupported"))
+		return
+	}
+
+	p := &Params{}
+	if err := p.Decode(a.cache.StateTag(), r.URL); err != nil {
+		WriteError(w, r, err)
+		return
+	}
+
+	if err := validateRegions(a.cache.Regions(), p.regions); err != nil {
+		WriteError(w, r, err)
+		return
+	}
+	p.scope = ScopeFromContext(r.Context())
+
+	var (
+		err    error
+		filter = p.filter(a.cache.CollectLaunchPermissions())
+	)
+
+	generation, sameEpoch := a.cache.Generation(), true
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		if generation, sameEpoch, err = parseEventID(id); err != nil {
+			WriteError(w, r, NewError(http.StatusBadRequest, CodeInvalidValue, "Last-Event-ID", "invalid Last-Event-ID: %s", id))
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	// Have clients reconnect quickly and start them at the current generation.
+	fmt.Fprint(w, "retry: 1000\n")
+	if sameEpoch {
+		fmt.Fprintf(w, "id: %s\n\n", eventID(generation))
+	} else {
+		generation = a.cache.Generation()
+		writeReset(w, generation)
+	}
+	flusher.Flush()
+
+	var timeout <-chan time.Time
+	if a.maxDuration > 0 {
+		timer := time.NewTimer(a.maxDuration)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	heartbeat := time.NewTicker(a.heartbeatInterval())
+	defer heartbeat.Stop()
+
+	for {
+		sets, complete, changed := a.cache.ChangesSince(generation)
+
+		if !complete {
+			// The client needs to fetch the current images from /amis.
+			generation = a.cache.Generation()
+			writeReset(w, generation)
+		}
+
+		for _, set := range sets {
+			generation = set.Generation
+			if err := writeChangeSet(w, set, filter); err != nil {
+				return
+			}
+		}
+
+		flusher.Flush()
+
+		select {
+		case <-changed:
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-timeout:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// Returns the time between heartbeats, which is short enough for idle streams
+// to get a heartbeat before they're closed.
+func (a *EventsAPI) heartbeatInterval() time.Duration {
+	if a.maxDuration > 0 && a.maxDuration/2 < heartbeatInterval {
+		return a.maxDuration / 2
+	}
+	return heartbeatInterval
+}
+
+// Returns the ID of the event that follows a change set.
+func eventID(generation uint64) string {
+	return fmt.Sprintf("%s-%d", epoch, generation)
+}
+
+// Returns the cache generation of an event ID, and false if the ID is from
+// another process.
+func parseEventID(id string) (uint64, bool, error) {
+	i := strings.LastIndex(id, "-")
+	generation, err := strconv.ParseUint(id[i+1:], 10, 64)
+	return generation, i >= 0 && id[:i] == epoch, err
+}
+
+// Writes a "reset" event, after which the client needs to fetch the current
+// images from /amis.
+func writeReset(w http.ResponseWriter, generation uint64) {
+	fmt.Fprintf(w, "id: %s\nevent: reset\ndata: {\"generation\":%d}\n\n", eventID(generation), generation)
+}
+
+// NewChange returns a Change from an amicache.Change.
+func NewChange(change amicache.Change) Change {
+	c := Change{Type: change.Type, Image: newResult(change.Image)}
+	if change.Previous != nil {
+		previous := newResult(*change.Previous)
+		c.Previous = &previous
+	}
+	return c
+}
+
+// Writes the changes that match the filter as a "changes" event. Only the
+// event ID is written if nothing matches so the client's Last-Event-ID is kept
+// current.
+func writeChangeSet(w http.ResponseWriter, set amicache.ChangeSet, filter *amicache.Filter) error {
+	result := ChangeSet{
+		Generation: set.Generation,
+		Time:       set.Time,
+		Changes:    []Change{},
+	}
+
+	for _, change := range set.Changes {
+		if MatchChange(filter, change) {
+			result.Changes = append(result.Changes, NewChange(change))
+		}
+	}
+
+	if len(result.Changes) == 0 {
+		_, err := fmt.Fprintf(w, "id: %s\n\n", eventID(set.Generation))
+		return err
+	}
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "id: %s\nevent: changes\ndata: %s\n\n", eventID(set.Generation), data)
+	return err
+}
+
+// changeCacher is used to represent an amicache.Cache. Used to mock the cache
+// in tests.
+type changeCacher interface {
+	Generation() uint64
+	ChangesSince(uint64) ([]amicache.ChangeSet, bool, <-chan struct{})
+	Regions() []string
+	StateTag() string
+	CollectLaunchPermissions() bool
+}
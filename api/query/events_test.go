@@ -0,0 +1,204 @@
+// Copyright 2020 Intuit, Inc.  All rights reserved.
+// Use of this source code is governed the MIT license
+// that can be found in the LICENSE file.
+
+package query
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/intuit/ami-query/amicache"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+type mockChangeCache struct {
+	sets []amicache.ChangeSet
+}
+
+func (m *mockChangeCache) Generation() uint64 {
+	return uint64(len(m.sets))
+}
+
+func (m *mockChangeCache) ChangesSince(generation uint64) ([]amicache.ChangeSet, bool, <-chan struct{}) {
+	if generation > uint64(len(m.sets)) {
+		return nil, false, nil
+	}
+	return m.sets[generation:], true, nil
+}
+
+func (mockChangeCache) Regions() []string              { return []string{"us-west-2", "us-east-1"} }
+func (mockChangeCache) StateTag() string               { return amicache.DefaultStateTag }
+func (mockChangeCache) CollectLaunchPermissions() bool { return false }
+
+// Returns a cached image in the provided region and state.
+func newStateImage(id, region, state string) amicache.Image {
+	return amicache.Image{
+		OwnerID: "123456789012",
+		Region:  region,
+		Image: &ec2.Image{
+			ImageId: aws.String(id),
+			Tags: []*ec2.Tag{{
+				Key:   aws.String(amicache.DefaultStateTag),
+				Value: aws.String(state),
+			}},
+		},
+	}
+}
+
+func TestEventsHandler(t *testing.T) {
+	previous := newStateImage("ami-2", "us-east-1", "available")
+
+	mc := &mockChangeCache{
+		sets: []amicache.ChangeSet{
+			{
+				Generation: 1,
+				Changes: []amicache.Change{
+					{Type: amicache.ImageAdded, Image: newStateImage("ami-1", "us-west-2", "available")},
+					{Type: amicache.ImageAdded, Image: newStateImage("ami-2", "us-east-1", "available")},
+				},
+			},
+			{
+				Generation: 2,
+				Changes: []amicache.Change{
+					{Type: amicache.ImageStateChanged, Image: newStateImage("ami-2", "us-east-1", "deprecated"), Previous: &previous},
+				},
+			},
+		},
+	}
+
+	var tests = []struct {
+		name        string
+		query       string
+		lastEventID string
+		statusCode  int
+		want        []string
+		notWant     []string
+	}{
+		{
+			name:       "current",
+			query:      "/events",
+			statusCode: http.StatusOK,
+			want:       []string{"retry: 1000\nid: " + epoch + "-2\n\n"},
+			notWant:    []string{"event: changes"},
+		},
+		{
+			name:        "resume",
+			query:       "/events",
+			lastEventID: epoch + "-0",
+			statusCode:  http.StatusOK,
+			want: []string{
+				"id: " + epoch + "-1\nevent: changes\ndata: ",
+				`"id":"ami-1"`,
+				"id: " + epoch + "-2\nevent: changes\ndata: ",
+				`"type":"state_changed"`,
+				`"previous":{"id":"ami-2"`,
+			},
+		},
+		{
+			name:        "filtered_region",
+			query:       "/events?region=us-west-2",
+			lastEventID: epoch + "-1",
+			statusCode:  http.StatusOK,
+			want:        []string{"id: " + epoch + "-2\n\n"},
+			notWant:     []string{"event: changes"},
+		},
+		{
+			name:        "filtered_state",
+			query:       "/events?state=available",
+			lastEventID: epoch + "-0",
+			statusCode:  http.StatusOK,
+			want:        []string{`"id":"ami-1"`, `"type":"state_changed"`},
+		},
+		{
+			name:        "reset",
+			query:       "/events",
+			lastEventID: epoch + "-42",
+			statusCode:  http.StatusOK,
+			want:        []string{"id: " + epoch + "-2\nevent: reset\ndata: {\"generation\":2}\n\n"},
+		},
+		{
+			name:        "other_epoch",
+			query:       "/events",
+			lastEventID: "x-1",
+			statusCode:  http.StatusOK,
+			want:        []string{"retry: 1000\nid: " + epoch + "-2\nevent: reset\ndata: {\"generation\":2}\n\n"},
+			notWant:     []string{"event: changes"},
+		},
+		{
+			name:        "no_epoch",
+			query:       "/events",
+			lastEventID: "1",
+			statusCode:  http.StatusOK,
+			want:        []string{"event: reset"},
+			notWant:     []string{"event: changes"},
+		},
+		{
+			name:       "heartbeat",
+			query:      "/events",
+			statusCode: http.StatusOK,
+			want:       []string{": heartbeat\n\n"},
+		},
+		{
+			name:        "bad_last_event_id",
+			query:       "/events",
+			lastEventID: "foo",
+			statusCode:  http.StatusBadRequest,
+		},
+		{
+			name:       "bad_region",
+			query:      "/events?region=us-foo-1",
+			statusCode: http.StatusBadRequest,
+		},
+		{
+			name:       "bad_key",
+			query:      "/events?foo=bar",
+			statusCode: http.StatusBadRequest,
+		},
+	}
+
+	ts := httptest.NewServer(&EventsAPI{cache: mc, maxDuration: 50 * time.Millisecond})
+	defer ts.Close()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", ts.URL+tt.query, nil)
+			if tt.lastEventID != "" {
+				req.Header.Set("Last-Event-ID", tt.lastEventID)
+			}
+
+			rsp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("want: <nil>, got: %v", err)
+			}
+			defer rsp.Body.Close()
+
+			if rsp.StatusCode != tt.statusCode {
+				t.Fatalf("want: status %d, got: status %d", tt.statusCode, rsp.StatusCode)
+			}
+
+			body, err := ioutil.ReadAll(rsp.Body)
+			if err != nil {
+				t.Fatalf("want: <nil>, got: %v", err)
+			}
+
+			for _, want := range tt.want {
+				if !strings.Contains(string(body), want) {
+					t.Errorf("want: %q in %q", want, body)
+				}
+			}
+
+			for _, notWant := range tt.notWant {
+				if strings.Contains(string(body), notWant) {
+					t.Errorf("don't want: %q in %q", notWant, body)
+				}
+			}
+		})
+	}
+}
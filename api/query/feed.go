@@ -0,0 +1,208 @@
+// Copyright 2020 Intuit, Inc.  All rights reserved.
+// Use of this source code is governed the MIT license
+// that can be found in the LICENSE file.
+
+package query
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/intuit/ami-query/amicache"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// APIPathFeed is the url path for the Atom feed of new images.
+const APIPathFeed = "/feeds/amis.atom"
+
+// The maximum number of entries in the feed.
+const maxFeedEntries = 50
+
+// FeedAPI serves an Atom feed of the images discovered by the cache.
+type FeedAPI struct {
+	cache feedCacher
+}
+
+// The Atom elements used by the feed. See RFC 4287.
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Author  atomPerson  `xml:"author"`
+	Link    atomLink    `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomPerson struct {
+	Name string `xml:"name"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomEntry struct {
+	ID        string   `xml:"id"`
+	Title     string   `xml:"title"`
+	Updated   string   `xml:"updated"`
+	Published string   `xml:"published"`
+	Link      atomLink `xml:"link"`
+	Summary   string   `xml:"summary"`
+}
+
+// NewFeedAPI returns a usable feed API.
+func NewFeedAPI(cache *amicache.Cache) *FeedAPI {
+	return &FeedAPI{cache: cache}
+}
+
+func (a *FeedAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p := &Params{}
+	if err := p.Decode(a.cache.StateTag(), r.URL); err != nil {
+		WriteError(w, r, err)
+		return
+	}
+
+	if err := validateRegions(a.cache.Regions(), p.regions); err != nil {
+		WriteError(w, r, err)
+		return
+	}
+	p.scope = ScopeFromContext(r.Context())
+
+	var (
+		base   = baseURL(r)
+		images = p.filter(a.cache.CollectLaunchPermissions()).Apply(a.newImages())
+		self   = base + APIPathFeed
+	)
+
+	if len(images) > maxFeedEntries {
+		images = images[:maxFeedEntries]
+	}
+
+	if r.URL.RawQuery != "" {
+		self += "?" + r.URL.RawQuery
+	}
+
+	feed := atomFeed{
+		ID:      self,
+		Title:   "New AMIs",
+		Author:  atomPerson{Name: "ami-query"},
+		Link:    atomLink{Rel: "self", Type: "application/atom+xml", Href: self},
+		Entries: []atomEntry{},
+	}
+
+	var updated time.Time
+	for _, image := range images {
+		created := creationDate(image)
+		if created.After(updated) {
+			updated = created
+		}
+
+		query := url.Values{"ami": {aws.StringValue(image.Image.ImageId)}, "region": {image.Region}}
+		feed.Entries = append(feed.Entries, atomEntry{
+			ID:        fmt.Sprintf("urn:ami-query:image:%s:%s", image.Region, aws.StringValue(image.Image.ImageId)),
+			Title:     fmt.Sprintf("%s (%s)", aws.StringValue(image.Image.Name), image.Region),
+			Updated:   created.Format(time.RFC3339),
+			Published: created.Format(time.RFC3339),
+			Link:      atomLink{Rel: "alternate", Type: "application/json", Href: base + APIPathQuery + "?" + query.Encode()},
+			Summary:   summary(image),
+		})
+	}
+
+	if updated.IsZero() {
+		updated = time.Now()
+	}
+	feed.Updated = updated.UTC().Format(time.RFC3339)
+
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	fmt.Fprint(w, xml.Header)
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	enc.Encode(feed)
+}
+
+// Returns the images added in the recorded change sets that are still cached,
+// newest first. Images are ordered by their creation dates, rather than when
+// they were added, so the feed doesn't change when the cache is reloaded. The
+// images added while the cache was warming up aren't new, so they're skipped.
+func (a *FeedAPI) newImages() []amicache.Image {
+	added := map[string]amicache.Image{}
+	for _, set := range a.cache.ChangeSets() {
+		if set.Warmup {
+			continue
+		}
+		for _, change := range set.Changes {
+			id := aws.StringValue(change.Image.Image.ImageId)
+			switch change.Type {
+			case amicache.ImageAdded, amicache.ImageStateChanged, amicache.ImageTagsChanged, amicache.ImageUpdated:
+				if _, ok := added[id]; ok || change.Type == amicache.ImageAdded {
+					added[id] = change.Image
+				}
+			case amicache.ImageRemoved:
+				delete(added, id)
+			}
+		}
+	}
+
+	images := []amicache.Image{}
+	for _, image := range added {
+		images = append(images, image)
+	}
+
+	sort.Slice(images, func(i, j int) bool {
+		ci, cj := creationDate(images[i]), creationDate(images[j])
+		if !ci.Equal(cj) {
+			return ci.After(cj)
+		}
+		return aws.StringValue(images[i].Image.ImageId) < aws.StringValue(images[j].Image.ImageId)
+	})
+
+	return images
+}
+
+// Returns the creation date of an image.
+func creationDate(image amicache.Image) time.Time {
+	t, _ := time.Parse("2006-01-02T15:04:05.000Z", aws.StringValue(image.Image.CreationDate))
+	return t
+}
+
+// Returns the summary of an image, its description followed by its tags.
+func summary(image amicache.Image) string {
+	tags := []string{}
+	for k, v := range image.Tags() {
+		tags = append(tags, k+"="+v)
+	}
+	sort.Strings(tags)
+
+	summary := aws.StringValue(image.Image.Description)
+	if len(tags) > 0 {
+		summary = strings.TrimSpace(summary + " [" + strings.Join(tags, ", ") + "]")
+	}
+	return summary
+}
+
+// Returns the scheme and host used to make the request.
+func baseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// feedCacher is used to represent an amicache.Cache. Used to mock the cache in
+// tests.
+type feedCacher interface {
+	ChangeSets() []amicache.ChangeSet
+	Regions() []string
+	StateTag() string
+	CollectLaunchPermissions() bool
+}
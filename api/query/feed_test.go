@@ -0,0 +1,123 @@
+// Copyright 2020 Intuit, Inc.  All rights reserved.
+// Use of this source code is governed the MIT license
+// that can be found in the LICENSE file.
+
+package query
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/intuit/ami-query/amicache"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+type mockFeedCache struct {
+	mockChangeCache
+}
+
+func (m *mockFeedCache) ChangeSets() []amicache.ChangeSet {
+	return m.sets
+}
+
+func TestFeedHandler(t *testing.T) {
+	image := func(id, region, state, created string) amicache.Image {
+		image := newStateImage(id, region, state)
+		image.Image.Name = aws.String(id)
+		image.Image.CreationDate = aws.String(created)
+		return image
+	}
+
+	mc := &mockFeedCache{mockChangeCache{
+		sets: []amicache.ChangeSet{
+			{
+				Generation: 1,
+				Changes: []amicache.Change{
+					{Type: amicache.ImageAdded, Image: image("ami-0", "us-west-2", "available", "2019-01-01T00:00:00.000Z")},
+				},
+				Warmup: true,
+			},
+			{
+				Generation: 2,
+				Changes: []amicache.Change{
+					{Type: amicache.ImageAdded, Image: image("ami-1", "us-west-2", "available", "2020-01-01T00:00:00.000Z")},
+					{Type: amicache.ImageAdded, Image: image("ami-2", "us-east-1", "available", "2020-03-01T00:00:00.000Z")},
+					{Type: amicache.ImageAdded, Image: image("ami-3", "us-west-2", "available", "2020-02-01T00:00:00.000Z")},
+				},
+			},
+			{
+				Generation: 3,
+				Changes: []amicache.Change{
+					{Type: amicache.ImageRemoved, Image: image("ami-3", "us-west-2", "available", "2020-02-01T00:00:00.000Z")},
+					{Type: amicache.ImageStateChanged, Image: image("ami-1", "us-west-2", "deprecated", "2020-01-01T00:00:00.000Z")},
+					{Type: amicache.ImageTagsChanged, Image: image("ami-4", "us-west-2", "available", "2020-04-01T00:00:00.000Z")},
+					{Type: amicache.ImageStateChanged, Image: image("ami-0", "us-west-2", "deprecated", "2019-01-01T00:00:00.000Z")},
+				},
+			},
+		},
+	}}
+
+	var tests = []struct {
+		name       string
+		query      string
+		statusCode int
+		want       []string
+	}{
+		{"feed", "", http.StatusOK, []string{"urn:ami-query:image:us-east-1:ami-2", "urn:ami-query:image:us-west-2:ami-1"}},
+		{"region", "?region=us-west-2", http.StatusOK, []string{"urn:ami-query:image:us-west-2:ami-1"}},
+		{"state", "?state=available", http.StatusOK, []string{"urn:ami-query:image:us-east-1:ami-2"}},
+		{"bad_region", "?region=us-foo-1", http.StatusBadRequest, nil},
+		{"bad_key", "?foo=bar", http.StatusBadRequest, nil},
+	}
+
+	ts := httptest.NewServer(&FeedAPI{cache: mc})
+	defer ts.Close()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rsp, err := http.Get(ts.URL + APIPathFeed + tt.query)
+			if err != nil {
+				t.Fatalf("want: <nil>, got: %v", err)
+			}
+			defer rsp.Body.Close()
+
+			if rsp.StatusCode != tt.statusCode {
+				t.Fatalf("want: status %d, got: status %d", tt.statusCode, rsp.StatusCode)
+			}
+
+			if tt.statusCode != http.StatusOK {
+				return
+			}
+
+			if want, got := "application/atom+xml; charset=utf-8", rsp.Header.Get("Content-Type"); want != got {
+				t.Errorf("want: %s, got: %s", want, got)
+			}
+
+			var feed atomFeed
+			if err := xml.NewDecoder(rsp.Body).Decode(&feed); err != nil {
+				t.Fatal(err)
+			}
+
+			if want, got := ts.URL+APIPathFeed+tt.query, feed.ID; want != got {
+				t.Errorf("want: %s, got: %s", want, got)
+			}
+
+			got := []string{}
+			for _, entry := range feed.Entries {
+				got = append(got, entry.ID)
+			}
+
+			if len(tt.want) != len(got) {
+				t.Fatalf("want: %v, got: %v", tt.want, got)
+			}
+			for i := range tt.want {
+				if tt.want[i] != got[i] {
+					t.Errorf("want: %v, got: %v", tt.want, got)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright 2020 Intuit, Inc.  All rights reserved.
+// Use of this source code is governed the MIT license
+// that can be found in the LICENSE file.
+
+package query
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+
+	"github.com/intuit/ami-query/amicache"
+)
+
+// NewFilter returns a filter for the images matching a query string using
+// the same parameters as the query API, e.g. "region=us-west-2&status=available".
+// The callback and pretty parameters are ignored.
+func NewFilter(cache *amicache.Cache, rawQuery string) (*amicache.Filter, error) {
+	p := &Params{}
+	if err := p.Decode(cache.StateTag(), &url.URL{RawQuery: rawQuery}); err != nil {
+		return nil, err
+	}
+	return p.filter(cache.CollectLaunchPermissions()), nil
+}
+
+// MatchChange returns whether the image matches the filter before or after the
+// change.
+func MatchChange(filter *amicache.Filter, change amicache.Change) bool {
+	images := []amicache.Image{change.Image}
+	if change.Previous != nil {
+		images = append(images, *change.Previous)
+	}
+	return len(filter.Apply(images)) > 0
+}
+
+// The context key of the scope.
+type scopeKey struct{}
+
+// The images a request can see.
+type scope struct {
+	id      string
+	filters []amicache.Filterer
+}
+
+// WithScope returns a copy of ctx with filters that limit the images a request
+// can see. They're applied before the filters of the query parameters. The id
+// identifies the scope, e.g. the principal and its rule, so the results cached
+// by clients in one scope aren't valid in another.
+func WithScope(ctx context.Context, id string, filters ...amicache.Filterer) context.Context {
+	return context.WithValue(ctx, scopeKey{}, scope{id: id, filters: filters})
+}
+
+// ScopeFromContext returns the filters set by WithScope, if any.
+func ScopeFromContext(ctx context.Context) []amicache.Filterer {
+	s, _ := ctx.Value(scopeKey{}).(scope)
+	return s.filters
+}
+
+// PartitionMatcher is implemented by scope filters that only allow the images
+// of some partitions. The regions and owners APIs only list the partitions
+// matched by every scope filter that implements it, along with the number of
+// images in the scope.
+type PartitionMatcher interface {
+	MatchPartition(amicache.Partition) bool
+}
+
+// Returns the id set by WithScope, if any.
+func scopeIDFromContext(ctx context.Context) string {
+	s, _ := ctx.Value(scopeKey{}).(scope)
+	return s.id
+}
+
+// Returns the filter for the images matching the query parameters. Unlike the
+// query API, which only searches the requested regions, the region parameter
+// is applied as a filter.
+func (p *Params) filter(launchPerms bool) *amicache.Filter {
+	filters := append([]amicache.Filterer{}, p.scope...)
+	filters = append(filters,
+		amicache.FilterByImageID(p.images...),
+		amicache.FilterByOwnerID(p.ownerID),
+		amicache.FilterByTags(p.tags),
+	)
+
+	if len(p.regions) > 0 {
+		regions := map[string]struct{}{}
+		for _, region := range p.regions {
+			regions[region] = struct{}{}
+		}
+		filters = append(filters, amicache.FilterFunc(func(images []amicache.Image) []amicache.Image {
+			newImages := []amicache.Image{}
+			for _, image := range images {
+				if _, ok := regions[image.Region]; ok {
+					newImages = append(newImages, image)
+				}
+			}
+			return newImages
+		}))
+	}
+
+	if launchPerms {
+		filters = append(filters, amicache.FilterByLaunchPermission(p.launchPerm))
+	}
+
+	return amicache.NewFilter(filters...)
+}
+
+// Returns an error if any of the regions aren't being cached.
+func validateRegions(cached, regions []string) error {
+	valid := map[string]struct{}{}
+	for _, region := range cached {
+		valid[region] = struct{}{}
+	}
+	for _, region := range regions {
+		if _, ok := valid[region]; !ok {
+			return NewError(http.StatusBadRequest, CodeUnknownRegion, "region", "%v: %s", amicache.ErrUnknownRegion, region)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,235 @@
+// Copyright 2020 Intuit, Inc.  All rights reserved.
+// Use of this source code is governed the MIT license
+// that can be found in the LICENSE file.
+
+package query
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// The output formats of the query API.
+const (
+	formatJSON      = "json"
+	formatCSV       = "csv"
+	formatNDJSON    = "ndjson"
+	formatYAML      = "yaml"
+	formatTerraform = "terraform"
+)
+
+// The media types of the CSV, NDJSON and YAML formats.
+const (
+	MediaTypeCSV    = "text/csv"
+	MediaTypeNDJSON = "application/x-ndjson"
+	MediaTypeYAML   = "application/x-yaml"
+)
+
+// The media types of the output formats. The JSON media type depends on the
+// API version, and the terraform format is JSON that's only available with
+// the format parameter.
+var formats = map[string]string{
+	formatJSON:      "",
+	formatCSV:       MediaTypeCSV,
+	formatNDJSON:    MediaTypeNDJSON,
+	formatYAML:      MediaTypeYAML,
+	formatTerraform: "",
+}
+
+// The prefix of the terraform format keys that contain a tag's value.
+const terraformTagPrefix = "tag_"
+
+// The prefix of the CSV columns that contain a tag's value.
+const tagColumnPrefix = "tag:"
+
+// The CSV columns for the Result fields, in the order they're written.
+var resultColumns = []string{
+	"id",
+	"owner_id",
+	"region",
+	"name",
+	"description",
+	"virtualizationtype",
+	"creationdate",
+}
+
+// The number of NDJSON lines written between flushes.
+const ndjsonFlushInterval = 100
+
+// Sets the format of the query from the Accept header if the format parameter
+// wasn't provided.
+func negotiateFormat(p *Params, r *http.Request) error {
+	if p.format == "" {
+		p.format = acceptFormat(r.Header.Get("Accept"))
+	}
+	if len(p.columns) > 0 && p.format != formatCSV {
+		return NewError(http.StatusBadRequest, CodeInvalidValue, "columns", "columns is only supported by the csv format")
+	}
+	return nil
+}
+
+// Returns the format of the first supported media type in an Accept header.
+// Quality values are ignored. It defaults to JSON.
+func acceptFormat(accept string) string {
+	for _, mediaRange := range strings.Split(accept, ",") {
+		mediaType := strings.TrimSpace(strings.SplitN(mediaRange, ";", 2)[0])
+		for format, formatType := range formats {
+			if formatType != "" && strings.EqualFold(mediaType, formatType) {
+				return format
+			}
+		}
+		if mediaType == MediaTypeV1 || mediaType == "application/json" || mediaType == "*/*" {
+			return formatJSON
+		}
+	}
+	return formatJSON
+}
+
+// Returns the media type of the query results, used to tell the formats apart
+// in ETags.
+func (a *API) representation(p *Params) string {
+	if mediaType := formats[p.format]; mediaType != "" {
+		return mediaType
+	}
+	return a.mediaType
+}
+
+// Returns true if the column is a Result field or a tag.
+func validColumn(column string) bool {
+	if strings.HasPrefix(column, tagColumnPrefix) {
+		return len(column) > len(tagColumnPrefix)
+	}
+	for _, c := range resultColumns {
+		if c == column {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the value of a CSV column.
+func (r Result) column(column string) string {
+	switch column {
+	case "id":
+		return r.ID
+	case "owner_id":
+		return r.OwnerID
+	case "region":
+		return r.Region
+	case "name":
+		return r.Name
+	case "description":
+		return r.Description
+	case "virtualizationtype":
+		return r.VirtualizationType
+	case "creationdate":
+		return r.CreationDate
+	}
+	return r.Tags[strings.TrimPrefix(column, tagColumnPrefix)]
+}
+
+// Returns the Result columns followed by a column for every tag in the
+// results, sorted by tag.
+func defaultColumns(results []Result) []string {
+	tags := map[string]struct{}{}
+	for _, result := range results {
+		for tag := range result.Tags {
+			tags[tag] = struct{}{}
+		}
+	}
+
+	tagColumns := []string{}
+	for tag := range tags {
+		tagColumns = append(tagColumns, tagColumnPrefix+tag)
+	}
+	sort.Strings(tagColumns)
+
+	return append(append([]string{}, resultColumns...), tagColumns...)
+}
+
+// Writes the results in the csv format of the query API.
+func encodeCSV(w http.ResponseWriter, p *Params, results []Result) {
+	w.Header().Set("Content-Type", MediaTypeCSV+"; charset=utf-8; header=present")
+	WriteCSV(w, results, p.columns)
+}
+
+// WriteCSV writes the results as CSV with a header row of the columns, which
+// are Result fields or tags in the form "tag:<key>". If no columns are
+// provided, the Result fields are followed by a column for every tag in the
+// results.
+func WriteCSV(w io.Writer, results []Result, columns []string) error {
+	if len(columns) == 0 {
+		columns = defaultColumns(results)
+	}
+
+	cw := csv.NewWriter(w)
+	cw.Write(columns)
+
+	row := make([]string, len(columns))
+	for _, result := range results {
+		for i, column := range columns {
+			row[i] = result.column(column)
+		}
+		cw.Write(row)
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+// Writes the results as newline delimited JSON, one result per line.
+func encodeNDJSON(w http.ResponseWriter, results []Result) {
+	w.Header().Set("Content-Type", MediaTypeNDJSON)
+
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+
+	for i, result := range results {
+		enc.Encode(result)
+		if flusher != nil && (i+1)%ndjsonFlushInterval == 0 {
+			flusher.Flush()
+		}
+	}
+}
+
+// Writes the results as a YAML sequence.
+func encodeYAML(w http.ResponseWriter, results []Result) {
+	w.Header().Set("Content-Type", MediaTypeYAML+"; charset=utf-8")
+	enc := yaml.NewEncoder(w)
+	enc.Encode(results)
+	enc.Close()
+}
+
+// Writes the result as a JSON object of strings, which can be read by
+// Terraform's external data source. The tags are flattened into tag_<key>
+// keys.
+func encodeTerraform(w http.ResponseWriter, p *Params, results []Result) {
+	result := results[0]
+
+	attrs := map[string]string{}
+	for _, column := range resultColumns {
+		attrs[column] = result.column(column)
+	}
+	for key, value := range result.Tags {
+		attrs[terraformTagPrefix+key] = value
+	}
+
+	encodeJSON(w, p, "application/json; charset=utf-8", attrs)
+}
+
+// Returns the error for a terraform format query that didn't match exactly
+// one image.
+func terraformError(matches int) error {
+	if matches == 0 {
+		return NewError(http.StatusNotFound, CodeNotFound, "", "no images matched the query")
+	}
+	return NewError(http.StatusBadRequest, CodeMultipleMatches, "first",
+		"%d images matched the query, use first=true to return the newest one", matches)
+}
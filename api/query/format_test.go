@@ -0,0 +1,284 @@
+// Copyright 2020 Intuit, Inc.  All rights reserved.
+// Use of this source code is governed the MIT license
+// that can be found in the LICENSE file.
+
+package query
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHandlerFormats(t *testing.T) {
+	const ndjson = `{"id":"ami-1a2b3c4d","owner_id":"123456789012","region":"us-west-2","name":"test-ami-1",` +
+		`"description":"Test AMI 1","virtualizationtype":"hvm","creationdate":"2017-11-29T16:00:00.000Z",` +
+		`"tags":{"state":"available"}}` + "\n"
+
+	tests := []struct {
+		name        string
+		query       string
+		accept      string
+		statusCode  int
+		contentType string
+		want        string
+	}{
+		{
+			name:        "csv",
+			query:       "?format=csv",
+			statusCode:  http.StatusOK,
+			contentType: "text/csv; charset=utf-8; header=present",
+			want: "id,owner_id,region,name,description,virtualizationtype,creationdate,tag:state\n" +
+				"ami-1a2b3c4d,123456789012,us-west-2,test-ami-1,Test AMI 1,hvm,2017-11-29T16:00:00.000Z,available\n",
+		},
+		{
+			name:        "csv_columns",
+			query:       "?format=csv&columns=id,tag:state&columns=tag:os",
+			statusCode:  http.StatusOK,
+			contentType: "text/csv; charset=utf-8; header=present",
+			want:        "id,tag:state,tag:os\nami-1a2b3c4d,available,\n",
+		},
+		{
+			name:        "csv_accept",
+			accept:      "text/csv",
+			statusCode:  http.StatusOK,
+			contentType: "text/csv; charset=utf-8; header=present",
+			want: "id,owner_id,region,name,description,virtualizationtype,creationdate,tag:state\n" +
+				"ami-1a2b3c4d,123456789012,us-west-2,test-ami-1,Test AMI 1,hvm,2017-11-29T16:00:00.000Z,available\n",
+		},
+		{
+			name:        "ndjson",
+			query:       "?format=ndjson",
+			statusCode:  http.StatusOK,
+			contentType: "application/x-ndjson",
+			want:        ndjson,
+		},
+		{
+			name:        "ndjson_accept",
+			accept:      "application/x-ndjson",
+			statusCode:  http.StatusOK,
+			contentType: "application/x-ndjson",
+			want:        ndjson,
+		},
+		{
+			name:        "format_overrides_accept",
+			query:       "?format=ndjson",
+			accept:      "text/csv",
+			statusCode:  http.StatusOK,
+			contentType: "application/x-ndjson",
+			want:        ndjson,
+		},
+		{
+			name:        "yaml",
+			query:       "?format=yaml",
+			statusCode:  http.StatusOK,
+			contentType: "application/x-yaml; charset=utf-8",
+			want: "- id: ami-1a2b3c4d\n" +
+				"  owner_id: \"123456789012\"\n" +
+				"  region: us-west-2\n" +
+				"  name: test-ami-1\n" +
+				"  description: Test AMI 1\n" +
+				"  virtualizationtype: hvm\n" +
+				"  creationdate: \"2017-11-29T16:00:00.000Z\"\n" +
+				"  tags:\n" +
+				"    state: available\n",
+		},
+		{
+			name:        "yaml_accept",
+			accept:      "application/x-yaml",
+			statusCode:  http.StatusOK,
+			contentType: "application/x-yaml; charset=utf-8",
+			want: "- id: ami-1a2b3c4d\n" +
+				"  owner_id: \"123456789012\"\n" +
+				"  region: us-west-2\n" +
+				"  name: test-ami-1\n" +
+				"  description: Test AMI 1\n" +
+				"  virtualizationtype: hvm\n" +
+				"  creationdate: \"2017-11-29T16:00:00.000Z\"\n" +
+				"  tags:\n" +
+				"    state: available\n",
+		},
+		{
+			name:        "terraform",
+			query:       "?format=terraform",
+			statusCode:  http.StatusOK,
+			contentType: "application/json; charset=utf-8",
+			want: `{"creationdate":"2017-11-29T16:00:00.000Z","description":"Test AMI 1","id":"ami-1a2b3c4d",` +
+				`"name":"test-ami-1","owner_id":"123456789012","region":"us-west-2","tag_state":"available",` +
+				`"virtualizationtype":"hvm"}` + "\n",
+		},
+		{
+			name:        "bad_format",
+			query:       "?format=xml",
+			statusCode:  http.StatusBadRequest,
+			contentType: "application/json; charset=utf-8",
+		},
+		{
+			name:        "bad_column",
+			query:       "?format=csv&columns=foo",
+			statusCode:  http.StatusBadRequest,
+			contentType: "application/json; charset=utf-8",
+		},
+		{
+			name:        "columns_without_csv",
+			query:       "?columns=id",
+			statusCode:  http.StatusBadRequest,
+			contentType: "application/json; charset=utf-8",
+		},
+	}
+
+	ts := httptest.NewServer(&API{cache: &mockCache{}, mediaType: MediaTypeV1})
+	defer ts.Close()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", ts.URL+APIPathQuery+tt.query, nil)
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+
+			rsp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("want: <nil>, got: %v", err)
+			}
+			defer rsp.Body.Close()
+
+			if tt.statusCode != rsp.StatusCode {
+				t.Errorf("want: status %d, got: status %d", tt.statusCode, rsp.StatusCode)
+			}
+			if want, got := tt.contentType, rsp.Header.Get("Content-Type"); want != got {
+				t.Errorf("want: %s, got: %s", want, got)
+			}
+
+			if tt.statusCode != http.StatusOK {
+				return
+			}
+
+			body, err := ioutil.ReadAll(rsp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := string(body); tt.want != got {
+				t.Errorf("\n\twant: %q\n\t got: %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestAcceptFormat(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{"", formatJSON},
+		{"*/*", formatJSON},
+		{"application/vnd.ami-query-v1+json", formatJSON},
+		{"text/csv", formatCSV},
+		{"text/csv; charset=utf-8", formatCSV},
+		{"application/x-ndjson", formatNDJSON},
+		{"text/html, application/x-ndjson;q=0.9, */*;q=0.8", formatNDJSON},
+		{"application/json, text/csv", formatJSON},
+	}
+
+	for _, tt := range tests {
+		if got := acceptFormat(tt.accept); tt.want != got {
+			t.Errorf("%q: want: %s, got: %s", tt.accept, tt.want, got)
+		}
+	}
+}
+
+func TestHandlerTerraform(t *testing.T) {
+	tests := []struct {
+		name       string
+		query      string
+		images     int
+		statusCode int
+		code       ErrorCode
+		want       string
+	}{
+		{"one", "?format=terraform", 1, http.StatusOK, "", "ami-0"},
+		{"none", "?format=terraform", 0, http.StatusNotFound, CodeNotFound, ""},
+		{"multiple", "?format=terraform", 3, http.StatusBadRequest, CodeMultipleMatches, ""},
+		{"first", "?format=terraform&first=true", 3, http.StatusOK, "", "ami-0"},
+		{"not_first", "?format=terraform&first=false", 3, http.StatusBadRequest, CodeMultipleMatches, ""},
+		{"bad_first", "?format=terraform&first=foo", 3, http.StatusBadRequest, CodeInvalidValue, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mc := &mockCache{images: newV2Images(tt.images)}
+			ts := httptest.NewServer(&API{cache: mc, mediaType: MediaTypeV1})
+			defer ts.Close()
+
+			rsp, err := http.Get(ts.URL + APIPathQuery + tt.query)
+			if err != nil {
+				t.Fatalf("want: <nil>, got: %v", err)
+			}
+			defer rsp.Body.Close()
+
+			if tt.statusCode != rsp.StatusCode {
+				t.Fatalf("want: status %d, got: status %d", tt.statusCode, rsp.StatusCode)
+			}
+
+			if tt.statusCode != http.StatusOK {
+				var got Error
+				if err := json.NewDecoder(rsp.Body).Decode(&got); err != nil {
+					t.Fatal(err)
+				}
+				if tt.code != got.Code {
+					t.Errorf("want: %s, got: %s", tt.code, got.Code)
+				}
+				return
+			}
+
+			got := map[string]string{}
+			if err := json.NewDecoder(rsp.Body).Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+			if tt.want != got["id"] {
+				t.Errorf("want: %s, got: %s", tt.want, got["id"])
+			}
+		})
+	}
+}
+
+func TestWriteCSV(t *testing.T) {
+	results := []Result{
+		{ID: "ami-1", OwnerID: "123456789012", Region: "us-west-2", Name: "a,b", Tags: map[string]string{"state": "available", "os": "rhel"}},
+		{ID: "ami-2", OwnerID: "123456789012", Region: "us-east-1", Tags: map[string]string{"state": "development"}},
+	}
+
+	tests := []struct {
+		name    string
+		columns []string
+		want    string
+	}{
+		{
+			name:    "default_columns",
+			columns: nil,
+			want: "id,owner_id,region,name,description,virtualizationtype,creationdate,tag:os,tag:state\n" +
+				"ami-1,123456789012,us-west-2,\"a,b\",,,,rhel,available\n" +
+				"ami-2,123456789012,us-east-1,,,,,,development\n",
+		},
+		{
+			name:    "columns",
+			columns: []string{"id", "tag:state"},
+			want:    "id,tag:state\nami-1,available\nami-2,development\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := WriteCSV(&buf, results, tt.columns); err != nil {
+				t.Fatal(err)
+			}
+			if got := buf.String(); tt.want != got {
+				t.Errorf("\n\twant: %q\n\t got: %q", tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,53 @@
+// Copyright 2020 Intuit, Inc.  All rights reserved.
+// Use of this source code is governed the MIT license
+// that can be found in the LICENSE file.
+
+package query
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/intuit/ami-query/amicache"
+)
+
+// APIPathHealth is the url path for the health API. It's meant for load
+// balancers and orchestrators, so it doesn't require authentication.
+const APIPathHealth = "/health"
+
+// HealthAPI reports that the service is up. The server only starts once the
+// cache is warmed, so a response means the cache can be queried.
+type HealthAPI struct {
+	cache healthCacher
+}
+
+// Health describes the state of the service.
+type Health struct {
+	Status       string     `json:"status"`
+	Generation   uint64     `json:"generation"`
+	LastModified *time.Time `json:"last_modified,omitempty"`
+}
+
+// NewHealthAPI returns a usable health API.
+func NewHealthAPI(cache *amicache.Cache) *HealthAPI {
+	return &HealthAPI{cache: cache}
+}
+
+func (a *HealthAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	health := Health{Status: "ok", Generation: a.cache.Generation()}
+	if modified := a.cache.LastModified(); !modified.IsZero() {
+		health.LastModified = &modified
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(health)
+}
+
+// healthCacher is used to represent an amicache.Cache. Used to mock the cache
+// in tests.
+type healthCacher interface {
+	Generation() uint64
+	LastModified() time.Time
+}
@@ -0,0 +1,48 @@
+// Copyright 2020 Intuit, Inc.  All rights reserved.
+// Use of this source code is governed the MIT license
+// that can be found in the LICENSE file.
+
+package query
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHealthHandler(t *testing.T) {
+	tests := []struct {
+		name  string
+		cache *mockCache
+		want  string
+	}{
+		{
+			name:  "empty",
+			cache: &mockCache{},
+			want:  `{"status":"ok","generation":0}`,
+		},
+		{
+			name:  "updated",
+			cache: &mockCache{generation: 3, modified: time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)},
+			want:  `{"status":"ok","generation":3,"last_modified":"2020-06-01T00:00:00Z"}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			(&HealthAPI{cache: tt.cache}).ServeHTTP(w, httptest.NewRequest("GET", APIPathHealth, nil))
+
+			if want, got := 200, w.Code; want != got {
+				t.Errorf("want: %d, got: %d", want, got)
+			}
+			if want, got := tt.want, strings.TrimSpace(w.Body.String()); want != got {
+				t.Errorf("\n\twant: %s\n\t got: %s", want, got)
+			}
+			if want, got := "no-store", w.Header().Get("Cache-Control"); want != got {
+				t.Errorf("want: %s, got: %s", want, got)
+			}
+		})
+	}
+}
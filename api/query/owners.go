@@ -0,0 +1,89 @@
+// Copyright 2020 Intuit, Inc.  All rights reserved.
+// Use of this source code is governed the MIT license
+// that can be found in the LICENSE file.
+
+package query
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/intuit/ami-query/amicache"
+)
+
+// APIPathOwners is the url path for the owners API.
+const APIPathOwners = "/owners"
+
+// OwnersAPI serves the list of owners being cached.
+type OwnersAPI struct {
+	cache cacher
+}
+
+// Owner describes an owner being cached and the regions it's cached in.
+type Owner struct {
+	ID          string           `json:"owner_id"`
+	Alias       string           `json:"alias,omitempty"`
+	Regions     []string         `json:"regions"`
+	ImageCount  int              `json:"image_count"`
+	Throttles   int              `json:"throttles"`
+	LastUpdated *time.Time       `json:"last_updated,omitempty"`
+	Errors      []PartitionError `json:"errors,omitempty"`
+}
+
+// NewOwnersAPI returns a usable owners API.
+func NewOwnersAPI(cache *amicache.Cache) *OwnersAPI {
+	return &OwnersAPI{cache: cache}
+}
+
+func (a *OwnersAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	scope, err := newPartitionScope(a.cache, ScopeFromContext(r.Context()))
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+
+	owners := []Owner{}
+	for _, status := range a.cache.Status() {
+		owner := Owner{
+			ID:         status.OwnerID,
+			Alias:      status.Alias,
+			Regions:    []string{},
+			ImageCount: status.ImageCount(),
+		}
+		for _, region := range a.cache.OwnerRegions(status.OwnerID) {
+			if scope.visible(amicache.Partition{OwnerID: status.OwnerID, Region: region}) {
+				owner.Regions = append(owner.Regions, region)
+			}
+		}
+		if scope.scoped() {
+			if len(owner.Regions) == 0 {
+				continue
+			}
+			owner.ImageCount = 0
+			for p, n := range scope.counts {
+				if p.OwnerID == status.OwnerID {
+					owner.ImageCount += n
+				}
+			}
+		}
+		if status.Err != nil {
+			owner.Errors = append(owner.Errors, PartitionError{Message: status.Err.Error()})
+		}
+		for _, p := range status.Partitions {
+			if !scope.visible(p.Partition) {
+				continue
+			}
+			owner.Throttles += p.Throttles
+			owner.LastUpdated = latest(owner.LastUpdated, p.LastUpdated)
+			if p.Err != nil && p.Err != status.Err {
+				owner.Errors = append(owner.Errors, PartitionError{
+					Region:  p.Region,
+					Source:  p.Source,
+					Message: p.Err.Error(),
+				})
+			}
+		}
+		owners = append(owners, owner)
+	}
+	writeJSON(w, r, owners)
+}
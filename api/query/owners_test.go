@@ -0,0 +1,87 @@
+// Copyright 2020 Intuit, Inc.  All rights reserved.
+// Use of this source code is governed the MIT license
+// that can be found in the LICENSE file.
+
+package query
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestOwnersHandler(t *testing.T) {
+	updated := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	ts := httptest.NewServer(&OwnersAPI{cache: newStatusMockCache(updated)})
+	defer ts.Close()
+
+	rsp, err := http.Get(ts.URL + APIPathOwners)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rsp.Body.Close()
+
+	if want, got := http.StatusOK, rsp.StatusCode; want != got {
+		t.Errorf("want: status %d, got: status %d", want, got)
+	}
+
+	var owners []Owner
+	if err := json.NewDecoder(rsp.Body).Decode(&owners); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Owner{
+		{
+			ID:          "123456789012",
+			Alias:       "foo",
+			Regions:     []string{"us-west-2"},
+			ImageCount:  3,
+			Throttles:   2,
+			LastUpdated: &updated,
+		},
+		{
+			ID:      "123456789013",
+			Regions: []string{"us-west-2"},
+			Errors: []PartitionError{
+				{Region: "us-west-2", Message: "access denied"},
+				{Region: "us-west-2", Source: "catalog", Message: "catalog unavailable"},
+			},
+		},
+	}
+	if !reflect.DeepEqual(want, owners) {
+		t.Errorf("\n\twant: %+v\n\t got: %+v", want, owners)
+	}
+}
+
+func TestOwnersHandlerScope(t *testing.T) {
+	updated := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	mc := newStatusMockCache(updated)
+	mc.images = newScopeImages()
+	a := &OwnersAPI{cache: mc}
+
+	r := httptest.NewRequest("GET", APIPathOwners, nil)
+	r = r.WithContext(WithScope(r.Context(), "test", newTestScope("123456789012", "foo")...))
+	w := httptest.NewRecorder()
+	a.ServeHTTP(w, r)
+
+	var owners []Owner
+	if err := json.NewDecoder(w.Body).Decode(&owners); err != nil {
+		t.Fatal(err)
+	}
+
+	// The failing owner isn't in the scope.
+	want := []Owner{{
+		ID:          "123456789012",
+		Alias:       "foo",
+		Regions:     []string{"us-west-2"},
+		ImageCount:  1,
+		Throttles:   2,
+		LastUpdated: &updated,
+	}}
+	if !reflect.DeepEqual(want, owners) {
+		t.Errorf("\n\twant: %+v\n\t got: %+v", want, owners)
+	}
+}
@@ -5,9 +5,13 @@
 package query
 
 import (
-	"fmt"
+	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/intuit/ami-query/amicache"
 )
 
 // Params defines all the dimensions of a query.
@@ -19,13 +23,19 @@ type Params struct {
 	launchPerm string
 	callback   string
 	pretty     bool
+	asOf       time.Time
+	format     string
+	columns    []string
+	first      bool
+	scope      []amicache.Filterer // Limits the images the client can see, see WithScope
+	scopeID    string              // Identifies the scope
 }
 
 // Decode populates a Params from a URL.
 func (p *Params) Decode(stateTag string, u *url.URL) error {
 	params, err := url.ParseQuery(u.RawQuery)
 	if err != nil {
-		return err
+		return NewError(http.StatusBadRequest, CodeBadRequest, "", "%v", err)
 	}
 
 	p.regions = []string{}
@@ -40,7 +50,7 @@ func (p *Params) Decode(stateTag string, u *url.URL) error {
 				if i := strings.Index(value, ":"); i != -1 {
 					p.tags[value[:i]] = append(p.tags[value[:i]], value[i+1:])
 				} else {
-					return fmt.Errorf("invalid query tag value: %s", value)
+					return NewError(http.StatusBadRequest, CodeInvalidTag, key, "invalid query tag value: %s", value)
 				}
 			}
 		case stateTag, "state", "status": // aliases for the state tag
@@ -57,14 +67,47 @@ func (p *Params) Decode(stateTag string, u *url.URL) error {
 			p.callback = values[0]
 		case "pretty":
 			p.pretty = p.pretty || values[0] != "0"
+		case "as_of":
+			if p.asOf, err = ParseTime(values[0]); err != nil {
+				return NewError(http.StatusBadRequest, CodeInvalidValue, key, "invalid as_of value: %s", values[0])
+			}
+		case "format":
+			if _, ok := formats[values[0]]; !ok {
+				return NewError(http.StatusBadRequest, CodeInvalidValue, key, "invalid format value: %s", values[0])
+			}
+			p.format = values[0]
+		case "first":
+			if values[0] == "" {
+				p.first = true
+			} else if p.first, err = strconv.ParseBool(values[0]); err != nil {
+				return NewError(http.StatusBadRequest, CodeInvalidValue, key, "invalid first value: %s", values[0])
+			}
+		case "columns":
+			for _, value := range values {
+				for _, column := range strings.Split(value, ",") {
+					if !validColumn(column) {
+						return NewError(http.StatusBadRequest, CodeInvalidValue, key, "invalid column: %s", column)
+					}
+					p.columns = append(p.columns, column)
+				}
+			}
 		default:
-			return fmt.Errorf("unknown query key: %s", key)
+			return NewError(http.StatusBadRequest, CodeUnknownKey, key, "unknown query key: %s", key)
 		}
 	}
 
 	return nil
 }
 
+// ParseTime parses an RFC 3339 timestamp or a date, which is treated as
+// midnight UTC, as in the as_of query parameter.
+func ParseTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", value)
+}
+
 // Removes dups from a string slice.
 func dedup(items []string) []string {
 	newItems := []string{}
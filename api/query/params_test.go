@@ -9,6 +9,7 @@ import (
 	"net/url"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/intuit/ami-query/amicache"
 )
@@ -103,6 +104,48 @@ func TestDecode(t *testing.T) {
 				tags:    map[string][]string{},
 			},
 		},
+		{
+			"as_of",
+			"as_of=2020-06-01T12:00:00Z",
+			Params{
+				asOf:    time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC),
+				regions: []string{},
+				images:  []string{},
+				tags:    map[string][]string{},
+			},
+		},
+		{
+			"format",
+			"format=csv&columns=id,tag:os&columns=region",
+			Params{
+				format:  "csv",
+				columns: []string{"id", "tag:os", "region"},
+				regions: []string{},
+				images:  []string{},
+				tags:    map[string][]string{},
+			},
+		},
+		{
+			"first",
+			"format=terraform&first",
+			Params{
+				format:  "terraform",
+				first:   true,
+				regions: []string{},
+				images:  []string{},
+				tags:    map[string][]string{},
+			},
+		},
+		{
+			"as_of_date",
+			"as_of=2020-06-01",
+			Params{
+				asOf:    time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC),
+				regions: []string{},
+				images:  []string{},
+				tags:    map[string][]string{},
+			},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -133,6 +176,14 @@ func TestDecodeBadTagValue(t *testing.T) {
 	}
 }
 
+func TestDecodeBadAsOf(t *testing.T) {
+	p := &Params{}
+	err := p.Decode(amicache.DefaultStateTag, &url.URL{RawQuery: "as_of=yesterday"})
+	if want, got := "invalid as_of value: yesterday", err.Error(); want != got {
+		t.Errorf("\n\twant err: %q\n\t got err: %q", want, got)
+	}
+}
+
 func TestDecodeParseError(t *testing.T) {
 	p := &Params{}
 	err := p.Decode(amicache.DefaultStateTag, &url.URL{RawQuery: `foo=%%bar`})
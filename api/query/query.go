@@ -6,10 +6,13 @@ package query
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/intuit/ami-query/amicache"
+	"github.com/intuit/ami-query/history"
 
 	"github.com/aws/aws-sdk-go/aws"
 )
@@ -17,94 +20,196 @@ import (
 // APIPathQuery is the url path for the query API.
 const APIPathQuery = "/amis"
 
+// Option configures an API.
+type Option interface {
+	set(*API)
+}
+
+// optionFunc is a function adapter that implements the Option interface.
+type optionFunc func(*API)
+
+func (fn optionFunc) set(a *API) { fn(a) }
+
+// History sets the store used to answer queries with the as_of parameter.
+// Those queries are rejected if it isn't set.
+func History(store *history.Store) Option {
+	return optionFunc(func(a *API) {
+		if store != nil {
+			a.history = store
+		}
+	})
+}
+
 // API serves the query API.
 type API struct {
-	cache   cacher
-	regions []string
+	cache     cacher
+	history   historian
+	maxAge    time.Duration
+	mediaType string // The media type of the API version, used in ETags
 }
 
 // Result contains the matching AMIs for a query.
 type Result struct {
-	ID                 string            `json:"id"`
-	OwnerID            string            `json:"owner_id"`
-	Region             string            `json:"region"`
-	Name               string            `json:"name"`
-	Description        string            `json:"description"`
-	VirtualizationType string            `json:"virtualizationtype"`
-	CreationDate       string            `json:"creationdate"`
-	Tags               map[string]string `json:"tags"`
+	ID                 string            `json:"id" yaml:"id"`
+	OwnerID            string            `json:"owner_id" yaml:"owner_id"`
+	Region             string            `json:"region" yaml:"region"`
+	Name               string            `json:"name" yaml:"name"`
+	Description        string            `json:"description" yaml:"description"`
+	VirtualizationType string            `json:"virtualizationtype" yaml:"virtualizationtype"`
+	CreationDate       string            `json:"creationdate" yaml:"creationdate"`
+	Tags               map[string]string `json:"tags" yaml:"tags"`
 }
 
 // NewAPI returns a usable query API.
-func NewAPI(cache *amicache.Cache) *API {
-	return &API{
-		cache:   cache,
-		regions: cache.Regions(),
+func NewAPI(cache *amicache.Cache, options ...Option) *API {
+	a := &API{cache: cache, mediaType: MediaTypeV1}
+	for _, opt := range options {
+		opt.set(a)
 	}
+	return a
 }
 
 func (a *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	p := &Params{}
 	if err := p.Decode(a.cache.StateTag(), r.URL); err != nil {
-		writeErr(w, err, http.StatusBadRequest)
+		WriteError(w, r, err)
+		return
+	}
+
+	if err := negotiateFormat(p, r); err != nil {
+		WriteError(w, r, err)
+		return
+	}
+
+	images, _, ok := a.query(w, r, p)
+	if !ok {
 		return
 	}
 
+	if p.first && len(images) > 1 {
+		images = images[:1]
+	}
+
+	// The terraform format describes a single image.
+	if p.format == formatTerraform && len(images) != 1 {
+		WriteError(w, r, terraformError(len(images)))
+		return
+	}
+
+	a.EncodeTo(w, p, images)
+}
+
+// Returns the images matching the query and the cache generation they were
+// read at. It returns false if a response was written instead, either an error
+// or a 304 if the client's cached results are still valid.
+func (a *API) query(w http.ResponseWriter, r *http.Request, p *Params) ([]amicache.Image, uint64, bool) {
+	p.scope, p.scopeID = ScopeFromContext(r.Context()), scopeIDFromContext(r.Context())
+
+	// Search the historical catalog for point-in-time queries.
+	if !p.asOf.IsZero() {
+		generation := a.cache.Generation()
+		images, err := a.getHistoricalImages(p)
+		if err != nil {
+			WriteError(w, r, err)
+			return nil, 0, false
+		}
+		return images, generation, true
+	}
+
 	// If no regions were provided, search all cached regions.
 	if len(p.regions) == 0 {
-		p.regions = a.regions
+		p.regions = a.cache.Regions()
+	} else if err := validateRegions(a.cache.Regions(), p.regions); err != nil {
+		WriteError(w, r, err)
+		return nil, 0, false
+	}
+
+	// The cache generation is read first so the results are at least as new
+	// as the generation in their ETag. The client's cached results are checked
+	// before the images are read, which isn't needed if they're still valid.
+	generation, modified := a.cache.Generation(), a.cache.LastModified()
+	tag := etag(generation, p.scopeID, a.representation(p), r.URL.Query())
+
+	if notModified(r, tag, modified) {
+		a.setCacheHeaders(w, p, tag, modified)
+		w.WriteHeader(http.StatusNotModified)
+		return nil, 0, false
 	}
 
 	images, err := a.getImages(p)
 	if err != nil {
-		writeErr(w, err, http.StatusBadRequest)
-		return
+		WriteError(w, r, err)
+		return nil, 0, false
 	}
 
-	a.EncodeTo(w, p, images)
+	a.setCacheHeaders(w, p, tag, modified)
+	return images, generation, true
 }
 
-// EncodeTo writes the JSON formatted results to the http.ResponseWriter.
+// EncodeTo writes the results to the http.ResponseWriter in the format of the
+// query, JSON by default.
 func (a *API) EncodeTo(w http.ResponseWriter, p *Params, images []amicache.Image) {
 	results := []Result{}
 	for _, image := range images {
-		results = append(results, Result{
-			OwnerID:            image.OwnerID,
-			Region:             image.Region,
-			ID:                 aws.StringValue(image.Image.ImageId),
-			Name:               aws.StringValue(image.Image.Name),
-			Description:        aws.StringValue(image.Image.Description),
-			VirtualizationType: aws.StringValue(image.Image.VirtualizationType),
-			CreationDate:       aws.StringValue(image.Image.CreationDate),
-			Tags:               image.Tags(),
-		})
+		results = append(results, newResult(image))
 	}
 
+	switch p.format {
+	case formatCSV:
+		encodeCSV(w, p, results)
+	case formatNDJSON:
+		encodeNDJSON(w, results)
+	case formatYAML:
+		encodeYAML(w, results)
+	case formatTerraform:
+		encodeTerraform(w, p, results)
+	default:
+		encodeJSON(w, p, "application/json; charset=utf-8", results)
+	}
+}
+
+// Writes v as JSON, or as JSONP if the query has a callback.
+func encodeJSON(w http.ResponseWriter, p *Params, contentType string, v interface{}) {
 	enc := json.NewEncoder(w)
 	enc.SetEscapeHTML(false)
 
 	if p.callback != "" {
 		w.Header().Set("Content-Type", "application/javascript")
 		fmt.Fprintf(w, "%s(", p.callback)
-		enc.Encode(results)
+		enc.Encode(v)
 		fmt.Fprint(w, ");")
 	} else {
-		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Header().Set("Content-Type", contentType)
 		if p.pretty {
 			enc.SetIndent("", " ")
 		}
-		enc.Encode(results)
+		enc.Encode(v)
+	}
+}
+
+// Returns the Result for a cached image.
+func newResult(image amicache.Image) Result {
+	return Result{
+		OwnerID:            image.OwnerID,
+		Region:             image.Region,
+		ID:                 aws.StringValue(image.Image.ImageId),
+		Name:               aws.StringValue(image.Image.Name),
+		Description:        aws.StringValue(image.Image.Description),
+		VirtualizationType: aws.StringValue(image.Image.VirtualizationType),
+		CreationDate:       aws.StringValue(image.Image.CreationDate),
+		Tags:               image.Tags(),
 	}
 }
 
 // Get the images from the cache based on the query.
 func (a *API) getImages(p *Params) ([]amicache.Image, error) {
 	images := []amicache.Image{}
-	filters := []amicache.Filterer{
+	filters := append([]amicache.Filterer{}, p.scope...)
+	filters = append(filters,
 		amicache.FilterByImageID(p.images...),
 		amicache.FilterByOwnerID(p.ownerID),
 		amicache.FilterByTags(p.tags),
-	}
+	)
 
 	if a.cache.CollectLaunchPermissions() {
 		filters = append(filters, amicache.FilterByLaunchPermission(p.launchPerm))
@@ -114,7 +219,9 @@ func (a *API) getImages(p *Params) ([]amicache.Image, error) {
 
 	for _, region := range p.regions {
 		matched, err := a.cache.FilterImages(region, filter)
-		if err != nil {
+		if errors.Is(err, amicache.ErrUnknownRegion) {
+			return nil, NewError(http.StatusBadRequest, CodeUnknownRegion, "region", "%v", err)
+		} else if err != nil {
 			return nil, err
 		}
 		images = append(images, matched...)
@@ -123,25 +230,38 @@ func (a *API) getImages(p *Params) ([]amicache.Image, error) {
 	return images, nil
 }
 
-// Writes a JSON formatted error message to an http.ResponseWriter.
-func writeErr(w http.ResponseWriter, err error, status int) {
-	var id string
-	switch status {
-	case http.StatusBadRequest:
-		id = "bad_request"
-	case http.StatusInternalServerError:
-		id = "internal_error"
-	default:
-		id = "unknown_error"
-		status = http.StatusInternalServerError
+// Get the images that were cached at the time of the query.
+func (a *API) getHistoricalImages(p *Params) ([]amicache.Image, error) {
+	if a.history == nil {
+		return nil, NewError(http.StatusBadRequest, CodeInvalidValue, "as_of", "as_of is unsupported, history is not enabled")
+	}
+
+	images, err := a.history.Images(p.asOf)
+	if err != nil {
+		return nil, NewError(http.StatusBadRequest, CodeInvalidValue, "as_of", "as_of %s: %v", p.asOf.Format(time.RFC3339), err)
 	}
-	http.Error(w, fmt.Sprintf(`{"id":"%s","message":"%s"}`, id, err), status)
+
+	images = p.filter(a.cache.CollectLaunchPermissions()).Apply(images)
+	amicache.SortByState(a.cache.StateTag(), images)
+	return images, nil
+}
+
+// historian is used to represent a history.Store. Used to mock the history in
+// tests.
+type historian interface {
+	Images(time.Time) ([]amicache.Image, error)
 }
 
 // cacher is used to represent an amicache.Cache. Used to mock the cache in tests.
 type cacher interface {
+	Generation() uint64
+	LastModified() time.Time
+	NextUpdate() time.Time
 	FilterImages(string, *amicache.Filter) ([]amicache.Image, error)
 	Regions() []string
+	OwnerIDs() []string
+	OwnerRegions(string) []string
+	Status() []amicache.OwnerStatus
 	StateTag() string
 	CollectLaunchPermissions() bool
 }
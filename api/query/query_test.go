@@ -5,10 +5,13 @@
 package query
 
 import (
+	"encoding/json"
 	"errors"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
 	"testing"
+	"time"
 
 	"github.com/intuit/ami-query/amicache"
 
@@ -19,12 +22,26 @@ import (
 type mockCache struct {
 	filterErr          error
 	collectLaunchPerms bool
+	status             []amicache.OwnerStatus
+	generation         uint64
+	modified           time.Time
+	nextUpdate         time.Time
+	images             []amicache.Image
 }
 
 func (mockCache) Regions() []string                 { return []string{"us-west-2"} }
+func (mockCache) OwnerIDs() []string                { return []string{"123456789012"} }
+func (mockCache) OwnerRegions(string) []string      { return []string{"us-west-2"} }
+func (m *mockCache) Generation() uint64             { return m.generation }
+func (m *mockCache) LastModified() time.Time        { return m.modified }
+func (m *mockCache) NextUpdate() time.Time          { return m.nextUpdate }
+func (m *mockCache) Status() []amicache.OwnerStatus { return m.status }
 func (m *mockCache) StateTag() string               { return amicache.DefaultStateTag }
 func (m *mockCache) CollectLaunchPermissions() bool { return m.collectLaunchPerms }
-func (m *mockCache) FilterImages(string, *amicache.Filter) ([]amicache.Image, error) {
+func (m *mockCache) FilterImages(region string, filter *amicache.Filter) ([]amicache.Image, error) {
+	if m.images != nil {
+		return filter.Apply(m.images), m.filterErr
+	}
 	images := []amicache.Image{
 		{
 			OwnerID: "123456789012",
@@ -61,10 +78,7 @@ func TestHandler(t *testing.T) {
 	}
 
 	mc := &mockCache{}
-	ts := httptest.NewServer(&API{
-		cache:   mc,
-		regions: []string{"us-west-2"},
-	})
+	ts := httptest.NewServer(&API{cache: mc})
 	defer ts.Close()
 
 	for _, tt := range tests {
@@ -84,3 +98,132 @@ func TestHandler(t *testing.T) {
 		})
 	}
 }
+
+type mockHistory struct{}
+
+func (mockHistory) Images(t time.Time) ([]amicache.Image, error) {
+	if t.Before(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		return nil, errors.New("time is outside of the recorded history")
+	}
+	return []amicache.Image{
+		amicache.NewImage(&ec2.Image{
+			ImageId:      aws.String("ami-1a2b3c4d"),
+			CreationDate: aws.String("2017-11-29T16:00:00.000Z"),
+		}, "123456789012", "us-west-2", nil),
+		amicache.NewImage(&ec2.Image{
+			ImageId:      aws.String("ami-2a2b3c4d"),
+			CreationDate: aws.String("2017-11-29T16:00:00.000Z"),
+		}, "123456789012", "us-east-1", nil),
+	}, nil
+}
+
+func TestHandlerAsOf(t *testing.T) {
+	var tests = []struct {
+		name       string
+		query      string
+		history    historian
+		statusCode int
+		want       int
+	}{
+		{"as_of", "/amis?as_of=2020-06-01", mockHistory{}, http.StatusOK, 2},
+		{"as_of_region", "/amis?as_of=2020-06-01T12:00:00Z&region=us-east-1", mockHistory{}, http.StatusOK, 1},
+		{"out_of_range", "/amis?as_of=2019-06-01", mockHistory{}, http.StatusBadRequest, 0},
+		{"bad_as_of", "/amis?as_of=foo", mockHistory{}, http.StatusBadRequest, 0},
+		{"no_history", "/amis?as_of=2020-06-01", nil, http.StatusBadRequest, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := httptest.NewServer(&API{cache: &mockCache{}, history: tt.history})
+			defer ts.Close()
+
+			rsp, err := http.Get(ts.URL + tt.query)
+			if err != nil {
+				t.Fatalf("want: <nil>, got: %v", err)
+			}
+			defer rsp.Body.Close()
+
+			if rsp.StatusCode != tt.statusCode {
+				t.Fatalf("want: status %d, got: status %d", tt.statusCode, rsp.StatusCode)
+			}
+
+			if tt.statusCode != http.StatusOK {
+				return
+			}
+
+			results := []Result{}
+			if err := json.NewDecoder(rsp.Body).Decode(&results); err != nil {
+				t.Fatal(err)
+			}
+			if want, got := tt.want, len(results); want != got {
+				t.Errorf("want: %d results, got: %d results", want, got)
+			}
+		})
+	}
+}
+
+func TestHandlerScope(t *testing.T) {
+	created := aws.String("2017-11-29T16:00:00.000Z")
+	mc := &mockCache{images: []amicache.Image{
+		amicache.NewImage(&ec2.Image{ImageId: aws.String("ami-1a2b3c4d"), CreationDate: created}, "123456789012", "us-west-2", nil),
+		amicache.NewImage(&ec2.Image{ImageId: aws.String("ami-2a2b3c4d"), CreationDate: created}, "210987654321", "us-west-2", nil),
+	}}
+	a := &API{cache: mc, history: mockHistory{}}
+
+	// Only the images in us-east-1 owned by 123456789012 are in scope.
+	scope := []amicache.Filterer{
+		amicache.FilterByOwnerID("123456789012"),
+		amicache.FilterFunc(func(images []amicache.Image) []amicache.Image {
+			newImages := []amicache.Image{}
+			for _, image := range images {
+				if image.Region == "us-east-1" {
+					newImages = append(newImages, image)
+				}
+			}
+			return newImages
+		}),
+	}
+
+	tests := []struct {
+		name      string
+		query     string
+		scope     []amicache.Filterer
+		want      []string
+		wantCache string
+	}{
+		{"unscoped", "/amis", nil, []string{"ami-1a2b3c4d", "ami-2a2b3c4d"}, "no-cache"},
+		{"owner", "/amis", scope[:1], []string{"ami-1a2b3c4d"}, "no-cache, private"},
+		{"as_of", "/amis?as_of=2020-06-01", scope, []string{"ami-2a2b3c4d"}, ""},
+		{"out_of_scope", "/amis?ami=ami-2a2b3c4d", scope[:1], []string{}, "no-cache, private"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", tt.query, nil)
+			if tt.scope != nil {
+				r = r.WithContext(WithScope(r.Context(), tt.name, tt.scope...))
+			}
+			w := httptest.NewRecorder()
+			a.ServeHTTP(w, r)
+
+			if want, got := http.StatusOK, w.Code; want != got {
+				t.Fatalf("want: status %d, got: status %d", want, got)
+			}
+			if want, got := tt.wantCache, w.Header().Get("Cache-Control"); want != got {
+				t.Errorf("want: %s, got: %s", want, got)
+			}
+
+			results := []Result{}
+			if err := json.NewDecoder(w.Body).Decode(&results); err != nil {
+				t.Fatal(err)
+			}
+			got := []string{}
+			for _, result := range results {
+				got = append(got, result.ID)
+			}
+			if !reflect.DeepEqual(tt.want, got) {
+				t.Errorf("want: %v, got: %v", tt.want, got)
+			}
+		})
+	}
+}
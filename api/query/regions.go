@@ -0,0 +1,179 @@
+// Copyright 2020 Intuit, Inc.  All rights reserved.
+// Use of this source code is governed the MIT license
+// that can be found in the LICENSE file.
+
+package query
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/intuit/ami-query/amicache"
+)
+
+// APIPathRegions is the url path for the regions API.
+const APIPathRegions = "/regions"
+
+// RegionsAPI serves the list of regions being cached.
+type RegionsAPI struct {
+	cache cacher
+}
+
+// Region describes a region being cached and the owners it's cached for.
+type Region struct {
+	Name        string           `json:"region"`
+	OwnerIDs    []string         `json:"owner_ids"`
+	ImageCount  int              `json:"image_count"`
+	Throttles   int              `json:"throttles"`
+	LastUpdated *time.Time       `json:"last_updated,omitempty"`
+	Errors      []PartitionError `json:"errors,omitempty"`
+}
+
+// PartitionError describes the failure to update an owner's images in a
+// region, from EC2 or from the named image source.
+type PartitionError struct {
+	OwnerID string `json:"owner_id,omitempty"`
+	Region  string `json:"region,omitempty"`
+	Source  string `json:"source,omitempty"`
+	Message string `json:"message"`
+}
+
+// NewRegionsAPI returns a usable regions API.
+func NewRegionsAPI(cache *amicache.Cache) *RegionsAPI {
+	return &RegionsAPI{cache: cache}
+}
+
+func (a *RegionsAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	scope, err := newPartitionScope(a.cache, ScopeFromContext(r.Context()))
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+
+	regions := map[string]*Region{}
+	for _, name := range a.cache.Regions() {
+		regions[name] = &Region{Name: name, OwnerIDs: []string{}}
+	}
+
+	for _, owner := range a.cache.Status() {
+		for _, name := range a.cache.OwnerRegions(owner.OwnerID) {
+			region, ok := regions[name]
+			if ok && scope.visible(amicache.Partition{OwnerID: owner.OwnerID, Region: name}) {
+				region.OwnerIDs = append(region.OwnerIDs, owner.OwnerID)
+			}
+		}
+		for _, p := range owner.Partitions {
+			region, ok := regions[p.Region]
+			if !ok || !scope.visible(p.Partition) {
+				continue
+			}
+			if !scope.scoped() {
+				region.ImageCount += p.ImageCount
+			}
+			region.Throttles += p.Throttles
+			region.LastUpdated = latest(region.LastUpdated, p.LastUpdated)
+			if p.Err != nil {
+				region.Errors = append(region.Errors, PartitionError{
+					OwnerID: p.OwnerID,
+					Source:  p.Source,
+					Message: p.Err.Error(),
+				})
+			}
+		}
+	}
+
+	for p, n := range scope.counts {
+		if region, ok := regions[p.Region]; ok {
+			region.ImageCount += n
+		}
+	}
+
+	results := []*Region{}
+	for _, region := range regions {
+		if !scope.scoped() || len(region.OwnerIDs) > 0 {
+			results = append(results, region)
+		}
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Name < results[j].Name
+	})
+
+	writeJSON(w, r, results)
+}
+
+// The partitions and images a request can see, see WithScope.
+type partitionScope struct {
+	matchers []PartitionMatcher
+	counts   map[amicache.Partition]int // Images in the scope, nil if unscoped
+}
+
+// Returns the partitions and number of cached images in the scope.
+func newPartitionScope(cache cacher, filters []amicache.Filterer) (*partitionScope, error) {
+	s := scopePartitions(filters)
+	if len(filters) == 0 {
+		return s, nil
+	}
+
+	filter := amicache.NewFilter(filters...)
+	s.counts = map[amicache.Partition]int{}
+	for _, region := range cache.Regions() {
+		images, err := cache.FilterImages(region, filter)
+		if err != nil {
+			return nil, err
+		}
+		for _, image := range images {
+			s.counts[amicache.Partition{OwnerID: image.OwnerID, Region: image.Region}]++
+		}
+	}
+
+	return s, nil
+}
+
+// Returns the partitions in the scope, without counting their images.
+func scopePartitions(filters []amicache.Filterer) *partitionScope {
+	s := &partitionScope{}
+	for _, f := range filters {
+		if m, ok := f.(PartitionMatcher); ok {
+			s.matchers = append(s.matchers, m)
+		}
+	}
+	return s
+}
+
+// Returns whether the request is scoped.
+func (s *partitionScope) scoped() bool {
+	return s.counts != nil
+}
+
+// Returns whether the partition is in the scope.
+func (s *partitionScope) visible(p amicache.Partition) bool {
+	for _, m := range s.matchers {
+		if !m.MatchPartition(p) {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the later of the two times. A zero t is ignored.
+func latest(cur *time.Time, t time.Time) *time.Time {
+	if t.IsZero() || (cur != nil && cur.After(t)) {
+		return cur
+	}
+	return &t
+}
+
+// Writes v as JSON to the http.ResponseWriter. The output is indented if the
+// pretty query parameter is provided.
+func writeJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	if _, ok := r.URL.Query()["pretty"]; ok {
+		enc.SetIndent("", " ")
+	}
+	enc.Encode(v)
+}
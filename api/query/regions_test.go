@@ -0,0 +1,159 @@
+// Copyright 2020 Intuit, Inc.  All rights reserved.
+// Use of this source code is governed the MIT license
+// that can be found in the LICENSE file.
+
+package query
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/intuit/ami-query/amicache"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// Returns a mockCache with one healthy and one failing owner, whose image
+// source is also failing.
+func newStatusMockCache(updated time.Time) *mockCache {
+	return &mockCache{
+		status: []amicache.OwnerStatus{
+			{
+				OwnerID: "123456789012",
+				Alias:   "foo",
+				Partitions: []amicache.PartitionStatus{{
+					Partition:   amicache.Partition{OwnerID: "123456789012", Region: "us-west-2"},
+					ImageCount:  3,
+					Throttles:   2,
+					LastUpdated: updated,
+				}},
+			},
+			{
+				OwnerID: "123456789013",
+				Partitions: []amicache.PartitionStatus{
+					{
+						Partition: amicache.Partition{OwnerID: "123456789013", Region: "us-west-2"},
+						Err:       errors.New("access denied"),
+					},
+					{
+						Partition: amicache.Partition{OwnerID: "123456789013", Region: "us-west-2"},
+						Source:    "catalog",
+						Err:       errors.New("catalog unavailable"),
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestRegionsHandler(t *testing.T) {
+	updated := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	ts := httptest.NewServer(&RegionsAPI{cache: newStatusMockCache(updated)})
+	defer ts.Close()
+
+	rsp, err := http.Get(ts.URL + APIPathRegions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rsp.Body.Close()
+
+	if want, got := http.StatusOK, rsp.StatusCode; want != got {
+		t.Errorf("want: status %d, got: status %d", want, got)
+	}
+
+	var regions []Region
+	if err := json.NewDecoder(rsp.Body).Decode(&regions); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Region{{
+		Name:        "us-west-2",
+		OwnerIDs:    []string{"123456789012", "123456789013"},
+		ImageCount:  3,
+		Throttles:   2,
+		LastUpdated: &updated,
+		Errors: []PartitionError{
+			{OwnerID: "123456789013", Message: "access denied"},
+			{OwnerID: "123456789013", Source: "catalog", Message: "catalog unavailable"},
+		},
+	}}
+	if !reflect.DeepEqual(want, regions) {
+		t.Errorf("\n\twant: %+v\n\t got: %+v", want, regions)
+	}
+}
+
+func TestRegionsHandlerScope(t *testing.T) {
+	updated := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	mc := newStatusMockCache(updated)
+	mc.images = newScopeImages()
+	a := &RegionsAPI{cache: mc}
+
+	r := httptest.NewRequest("GET", APIPathRegions, nil)
+	r = r.WithContext(WithScope(r.Context(), "test", newTestScope("123456789012", "foo")...))
+	w := httptest.NewRecorder()
+	a.ServeHTTP(w, r)
+
+	var regions []Region
+	if err := json.NewDecoder(w.Body).Decode(&regions); err != nil {
+		t.Fatal(err)
+	}
+
+	// The failing owner isn't in the scope.
+	want := []Region{{
+		Name:        "us-west-2",
+		OwnerIDs:    []string{"123456789012"},
+		ImageCount:  1,
+		Throttles:   2,
+		LastUpdated: &updated,
+	}}
+	if !reflect.DeepEqual(want, regions) {
+		t.Errorf("\n\twant: %+v\n\t got: %+v", want, regions)
+	}
+
+	// Regions without owners in the scope aren't listed.
+	r = r.WithContext(WithScope(r.Context(), "none", newTestScope("210987654321", "foo")...))
+	w = httptest.NewRecorder()
+	a.ServeHTTP(w, r)
+
+	if want, got := "[]\n", w.Body.String(); want != got {
+		t.Errorf("want: %q, got: %q", want, got)
+	}
+}
+
+// Returns the images of the healthy owner of newStatusMockCache, one of which
+// is tagged team=foo.
+func newScopeImages() []amicache.Image {
+	return []amicache.Image{
+		amicache.NewImage(&ec2.Image{
+			ImageId: aws.String("ami-1a2b3c4d"),
+			Tags:    []*ec2.Tag{{Key: aws.String("team"), Value: aws.String("foo")}},
+		}, "123456789012", "us-west-2", nil),
+		amicache.NewImage(&ec2.Image{ImageId: aws.String("ami-2a2b3c4d")}, "123456789012", "us-west-2", nil),
+		amicache.NewImage(&ec2.Image{ImageId: aws.String("ami-3a2b3c4d")}, "123456789012", "us-west-2", nil),
+	}
+}
+
+// A scope filter of the images and partitions of an owner.
+type ownerScope string
+
+func (s ownerScope) Filter(images []amicache.Image) []amicache.Image {
+	return amicache.FilterByOwnerID(string(s))(images)
+}
+
+func (s ownerScope) MatchPartition(p amicache.Partition) bool {
+	return p.OwnerID == string(s)
+}
+
+// Returns the scope of an owner's images tagged with the team.
+func newTestScope(ownerID, team string) []amicache.Filterer {
+	return []amicache.Filterer{
+		ownerScope(ownerID),
+		amicache.FilterByTags(map[string][]string{"team": {team}}),
+	}
+}
@@ -0,0 +1,255 @@
+// Copyright 2020 Intuit, Inc.  All rights reserved.
+// Use of this source code is governed the MIT license
+// that can be found in the LICENSE file.
+
+package query
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/intuit/ami-query/amicache"
+)
+
+// APIPathQueryV2 is the url path for version 2 of the query API.
+const APIPathQueryV2 = "/v2/amis"
+
+// The media types of the query API versions.
+const (
+	MediaTypeV1 = "application/vnd.ami-query-v1+json"
+	MediaTypeV2 = "application/vnd.ami-query-v2+json"
+)
+
+// The default and maximum number of images in a page of results.
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+// The codes of the warnings included in a v2 response.
+const (
+	WarningStalePartition = "stale_partition"
+	WarningResultsChanged = "results_changed"
+)
+
+// APIV2 serves version 2 of the query API, which wraps the results in an
+// Envelope.
+type APIV2 struct {
+	api *API
+}
+
+// Envelope contains a page of the matching AMIs for a query and metadata
+// about the cache they were read from.
+type Envelope struct {
+	Items           []Result  `json:"items"`
+	Count           int       `json:"count"`
+	CacheGeneration uint64    `json:"cache_generation"`
+	CacheAge        int64     `json:"cache_age"` // Seconds since the oldest queried partition was updated
+	Warnings        []Warning `json:"warnings"`
+	NextCursor      string    `json:"next_cursor,omitempty"`
+}
+
+// Warning describes a condition that may make the results incomplete or out
+// of date.
+type Warning struct {
+	Code    string `json:"code"`
+	OwnerID string `json:"owner_id,omitempty"`
+	Region  string `json:"region,omitempty"`
+	Message string `json:"message"`
+}
+
+// The position of the next page of results. The generation is used to warn
+// clients when the results changed while they were paging through them.
+type cursor struct {
+	Generation uint64 `json:"g"`
+	Offset     int    `json:"o"`
+}
+
+// NewAPIV2 returns a usable v2 query API.
+func NewAPIV2(cache *amicache.Cache, options ...Option) *APIV2 {
+	a := &APIV2{api: NewAPI(cache, options...)}
+	a.api.mediaType = MediaTypeV2
+	return a
+}
+
+func (a *APIV2) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	values, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		WriteError(w, r, NewError(http.StatusBadRequest, CodeBadRequest, "", "%v", err))
+		return
+	}
+
+	// The pagination parameters are only supported by v2, so they're removed
+	// before the rest of the query is decoded.
+	limit := defaultPageSize
+	if value := values.Get("limit"); value != "" {
+		if limit, err = strconv.Atoi(value); err != nil || limit < 1 || limit > maxPageSize {
+			WriteError(w, r, NewError(http.StatusBadRequest, CodeInvalidValue, "limit", "invalid limit value: %s", value))
+			return
+		}
+	}
+
+	var start cursor
+	if value := values.Get("cursor"); value != "" {
+		if start, err = decodeCursor(value); err != nil {
+			WriteError(w, r, NewError(http.StatusBadRequest, CodeInvalidValue, "cursor", "invalid cursor value: %s", value))
+			return
+		}
+	}
+
+	values.Del("limit")
+	values.Del("cursor")
+
+	p := &Params{}
+	if err := p.Decode(a.api.cache.StateTag(), &url.URL{RawQuery: values.Encode()}); err != nil {
+		WriteError(w, r, err)
+		return
+	}
+
+	if p.format != "" && p.format != formatJSON {
+		WriteError(w, r, NewError(http.StatusBadRequest, CodeInvalidValue, "format", "format %s is unsupported by the v2 API", p.format))
+		return
+	}
+	if len(p.columns) > 0 {
+		WriteError(w, r, NewError(http.StatusBadRequest, CodeInvalidValue, "columns", "columns is only supported by the csv format"))
+		return
+	}
+
+	images, generation, ok := a.api.query(w, r, p)
+	if !ok {
+		return
+	}
+
+	if p.first && len(images) > 1 {
+		images = images[:1]
+	}
+
+	env := Envelope{
+		Items:           []Result{},
+		CacheGeneration: generation,
+		CacheAge:        a.cacheAge(p),
+		Warnings:        a.staleWarnings(p),
+	}
+
+	if start.Generation != 0 && start.Generation != generation {
+		env.Warnings = append(env.Warnings, Warning{
+			Code:    WarningResultsChanged,
+			Message: "the cached AMIs changed since the first page, results may be missing or repeated",
+		})
+	}
+
+	if start.Offset < len(images) {
+		images = images[start.Offset:]
+	} else {
+		images = nil
+	}
+	if len(images) > limit {
+		images = images[:limit]
+		env.NextCursor = encodeCursor(cursor{Generation: generation, Offset: start.Offset + limit})
+	}
+
+	for _, image := range images {
+		env.Items = append(env.Items, newResult(image))
+	}
+	env.Count = len(env.Items)
+
+	encodeJSON(w, p, MediaTypeV2+"; charset=utf-8", env)
+}
+
+// Returns the number of seconds since the oldest queried partition in the
+// request's scope was last updated successfully.
+func (a *APIV2) cacheAge(p *Params) int64 {
+	var (
+		oldest time.Time
+		scope  = scopePartitions(p.scope)
+	)
+	for _, status := range a.api.cache.Status() {
+		if p.ownerID != "" && p.ownerID != status.OwnerID {
+			continue
+		}
+		for _, partition := range status.Partitions {
+			if !queried(p, partition.Region) || !scope.visible(partition.Partition) || partition.LastUpdated.IsZero() {
+				continue
+			}
+			if oldest.IsZero() || partition.LastUpdated.Before(oldest) {
+				oldest = partition.LastUpdated
+			}
+		}
+	}
+	if oldest.IsZero() {
+		return 0
+	}
+	return int64(time.Since(oldest) / time.Second)
+}
+
+// Returns a warning for every queried partition in the request's scope whose
+// last update failed. The cached images of the partition are kept from its
+// last successful update, so they may be out of date, and there are none if
+// it was never updated.
+func (a *APIV2) staleWarnings(p *Params) []Warning {
+	var (
+		warnings = []Warning{}
+		scope    = scopePartitions(p.scope)
+	)
+	for _, status := range a.api.cache.Status() {
+		if p.ownerID != "" && p.ownerID != status.OwnerID {
+			continue
+		}
+		for _, partition := range status.Partitions {
+			if partition.Err == nil || !queried(p, partition.Region) || !scope.visible(partition.Partition) {
+				continue
+			}
+			message := fmt.Sprintf("update failed, no AMIs have been cached: %v", partition.Err)
+			if !partition.LastUpdated.IsZero() {
+				message = fmt.Sprintf("update failed, the cached AMIs are from %s: %v", partition.LastUpdated.UTC().Format(time.RFC3339), partition.Err)
+			}
+			warnings = append(warnings, Warning{
+				Code:    WarningStalePartition,
+				OwnerID: partition.OwnerID,
+				Region:  partition.Region,
+				Message: message,
+			})
+		}
+	}
+	return warnings
+}
+
+// Returns true if the region is searched by the query.
+func queried(p *Params, region string) bool {
+	if len(p.regions) == 0 {
+		return true
+	}
+	for _, r := range p.regions {
+		if r == region {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the opaque string form of a cursor.
+func encodeCursor(c cursor) string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// Parses a cursor returned by encodeCursor.
+func decodeCursor(value string) (cursor, error) {
+	var c cursor
+	b, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return c, err
+	}
+	if err := json.Unmarshal(b, &c); err != nil {
+		return c, err
+	}
+	if c.Offset < 0 {
+		return c, strconv.ErrRange
+	}
+	return c, nil
+}
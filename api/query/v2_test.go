@@ -0,0 +1,360 @@
+// Copyright 2020 Intuit, Inc.  All rights reserved.
+// Use of this source code is governed the MIT license
+// that can be found in the LICENSE file.
+
+package query
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/intuit/ami-query/amicache"
+	"github.com/intuit/ami-query/awstest"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// Returns n available images created a day apart, newest first.
+func newV2Images(n int) []amicache.Image {
+	images := []amicache.Image{}
+	for i := 0; i < n; i++ {
+		images = append(images, amicache.NewImage(&ec2.Image{
+			ImageId:      aws.String(fmt.Sprintf("ami-%d", i)),
+			CreationDate: aws.String(time.Date(2020, 6, 30-i, 0, 0, 0, 0, time.UTC).Format("2006-01-02T15:04:05.000Z")),
+			Tags: []*ec2.Tag{{
+				Key:   aws.String(amicache.DefaultStateTag),
+				Value: aws.String("available"),
+			}},
+		}, "123456789012", "us-west-2", nil))
+	}
+	return images
+}
+
+func getEnvelope(t *testing.T, url string) Envelope {
+	t.Helper()
+	rsp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("want: <nil>, got: %v", err)
+	}
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode != http.StatusOK {
+		t.Fatalf("want: status %d, got: status %d", http.StatusOK, rsp.StatusCode)
+	}
+	if want, got := MediaTypeV2+"; charset=utf-8", rsp.Header.Get("Content-Type"); want != got {
+		t.Errorf("want: %s, got: %s", want, got)
+	}
+
+	var env Envelope
+	if err := json.NewDecoder(rsp.Body).Decode(&env); err != nil {
+		t.Fatal(err)
+	}
+	return env
+}
+
+func TestHandlerV2(t *testing.T) {
+	lastUpdated := time.Now().Add(-time.Hour)
+	mc := &mockCache{
+		generation: 42,
+		images:     newV2Images(3),
+		status: []amicache.OwnerStatus{{
+			OwnerID: "123456789012",
+			Partitions: []amicache.PartitionStatus{
+				{
+					Partition:   amicache.Partition{OwnerID: "123456789012", Region: "us-west-2"},
+					LastUpdated: lastUpdated,
+					Err:         errors.New("throttled"),
+				},
+				{
+					Partition:   amicache.Partition{OwnerID: "123456789012", Region: "us-east-1"},
+					LastUpdated: time.Now().Add(-2 * time.Hour),
+					Err:         errors.New("access denied"),
+				},
+			},
+		}},
+	}
+
+	ts := httptest.NewServer(&APIV2{api: &API{cache: mc, mediaType: MediaTypeV2}})
+	defer ts.Close()
+
+	env := getEnvelope(t, ts.URL+APIPathQueryV2+"?region=us-west-2")
+
+	if want, got := 3, env.Count; want != got {
+		t.Errorf("want: %d, got: %d", want, got)
+	}
+	if want, got := uint64(42), env.CacheGeneration; want != got {
+		t.Errorf("want: %d, got: %d", want, got)
+	}
+	if env.CacheAge < 3600 || env.CacheAge > 3610 {
+		t.Errorf("want: 3600s, got: %ds", env.CacheAge)
+	}
+	if want, got := "", env.NextCursor; want != got {
+		t.Errorf("want: %q, got: %q", want, got)
+	}
+
+	// Only the queried partitions are included in the warnings.
+	want := Warning{
+		Code:    WarningStalePartition,
+		OwnerID: "123456789012",
+		Region:  "us-west-2",
+		Message: "update failed, the cached AMIs are from " + lastUpdated.UTC().Format(time.RFC3339) + ": throttled",
+	}
+	if len(env.Warnings) != 1 || env.Warnings[0] != want {
+		t.Errorf("want: %+v, got: %+v", want, env.Warnings)
+	}
+}
+
+func TestHandlerV2Scope(t *testing.T) {
+	mc := &mockCache{
+		images: newV2Images(1),
+		status: []amicache.OwnerStatus{
+			{
+				OwnerID: "123456789012",
+				Partitions: []amicache.PartitionStatus{{
+					Partition:   amicache.Partition{OwnerID: "123456789012", Region: "us-west-2"},
+					LastUpdated: time.Now().Add(-time.Hour),
+				}},
+			},
+			{
+				OwnerID: "210987654321",
+				Partitions: []amicache.PartitionStatus{{
+					Partition:   amicache.Partition{OwnerID: "210987654321", Region: "us-west-2"},
+					LastUpdated: time.Now().Add(-3 * time.Hour),
+					Err:         errors.New("access denied"),
+				}},
+			},
+		},
+	}
+	a := &APIV2{api: &API{cache: mc, mediaType: MediaTypeV2}}
+
+	tests := []struct {
+		name         string
+		scope        []amicache.Filterer
+		wantAge      int64
+		wantWarnings int
+	}{
+		{"unscoped", nil, 3 * 3600, 1},
+		// The other owner's partition is neither warned about nor used for
+		// the age of the cache.
+		{"scoped", []amicache.Filterer{ownerScope("123456789012")}, 3600, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", APIPathQueryV2, nil)
+			if tt.scope != nil {
+				r = r.WithContext(WithScope(r.Context(), tt.name, tt.scope...))
+			}
+			w := httptest.NewRecorder()
+			a.ServeHTTP(w, r)
+
+			var env Envelope
+			if err := json.NewDecoder(w.Body).Decode(&env); err != nil {
+				t.Fatal(err)
+			}
+			if env.CacheAge < tt.wantAge || env.CacheAge > tt.wantAge+10 {
+				t.Errorf("want: %ds, got: %ds", tt.wantAge, env.CacheAge)
+			}
+			if want, got := tt.wantWarnings, len(env.Warnings); want != got {
+				t.Errorf("want: %d warnings, got: %+v", want, env.Warnings)
+			}
+		})
+	}
+}
+
+// The images of a partition that fails to update are still returned, with a
+// warning, when the cache is updated from EC2.
+func TestHandlerV2FailedPartition(t *testing.T) {
+	srv := awstest.NewServer()
+	defer srv.Close()
+
+	srv.AddImage("us-west-2", awstest.Image{ID: "ami-1", OwnerID: "123456789012", CreationDate: "2020-06-01T00:00:00.000Z"})
+	srv.AddImage("us-east-1", awstest.Image{ID: "ami-2", OwnerID: "123456789012", CreationDate: "2020-06-02T00:00:00.000Z"})
+
+	sess, err := session.NewSession(aws.NewConfig().
+		WithHTTPClient(srv.Client()).
+		WithRegion("us-east-1").
+		WithCredentials(credentials.NewStaticCredentials("id", "secret", "")),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cache := amicache.New(sts.New(sess), "ami-query", []string{"123456789012"},
+		amicache.Regions("us-west-2", "us-east-1"),
+		amicache.HTTPClient(srv.Client()),
+		amicache.RefreshCooldown(0),
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	warmed := make(chan struct{})
+	go cache.Run(ctx, warmed)
+	<-warmed
+
+	// us-east-1 fails to update.
+	srv.DisableRegion("us-east-1", true)
+	id, err := cache.Refresh(amicache.RefreshScope{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if status, _ := cache.RefreshStatus(id); status.State == amicache.RefreshCompleted {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("refresh didn't complete")
+		}
+	}
+
+	ts := httptest.NewServer(NewAPIV2(cache))
+	defer ts.Close()
+
+	env := getEnvelope(t, ts.URL+APIPathQueryV2)
+
+	got := []string{}
+	for _, item := range env.Items {
+		got = append(got, item.ID)
+	}
+	if want := []string{"ami-2", "ami-1"}; !reflect.DeepEqual(want, got) {
+		t.Errorf("want: %v, got: %v", want, got)
+	}
+
+	if len(env.Warnings) != 1 {
+		t.Fatalf("want: 1 warning, got: %+v", env.Warnings)
+	}
+	if w := env.Warnings[0]; w.Code != WarningStalePartition || w.Region != "us-east-1" ||
+		!strings.HasPrefix(w.Message, "update failed, the cached AMIs are from ") {
+		t.Errorf("want: stale_partition warning for us-east-1, got: %+v", w)
+	}
+}
+
+func TestHandlerV2Pagination(t *testing.T) {
+	mc := &mockCache{generation: 1, images: newV2Images(5)}
+
+	ts := httptest.NewServer(&APIV2{api: &API{cache: mc, mediaType: MediaTypeV2}})
+	defer ts.Close()
+
+	var (
+		got   = []string{}
+		pages = 0
+		query = url.Values{"limit": {"2"}}
+	)
+
+	for {
+		env := getEnvelope(t, ts.URL+APIPathQueryV2+"?"+query.Encode())
+		pages++
+		for _, item := range env.Items {
+			got = append(got, item.ID)
+		}
+		if len(env.Warnings) != 0 {
+			t.Errorf("want: no warnings, got: %+v", env.Warnings)
+		}
+		if env.NextCursor == "" {
+			break
+		}
+		query.Set("cursor", env.NextCursor)
+	}
+
+	if want := 3; want != pages {
+		t.Errorf("want: %d pages, got: %d pages", want, pages)
+	}
+
+	want := []string{"ami-0", "ami-1", "ami-2", "ami-3", "ami-4"}
+	if fmt.Sprint(want) != fmt.Sprint(got) {
+		t.Errorf("want: %v, got: %v", want, got)
+	}
+
+	// Clients are warned when the results change between pages.
+	env := getEnvelope(t, ts.URL+APIPathQueryV2+"?limit=2")
+	mc.generation++
+	env = getEnvelope(t, ts.URL+APIPathQueryV2+"?limit=2&cursor="+env.NextCursor)
+	if len(env.Warnings) != 1 || env.Warnings[0].Code != WarningResultsChanged {
+		t.Errorf("want: %s warning, got: %+v", WarningResultsChanged, env.Warnings)
+	}
+}
+
+func TestHandlerV2Errors(t *testing.T) {
+	tests := []struct {
+		name      string
+		query     string
+		code      ErrorCode
+		parameter string
+	}{
+		{"bad_limit", "?limit=foo", CodeInvalidValue, "limit"},
+		{"zero_limit", "?limit=0", CodeInvalidValue, "limit"},
+		{"large_limit", "?limit=1001", CodeInvalidValue, "limit"},
+		{"bad_cursor", "?cursor=foo", CodeInvalidValue, "cursor"},
+		{"negative_cursor", "?cursor=" + encodeCursor(cursor{Offset: -1}), CodeInvalidValue, "cursor"},
+		{"unknown_key", "?foo=bar", CodeUnknownKey, "foo"},
+		{"csv_format", "?format=csv", CodeInvalidValue, "format"},
+		{"yaml_format", "?format=yaml", CodeInvalidValue, "format"},
+	}
+
+	ts := httptest.NewServer(&APIV2{api: &API{cache: &mockCache{}, mediaType: MediaTypeV2}})
+	defer ts.Close()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rsp, err := http.Get(ts.URL + APIPathQueryV2 + tt.query)
+			if err != nil {
+				t.Fatalf("want: <nil>, got: %v", err)
+			}
+			defer rsp.Body.Close()
+
+			if rsp.StatusCode != http.StatusBadRequest {
+				t.Errorf("want: status %d, got: status %d", http.StatusBadRequest, rsp.StatusCode)
+			}
+
+			var got Error
+			if err := json.NewDecoder(rsp.Body).Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+			if tt.code != got.Code || tt.parameter != got.Parameter {
+				t.Errorf("want: %s %q, got: %s %q", tt.code, tt.parameter, got.Code, got.Parameter)
+			}
+		})
+	}
+}
+
+// The v1 response must not change for existing clients.
+func TestHandlerV1Compatibility(t *testing.T) {
+	ts := httptest.NewServer(&API{cache: &mockCache{}, mediaType: MediaTypeV1})
+	defer ts.Close()
+
+	rsp, err := http.Get(ts.URL + APIPathQuery)
+	if err != nil {
+		t.Fatalf("want: <nil>, got: %v", err)
+	}
+	defer rsp.Body.Close()
+
+	body, err := ioutil.ReadAll(rsp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `[{"id":"ami-1a2b3c4d","owner_id":"123456789012","region":"us-west-2","name":"test-ami-1",` +
+		`"description":"Test AMI 1","virtualizationtype":"hvm","creationdate":"2017-11-29T16:00:00.000Z",` +
+		`"tags":{"state":"available"}}]` + "\n"
+	if got := string(body); want != got {
+		t.Errorf("\n\twant: %s\n\t got: %s", want, got)
+	}
+	if want, got := "application/json; charset=utf-8", rsp.Header.Get("Content-Type"); want != got {
+		t.Errorf("want: %s, got: %s", want, got)
+	}
+}
@@ -0,0 +1,215 @@
+// Copyright 2020 Intuit, Inc.  All rights reserved.
+// Use of this source code is governed the MIT license
+// that can be found in the LICENSE file.
+
+// Package ratelimit limits the rate of requests clients make to the query API.
+//
+//	limiter := ratelimit.New(ratelimit.Limit{Rate: 10, Burst: 20})
+//	handler = limiter.Wrap(handler)
+package ratelimit
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/intuit/ami-query/api/auth"
+	"github.com/intuit/ami-query/api/query"
+)
+
+// The interval between removals of the clients whose buckets are full.
+const sweepInterval = time.Minute
+
+// Limit is the rate of requests a client can make. A rate of zero or less
+// doesn't limit the requests.
+type Limit struct {
+	Rate  float64 `json:"rate"`  // Sustained requests per second
+	Burst int     `json:"burst"` // Requests allowed to exceed the rate
+}
+
+// Option configures a Limiter.
+type Option interface {
+	set(*Limiter)
+}
+
+// optionFunc is a function adapter that implements the Option interface.
+type optionFunc func(*Limiter)
+
+func (fn optionFunc) set(l *Limiter) { fn(l) }
+
+// Quotas sets the limits of principals by name, which are used instead of the
+// default limit.
+func Quotas(quotas map[string]Limit) Option {
+	return optionFunc(func(l *Limiter) {
+		for name, limit := range quotas {
+			l.quotas[name] = limit
+		}
+	})
+}
+
+// Limiter limits the rate of requests of each client with a token bucket.
+type Limiter struct {
+	limit  Limit
+	quotas map[string]Limit // by principal name
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket // by client
+	allowed   uint64
+	rejected  uint64
+	lastSweep time.Time
+
+	// Used to mock the time in tests.
+	now func() time.Time
+}
+
+// bucket holds the tokens of a client.
+type bucket struct {
+	limit    Limit
+	tokens   float64
+	last     time.Time
+	rejected uint64
+}
+
+// Stats are the numbers of requests allowed and rejected by a Limiter since
+// it was created.
+type Stats struct {
+	Allowed  uint64        `json:"allowed"`
+	Rejected uint64        `json:"rejected"`
+	Clients  []ClientStats `json:"clients"`
+}
+
+// ClientStats is the number of requests rejected for a client. Clients are
+// forgotten once they stop exceeding their limit.
+type ClientStats struct {
+	Client   string `json:"client"`
+	Rejected uint64 `json:"rejected"`
+}
+
+// New returns a Limiter with the default limit of clients.
+func New(limit Limit, options ...Option) *Limiter {
+	l := &Limiter{
+		limit:   limit,
+		quotas:  map[string]Limit{},
+		buckets: map[string]*bucket{},
+		now:     time.Now,
+	}
+	for _, opt := range options {
+		opt.set(l)
+	}
+	return l
+}
+
+// Wrap returns a handler that calls h for requests within their client's
+// limit, and writes a rate limited error with a Retry-After header otherwise.
+// Clients are identified by the principal of authenticated requests, so h must
+// be wrapped by an auth.Middleware if there is one, and by their IP address
+// otherwise.
+func (l *Limiter) Wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client, limit := l.client(r)
+		if retryAfter, ok := l.allow(client, limit); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			query.WriteError(w, r, query.NewError(http.StatusTooManyRequests, query.CodeRateLimited, "", "rate limit of %g requests per second exceeded", limit.Rate))
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// Returns the client of a request and its limit.
+func (l *Limiter) client(r *http.Request) (string, Limit) {
+	if principal := auth.FromContext(r.Context()); principal != nil {
+		if limit, ok := l.quotas[principal.Name]; ok {
+			return "principal:" + principal.Name, limit
+		}
+		return "principal:" + principal.Name, l.limit
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host, l.limit
+}
+
+// Takes a token from the client's bucket. It returns false and the time until
+// the next token is added if there are none.
+func (l *Limiter) allow(client string, limit Limit) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+
+	if limit.Rate <= 0 {
+		l.allowed++
+		return 0, true
+	}
+
+	b, ok := l.buckets[client]
+	if !ok || b.limit != limit {
+		b = &bucket{limit: limit, tokens: burst(limit), last: now}
+		l.buckets[client] = b
+	}
+
+	b.tokens = math.Min(burst(limit), b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		l.allowed++
+		return 0, true
+	}
+
+	b.rejected++
+	l.rejected++
+	return time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second)), false
+}
+
+// Removes the buckets that are full, since they're the same as new ones, so
+// the clients that were seen once aren't kept. It's done at most once per
+// sweepInterval.
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < sweepInterval {
+		return
+	}
+	l.lastSweep = now
+
+	for client, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*b.limit.Rate >= burst(b.limit) {
+			delete(l.buckets, client)
+		}
+	}
+}
+
+// Stats returns the numbers of allowed and rejected requests, and of the
+// rejected requests of each client, most rejected first.
+func (l *Limiter) Stats() Stats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	stats := Stats{Allowed: l.allowed, Rejected: l.rejected, Clients: []ClientStats{}}
+	for client, b := range l.buckets {
+		if b.rejected > 0 {
+			stats.Clients = append(stats.Clients, ClientStats{Client: client, Rejected: b.rejected})
+		}
+	}
+	sort.Slice(stats.Clients, func(i, j int) bool {
+		if stats.Clients[i].Rejected != stats.Clients[j].Rejected {
+			return stats.Clients[i].Rejected > stats.Clients[j].Rejected
+		}
+		return stats.Clients[i].Client < stats.Clients[j].Client
+	})
+	return stats
+}
+
+// Returns the maximum number of tokens of a bucket, which is at least one.
+func burst(limit Limit) float64 {
+	if limit.Burst < 1 {
+		return 1
+	}
+	return float64(limit.Burst)
+}
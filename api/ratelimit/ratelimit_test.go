@@ -0,0 +1,114 @@
+// Copyright 2020 Intuit, Inc.  All rights reserved.
+// Use of this source code is governed the MIT license
+// that can be found in the LICENSE file.
+
+package ratelimit
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/intuit/ami-query/api/auth"
+	"github.com/intuit/ami-query/api/query"
+)
+
+func TestLimiter(t *testing.T) {
+	l := New(Limit{Rate: 1, Burst: 2}, Quotas(map[string]Limit{
+		"ci":     {Rate: 10, Burst: 3},
+		"deploy": {Rate: 0},
+	}))
+
+	now := time.Unix(1600000000, 0)
+	l.now = func() time.Time { return now }
+
+	h := l.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	// Returns the response to a request from the address, authenticated as
+	// the principal if it isn't empty.
+	get := func(addr, principal string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/amis", nil)
+		r.RemoteAddr = addr
+		if principal != "" {
+			r = r.WithContext(auth.NewContext(r.Context(), &auth.Principal{Name: principal, Method: auth.MethodAPIKey}))
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	tests := []struct {
+		name       string
+		addr       string
+		principal  string
+		advance    time.Duration
+		statusCode int
+		retryAfter string
+	}{
+		{"ip_burst_1", "10.0.0.1:1234", "", 0, http.StatusOK, ""},
+		{"ip_burst_2", "10.0.0.1:1235", "", 0, http.StatusOK, ""},
+		{"ip_limited", "10.0.0.1:1236", "", 0, http.StatusTooManyRequests, "1"},
+		{"other_ip", "10.0.0.2:1234", "", 0, http.StatusOK, ""},
+		{"ip_refilled", "10.0.0.1:1234", "", time.Second, http.StatusOK, ""},
+		{"ip_limited_again", "10.0.0.1:1234", "", 0, http.StatusTooManyRequests, "1"},
+		{"principal_default", "10.0.0.1:1234", "team", 0, http.StatusOK, ""},
+		{"quota_1", "10.0.0.1:1234", "ci", 0, http.StatusOK, ""},
+		{"quota_2", "10.0.0.2:1234", "ci", 0, http.StatusOK, ""},
+		{"quota_3", "10.0.0.3:1234", "ci", 0, http.StatusOK, ""},
+		{"quota_limited", "10.0.0.1:1234", "ci", 0, http.StatusTooManyRequests, "1"},
+		{"quota_refilled", "10.0.0.1:1234", "ci", 100 * time.Millisecond, http.StatusOK, ""},
+		{"unlimited_1", "10.0.0.1:1234", "deploy", 0, http.StatusOK, ""},
+		{"unlimited_2", "10.0.0.1:1234", "deploy", 0, http.StatusOK, ""},
+		{"unlimited_3", "10.0.0.1:1234", "deploy", 0, http.StatusOK, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now = now.Add(tt.advance)
+			w := get(tt.addr, tt.principal)
+			if want, got := tt.statusCode, w.Code; want != got {
+				t.Fatalf("want: status %d, got: status %d", want, got)
+			}
+			if want, got := tt.retryAfter, w.Header().Get("Retry-After"); want != got {
+				t.Errorf("want: Retry-After %s, got: Retry-After %s", want, got)
+			}
+			if tt.statusCode != http.StatusTooManyRequests {
+				return
+			}
+			apiErr := query.Error{}
+			if err := json.NewDecoder(w.Body).Decode(&apiErr); err != nil {
+				t.Fatal(err)
+			}
+			if want, got := query.CodeRateLimited, apiErr.Code; want != got {
+				t.Errorf("want: %s, got: %s", want, got)
+			}
+		})
+	}
+
+	want := Stats{
+		Allowed:  12,
+		Rejected: 3,
+		Clients: []ClientStats{
+			{Client: "ip:10.0.0.1", Rejected: 2},
+			{Client: "principal:ci", Rejected: 1},
+		},
+	}
+	if got := l.Stats(); !reflect.DeepEqual(want, got) {
+		t.Errorf("want: %+v, got: %+v", want, got)
+	}
+
+	// The clients are forgotten once their buckets are full again, but the
+	// totals are kept.
+	now = now.Add(sweepInterval)
+	get("10.0.0.3:1234", "")
+	want = Stats{Allowed: 13, Rejected: 3, Clients: []ClientStats{}}
+	if got := l.Stats(); !reflect.DeepEqual(want, got) {
+		t.Errorf("want: %+v, got: %+v", want, got)
+	}
+	if want, got := 1, len(l.buckets); want != got {
+		t.Errorf("want: %d buckets, got: %d buckets", want, got)
+	}
+}
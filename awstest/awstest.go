@@ -0,0 +1,687 @@
+// Copyright 2020 Intuit, Inc.  All rights reserved.
+// Use of this source code is governed the MIT license
+// that can be found in the LICENSE file.
+
+// Package awstest provides a local stand-in for the EC2, STS and SQS APIs used
+// by ami-query, for integration tests that exercise the AWS SDK's HTTP, retry
+// and throttling behavior.
+//
+// The Server speaks enough of the EC2, STS and SQS Query protocols to answer
+// the DescribeImages, DescribeImageAttribute, DescribeRegions, AssumeRole,
+// ReceiveMessage and DeleteMessage actions, and it has a single SQS queue
+// whose URL can have any path. The region and service of a request are read
+// from its signature, so every AWS endpoint can be routed to the Server with
+// the HTTP client returned by its Client method.
+package awstest
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The actions answered by the Server.
+const (
+	ActionAssumeRole             = "AssumeRole"
+	ActionDescribeImages         = "DescribeImages"
+	ActionDescribeImageAttribute = "DescribeImageAttribute"
+	ActionDescribeRegions        = "DescribeRegions"
+	ActionReceiveMessage         = "ReceiveMessage"
+	ActionDeleteMessage          = "DeleteMessage"
+)
+
+// Image is an AMI served by the Server.
+type Image struct {
+	ID                 string
+	OwnerID            string
+	Name               string
+	Description        string
+	VirtualizationType string
+	CreationDate       string
+	State              string // The default is "available"
+	Tags               map[string]string
+	LaunchPermissions  []string
+}
+
+// A message in the Server's SQS queue. It's in flight, and isn't received
+// again, until visible.
+type message struct {
+	id      string
+	body    string
+	receipt string // The receipt handle of the last receive
+	visible time.Time
+}
+
+// Server is a stand-in for the EC2, STS and SQS APIs. It's safe for
+// concurrent use.
+type Server struct {
+	// URL is the base URL of the Server, which can be used as the endpoint of
+	// any service.
+	URL string
+
+	srv        *httptest.Server
+	mu         sync.Mutex
+	images     map[string][]Image // Indexed by region
+	denied     map[string]bool    // Accounts whose role can't be assumed
+	disabled   map[string]bool    // Regions whose EC2 requests fail
+	throttles  map[string]int     // Number of requests to throttle by action
+	latency    time.Duration
+	calls      map[string]int // Number of requests by action
+	requestID  int
+	messages   []*message    // The SQS queue, oldest first
+	visibility time.Duration // The visibility timeout of received messages
+	messageID  int
+}
+
+// NewServer starts and returns a Server. It serves HTTPS with a self-signed
+// certificate, so it must be used with the client returned by Client, or
+// with TLS verification disabled.
+func NewServer() *Server {
+	s := &Server{
+		images:     map[string][]Image{},
+		denied:     map[string]bool{},
+		disabled:   map[string]bool{},
+		throttles:  map[string]int{},
+		calls:      map[string]int{},
+		visibility: 30 * time.Second,
+	}
+	s.srv = httptest.NewTLSServer(http.HandlerFunc(s.serveHTTP))
+	s.URL = s.srv.URL
+	return s
+}
+
+// Close shuts down the Server.
+func (s *Server) Close() {
+	s.srv.Close()
+}
+
+// Client returns an HTTP client that sends every request to the Server,
+// whatever its URL, so it can be used with the default AWS endpoints.
+func (s *Server) Client() *http.Client {
+	addr := s.srv.Listener.Addr().String()
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, network, addr)
+			},
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+}
+
+// AddImage adds an image to a region.
+func (s *Server) AddImage(region string, image Image) {
+	if image.State == "" {
+		image.State = "available"
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.images[region] = append(s.images[region], image)
+}
+
+// DenyRole makes the roles of the account fail to be assumed.
+func (s *Server) DenyRole(account string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.denied[account] = true
+}
+
+// DisableRegion makes the EC2 requests in the region fail with an
+// authorization error, or succeed again if disabled is false.
+func (s *Server) DisableRegion(region string, disabled bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.disabled[region] = disabled
+}
+
+// SendMessage adds a message with the body to the SQS queue.
+func (s *Server) SendMessage(body string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.messageID++
+	s.messages = append(s.messages, &message{id: strconv.Itoa(s.messageID), body: body})
+}
+
+// SetVisibilityTimeout sets the time received messages are hidden from other
+// receives until they're deleted. The default is 30 seconds.
+func (s *Server) SetVisibilityTimeout(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.visibility = d
+}
+
+// Messages returns the number of messages in the SQS queue, including the
+// messages in flight.
+func (s *Server) Messages() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.messages)
+}
+
+// Throttle makes the next n requests of the action fail with a throttling
+// error.
+func (s *Server) Throttle(action string, n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.throttles[action] = n
+}
+
+// SetLatency delays every response by d.
+func (s *Server) SetLatency(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latency = d
+}
+
+// Calls returns the number of requests made for the action, including the
+// throttled requests.
+func (s *Server) Calls(action string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls[action]
+}
+
+// The credential scope of a request's signature, e.g.
+// Credential=AKID/20200601/us-west-2/ec2/aws4_request.
+var credentialScope = regexp.MustCompile(`Credential=([^/]+)/[^/]+/([^/]+)/([^/]+)/`)
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var region, service string
+	if m := credentialScope.FindStringSubmatch(r.Header.Get("Authorization")); m != nil {
+		region, service = m[2], m[3]
+	}
+	action := r.Form.Get("Action")
+
+	s.mu.Lock()
+	s.calls[action]++
+	s.requestID++
+	var (
+		latency   = s.latency
+		requestID = strconv.Itoa(s.requestID)
+		throttled = s.throttles[action] > 0
+		disabled  = s.disabled[region]
+	)
+	if throttled {
+		s.throttles[action]--
+	}
+	s.mu.Unlock()
+
+	if latency > 0 {
+		select {
+		case <-time.After(latency):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/xml")
+
+	if service == "sqs" {
+		if throttled {
+			writeSQSError(w, http.StatusBadRequest, "RequestThrottled", "Request is throttled.", requestID)
+			return
+		}
+		switch action {
+		case ActionReceiveMessage:
+			s.receiveMessage(w, r, requestID)
+		case ActionDeleteMessage:
+			s.deleteMessage(w, r, requestID)
+		default:
+			writeSQSError(w, http.StatusBadRequest, "InvalidAction", "unsupported action: "+action, requestID)
+		}
+		return
+	}
+
+	if service == "sts" {
+		if throttled {
+			writeSTSError(w, http.StatusBadRequest, "Throttling", "Rate exceeded", requestID)
+			return
+		}
+		switch action {
+		case ActionAssumeRole:
+			s.assumeRole(w, r, requestID)
+		default:
+			writeSTSError(w, http.StatusBadRequest, "InvalidAction", "unsupported action: "+action, requestID)
+		}
+		return
+	}
+
+	if throttled {
+		writeEC2Error(w, http.StatusServiceUnavailable, "RequestLimitExceeded", "Request limit exceeded.", requestID)
+		return
+	}
+
+	if disabled {
+		writeEC2Error(w, http.StatusForbidden, "UnauthorizedOperation", "You are not authorized to perform this operation.", requestID)
+		return
+	}
+
+	switch action {
+	case ActionDescribeImages:
+		s.describeImages(w, r, region, requestID)
+	case ActionDescribeImageAttribute:
+		s.describeImageAttribute(w, r, region, requestID)
+	case ActionDescribeRegions:
+		s.describeRegions(w, requestID)
+	default:
+		writeEC2Error(w, http.StatusBadRequest, "InvalidAction", "unsupported action: "+action, requestID)
+	}
+}
+
+// The format of role ARNs, e.g. arn:aws:iam::123456789012:role/ami-query.
+var roleARN = regexp.MustCompile(`^arn:aws:iam::(\d{12}):role/(.+)$`)
+
+func (s *Server) assumeRole(w http.ResponseWriter, r *http.Request, requestID string) {
+	arn := r.Form.Get("RoleArn")
+	m := roleARN.FindStringSubmatch(arn)
+	if m == nil {
+		writeSTSError(w, http.StatusBadRequest, "ValidationError", "invalid role arn: "+arn, requestID)
+		return
+	}
+
+	s.mu.Lock()
+	denied := s.denied[m[1]]
+	s.mu.Unlock()
+
+	if denied {
+		writeSTSError(w, http.StatusForbidden, "AccessDenied", "not authorized to perform sts:AssumeRole on "+arn, requestID)
+		return
+	}
+
+	writeXML(w, assumeRoleResponse{
+		Result: assumeRoleResult{
+			Credentials: roleCredentials{
+				AccessKeyID:     "ASIA" + m[1],
+				SecretAccessKey: "secret",
+				SessionToken:    "token",
+				Expiration:      time.Now().Add(time.Hour).UTC().Format(time.RFC3339),
+			},
+			AssumedRoleUser: assumedRoleUser{
+				ARN:           fmt.Sprintf("arn:aws:sts::%s:assumed-role/%s/%s", m[1], m[2], r.Form.Get("RoleSessionName")),
+				AssumedRoleID: "AROA" + m[1],
+			},
+		},
+		RequestID: requestID,
+	})
+}
+
+// describeImages answers DescribeImages with the images of the region, which
+// are filtered by the Owner, ImageId and tag-key filter parameters.
+func (s *Server) describeImages(w http.ResponseWriter, r *http.Request, region, requestID string) {
+	var (
+		owners  = listParam(r, "Owner")
+		ids     = listParam(r, "ImageId")
+		tagKeys = []string{}
+	)
+	for i := 1; ; i++ {
+		name := r.Form.Get(fmt.Sprintf("Filter.%d.Name", i))
+		if name == "" {
+			break
+		}
+		if name != "tag-key" {
+			writeEC2Error(w, http.StatusBadRequest, "InvalidParameterValue", "unsupported filter: "+name, requestID)
+			return
+		}
+		tagKeys = append(tagKeys, listParam(r, fmt.Sprintf("Filter.%d.Value", i))...)
+	}
+
+	s.mu.Lock()
+	images := []Image{}
+	for _, image := range s.images[region] {
+		if matches(owners, image.OwnerID) && matches(ids, image.ID) && hasTag(image, tagKeys) {
+			images = append(images, image)
+		}
+	}
+	s.mu.Unlock()
+
+	rsp := describeImagesResponse{RequestID: requestID, Images: []imageItem{}}
+	for _, image := range images {
+		item := imageItem{
+			ImageID:            image.ID,
+			OwnerID:            image.OwnerID,
+			State:              image.State,
+			Name:               image.Name,
+			Description:        image.Description,
+			VirtualizationType: image.VirtualizationType,
+			CreationDate:       image.CreationDate,
+			Tags:               []tagItem{},
+		}
+		keys := []string{}
+		for key := range image.Tags {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			item.Tags = append(item.Tags, tagItem{key, image.Tags[key]})
+		}
+		rsp.Images = append(rsp.Images, item)
+	}
+
+	writeXML(w, rsp)
+}
+
+func (s *Server) describeImageAttribute(w http.ResponseWriter, r *http.Request, region, requestID string) {
+	id := r.Form.Get("ImageId")
+	if attr := r.Form.Get("Attribute"); attr != "launchPermission" {
+		writeEC2Error(w, http.StatusBadRequest, "InvalidParameterValue", "unsupported attribute: "+attr, requestID)
+		return
+	}
+
+	s.mu.Lock()
+	var image *Image
+	for i := range s.images[region] {
+		if s.images[region][i].ID == id {
+			image = &s.images[region][i]
+			break
+		}
+	}
+	perms := []permissionItem{}
+	if image != nil {
+		for _, account := range image.LaunchPermissions {
+			perms = append(perms, permissionItem{account})
+		}
+	}
+	s.mu.Unlock()
+
+	if image == nil {
+		writeEC2Error(w, http.StatusBadRequest, "InvalidAMIID.NotFound", fmt.Sprintf("The image id '[%s]' does not exist", id), requestID)
+		return
+	}
+
+	writeXML(w, describeImageAttributeResponse{
+		RequestID:         requestID,
+		ImageID:           id,
+		LaunchPermissions: perms,
+	})
+}
+
+// describeRegions answers DescribeRegions with the regions that have images.
+func (s *Server) describeRegions(w http.ResponseWriter, requestID string) {
+	s.mu.Lock()
+	regions := []string{}
+	for region := range s.images {
+		regions = append(regions, region)
+	}
+	s.mu.Unlock()
+	sort.Strings(regions)
+
+	rsp := describeRegionsResponse{RequestID: requestID, Regions: []regionItem{}}
+	for _, region := range regions {
+		rsp.Regions = append(rsp.Regions, regionItem{region, "ec2." + region + ".amazonaws.com"})
+	}
+
+	writeXML(w, rsp)
+}
+
+// Returns the values of a list parameter, e.g. Owner.1, Owner.2, etc.
+// Receives up to MaxNumberOfMessages visible messages, waiting up to
+// WaitTimeSeconds for one to be visible.
+func (s *Server) receiveMessage(w http.ResponseWriter, r *http.Request, requestID string) {
+	max, _ := strconv.Atoi(r.Form.Get("MaxNumberOfMessages"))
+	if max < 1 {
+		max = 1
+	}
+	wait, _ := strconv.Atoi(r.Form.Get("WaitTimeSeconds"))
+	deadline := time.Now().Add(time.Duration(wait) * time.Second)
+
+	rsp := receiveMessageResponse{RequestID: requestID}
+	for {
+		s.mu.Lock()
+		now := time.Now()
+		for _, m := range s.messages {
+			if len(rsp.Messages) == max {
+				break
+			}
+			if m.visible.After(now) {
+				continue
+			}
+			s.requestID++
+			m.receipt = m.id + "-" + strconv.Itoa(s.requestID)
+			m.visible = now.Add(s.visibility)
+			sum := md5.Sum([]byte(m.body))
+			rsp.Messages = append(rsp.Messages, messageItem{
+				MessageID:     m.id,
+				ReceiptHandle: m.receipt,
+				MD5OfBody:     hex.EncodeToString(sum[:]),
+				Body:          m.body,
+			})
+		}
+		s.mu.Unlock()
+
+		if len(rsp.Messages) > 0 || !time.Now().Before(deadline) {
+			break
+		}
+		select {
+		case <-time.After(10 * time.Millisecond):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	writeXML(w, rsp)
+}
+
+// Deletes the message with the ReceiptHandle of its last receive.
+func (s *Server) deleteMessage(w http.ResponseWriter, r *http.Request, requestID string) {
+	receipt := r.Form.Get("ReceiptHandle")
+
+	s.mu.Lock()
+	found := false
+	for i, m := range s.messages {
+		if m.receipt != "" && m.receipt == receipt {
+			s.messages = append(s.messages[:i], s.messages[i+1:]...)
+			found = true
+			break
+		}
+	}
+	s.mu.Unlock()
+
+	if !found {
+		writeSQSError(w, http.StatusBadRequest, "ReceiptHandleIsInvalid", "invalid receipt handle: "+receipt, requestID)
+		return
+	}
+
+	writeXML(w, deleteMessageResponse{RequestID: requestID})
+}
+
+func listParam(r *http.Request, name string) []string {
+	values := []string{}
+	for i := 1; ; i++ {
+		value, ok := r.Form[fmt.Sprintf("%s.%d", name, i)]
+		if !ok {
+			return values
+		}
+		values = append(values, value...)
+	}
+}
+
+// Returns whether the value is in the list, or the list is empty.
+func matches(list []string, value string) bool {
+	if len(list) == 0 {
+		return true
+	}
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns whether the image has any of the tag keys, or keys is empty.
+func hasTag(image Image, keys []string) bool {
+	if len(keys) == 0 {
+		return true
+	}
+	for _, key := range keys {
+		if _, ok := image.Tags[key]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func writeXML(w http.ResponseWriter, v interface{}) {
+	data, err := xml.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write([]byte(xml.Header))
+	w.Write(data)
+}
+
+func writeEC2Error(w http.ResponseWriter, status int, code, message, requestID string) {
+	w.WriteHeader(status)
+	writeXML(w, ec2ErrorResponse{
+		Errors:    []errorItem{{Code: code, Message: message}},
+		RequestID: requestID,
+	})
+}
+
+func writeSTSError(w http.ResponseWriter, status int, code, message, requestID string) {
+	w.WriteHeader(status)
+	typ := "Sender"
+	if status >= http.StatusInternalServerError {
+		typ = "Receiver"
+	}
+	writeXML(w, stsErrorResponse{
+		Error:     errorItem{Type: typ, Code: code, Message: message},
+		RequestID: requestID,
+	})
+}
+
+func writeSQSError(w http.ResponseWriter, status int, code, message, requestID string) {
+	w.WriteHeader(status)
+	writeXML(w, sqsErrorResponse{
+		Error:     errorItem{Type: "Sender", Code: code, Message: message},
+		RequestID: requestID,
+	})
+}
+
+// The XML documents of the responses.
+
+type describeImagesResponse struct {
+	XMLName   xml.Name    `xml:"http://ec2.amazonaws.com/doc/2016-11-15/ DescribeImagesResponse"`
+	RequestID string      `xml:"requestId"`
+	Images    []imageItem `xml:"imagesSet>item"`
+}
+
+type imageItem struct {
+	ImageID            string    `xml:"imageId"`
+	OwnerID            string    `xml:"imageOwnerId"`
+	State              string    `xml:"imageState"`
+	Name               string    `xml:"name"`
+	Description        string    `xml:"description"`
+	VirtualizationType string    `xml:"virtualizationType"`
+	CreationDate       string    `xml:"creationDate"`
+	Tags               []tagItem `xml:"tagSet>item"`
+}
+
+type tagItem struct {
+	Key   string `xml:"key"`
+	Value string `xml:"value"`
+}
+
+type describeImageAttributeResponse struct {
+	XMLName           xml.Name         `xml:"http://ec2.amazonaws.com/doc/2016-11-15/ DescribeImageAttributeResponse"`
+	RequestID         string           `xml:"requestId"`
+	ImageID           string           `xml:"imageId"`
+	LaunchPermissions []permissionItem `xml:"launchPermission>item"`
+}
+
+type permissionItem struct {
+	UserID string `xml:"userId"`
+}
+
+type describeRegionsResponse struct {
+	XMLName   xml.Name     `xml:"http://ec2.amazonaws.com/doc/2016-11-15/ DescribeRegionsResponse"`
+	RequestID string       `xml:"requestId"`
+	Regions   []regionItem `xml:"regionInfo>item"`
+}
+
+type regionItem struct {
+	RegionName     string `xml:"regionName"`
+	RegionEndpoint string `xml:"regionEndpoint"`
+}
+
+type ec2ErrorResponse struct {
+	XMLName   xml.Name    `xml:"Response"`
+	Errors    []errorItem `xml:"Errors>Error"`
+	RequestID string      `xml:"RequestID"`
+}
+
+type assumeRoleResponse struct {
+	XMLName   xml.Name         `xml:"https://sts.amazonaws.com/doc/2011-06-15/ AssumeRoleResponse"`
+	Result    assumeRoleResult `xml:"AssumeRoleResult"`
+	RequestID string           `xml:"ResponseMetadata>RequestId"`
+}
+
+type assumeRoleResult struct {
+	Credentials     roleCredentials `xml:"Credentials"`
+	AssumedRoleUser assumedRoleUser `xml:"AssumedRoleUser"`
+}
+
+type roleCredentials struct {
+	AccessKeyID     string `xml:"AccessKeyId"`
+	SecretAccessKey string `xml:"SecretAccessKey"`
+	SessionToken    string `xml:"SessionToken"`
+	Expiration      string `xml:"Expiration"`
+}
+
+type assumedRoleUser struct {
+	ARN           string `xml:"Arn"`
+	AssumedRoleID string `xml:"AssumedRoleId"`
+}
+
+type stsErrorResponse struct {
+	XMLName   xml.Name  `xml:"https://sts.amazonaws.com/doc/2011-06-15/ ErrorResponse"`
+	Error     errorItem `xml:"Error"`
+	RequestID string    `xml:"RequestId"`
+}
+
+type receiveMessageResponse struct {
+	XMLName   xml.Name      `xml:"http://queue.amazonaws.com/doc/2012-11-05/ ReceiveMessageResponse"`
+	Messages  []messageItem `xml:"ReceiveMessageResult>Message"`
+	RequestID string        `xml:"ResponseMetadata>RequestId"`
+}
+
+type messageItem struct {
+	MessageID     string `xml:"MessageId"`
+	ReceiptHandle string `xml:"ReceiptHandle"`
+	MD5OfBody     string `xml:"MD5OfBody"`
+	Body          string `xml:"Body"`
+}
+
+type deleteMessageResponse struct {
+	XMLName   xml.Name `xml:"http://queue.amazonaws.com/doc/2012-11-05/ DeleteMessageResponse"`
+	RequestID string   `xml:"ResponseMetadata>RequestId"`
+}
+
+type sqsErrorResponse struct {
+	XMLName   xml.Name  `xml:"http://queue.amazonaws.com/doc/2012-11-05/ ErrorResponse"`
+	Error     errorItem `xml:"Error"`
+	RequestID string    `xml:"RequestId"`
+}
+
+type errorItem struct {
+	Type    string `xml:"Type,omitempty"`
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
@@ -0,0 +1,358 @@
+// Copyright 2020 Intuit, Inc.  All rights reserved.
+// Use of this source code is governed the MIT license
+// that can be found in the LICENSE file.
+
+package awstest
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// Returns a session that sends every request to the server, with fast
+// retries.
+func newSession(t *testing.T, s *Server) *session.Session {
+	t.Helper()
+	sess, err := session.NewSession(aws.NewConfig().
+		WithHTTPClient(s.Client()).
+		WithRegion("us-west-2").
+		WithCredentials(credentials.NewStaticCredentials("id", "secret", "")),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess.Config.Retryer = client.DefaultRetryer{
+		NumMaxRetries:    3,
+		MinRetryDelay:    time.Millisecond,
+		MaxRetryDelay:    time.Millisecond,
+		MinThrottleDelay: time.Millisecond,
+		MaxThrottleDelay: time.Millisecond,
+	}
+	return sess
+}
+
+// Returns the code of an AWS error.
+func errCode(err error) string {
+	if awsErr, ok := err.(awserr.Error); ok {
+		return awsErr.Code()
+	}
+	return ""
+}
+
+func testServer() *Server {
+	s := NewServer()
+	s.AddImage("us-west-2", Image{
+		ID:                 "ami-1",
+		OwnerID:            "123456789012",
+		Name:               "rhel-1",
+		VirtualizationType: "hvm",
+		CreationDate:       "2020-06-01T00:00:00.000Z",
+		Tags:               map[string]string{"state": "available", "os": "rhel"},
+		LaunchPermissions:  []string{"111111111111", "222222222222"},
+	})
+	s.AddImage("us-west-2", Image{ID: "ami-2", OwnerID: "123456789012", State: "pending"})
+	s.AddImage("us-west-2", Image{ID: "ami-3", OwnerID: "210987654321"})
+	s.AddImage("us-east-1", Image{ID: "ami-4", OwnerID: "123456789012"})
+	return s
+}
+
+func TestAssumeRole(t *testing.T) {
+	s := testServer()
+	defer s.Close()
+	s.DenyRole("210987654321")
+
+	svc := sts.New(newSession(t, s))
+
+	rsp, err := svc.AssumeRole(&sts.AssumeRoleInput{
+		RoleArn:         aws.String("arn:aws:iam::123456789012:role/ami-query"),
+		RoleSessionName: aws.String("test"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := "ASIA123456789012", aws.StringValue(rsp.Credentials.AccessKeyId); want != got {
+		t.Errorf("want: %s, got: %s", want, got)
+	}
+	if want, got := "arn:aws:sts::123456789012:assumed-role/ami-query/test", aws.StringValue(rsp.AssumedRoleUser.Arn); want != got {
+		t.Errorf("want: %s, got: %s", want, got)
+	}
+
+	_, err = svc.AssumeRole(&sts.AssumeRoleInput{
+		RoleArn:         aws.String("arn:aws:iam::210987654321:role/ami-query"),
+		RoleSessionName: aws.String("test"),
+	})
+	if want, got := "AccessDenied", errCode(err); want != got {
+		t.Errorf("want: %s, got: %s (%v)", want, got, err)
+	}
+}
+
+func TestDescribeImages(t *testing.T) {
+	s := testServer()
+	defer s.Close()
+
+	svc := ec2.New(newSession(t, s))
+
+	tests := []struct {
+		name  string
+		input *ec2.DescribeImagesInput
+		want  []string
+	}{
+		{"all", &ec2.DescribeImagesInput{}, []string{"ami-1", "ami-2", "ami-3"}},
+		{"owner", &ec2.DescribeImagesInput{Owners: aws.StringSlice([]string{"123456789012"})}, []string{"ami-1", "ami-2"}},
+		{"image", &ec2.DescribeImagesInput{ImageIds: aws.StringSlice([]string{"ami-3"})}, []string{"ami-3"}},
+		{"tag_key", &ec2.DescribeImagesInput{Filters: []*ec2.Filter{{
+			Name:   aws.String("tag-key"),
+			Values: aws.StringSlice([]string{"os"}),
+		}}}, []string{"ami-1"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rsp, err := svc.DescribeImages(tt.input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := []string{}
+			for _, image := range rsp.Images {
+				got = append(got, aws.StringValue(image.ImageId))
+			}
+			if !reflect.DeepEqual(tt.want, got) {
+				t.Errorf("want: %v, got: %v", tt.want, got)
+			}
+		})
+	}
+
+	rsp, err := svc.DescribeImages(&ec2.DescribeImagesInput{ImageIds: aws.StringSlice([]string{"ami-1"})})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &ec2.Image{
+		ImageId:            aws.String("ami-1"),
+		OwnerId:            aws.String("123456789012"),
+		State:              aws.String("available"),
+		Name:               aws.String("rhel-1"),
+		Description:        aws.String(""),
+		VirtualizationType: aws.String("hvm"),
+		CreationDate:       aws.String("2020-06-01T00:00:00.000Z"),
+		Tags: []*ec2.Tag{
+			{Key: aws.String("os"), Value: aws.String("rhel")},
+			{Key: aws.String("state"), Value: aws.String("available")},
+		},
+	}
+	if got := rsp.Images[0]; !reflect.DeepEqual(want, got) {
+		t.Errorf("\n\twant: %v\n\t got: %v", want, got)
+	}
+}
+
+func TestDescribeImageAttribute(t *testing.T) {
+	s := testServer()
+	defer s.Close()
+
+	svc := ec2.New(newSession(t, s))
+
+	rsp, err := svc.DescribeImageAttribute(&ec2.DescribeImageAttributeInput{
+		ImageId:   aws.String("ami-1"),
+		Attribute: aws.String("launchPermission"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []string{}
+	for _, perm := range rsp.LaunchPermissions {
+		got = append(got, aws.StringValue(perm.UserId))
+	}
+	if want := []string{"111111111111", "222222222222"}; !reflect.DeepEqual(want, got) {
+		t.Errorf("want: %v, got: %v", want, got)
+	}
+
+	// The image is in another region.
+	_, err = svc.DescribeImageAttribute(&ec2.DescribeImageAttributeInput{
+		ImageId:   aws.String("ami-4"),
+		Attribute: aws.String("launchPermission"),
+	})
+	if want, got := "InvalidAMIID.NotFound", errCode(err); want != got {
+		t.Errorf("want: %s, got: %s (%v)", want, got, err)
+	}
+}
+
+func TestDescribeRegions(t *testing.T) {
+	s := testServer()
+	defer s.Close()
+
+	rsp, err := ec2.New(newSession(t, s)).DescribeRegions(&ec2.DescribeRegionsInput{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []string{}
+	for _, region := range rsp.Regions {
+		got = append(got, aws.StringValue(region.RegionName))
+	}
+	if want := []string{"us-east-1", "us-west-2"}; !reflect.DeepEqual(want, got) {
+		t.Errorf("want: %v, got: %v", want, got)
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	s := testServer()
+	defer s.Close()
+
+	sess := newSession(t, s)
+
+	// Throttled requests are retried by the SDK.
+	s.Throttle(ActionDescribeImages, 2)
+	if _, err := ec2.New(sess).DescribeImages(&ec2.DescribeImagesInput{}); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 3, s.Calls(ActionDescribeImages); want != got {
+		t.Errorf("want: %d calls, got: %d calls", want, got)
+	}
+
+	// The error is returned once the retries are exhausted.
+	s.Throttle(ActionDescribeImageAttribute, 1)
+	_, err := ec2.New(sess).DescribeImageAttributeWithContext(context.Background(), &ec2.DescribeImageAttributeInput{
+		ImageId:   aws.String("ami-1"),
+		Attribute: aws.String("launchPermission"),
+	}, func(r *request.Request) { r.Retryer = client.NoOpRetryer{} })
+	if want, got := "RequestLimitExceeded", errCode(err); want != got {
+		t.Errorf("want: %s, got: %s (%v)", want, got, err)
+	}
+
+	s.Throttle(ActionAssumeRole, 4)
+	_, err = sts.New(sess).AssumeRole(&sts.AssumeRoleInput{
+		RoleArn:         aws.String("arn:aws:iam::123456789012:role/ami-query"),
+		RoleSessionName: aws.String("test"),
+	})
+	if want, got := "Throttling", errCode(err); want != got {
+		t.Errorf("want: %s, got: %s (%v)", want, got, err)
+	}
+	if want, got := 4, s.Calls(ActionAssumeRole); want != got {
+		t.Errorf("want: %d calls, got: %d calls", want, got)
+	}
+}
+
+func TestDisableRegion(t *testing.T) {
+	s := testServer()
+	defer s.Close()
+
+	sess := newSession(t, s)
+
+	s.DisableRegion("us-east-1", true)
+	if _, err := ec2.New(sess, aws.NewConfig().WithRegion("us-east-1")).DescribeImages(&ec2.DescribeImagesInput{}); errCode(err) != "UnauthorizedOperation" {
+		t.Errorf("want: UnauthorizedOperation, got: %v", err)
+	}
+
+	// Other regions aren't affected.
+	if _, err := ec2.New(sess).DescribeImages(&ec2.DescribeImagesInput{}); err != nil {
+		t.Errorf("want: <nil>, got: %v", err)
+	}
+
+	s.DisableRegion("us-east-1", false)
+	if _, err := ec2.New(sess, aws.NewConfig().WithRegion("us-east-1")).DescribeImages(&ec2.DescribeImagesInput{}); err != nil {
+		t.Errorf("want: <nil>, got: %v", err)
+	}
+}
+
+func TestLatency(t *testing.T) {
+	s := testServer()
+	defer s.Close()
+
+	s.SetLatency(time.Second)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := ec2.New(newSession(t, s)).DescribeImagesWithContext(ctx, &ec2.DescribeImagesInput{})
+	if err == nil {
+		t.Error("want: error, got: nil")
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("want: canceled request, got: %s elapsed", elapsed)
+	}
+}
+
+func TestMessages(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+
+	s.SetVisibilityTimeout(50 * time.Millisecond)
+	s.SendMessage(`{"id":"1"}`)
+	s.SendMessage(`{"id":"2"}`)
+
+	svc := sqs.New(newSession(t, s))
+	queueURL := s.URL + "/123456789012/events"
+
+	out, err := svc.ReceiveMessage(&sqs.ReceiveMessageInput{
+		QueueUrl:            aws.String(queueURL),
+		MaxNumberOfMessages: aws.Int64(10),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var bodies []string
+	for _, m := range out.Messages {
+		bodies = append(bodies, aws.StringValue(m.Body))
+	}
+	if want := []string{`{"id":"1"}`, `{"id":"2"}`}; !reflect.DeepEqual(want, bodies) {
+		t.Fatalf("want: %v, got: %v", want, bodies)
+	}
+
+	// The messages are in flight until the visibility timeout expires.
+	out2, err := svc.ReceiveMessage(&sqs.ReceiveMessageInput{QueueUrl: aws.String(queueURL)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out2.Messages) != 0 {
+		t.Errorf("want: no messages, got: %d", len(out2.Messages))
+	}
+
+	if _, err := svc.DeleteMessage(&sqs.DeleteMessageInput{
+		QueueUrl:      aws.String(queueURL),
+		ReceiptHandle: out.Messages[0].ReceiptHandle,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 1, s.Messages(); want != got {
+		t.Errorf("want: %d, got: %d", want, got)
+	}
+
+	// The undeleted message is redelivered, with a new receipt handle.
+	out3, err := svc.ReceiveMessage(&sqs.ReceiveMessageInput{
+		QueueUrl:        aws.String(queueURL),
+		WaitTimeSeconds: aws.Int64(1),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out3.Messages) != 1 || aws.StringValue(out3.Messages[0].Body) != `{"id":"2"}` {
+		t.Fatalf("want: redelivered message, got: %v", out3.Messages)
+	}
+
+	if _, err := svc.DeleteMessage(&sqs.DeleteMessageInput{
+		QueueUrl:      aws.String(queueURL),
+		ReceiptHandle: out.Messages[1].ReceiptHandle,
+	}); errCode(err) != "ReceiptHandleIsInvalid" {
+		t.Errorf("want: ReceiptHandleIsInvalid, got: %v", err)
+	}
+	if _, err := svc.DeleteMessage(&sqs.DeleteMessageInput{
+		QueueUrl:      aws.String(queueURL),
+		ReceiptHandle: out3.Messages[0].ReceiptHandle,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 0, s.Messages(); want != got {
+		t.Errorf("want: %d, got: %d", want, got)
+	}
+}
@@ -0,0 +1,296 @@
+// Copyright 2020 Intuit, Inc.  All rights reserved.
+// Use of this source code is governed the MIT license
+// that can be found in the LICENSE file.
+
+// Package client is a client for the ami-query API.
+//
+//	c, err := client.New("https://ami-query.example.com")
+//	if err != nil {
+//		return err
+//	}
+//	image, err := c.Latest(ctx, client.NewFilter().
+//		Region("us-west-2").
+//		Tag("os", "rhel").
+//		State("available"))
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/intuit/ami-query/api/auth"
+	"github.com/intuit/ami-query/api/query"
+)
+
+// DefaultUserAgent is the User-Agent header sent with requests unless the
+// UserAgent option is used.
+const DefaultUserAgent = "ami-query-client"
+
+// ErrNoMatch is returned by Latest when no images match the filter.
+var ErrNoMatch = errors.New("no images matched the query")
+
+// Option is the option interface. It has private methods to prevent its use
+// from outside of this package.
+type Option interface {
+	set(*Client)
+}
+
+// optionFunc is a function adapter that implements the Option interface.
+type optionFunc func(*Client)
+
+func (fn optionFunc) set(c *Client) { fn(c) }
+
+// HTTPClient sets the HTTP client used to make requests.
+func HTTPClient(client *http.Client) Option {
+	return optionFunc(func(c *Client) {
+		if client != nil {
+			c.client = client
+		}
+	})
+}
+
+// MaxAttempts sets the maximum number of attempts made for a request. Requests
+// that fail with a network error, a 429 or a 5xx status are retried.
+func MaxAttempts(max int) Option {
+	return optionFunc(func(c *Client) {
+		if max > 0 {
+			c.maxAttempts = max
+		}
+	})
+}
+
+// Backoff sets the delay before the first retry of a request, which doubles
+// for each retry up to max. A Retry-After header in the response takes
+// precedence.
+func Backoff(base, max time.Duration) Option {
+	return optionFunc(func(c *Client) {
+		if base > 0 && max >= base {
+			c.backoffBase = base
+			c.backoffMax = max
+		}
+	})
+}
+
+// UserAgent sets the User-Agent header sent with requests.
+func UserAgent(userAgent string) Option {
+	return optionFunc(func(c *Client) {
+		if userAgent != "" {
+			c.userAgent = userAgent
+		}
+	})
+}
+
+// APIKey sets the API key sent with requests to a server that requires
+// authentication.
+func APIKey(key string) Option {
+	return optionFunc(func(c *Client) {
+		c.apiKey = key
+	})
+}
+
+// BearerToken sets the bearer token, e.g. a JWT, sent with requests to a
+// server that requires authentication.
+func BearerToken(token string) Option {
+	return optionFunc(func(c *Client) {
+		c.bearerToken = token
+	})
+}
+
+// Client queries an ami-query server. It's safe for concurrent use.
+type Client struct {
+	baseURL     *url.URL
+	client      *http.Client
+	maxAttempts int
+	backoffBase time.Duration
+	backoffMax  time.Duration
+	userAgent   string
+	apiKey      string
+	bearerToken string
+}
+
+// New returns a Client for the ami-query server at baseURL, e.g.
+// "https://ami-query.example.com".
+func New(baseURL string, options ...Option) (*Client, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid base url: %s", baseURL)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/")
+
+	c := &Client{
+		baseURL:     u,
+		client:      &http.Client{Timeout: 30 * time.Second},
+		maxAttempts: 3,
+		backoffBase: 250 * time.Millisecond,
+		backoffMax:  5 * time.Second,
+		userAgent:   DefaultUserAgent,
+	}
+	for _, opt := range options {
+		opt.set(c)
+	}
+	return c, nil
+}
+
+// Images returns the images matching the filter, sorted by state and then by
+// creation date, newest first. A nil filter matches every cached image.
+func (c *Client) Images(ctx context.Context, filter *Filter) ([]query.Result, error) {
+	results := []query.Result{}
+	if err := c.get(ctx, query.APIPathQuery, filter.Values(), &results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// Latest returns the newest image matching the filter, preferring images in
+// the best state. It returns ErrNoMatch if no images match.
+func (c *Client) Latest(ctx context.Context, filter *Filter) (query.Result, error) {
+	values := filter.Values()
+	values.Set("first", "true")
+
+	results := []query.Result{}
+	if err := c.get(ctx, query.APIPathQuery, values, &results); err != nil {
+		return query.Result{}, err
+	}
+	if len(results) == 0 {
+		return query.Result{}, ErrNoMatch
+	}
+	return results[0], nil
+}
+
+// Makes a GET request, retrying it if it fails with a retryable error, and
+// decodes the JSON response into v. Errors returned by the API are returned
+// as a *query.Error.
+func (c *Client) get(ctx context.Context, path string, values url.Values, v interface{}) error {
+	u := *c.baseURL
+	u.Path += path
+	u.RawQuery = values.Encode()
+
+	for attempt := 1; ; attempt++ {
+		retryAfter, err := c.do(ctx, u.String(), v)
+		if err == nil || retryAfter < 0 || attempt >= c.maxAttempts {
+			return err
+		}
+
+		if retryAfter == 0 {
+			retryAfter = backoff(attempt-1, c.backoffBase, c.backoffMax)
+		}
+
+		timer := time.NewTimer(retryAfter)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// Makes a single request. It returns how long to wait before retrying the
+// request if it failed with a retryable error, zero if the client should
+// choose, or a negative duration if it shouldn't be retried.
+func (c *Client) do(ctx context.Context, u string, v interface{}) (time.Duration, error) {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return -1, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", query.MediaTypeV1)
+	req.Header.Set("User-Agent", c.userAgent)
+	if c.apiKey != "" {
+		req.Header.Set(auth.HeaderAPIKey, c.apiKey)
+	}
+	if c.bearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+c.bearerToken)
+	}
+
+	rsp, err := c.client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return -1, ctx.Err()
+		}
+		return 0, err
+	}
+	defer func() {
+		io.Copy(ioutil.Discard, rsp.Body)
+		rsp.Body.Close()
+	}()
+
+	if rsp.StatusCode != http.StatusOK {
+		err := responseError(rsp)
+		if !retryable(rsp.StatusCode) {
+			return -1, err
+		}
+		return retryAfter(rsp.Header.Get("Retry-After"), c.backoffMax), err
+	}
+
+	if err := json.NewDecoder(rsp.Body).Decode(v); err != nil {
+		return -1, fmt.Errorf("decoding response: %v", err)
+	}
+	return -1, nil
+}
+
+// Returns the error in an API response. Responses that don't contain an API
+// error, such as those from a proxy, are described by their status.
+func responseError(rsp *http.Response) error {
+	apiErr := &query.Error{}
+	if err := json.NewDecoder(rsp.Body).Decode(apiErr); err != nil || apiErr.Code == "" {
+		apiErr = query.NewError(rsp.StatusCode, query.CodeInternal, "", "unexpected response: %s", rsp.Status)
+	}
+	apiErr.Status = rsp.StatusCode
+	if apiErr.RequestID == "" {
+		apiErr.RequestID = rsp.Header.Get(query.HeaderRequestID)
+	}
+	return apiErr
+}
+
+// Returns true if a request that failed with the status code may succeed if
+// it's retried.
+func retryable(statusCode int) bool {
+	switch statusCode {
+	case http.StatusTooManyRequests,
+		http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// Returns the delay in a Retry-After header given in seconds, up to max. It
+// returns zero if the header is missing or invalid.
+func retryAfter(value string, max time.Duration) time.Duration {
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds < 0 {
+		return 0
+	}
+	if delay := time.Duration(seconds) * time.Second; delay < max {
+		return delay
+	}
+	return max
+}
+
+// Returns the delay before the next retry, doubling the base delay for every
+// attempt up to max.
+func backoff(attempt int, base, max time.Duration) time.Duration {
+	delay := base
+	for i := 0; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
@@ -0,0 +1,428 @@
+// Copyright 2020 Intuit, Inc.  All rights reserved.
+// Use of this source code is governed the MIT license
+// that can be found in the LICENSE file.
+
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/intuit/ami-query/amicache"
+	"github.com/intuit/ami-query/api/auth"
+	"github.com/intuit/ami-query/api/query"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/aws/aws-sdk-go/service/sts/stsiface"
+)
+
+type mockSTS struct {
+	stsiface.STSAPI
+}
+
+func (mockSTS) AssumeRole(*sts.AssumeRoleInput) (*sts.AssumeRoleOutput, error) {
+	return &sts.AssumeRoleOutput{
+		Credentials: &sts.Credentials{
+			AccessKeyId:     aws.String("AKID"),
+			SecretAccessKey: aws.String("SECRET"),
+			SessionToken:    aws.String("TOKEN"),
+		},
+	}, nil
+}
+
+// The images returned by the mock EC2 API, in the same order.
+const describeImages = `<?xml version="1.0" encoding="UTF-8"?>
+<DescribeImagesResponse xmlns="http://ec2.amazonaws.com/doc/2016-11-15/">
+  <imagesSet>
+    <item>
+      <imageId>ami-1</imageId>
+      <name>rhel-1</name>
+      <creationDate>2020-06-01T00:00:00.000Z</creationDate>
+      <virtualizationType>hvm</virtualizationType>
+      <tagSet>
+        <item><key>state</key><value>available</value></item>
+        <item><key>os</key><value>rhel</value></item>
+      </tagSet>
+    </item>
+    <item>
+      <imageId>ami-2</imageId>
+      <name>rhel-2</name>
+      <creationDate>2020-06-02T00:00:00.000Z</creationDate>
+      <virtualizationType>hvm</virtualizationType>
+      <tagSet>
+        <item><key>state</key><value>available</value></item>
+        <item><key>os</key><value>rhel</value></item>
+      </tagSet>
+    </item>
+    <item>
+      <imageId>ami-3</imageId>
+      <name>rhel-3</name>
+      <creationDate>2020-06-03T00:00:00.000Z</creationDate>
+      <virtualizationType>hvm</virtualizationType>
+      <tagSet>
+        <item><key>state</key><value>development</value></item>
+        <item><key>os</key><value>rhel</value></item>
+      </tagSet>
+    </item>
+    <item>
+      <imageId>ami-4</imageId>
+      <name>ubuntu-1</name>
+      <creationDate>2020-06-04T00:00:00.000Z</creationDate>
+      <virtualizationType>hvm</virtualizationType>
+      <tagSet>
+        <item><key>state</key><value>available</value></item>
+        <item><key>os</key><value>ubuntu</value></item>
+      </tagSet>
+    </item>
+  </imagesSet>
+</DescribeImagesResponse>`
+
+// Only ami-4 can be launched by 111111111111.
+const describeImageAttribute = `<?xml version="1.0" encoding="UTF-8"?>
+<DescribeImageAttributeResponse xmlns="http://ec2.amazonaws.com/doc/2016-11-15/">
+  <imageId>%s</imageId>
+  <launchPermission>%s</launchPermission>
+</DescribeImageAttributeResponse>`
+
+// Answers the EC2 API requests made by the cache.
+func mockEC2(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/xml")
+
+	switch r.Form.Get("Action") {
+	case "DescribeImages":
+		fmt.Fprint(w, describeImages)
+	case "DescribeImageAttribute":
+		id, perms := r.Form.Get("ImageId"), ""
+		if id == "ami-4" {
+			perms = "<item><userId>111111111111</userId></item>"
+		}
+		fmt.Fprintf(w, describeImageAttribute, id, perms)
+	default:
+		http.Error(w, "unexpected action: "+r.Form.Get("Action"), http.StatusBadRequest)
+	}
+}
+
+// Returns a server running the query API with a warmed cache of the mock EC2
+// images. handler wraps the query API if it isn't nil. The returned function
+// stops the server and the cache.
+func newServer(handler func(http.Handler) http.Handler) (*httptest.Server, func()) {
+	// Every EC2 endpoint is routed to the mock EC2 API.
+	ec2 := httptest.NewTLSServer(http.HandlerFunc(mockEC2))
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, ec2.Listener.Addr().String())
+		},
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}
+
+	cache := amicache.New(mockSTS{}, "role", []string{"123456789012"},
+		amicache.Regions("us-west-2"),
+		amicache.CollectLaunchPermissions(true),
+		amicache.HTTPClient(&http.Client{Transport: transport}),
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	warmed := make(chan struct{})
+	go cache.Run(ctx, warmed)
+	<-warmed
+
+	var h http.Handler = query.NewAPI(cache)
+	if handler != nil {
+		h = handler(h)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(query.APIPathQuery, h)
+
+	ts := httptest.NewServer(mux)
+	return ts, func() {
+		ts.Close()
+		cancel()
+		ec2.Close()
+	}
+}
+
+func newClient(t *testing.T, baseURL string, options ...Option) *Client {
+	t.Helper()
+	c, err := New(baseURL, append([]Option{Backoff(time.Millisecond, 10*time.Millisecond)}, options...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func ids(results []query.Result) []string {
+	ids := []string{}
+	for _, result := range results {
+		ids = append(ids, result.ID)
+	}
+	return ids
+}
+
+func TestImages(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter *Filter
+		want   []string
+	}{
+		{"nil", nil, []string{"ami-4", "ami-2", "ami-1", "ami-3"}},
+		{"region", NewFilter().Region("us-west-2"), []string{"ami-4", "ami-2", "ami-1", "ami-3"}},
+		{"tag", NewFilter().Tag("os", "rhel"), []string{"ami-2", "ami-1", "ami-3"}},
+		{"tag_values", NewFilter().Tag("os", "rhel", "ubuntu"), []string{"ami-4", "ami-2", "ami-1", "ami-3"}},
+		{"state", NewFilter().State("development"), []string{"ami-3"}},
+		{"owner", NewFilter().Owner("123456789012").Tag("os", "ubuntu"), []string{"ami-4"}},
+		{"other_owner", NewFilter().Owner("210987654321"), []string{}},
+		{"launch_permission", NewFilter().LaunchPermission("111111111111"), []string{"ami-4"}},
+		{"image", NewFilter().Image("ami-1", "ami-3"), []string{"ami-1", "ami-3"}},
+	}
+
+	ts, stop := newServer(nil)
+	defer stop()
+	c := newClient(t, ts.URL)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			results, err := c.Images(context.Background(), tt.filter)
+			if err != nil {
+				t.Fatalf("want: <nil>, got: %v", err)
+			}
+			if want, got := fmt.Sprint(tt.want), fmt.Sprint(ids(results)); want != got {
+				t.Errorf("want: %s, got: %s", want, got)
+			}
+		})
+	}
+}
+
+func TestLatest(t *testing.T) {
+	ts, stop := newServer(nil)
+	defer stop()
+	c := newClient(t, ts.URL)
+
+	got, err := c.Latest(context.Background(), NewFilter().Tag("os", "rhel").State("available"))
+	if err != nil {
+		t.Fatalf("want: <nil>, got: %v", err)
+	}
+
+	want := query.Result{
+		ID:                 "ami-2",
+		OwnerID:            "123456789012",
+		Region:             "us-west-2",
+		Name:               "rhel-2",
+		VirtualizationType: "hvm",
+		CreationDate:       "2020-06-02T00:00:00.000Z",
+		Tags:               map[string]string{"state": "available", "os": "rhel"},
+	}
+	if fmt.Sprint(want) != fmt.Sprint(got) {
+		t.Errorf("\n\twant: %+v\n\t got: %+v", want, got)
+	}
+
+	if _, err := c.Latest(context.Background(), NewFilter().Tag("os", "windows")); err != ErrNoMatch {
+		t.Errorf("want: %v, got: %v", ErrNoMatch, err)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	var attempts int32
+	ts, stop := newServer(func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&attempts, 1)
+			h.ServeHTTP(w, r)
+		})
+	})
+	defer stop()
+	c := newClient(t, ts.URL)
+
+	_, err := c.Images(context.Background(), NewFilter().Region("us-foo-1"))
+
+	var apiErr *query.Error
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("want: *query.Error, got: %T %v", err, err)
+	}
+	if apiErr.Status != http.StatusBadRequest || apiErr.Code != query.CodeUnknownRegion || apiErr.Parameter != "region" {
+		t.Errorf("want: 400 %s region, got: %d %s %s", query.CodeUnknownRegion, apiErr.Status, apiErr.Code, apiErr.Parameter)
+	}
+
+	// Client errors aren't retried.
+	if want, got := int32(1), atomic.LoadInt32(&attempts); want != got {
+		t.Errorf("want: %d attempts, got: %d attempts", want, got)
+	}
+}
+
+// tokenAuthenticator accepts a single bearer token.
+type tokenAuthenticator string
+
+func (a tokenAuthenticator) Authenticate(r *http.Request) (*auth.Principal, error) {
+	switch r.Header.Get("Authorization") {
+	case "":
+		return nil, auth.ErrNoCredentials
+	case "Bearer " + string(a):
+		return &auth.Principal{Name: "token", Method: auth.MethodJWT}, nil
+	default:
+		return nil, errors.New("invalid bearer token")
+	}
+}
+
+func TestAuthentication(t *testing.T) {
+	keys, err := auth.NewAPIKeys(map[string]string{"ci": auth.HashAPIKey("ci-key")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := auth.New([]auth.Authenticator{keys, tokenAuthenticator("token")})
+
+	ts, stop := newServer(m.Wrap)
+	defer stop()
+
+	tests := []struct {
+		name    string
+		options []Option
+		wantErr bool
+	}{
+		{"api_key", []Option{APIKey("ci-key")}, false},
+		{"bearer_token", []Option{BearerToken("token")}, false},
+		{"no_credentials", nil, true},
+		{"bad_api_key", []Option{APIKey("other-key")}, true},
+		{"bad_bearer_token", []Option{BearerToken("other-token")}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newClient(t, ts.URL, tt.options...).Images(context.Background(), nil)
+			if !tt.wantErr {
+				if err != nil {
+					t.Errorf("want: nil, got: %v", err)
+				}
+				return
+			}
+			var apiErr *query.Error
+			if !errors.As(err, &apiErr) || apiErr.Code != query.CodeUnauthorized {
+				t.Errorf("want: %s error, got: %v", query.CodeUnauthorized, err)
+			}
+		})
+	}
+}
+
+func TestRetries(t *testing.T) {
+	tests := []struct {
+		name        string
+		failures    int32
+		statusCode  int
+		maxAttempts int
+		wantErr     bool
+	}{
+		{"unavailable", 2, http.StatusServiceUnavailable, 3, false},
+		{"rate_limited", 1, http.StatusTooManyRequests, 3, false},
+		{"exhausted", 3, http.StatusServiceUnavailable, 3, true},
+		{"not_retried", 1, http.StatusServiceUnavailable, 1, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var attempts int32
+			ts, stop := newServer(func(h http.Handler) http.Handler {
+				return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					if atomic.AddInt32(&attempts, 1) <= tt.failures {
+						w.Header().Set("Retry-After", "0")
+						http.Error(w, "unavailable", tt.statusCode)
+						return
+					}
+					h.ServeHTTP(w, r)
+				})
+			})
+			defer stop()
+			c := newClient(t, ts.URL, MaxAttempts(tt.maxAttempts))
+
+			results, err := c.Images(context.Background(), NewFilter().Image("ami-1"))
+			if tt.wantErr {
+				var apiErr *query.Error
+				if !errors.As(err, &apiErr) || apiErr.Status != tt.statusCode {
+					t.Errorf("want: status %d, got: %v", tt.statusCode, err)
+				}
+			} else if err != nil || len(results) != 1 {
+				t.Errorf("want: 1 result, got: %d results, %v", len(results), err)
+			}
+
+			want := tt.failures + 1
+			if want > int32(tt.maxAttempts) {
+				want = int32(tt.maxAttempts)
+			}
+			if got := atomic.LoadInt32(&attempts); want != got {
+				t.Errorf("want: %d attempts, got: %d attempts", want, got)
+			}
+		})
+	}
+}
+
+func TestContext(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	c, err := New(ts.URL, Backoff(time.Hour, time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if _, err := c.Images(ctx, nil); err != context.DeadlineExceeded {
+		t.Errorf("want: %v, got: %v", context.DeadlineExceeded, err)
+	}
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		baseURL string
+		wantErr bool
+	}{
+		{"http://localhost:8080", false},
+		{"https://ami-query.example.com/prefix/", false},
+		{"localhost:8080", true},
+		{"ftp://localhost", true},
+		{"%", true},
+	}
+	for _, tt := range tests {
+		if _, err := New(tt.baseURL); tt.wantErr != (err != nil) {
+			t.Errorf("%s: want: error %t, got: %v", tt.baseURL, tt.wantErr, err)
+		}
+	}
+}
+
+func TestFilterValues(t *testing.T) {
+	asOf := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	f := NewFilter().
+		Region("us-west-2", "us-east-1").
+		Tag("os", "rhel").
+		State("available").
+		Owner("123456789012").
+		LaunchPermission("111111111111").
+		AsOf(asOf)
+
+	want := "as_of=2020-06-01T00%3A00%3A00Z&launch_permission=111111111111&owner_id=123456789012" +
+		"&region=us-west-2&region=us-east-1&state=available&tag=os%3Arhel"
+	if got := f.Values().Encode(); want != got {
+		t.Errorf("\n\twant: %s\n\t got: %s", want, got)
+	}
+
+	// The values are a copy.
+	f.Values().Set("region", "eu-west-1")
+	if want, got := 2, len(f.Values()["region"]); want != got {
+		t.Errorf("want: %d, got: %d", want, got)
+	}
+}
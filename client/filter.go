@@ -0,0 +1,95 @@
+// Copyright 2020 Intuit, Inc.  All rights reserved.
+// Use of this source code is governed the MIT license
+// that can be found in the LICENSE file.
+
+package client
+
+import (
+	"net/url"
+	"time"
+)
+
+// Filter selects the images returned by a query. Its methods add to the
+// filter and return it, so they can be chained. Images must match every
+// condition, and at least one of the values given for each condition.
+type Filter struct {
+	values url.Values
+}
+
+// NewFilter returns a Filter that matches every image. It's equivalent to a
+// zero Filter.
+func NewFilter() *Filter {
+	return &Filter{}
+}
+
+// Region limits the images to those in the regions. Every cached region is
+// searched if it isn't set.
+func (f *Filter) Region(regions ...string) *Filter {
+	return f.add("region", regions...)
+}
+
+// Image limits the images to those with the IDs.
+func (f *Filter) Image(ids ...string) *Filter {
+	return f.add("ami", ids...)
+}
+
+// Tag limits the images to those with the tag set to one of the values.
+func (f *Filter) Tag(key string, values ...string) *Filter {
+	for _, value := range values {
+		f.add("tag", key+":"+value)
+	}
+	return f
+}
+
+// State limits the images to those in one of the states, e.g. "available".
+// The state is read from the server's state tag.
+func (f *Filter) State(states ...string) *Filter {
+	return f.add("state", states...)
+}
+
+// Owner limits the images to those owned by the account.
+func (f *Filter) Owner(ownerID string) *Filter {
+	return f.set("owner_id", ownerID)
+}
+
+// LaunchPermission limits the images to those the account can launch. It's
+// ignored by servers that don't collect launch permissions.
+func (f *Filter) LaunchPermission(account string) *Filter {
+	return f.set("launch_permission", account)
+}
+
+// AsOf queries the images that were cached at the time. It requires the
+// server's history to be enabled.
+func (f *Filter) AsOf(t time.Time) *Filter {
+	return f.set("as_of", t.UTC().Format(time.RFC3339))
+}
+
+// Values returns the query parameters of the filter.
+func (f *Filter) Values() url.Values {
+	values := url.Values{}
+	if f == nil {
+		return values
+	}
+	for key, v := range f.values {
+		values[key] = append([]string{}, v...)
+	}
+	return values
+}
+
+func (f *Filter) add(key string, values ...string) *Filter {
+	if f.values == nil {
+		f.values = url.Values{}
+	}
+	for _, value := range values {
+		f.values.Add(key, value)
+	}
+	return f
+}
+
+func (f *Filter) set(key, value string) *Filter {
+	if f.values == nil {
+		f.values = url.Values{}
+	}
+	f.values.Set(key, value)
+	return f
+}
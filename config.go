@@ -5,11 +5,20 @@
 package main
 
 import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/intuit/ami-query/api/auth"
+	"github.com/intuit/ami-query/api/ratelimit"
 )
 
 // Config is the configuration for ami-query.
@@ -18,17 +27,80 @@ type Config struct {
 	RoleName                   string
 	TagFilter                  string
 	OwnerIDs                   []string
+	OwnerAliases               map[string]string
 	Regions                    []string
+	DiscoverRegions            bool
+	RegionDiscoveryTTL         time.Duration
+	DiscoveryRegion            string
 	CacheTTL                   time.Duration
+	CachePermissionTTL         time.Duration
 	CacheMaxConcurrentRequests int
 	CacheMaxRequestRetries     int
+	CacheRequestRate           float64
+	CacheRequestBurst          int
 	AppLog                     string
 	HTTPLog                    string
+	HTTPMaxAge                 time.Duration
 	CorsAllowedOrigins         []string
 	SSLCert                    string
 	SSLKey                     string
 	StateTag                   string
 	CollectLaunchPermissions   bool
+	AdminToken                 string
+	AdminRefreshCooldown       time.Duration
+	EventQueueURL              string
+	Webhooks                   []WebhookConfig
+	WebhookQueueDir            string
+	HistoryFile                string
+	HistoryRetention           time.Duration
+	CatalogFile                string
+	Sources                    []SourceConfig
+	STSEndpoint                string
+	EC2Endpoint                string
+	EC2RegionEndpoints         map[string]string
+	APIKeys                    []APIKeyConfig
+	JWKSFile                   string
+	JWTIssuer                  string
+	JWTAudience                string
+	AuditLog                   string
+	TLSClientCAFile            string
+	TLSClientAuth              tls.ClientAuthType
+	TLSClientPrincipals        map[string]string
+	TLSMinVersion              uint16
+	TLSCipherSuites            []uint16
+	TLSReloadInterval          time.Duration
+	Policy                     map[string]auth.Rule
+	RateLimit                  float64
+	RateLimitBurst             int
+	RateLimitQuotas            map[string]ratelimit.Limit
+}
+
+// WebhookConfig is a webhook target read from AMIQUERY_WEBHOOKS_FILE. Filter
+// is a query string using the same parameters as the query API. ID identifies
+// the webhook's queued deliveries, see webhook.Hook.
+type WebhookConfig struct {
+	ID     string `json:"id"`
+	URL    string `json:"url"`
+	Secret string `json:"secret"`
+	Filter string `json:"filter"`
+}
+
+// SourceConfig is an image source read from AMIQUERY_SOURCES_FILE. The images
+// are read from either a catalog File or a catalog URL, every TTL.
+type SourceConfig struct {
+	Name   string        `json:"name"`
+	File   string        `json:"file"`
+	URL    string        `json:"url"`
+	RawTTL string        `json:"ttl"`
+	TTL    time.Duration `json:"-"`
+}
+
+// APIKeyConfig is an API key read from AMIQUERY_API_KEYS_FILE. Only the hex
+// encoded SHA-256 hash of the key is configured. Name identifies the clients
+// using the key.
+type APIKeyConfig struct {
+	Name   string `json:"name"`
+	SHA256 string `json:"sha256"`
 }
 
 // NewConfig returns a Config with settings pulled from the environment. See
@@ -38,6 +110,7 @@ func NewConfig() (*Config, error) {
 	var cfg = Config{
 		ListenAddr:               ":8080",
 		CacheTTL:                 15 * time.Minute,
+		CachePermissionTTL:       time.Hour,
 		RoleName:                 os.Getenv("AMIQUERY_ROLE_NAME"),
 		TagFilter:                os.Getenv("AMIQUERY_TAG_FILTER"),
 		StateTag:                 os.Getenv("AMIQUERY_STATE_TAG"),
@@ -46,6 +119,23 @@ func NewConfig() (*Config, error) {
 		CollectLaunchPermissions: true,
 		SSLCert:                  os.Getenv("SSL_CERTIFICATE_FILE"),
 		SSLKey:                   os.Getenv("SSL_KEY_FILE"),
+		AdminToken:               os.Getenv("AMIQUERY_ADMIN_TOKEN"),
+		AdminRefreshCooldown:     time.Minute,
+		EventQueueURL:            os.Getenv("AMIQUERY_EVENT_QUEUE_URL"),
+		WebhookQueueDir:          os.Getenv("AMIQUERY_WEBHOOK_QUEUE_DIR"),
+		HistoryFile:              os.Getenv("AMIQUERY_HISTORY_FILE"),
+		HistoryRetention:         90 * 24 * time.Hour,
+		CatalogFile:              os.Getenv("AMIQUERY_CATALOG_FILE"),
+		STSEndpoint:              os.Getenv("AMIQUERY_STS_ENDPOINT"),
+		EC2Endpoint:              os.Getenv("AMIQUERY_EC2_ENDPOINT"),
+		JWKSFile:                 os.Getenv("AMIQUERY_JWKS_FILE"),
+		JWTIssuer:                os.Getenv("AMIQUERY_JWT_ISSUER"),
+		JWTAudience:              os.Getenv("AMIQUERY_JWT_AUDIENCE"),
+		AuditLog:                 os.Getenv("AMIQUERY_AUDIT_LOGFILE"),
+		TLSClientCAFile:          os.Getenv("AMIQUERY_TLS_CLIENT_CA_FILE"),
+		TLSMinVersion:            tls.VersionTLS12,
+		TLSReloadInterval:        time.Minute,
+		RateLimitBurst:           20,
 	}
 
 	// The address to listen on.
@@ -53,15 +143,34 @@ func NewConfig() (*Config, error) {
 		cfg.ListenAddr = laddr
 	}
 
-	// The role assumed into in targeted accounts.
-	if cfg.RoleName == "" {
+	// The catalog file the images are read from instead of EC2.
+	if cfg.CatalogFile != "" {
+		if _, err := os.Stat(cfg.CatalogFile); err != nil {
+			return nil, fmt.Errorf("failed to read AMIQUERY_CATALOG_FILE: %v", err)
+		}
+	}
+
+	// The role assumed into in targeted accounts. It's unused with a catalog
+	// file.
+	if cfg.RoleName == "" && cfg.CatalogFile == "" {
 		return nil, fmt.Errorf("AMIQUERY_ROLE_NAME is undefined")
 	}
 
-	// Owner IDs used to filter AMI results.
+	// Owner IDs used to filter AMI results, optionally with an alias in the
+	// form of "owner_id:alias". They're taken from the catalog file if it's
+	// set and they aren't.
 	if ownerIDs := os.Getenv("AMIQUERY_OWNER_IDS"); ownerIDs != "" {
-		cfg.OwnerIDs = strings.Split(ownerIDs, ",")
-	} else {
+		for _, owner := range strings.Split(ownerIDs, ",") {
+			if i := strings.Index(owner, ":"); i != -1 {
+				if cfg.OwnerAliases == nil {
+					cfg.OwnerAliases = map[string]string{}
+				}
+				cfg.OwnerAliases[owner[:i]] = owner[i+1:]
+				owner = owner[:i]
+			}
+			cfg.OwnerIDs = append(cfg.OwnerIDs, owner)
+		}
+	} else if cfg.CatalogFile == "" {
 		return nil, fmt.Errorf("AMIQUERY_OWNER_IDS is undefined")
 	}
 
@@ -70,6 +179,53 @@ func NewConfig() (*Config, error) {
 		cfg.Regions = strings.Split(regions, ",")
 	}
 
+	// Endpoint URLs of the STS and EC2 APIs, e.g. VPC endpoints.
+	if cfg.STSEndpoint != "" {
+		if err := checkEndpoint(cfg.STSEndpoint); err != nil {
+			return nil, fmt.Errorf("failed to read AMIQUERY_STS_ENDPOINT: %v", err)
+		}
+	}
+	if cfg.EC2Endpoint != "" {
+		// The region placeholder isn't valid in a host name.
+		if err := checkEndpoint(strings.Replace(cfg.EC2Endpoint, "{region}", "region", -1)); err != nil {
+			return nil, fmt.Errorf("failed to read AMIQUERY_EC2_ENDPOINT: invalid endpoint url: %s", cfg.EC2Endpoint)
+		}
+	}
+
+	// Endpoint URLs of the EC2 API in specific regions, in the form of
+	// "region=url".
+	if endpoints := os.Getenv("AMIQUERY_EC2_REGION_ENDPOINTS"); endpoints != "" {
+		cfg.EC2RegionEndpoints = map[string]string{}
+		for _, endpoint := range strings.Split(endpoints, ",") {
+			i := strings.Index(endpoint, "=")
+			if i < 1 {
+				return nil, fmt.Errorf("failed to read AMIQUERY_EC2_REGION_ENDPOINTS: invalid endpoint: %s", endpoint)
+			}
+			region, u := strings.TrimSpace(endpoint[:i]), strings.TrimSpace(endpoint[i+1:])
+			if err := checkEndpoint(u); err != nil {
+				return nil, fmt.Errorf("failed to read AMIQUERY_EC2_REGION_ENDPOINTS: %v", err)
+			}
+			cfg.EC2RegionEndpoints[region] = u
+		}
+	}
+
+	// If the enabled regions should be discovered in each owner's account.
+	if discover := os.Getenv("AMIQUERY_DISCOVER_REGIONS"); discover != "" {
+		if cfg.DiscoverRegions, err = strconv.ParseBool(discover); err != nil {
+			return nil, fmt.Errorf("failed to read AMIQUERY_DISCOVER_REGIONS: %v", err)
+		}
+	}
+
+	// Duration between refreshes of the discovered regions.
+	if ttl := os.Getenv("AMIQUERY_REGION_DISCOVERY_TTL"); ttl != "" {
+		if cfg.RegionDiscoveryTTL, err = time.ParseDuration(ttl); err != nil {
+			return nil, fmt.Errorf("failed to read AMIQUERY_REGION_DISCOVERY_TTL: %v", err)
+		}
+	}
+
+	// The region used to discover the enabled regions.
+	cfg.DiscoveryRegion = os.Getenv("AMIQUERY_DISCOVERY_REGION")
+
 	// If launch permissions should be collected for each AMI.
 	if collect := os.Getenv("AMIQUERY_COLLECT_LAUNCH_PERMISSIONS"); collect != "" {
 		if cfg.CollectLaunchPermissions, err = strconv.ParseBool(collect); err != nil {
@@ -85,6 +241,13 @@ func NewConfig() (*Config, error) {
 		}
 	}
 
+	// Duration launch permissions are reused for unchanged AMIs.
+	if ttl := os.Getenv("AMIQUERY_CACHE_PERMISSION_TTL"); ttl != "" {
+		if cfg.CachePermissionTTL, err = time.ParseDuration(ttl); err != nil {
+			return nil, fmt.Errorf("failed to read AMIQUERY_CACHE_PERMISSION_TTL: %v", err)
+		}
+	}
+
 	// Maximum number of goroutines used for updating the cache.
 	if maxRequests := os.Getenv("AMIQUERY_CACHE_MAX_CONCURRENT_REQUESTS"); maxRequests != "" {
 		if cfg.CacheMaxConcurrentRequests, err = strconv.Atoi(maxRequests); err != nil {
@@ -99,6 +262,162 @@ func NewConfig() (*Config, error) {
 		}
 	}
 
+	// Sustained API requests per second allowed in a region for an owner.
+	if rate := os.Getenv("AMIQUERY_CACHE_REQUEST_RATE"); rate != "" {
+		if cfg.CacheRequestRate, err = strconv.ParseFloat(rate, 64); err != nil {
+			return nil, fmt.Errorf("failed to read AMIQUERY_CACHE_REQUEST_RATE: %v", err)
+		}
+	}
+
+	// API requests allowed to exceed the rate in a region for an owner.
+	if burst := os.Getenv("AMIQUERY_CACHE_REQUEST_BURST"); burst != "" {
+		if cfg.CacheRequestBurst, err = strconv.Atoi(burst); err != nil {
+			return nil, fmt.Errorf("failed to read AMIQUERY_CACHE_REQUEST_BURST: %v", err)
+		}
+	}
+
+	// Maximum duration clients may cache query results for.
+	if maxAge := os.Getenv("AMIQUERY_HTTP_MAX_AGE"); maxAge != "" {
+		if cfg.HTTPMaxAge, err = time.ParseDuration(maxAge); err != nil {
+			return nil, fmt.Errorf("failed to read AMIQUERY_HTTP_MAX_AGE: %v", err)
+		}
+	}
+
+	// Minimum duration between on-demand cache refreshes.
+	if cooldown := os.Getenv("AMIQUERY_ADMIN_REFRESH_COOLDOWN"); cooldown != "" {
+		if cfg.AdminRefreshCooldown, err = time.ParseDuration(cooldown); err != nil {
+			return nil, fmt.Errorf("failed to read AMIQUERY_ADMIN_REFRESH_COOLDOWN: %v", err)
+		}
+	}
+
+	// How long the history of changed and removed AMIs is kept.
+	if retention := os.Getenv("AMIQUERY_HISTORY_RETENTION"); retention != "" {
+		if cfg.HistoryRetention, err = time.ParseDuration(retention); err != nil {
+			return nil, fmt.Errorf("failed to read AMIQUERY_HISTORY_RETENTION: %v", err)
+		}
+	}
+
+	// The webhooks notified of AMI state transitions.
+	if file := os.Getenv("AMIQUERY_WEBHOOKS_FILE"); file != "" {
+		if cfg.Webhooks, err = readWebhooks(file); err != nil {
+			return nil, fmt.Errorf("failed to read AMIQUERY_WEBHOOKS_FILE: %v", err)
+		}
+	}
+
+	// The image sources cached along with the images from EC2.
+	if file := os.Getenv("AMIQUERY_SOURCES_FILE"); file != "" {
+		if cfg.Sources, err = readSources(file); err != nil {
+			return nil, fmt.Errorf("failed to read AMIQUERY_SOURCES_FILE: %v", err)
+		}
+	}
+
+	// The API keys accepted by the query APIs.
+	if file := os.Getenv("AMIQUERY_API_KEYS_FILE"); file != "" {
+		if cfg.APIKeys, err = readAPIKeys(file); err != nil {
+			return nil, fmt.Errorf("failed to read AMIQUERY_API_KEYS_FILE: %v", err)
+		}
+	}
+
+	// The JSON Web Key Set bearer tokens are verified with.
+	if cfg.JWKSFile != "" {
+		if _, err := os.Stat(cfg.JWKSFile); err != nil {
+			return nil, fmt.Errorf("failed to read AMIQUERY_JWKS_FILE: %v", err)
+		}
+	}
+
+	// The CA bundle client certificates are verified with, and if they're
+	// required.
+	if cfg.TLSClientCAFile != "" {
+		if cfg.SSLCert == "" || cfg.SSLKey == "" {
+			return nil, fmt.Errorf("AMIQUERY_TLS_CLIENT_CA_FILE requires SSL_CERTIFICATE_FILE and SSL_KEY_FILE")
+		}
+		if _, err := os.Stat(cfg.TLSClientCAFile); err != nil {
+			return nil, fmt.Errorf("failed to read AMIQUERY_TLS_CLIENT_CA_FILE: %v", err)
+		}
+		cfg.TLSClientAuth = tls.RequireAndVerifyClientCert
+	}
+	if clientAuth := os.Getenv("AMIQUERY_TLS_CLIENT_AUTH"); clientAuth != "" {
+		switch {
+		case cfg.TLSClientCAFile == "":
+			return nil, fmt.Errorf("AMIQUERY_TLS_CLIENT_AUTH requires AMIQUERY_TLS_CLIENT_CA_FILE")
+		case clientAuth == "required":
+			cfg.TLSClientAuth = tls.RequireAndVerifyClientCert
+		case clientAuth == "optional":
+			cfg.TLSClientAuth = tls.VerifyClientCertIfGiven
+		default:
+			return nil, fmt.Errorf("failed to read AMIQUERY_TLS_CLIENT_AUTH: invalid value: %s", clientAuth)
+		}
+	}
+
+	// The principals of client certificate subjects.
+	if file := os.Getenv("AMIQUERY_TLS_CLIENT_PRINCIPALS_FILE"); file != "" {
+		if cfg.TLSClientPrincipals, err = readClientPrincipals(file); err != nil {
+			return nil, fmt.Errorf("failed to read AMIQUERY_TLS_CLIENT_PRINCIPALS_FILE: %v", err)
+		}
+	}
+
+	// The minimum TLS version accepted by the server.
+	if version := os.Getenv("AMIQUERY_TLS_MIN_VERSION"); version != "" {
+		if cfg.TLSMinVersion, err = parseTLSVersion(version); err != nil {
+			return nil, fmt.Errorf("failed to read AMIQUERY_TLS_MIN_VERSION: %v", err)
+		}
+	}
+
+	// The cipher suites accepted by the server for TLS 1.2 and earlier.
+	if suites := os.Getenv("AMIQUERY_TLS_CIPHER_SUITES"); suites != "" {
+		for _, name := range strings.Split(suites, ",") {
+			id, err := parseCipherSuite(strings.TrimSpace(name))
+			if err != nil {
+				return nil, fmt.Errorf("failed to read AMIQUERY_TLS_CIPHER_SUITES: %v", err)
+			}
+			cfg.TLSCipherSuites = append(cfg.TLSCipherSuites, id)
+		}
+	}
+
+	// Duration between checks for rotated certificate files.
+	if interval := os.Getenv("AMIQUERY_TLS_RELOAD_INTERVAL"); interval != "" {
+		if cfg.TLSReloadInterval, err = time.ParseDuration(interval); err != nil {
+			return nil, fmt.Errorf("failed to read AMIQUERY_TLS_RELOAD_INTERVAL: %v", err)
+		}
+	}
+
+	// The rules limiting the images principals can see.
+	if file := os.Getenv("AMIQUERY_POLICY_FILE"); file != "" {
+		if len(cfg.APIKeys) == 0 && cfg.JWKSFile == "" && cfg.TLSClientCAFile == "" {
+			return nil, fmt.Errorf("AMIQUERY_POLICY_FILE requires AMIQUERY_API_KEYS_FILE, AMIQUERY_JWKS_FILE or AMIQUERY_TLS_CLIENT_CA_FILE")
+		}
+		if cfg.Policy, err = readPolicy(file); err != nil {
+			return nil, fmt.Errorf("failed to read AMIQUERY_POLICY_FILE: %v", err)
+		}
+	}
+
+	// Sustained requests per second allowed for a client of the query APIs.
+	if rate := os.Getenv("AMIQUERY_RATE_LIMIT"); rate != "" {
+		if cfg.RateLimit, err = strconv.ParseFloat(rate, 64); err != nil {
+			return nil, fmt.Errorf("failed to read AMIQUERY_RATE_LIMIT: %v", err)
+		}
+	}
+
+	// Requests allowed to exceed the rate for a client of the query APIs.
+	if burst := os.Getenv("AMIQUERY_RATE_LIMIT_BURST"); burst != "" {
+		if cfg.RateLimitBurst, err = strconv.Atoi(burst); err != nil {
+			return nil, fmt.Errorf("failed to read AMIQUERY_RATE_LIMIT_BURST: %v", err)
+		}
+		if cfg.RateLimitBurst < 1 {
+			return nil, fmt.Errorf("failed to read AMIQUERY_RATE_LIMIT_BURST: must be at least 1")
+		}
+	}
+
+	// The rate limits of principals that differ from the default.
+	if file := os.Getenv("AMIQUERY_RATE_LIMIT_QUOTAS_FILE"); file != "" {
+		if len(cfg.APIKeys) == 0 && cfg.JWKSFile == "" && cfg.TLSClientCAFile == "" {
+			return nil, fmt.Errorf("AMIQUERY_RATE_LIMIT_QUOTAS_FILE requires AMIQUERY_API_KEYS_FILE, AMIQUERY_JWKS_FILE or AMIQUERY_TLS_CLIENT_CA_FILE")
+		}
+		if cfg.RateLimitQuotas, err = readRateLimitQuotas(file); err != nil {
+			return nil, fmt.Errorf("failed to read AMIQUERY_RATE_LIMIT_QUOTAS_FILE: %v", err)
+		}
+	}
+
 	if origins := os.Getenv("AMIQUERY_CORS_ALLOWED_ORIGINS"); origins != "" {
 		for _, origin := range strings.Split(origins, ",") {
 			cfg.CorsAllowedOrigins = append(cfg.CorsAllowedOrigins, strings.TrimSpace(origin))
@@ -107,3 +426,229 @@ func NewConfig() (*Config, error) {
 
 	return &cfg, nil
 }
+
+// Reads the webhooks from a JSON file containing a list of WebhookConfig.
+func readWebhooks(file string) ([]WebhookConfig, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	webhooks := []WebhookConfig{}
+	if err := json.Unmarshal(data, &webhooks); err != nil {
+		return nil, err
+	}
+
+	for _, webhook := range webhooks {
+		u, err := url.Parse(webhook.URL)
+		if err != nil {
+			return nil, err
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return nil, fmt.Errorf("invalid webhook url: %s", webhook.URL)
+		}
+		if _, err := url.ParseQuery(webhook.Filter); err != nil {
+			return nil, fmt.Errorf("invalid webhook filter: %s", webhook.Filter)
+		}
+	}
+
+	return webhooks, nil
+}
+
+// Reads the image sources from a JSON file containing a list of SourceConfig.
+func readSources(file string) ([]SourceConfig, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	sources := []SourceConfig{}
+	if err := json.Unmarshal(data, &sources); err != nil {
+		return nil, err
+	}
+
+	names := map[string]struct{}{}
+	for i, source := range sources {
+		if source.Name == "" {
+			return nil, fmt.Errorf("source %d: name is undefined", i)
+		}
+		if _, dup := names[source.Name]; dup {
+			return nil, fmt.Errorf("duplicate source name: %s", source.Name)
+		}
+		names[source.Name] = struct{}{}
+
+		if (source.File == "") == (source.URL == "") {
+			return nil, fmt.Errorf("source %s: exactly one of file or url is required", source.Name)
+		}
+		if source.URL != "" {
+			u, err := url.Parse(source.URL)
+			if err != nil {
+				return nil, err
+			}
+			if u.Scheme != "http" && u.Scheme != "https" {
+				return nil, fmt.Errorf("invalid source url: %s", source.URL)
+			}
+		}
+		if source.RawTTL != "" {
+			if sources[i].TTL, err = time.ParseDuration(source.RawTTL); err != nil {
+				return nil, fmt.Errorf("source %s: invalid ttl: %s", source.Name, source.RawTTL)
+			}
+		}
+	}
+
+	return sources, nil
+}
+
+// Reads the API keys from a JSON file containing a list of APIKeyConfig.
+func readAPIKeys(file string) ([]APIKeyConfig, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []APIKeyConfig{}
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, err
+	}
+
+	names := map[string]struct{}{}
+	for i, key := range keys {
+		if key.Name == "" {
+			return nil, fmt.Errorf("api key %d: name is undefined", i)
+		}
+		if _, dup := names[key.Name]; dup {
+			return nil, fmt.Errorf("duplicate api key name: %s", key.Name)
+		}
+		names[key.Name] = struct{}{}
+
+		if b, err := hex.DecodeString(key.SHA256); err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("api key %s: invalid sha256 hash", key.Name)
+		}
+	}
+
+	return keys, nil
+}
+
+// Reads the principals of client certificate subjects from a JSON object
+// mapping subjects to principal names.
+func readClientPrincipals(file string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	principals := map[string]string{}
+	if err := json.Unmarshal(data, &principals); err != nil {
+		return nil, err
+	}
+
+	for subject, name := range principals {
+		if name == "" {
+			return nil, fmt.Errorf("principal of %s is undefined", subject)
+		}
+	}
+
+	return principals, nil
+}
+
+// Reads the policy from a JSON object mapping principal names to their rules.
+func readPolicy(file string) (map[string]auth.Rule, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	rules := map[string]auth.Rule{}
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, err
+	}
+
+	for name, rule := range rules {
+		if name == "" {
+			return nil, fmt.Errorf("principal name is undefined")
+		}
+		for _, values := range [][]string{rule.Owners, rule.Regions} {
+			for _, value := range values {
+				if value == "" {
+					return nil, fmt.Errorf("rule %s: empty owner or region", name)
+				}
+			}
+		}
+		for key, values := range rule.Tags {
+			if len(values) == 0 {
+				return nil, fmt.Errorf("rule %s: tag %s has no values", name, key)
+			}
+		}
+	}
+
+	return rules, nil
+}
+
+// Reads the rate limit quotas from a JSON object mapping principal names to
+// their limits.
+func readRateLimitQuotas(file string) (map[string]ratelimit.Limit, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	quotas := map[string]ratelimit.Limit{}
+	if err := json.Unmarshal(data, &quotas); err != nil {
+		return nil, err
+	}
+
+	for name, limit := range quotas {
+		if name == "" {
+			return nil, fmt.Errorf("principal name is undefined")
+		}
+		if limit.Rate > 0 && limit.Burst < 1 {
+			return nil, fmt.Errorf("quota %s: burst must be at least 1", name)
+		}
+	}
+
+	return quotas, nil
+}
+
+// Returns the TLS version with a name such as "1.2".
+func parseTLSVersion(version string) (uint16, error) {
+	switch version {
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unsupported tls version: %s", version)
+}
+
+// Returns the ID of a cipher suite with a name such as
+// "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256". Only the secure suites that can be
+// configured, those of TLS 1.2 and earlier, are supported.
+func parseCipherSuite(name string) (uint16, error) {
+	for _, suite := range tls.CipherSuites() {
+		if suite.Name != name {
+			continue
+		}
+		for _, version := range suite.SupportedVersions {
+			if version <= tls.VersionTLS12 {
+				return suite.ID, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("unsupported cipher suite: %s", name)
+}
+
+// Returns an error if the endpoint isn't an http or https URL.
+func checkEndpoint(endpoint string) error {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid endpoint url: %s", endpoint)
+	}
+	return nil
+}
@@ -5,11 +5,15 @@
 package main
 
 import (
+	"crypto/tls"
 	"errors"
 	"os"
 	"reflect"
 	"testing"
 	"time"
+
+	"github.com/intuit/ami-query/api/auth"
+	"github.com/intuit/ami-query/api/ratelimit"
 )
 
 func TestConfig(t *testing.T) {
@@ -31,7 +35,13 @@ func TestConfig(t *testing.T) {
 				RoleName:                 "foo",
 				OwnerIDs:                 []string{"123456789012", "123456789013"},
 				CacheTTL:                 15 * time.Minute,
+				CachePermissionTTL:       time.Hour,
 				CollectLaunchPermissions: true,
+				AdminRefreshCooldown:     time.Minute,
+				HistoryRetention:         90 * 24 * time.Hour,
+				TLSMinVersion:            tls.VersionTLS12,
+				TLSReloadInterval:        time.Minute,
+				RateLimitBurst:           20,
 			},
 			err: nil,
 		},
@@ -43,17 +53,51 @@ func TestConfig(t *testing.T) {
 				"AMIQUERY_ROLE_NAME":                     "foo",
 				"AMIQUERY_TAG_FILTER":                    "foo",
 				"AMIQUERY_STATE_TAG":                     "foo",
-				"AMIQUERY_OWNER_IDS":                     "123456789012,123456789013",
+				"AMIQUERY_OWNER_IDS":                     "123456789012:prod,123456789013",
 				"AMIQUERY_REGIONS":                       "us-west-1,us-west-2",
+				"AMIQUERY_DISCOVER_REGIONS":              "true",
+				"AMIQUERY_REGION_DISCOVERY_TTL":          "2h",
+				"AMIQUERY_DISCOVERY_REGION":              "us-gov-west-1",
 				"AMIQUERY_CACHE_TTL":                     "20m",
+				"AMIQUERY_CACHE_PERMISSION_TTL":          "6h",
 				"AMIQUERY_CACHE_MAX_CONCURRENT_REQUESTS": "1",
 				"AMIQUERY_CACHE_MAX_REQUEST_RETRIES":     "1",
+				"AMIQUERY_CACHE_REQUEST_RATE":            "2.5",
+				"AMIQUERY_CACHE_REQUEST_BURST":           "5",
 				"AMIQUERY_APP_LOGFILE":                   "/tmp/app.log",
 				"AMIQUERY_HTTP_LOGFILE":                  "/tmp/http.log",
+				"AMIQUERY_HTTP_MAX_AGE":                  "5m",
 				"AMIQUERY_CORS_ALLOWED_ORIGINS":          "foo.com, bar.com , baz.com",
 				"AMIQUERY_COLLECT_LAUNCH_PERMISSIONS":    "false",
 				"SSL_CERTIFICATE_FILE":                   "/tmp/test.crt",
 				"SSL_KEY_FILE":                           "/tmp/test.key",
+				"AMIQUERY_ADMIN_TOKEN":                   "foo",
+				"AMIQUERY_ADMIN_REFRESH_COOLDOWN":        "30s",
+				"AMIQUERY_EVENT_QUEUE_URL":               "https://sqs.us-west-2.amazonaws.com/123456789012/ami-events",
+				"AMIQUERY_WEBHOOKS_FILE":                 "testdata/webhooks.json",
+				"AMIQUERY_WEBHOOK_QUEUE_DIR":             "/tmp/webhooks",
+				"AMIQUERY_HISTORY_FILE":                  "/tmp/history.jsonl",
+				"AMIQUERY_HISTORY_RETENTION":             "720h",
+				"AMIQUERY_CATALOG_FILE":                  "testdata/catalog.yaml",
+				"AMIQUERY_SOURCES_FILE":                  "testdata/sources.json",
+				"AMIQUERY_STS_ENDPOINT":                  "https://vpce-1.sts.us-west-2.vpce.amazonaws.com",
+				"AMIQUERY_EC2_ENDPOINT":                  "https://vpce-2.ec2.{region}.vpce.amazonaws.com",
+				"AMIQUERY_EC2_REGION_ENDPOINTS":          "us-west-1=http://localhost:4566, us-west-2=https://ec2.example.com",
+				"AMIQUERY_API_KEYS_FILE":                 "testdata/api_keys.json",
+				"AMIQUERY_JWKS_FILE":                     "testdata/jwks.json",
+				"AMIQUERY_JWT_ISSUER":                    "https://issuer.example.com",
+				"AMIQUERY_JWT_AUDIENCE":                  "ami-query",
+				"AMIQUERY_AUDIT_LOGFILE":                 "/tmp/audit.log",
+				"AMIQUERY_TLS_CLIENT_CA_FILE":            "testdata/client_ca.pem",
+				"AMIQUERY_TLS_CLIENT_AUTH":               "optional",
+				"AMIQUERY_TLS_CLIENT_PRINCIPALS_FILE":    "testdata/client_principals.json",
+				"AMIQUERY_TLS_MIN_VERSION":               "1.3",
+				"AMIQUERY_TLS_CIPHER_SUITES":             "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+				"AMIQUERY_TLS_RELOAD_INTERVAL":           "30s",
+				"AMIQUERY_POLICY_FILE":                   "testdata/policy.json",
+				"AMIQUERY_RATE_LIMIT":                    "2.5",
+				"AMIQUERY_RATE_LIMIT_BURST":              "10",
+				"AMIQUERY_RATE_LIMIT_QUOTAS_FILE":        "testdata/rate_limit_quotas.json",
 			},
 			want: &Config{
 				ListenAddr:                 ":8081",
@@ -61,16 +105,81 @@ func TestConfig(t *testing.T) {
 				TagFilter:                  "foo",
 				StateTag:                   "foo",
 				Regions:                    []string{"us-west-1", "us-west-2"},
+				DiscoverRegions:            true,
+				RegionDiscoveryTTL:         2 * time.Hour,
+				DiscoveryRegion:            "us-gov-west-1",
 				OwnerIDs:                   []string{"123456789012", "123456789013"},
+				OwnerAliases:               map[string]string{"123456789012": "prod"},
 				CacheTTL:                   20 * time.Minute,
+				CachePermissionTTL:         6 * time.Hour,
 				CacheMaxConcurrentRequests: 1,
 				CacheMaxRequestRetries:     1,
+				CacheRequestRate:           2.5,
+				CacheRequestBurst:          5,
 				AppLog:                     "/tmp/app.log",
 				HTTPLog:                    "/tmp/http.log",
+				HTTPMaxAge:                 5 * time.Minute,
 				CorsAllowedOrigins:         []string{"foo.com", "bar.com", "baz.com"},
 				CollectLaunchPermissions:   false,
 				SSLCert:                    "/tmp/test.crt",
 				SSLKey:                     "/tmp/test.key",
+				AdminToken:                 "foo",
+				AdminRefreshCooldown:       30 * time.Second,
+				EventQueueURL:              "https://sqs.us-west-2.amazonaws.com/123456789012/ami-events",
+				Webhooks: []WebhookConfig{{
+					ID:     "platform",
+					URL:    "https://example.com/hooks/ami",
+					Secret: "foo",
+					Filter: "region=us-west-2&status=available",
+				}},
+				WebhookQueueDir:  "/tmp/webhooks",
+				HistoryFile:      "/tmp/history.jsonl",
+				HistoryRetention: 720 * time.Hour,
+				CatalogFile:      "testdata/catalog.yaml",
+				Sources: []SourceConfig{
+					{Name: "catalog", File: "testdata/catalog.yaml", RawTTL: "5m", TTL: 5 * time.Minute},
+					{Name: "mirror", URL: "https://ami-query.example.com/amis"},
+				},
+				STSEndpoint: "https://vpce-1.sts.us-west-2.vpce.amazonaws.com",
+				EC2Endpoint: "https://vpce-2.ec2.{region}.vpce.amazonaws.com",
+				EC2RegionEndpoints: map[string]string{
+					"us-west-1": "http://localhost:4566",
+					"us-west-2": "https://ec2.example.com",
+				},
+				APIKeys: []APIKeyConfig{
+					{Name: "ci", SHA256: "2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"},
+					{Name: "deploy", SHA256: "fcde2b2edba56bf408601fb721fe9b5c338d10ee429ea04fae5511b68fbf8fb9"},
+				},
+				JWKSFile:        "testdata/jwks.json",
+				JWTIssuer:       "https://issuer.example.com",
+				JWTAudience:     "ami-query",
+				AuditLog:        "/tmp/audit.log",
+				TLSClientCAFile: "testdata/client_ca.pem",
+				TLSClientAuth:   tls.VerifyClientCertIfGiven,
+				TLSClientPrincipals: map[string]string{
+					"CN=ci.example.com,O=Example":     "ci",
+					"CN=deploy.example.com,O=Example": "deploy",
+				},
+				TLSMinVersion: tls.VersionTLS13,
+				TLSCipherSuites: []uint16{
+					tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+					tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+				},
+				TLSReloadInterval: 30 * time.Second,
+				Policy: map[string]auth.Rule{
+					"ci": {
+						Owners:  []string{"123456789012"},
+						Regions: []string{"us-west-2"},
+						Tags:    map[string][]string{"team": {"platform", "security"}},
+					},
+					"*": {Owners: []string{"123456789013"}},
+				},
+				RateLimit:      2.5,
+				RateLimitBurst: 10,
+				RateLimitQuotas: map[string]ratelimit.Limit{
+					"ci":     {Rate: 50, Burst: 100},
+					"deploy": {Rate: 0},
+				},
 			},
 			err: nil,
 		},
@@ -80,6 +189,55 @@ func TestConfig(t *testing.T) {
 			want: nil,
 			err:  errors.New("AMIQUERY_ROLE_NAME is undefined"),
 		},
+		{
+			name: "catalog_settings",
+			vars: map[string]string{
+				"AMIQUERY_OWNER_IDS":    "123456789012",
+				"AMIQUERY_CATALOG_FILE": "testdata/catalog.yaml",
+			},
+			want: &Config{
+				ListenAddr:               ":8080",
+				OwnerIDs:                 []string{"123456789012"},
+				CacheTTL:                 15 * time.Minute,
+				CachePermissionTTL:       time.Hour,
+				CollectLaunchPermissions: true,
+				AdminRefreshCooldown:     time.Minute,
+				HistoryRetention:         90 * 24 * time.Hour,
+				TLSMinVersion:            tls.VersionTLS12,
+				TLSReloadInterval:        time.Minute,
+				RateLimitBurst:           20,
+				CatalogFile:              "testdata/catalog.yaml",
+			},
+			err: nil,
+		},
+		{
+			name: "catalog_without_owner_ids",
+			vars: map[string]string{
+				"AMIQUERY_CATALOG_FILE": "testdata/catalog.yaml",
+			},
+			want: &Config{
+				ListenAddr:               ":8080",
+				CacheTTL:                 15 * time.Minute,
+				CachePermissionTTL:       time.Hour,
+				CollectLaunchPermissions: true,
+				AdminRefreshCooldown:     time.Minute,
+				HistoryRetention:         90 * 24 * time.Hour,
+				TLSMinVersion:            tls.VersionTLS12,
+				TLSReloadInterval:        time.Minute,
+				RateLimitBurst:           20,
+				CatalogFile:              "testdata/catalog.yaml",
+			},
+			err: nil,
+		},
+		{
+			name: "bad_catalog_file",
+			vars: map[string]string{
+				"AMIQUERY_OWNER_IDS":    "123456789012",
+				"AMIQUERY_CATALOG_FILE": "testdata/missing.yaml",
+			},
+			want: nil,
+			err:  errors.New("failed to read AMIQUERY_CATALOG_FILE: stat testdata/missing.yaml: no such file or directory"),
+		},
 		{
 			name: "missing_owner_ids",
 			vars: map[string]string{
@@ -98,6 +256,16 @@ func TestConfig(t *testing.T) {
 			want: nil,
 			err:  errors.New("failed to read AMIQUERY_CACHE_TTL: time: invalid duration \"foo\""),
 		},
+		{
+			name: "bad_cache_permission_ttl_value",
+			vars: map[string]string{
+				"AMIQUERY_ROLE_NAME":            "foo",
+				"AMIQUERY_OWNER_IDS":            "123456789012,123456789013",
+				"AMIQUERY_CACHE_PERMISSION_TTL": "foo",
+			},
+			want: nil,
+			err:  errors.New("failed to read AMIQUERY_CACHE_PERMISSION_TTL: time: invalid duration \"foo\""),
+		},
 		{
 			name: "bad_cache_max_requests_value",
 			vars: map[string]string{
@@ -118,6 +286,241 @@ func TestConfig(t *testing.T) {
 			want: nil,
 			err:  errors.New(`failed to read AMIQUERY_CACHE_MAX_REQUEST_RETRIES: strconv.Atoi: parsing "1foo": invalid syntax`),
 		},
+		{
+			name: "bad_cache_request_rate_value",
+			vars: map[string]string{
+				"AMIQUERY_ROLE_NAME":          "foo",
+				"AMIQUERY_OWNER_IDS":          "123456789012,123456789013",
+				"AMIQUERY_CACHE_REQUEST_RATE": "1foo",
+			},
+			want: nil,
+			err:  errors.New(`failed to read AMIQUERY_CACHE_REQUEST_RATE: strconv.ParseFloat: parsing "1foo": invalid syntax`),
+		},
+		{
+			name: "bad_cache_request_burst_value",
+			vars: map[string]string{
+				"AMIQUERY_ROLE_NAME":           "foo",
+				"AMIQUERY_OWNER_IDS":           "123456789012,123456789013",
+				"AMIQUERY_CACHE_REQUEST_BURST": "1foo",
+			},
+			want: nil,
+			err:  errors.New(`failed to read AMIQUERY_CACHE_REQUEST_BURST: strconv.Atoi: parsing "1foo": invalid syntax`),
+		},
+		{
+			name: "bad_discover_regions_value",
+			vars: map[string]string{
+				"AMIQUERY_ROLE_NAME":        "foo",
+				"AMIQUERY_OWNER_IDS":        "123456789012,123456789013",
+				"AMIQUERY_DISCOVER_REGIONS": "foo",
+			},
+			want: nil,
+			err:  errors.New(`failed to read AMIQUERY_DISCOVER_REGIONS: strconv.ParseBool: parsing "foo": invalid syntax`),
+		},
+		{
+			name: "bad_admin_refresh_cooldown_value",
+			vars: map[string]string{
+				"AMIQUERY_ROLE_NAME":              "foo",
+				"AMIQUERY_OWNER_IDS":              "123456789012,123456789013",
+				"AMIQUERY_ADMIN_REFRESH_COOLDOWN": "foo",
+			},
+			want: nil,
+			err:  errors.New("failed to read AMIQUERY_ADMIN_REFRESH_COOLDOWN: time: invalid duration \"foo\""),
+		},
+		{
+			name: "bad_http_max_age_value",
+			vars: map[string]string{
+				"AMIQUERY_ROLE_NAME":    "foo",
+				"AMIQUERY_OWNER_IDS":    "123456789012,123456789013",
+				"AMIQUERY_HTTP_MAX_AGE": "foo",
+			},
+			want: nil,
+			err:  errors.New("failed to read AMIQUERY_HTTP_MAX_AGE: time: invalid duration \"foo\""),
+		},
+		{
+			name: "bad_history_retention_value",
+			vars: map[string]string{
+				"AMIQUERY_ROLE_NAME":         "foo",
+				"AMIQUERY_OWNER_IDS":         "123456789012,123456789013",
+				"AMIQUERY_HISTORY_RETENTION": "foo",
+			},
+			want: nil,
+			err:  errors.New("failed to read AMIQUERY_HISTORY_RETENTION: time: invalid duration \"foo\""),
+		},
+		{
+			name: "bad_webhooks_file",
+			vars: map[string]string{
+				"AMIQUERY_ROLE_NAME":     "foo",
+				"AMIQUERY_OWNER_IDS":     "123456789012,123456789013",
+				"AMIQUERY_WEBHOOKS_FILE": "testdata/webhooks_bad_url.json",
+			},
+			want: nil,
+			err:  errors.New("failed to read AMIQUERY_WEBHOOKS_FILE: invalid webhook url: ftp://example.com/hooks/ami"),
+		},
+		{
+			name: "bad_sources_file",
+			vars: map[string]string{
+				"AMIQUERY_ROLE_NAME":    "foo",
+				"AMIQUERY_OWNER_IDS":    "123456789012,123456789013",
+				"AMIQUERY_SOURCES_FILE": "testdata/sources_bad_url.json",
+			},
+			want: nil,
+			err:  errors.New("failed to read AMIQUERY_SOURCES_FILE: invalid source url: ftp://ami-query.example.com/amis"),
+		},
+		{
+			name: "bad_sts_endpoint",
+			vars: map[string]string{
+				"AMIQUERY_ROLE_NAME":    "foo",
+				"AMIQUERY_OWNER_IDS":    "123456789012,123456789013",
+				"AMIQUERY_STS_ENDPOINT": "sts.example.com",
+			},
+			want: nil,
+			err:  errors.New("failed to read AMIQUERY_STS_ENDPOINT: invalid endpoint url: sts.example.com"),
+		},
+		{
+			name: "bad_ec2_endpoint",
+			vars: map[string]string{
+				"AMIQUERY_ROLE_NAME":    "foo",
+				"AMIQUERY_OWNER_IDS":    "123456789012,123456789013",
+				"AMIQUERY_EC2_ENDPOINT": "ftp://ec2.{region}.example.com",
+			},
+			want: nil,
+			err:  errors.New("failed to read AMIQUERY_EC2_ENDPOINT: invalid endpoint url: ftp://ec2.{region}.example.com"),
+		},
+		{
+			name: "bad_ec2_region_endpoints",
+			vars: map[string]string{
+				"AMIQUERY_ROLE_NAME":            "foo",
+				"AMIQUERY_OWNER_IDS":            "123456789012,123456789013",
+				"AMIQUERY_EC2_REGION_ENDPOINTS": "us-west-2",
+			},
+			want: nil,
+			err:  errors.New("failed to read AMIQUERY_EC2_REGION_ENDPOINTS: invalid endpoint: us-west-2"),
+		},
+		{
+			name: "bad_api_keys_file",
+			vars: map[string]string{
+				"AMIQUERY_ROLE_NAME":     "foo",
+				"AMIQUERY_OWNER_IDS":     "123456789012,123456789013",
+				"AMIQUERY_API_KEYS_FILE": "testdata/api_keys_bad_hash.json",
+			},
+			want: nil,
+			err:  errors.New("failed to read AMIQUERY_API_KEYS_FILE: api key ci: invalid sha256 hash"),
+		},
+		{
+			name: "bad_jwks_file",
+			vars: map[string]string{
+				"AMIQUERY_ROLE_NAME": "foo",
+				"AMIQUERY_OWNER_IDS": "123456789012,123456789013",
+				"AMIQUERY_JWKS_FILE": "testdata/missing.json",
+			},
+			want: nil,
+			err:  errors.New("failed to read AMIQUERY_JWKS_FILE: stat testdata/missing.json: no such file or directory"),
+		},
+		{
+			name: "client_ca_without_certificate",
+			vars: map[string]string{
+				"AMIQUERY_ROLE_NAME":          "foo",
+				"AMIQUERY_OWNER_IDS":          "123456789012,123456789013",
+				"AMIQUERY_TLS_CLIENT_CA_FILE": "testdata/client_ca.pem",
+			},
+			want: nil,
+			err:  errors.New("AMIQUERY_TLS_CLIENT_CA_FILE requires SSL_CERTIFICATE_FILE and SSL_KEY_FILE"),
+		},
+		{
+			name: "bad_tls_client_auth",
+			vars: map[string]string{
+				"AMIQUERY_ROLE_NAME":          "foo",
+				"AMIQUERY_OWNER_IDS":          "123456789012,123456789013",
+				"SSL_CERTIFICATE_FILE":        "/tmp/test.crt",
+				"SSL_KEY_FILE":                "/tmp/test.key",
+				"AMIQUERY_TLS_CLIENT_CA_FILE": "testdata/client_ca.pem",
+				"AMIQUERY_TLS_CLIENT_AUTH":    "sometimes",
+			},
+			want: nil,
+			err:  errors.New("failed to read AMIQUERY_TLS_CLIENT_AUTH: invalid value: sometimes"),
+		},
+		{
+			name: "bad_tls_min_version",
+			vars: map[string]string{
+				"AMIQUERY_ROLE_NAME":       "foo",
+				"AMIQUERY_OWNER_IDS":       "123456789012,123456789013",
+				"AMIQUERY_TLS_MIN_VERSION": "1.4",
+			},
+			want: nil,
+			err:  errors.New("failed to read AMIQUERY_TLS_MIN_VERSION: unsupported tls version: 1.4"),
+		},
+		{
+			name: "bad_tls_cipher_suites",
+			vars: map[string]string{
+				"AMIQUERY_ROLE_NAME":         "foo",
+				"AMIQUERY_OWNER_IDS":         "123456789012,123456789013",
+				"AMIQUERY_TLS_CIPHER_SUITES": "TLS_RSA_WITH_RC4_128_SHA",
+			},
+			want: nil,
+			err:  errors.New("failed to read AMIQUERY_TLS_CIPHER_SUITES: unsupported cipher suite: TLS_RSA_WITH_RC4_128_SHA"),
+		},
+		{
+			name: "bad_tls_reload_interval",
+			vars: map[string]string{
+				"AMIQUERY_ROLE_NAME":           "foo",
+				"AMIQUERY_OWNER_IDS":           "123456789012,123456789013",
+				"AMIQUERY_TLS_RELOAD_INTERVAL": "foo",
+			},
+			want: nil,
+			err:  errors.New(`failed to read AMIQUERY_TLS_RELOAD_INTERVAL: time: invalid duration "foo"`),
+		},
+		{
+			name: "policy_without_authentication",
+			vars: map[string]string{
+				"AMIQUERY_ROLE_NAME":   "foo",
+				"AMIQUERY_OWNER_IDS":   "123456789012,123456789013",
+				"AMIQUERY_POLICY_FILE": "testdata/policy.json",
+			},
+			want: nil,
+			err:  errors.New("AMIQUERY_POLICY_FILE requires AMIQUERY_API_KEYS_FILE, AMIQUERY_JWKS_FILE or AMIQUERY_TLS_CLIENT_CA_FILE"),
+		},
+		{
+			name: "bad_policy_file",
+			vars: map[string]string{
+				"AMIQUERY_ROLE_NAME":     "foo",
+				"AMIQUERY_OWNER_IDS":     "123456789012,123456789013",
+				"AMIQUERY_API_KEYS_FILE": "testdata/api_keys.json",
+				"AMIQUERY_POLICY_FILE":   "testdata/policy_bad_tags.json",
+			},
+			want: nil,
+			err:  errors.New("failed to read AMIQUERY_POLICY_FILE: rule ci: tag team has no values"),
+		},
+		{
+			name: "bad_rate_limit",
+			vars: map[string]string{
+				"AMIQUERY_ROLE_NAME":  "foo",
+				"AMIQUERY_OWNER_IDS":  "123456789012,123456789013",
+				"AMIQUERY_RATE_LIMIT": "foo",
+			},
+			want: nil,
+			err:  errors.New(`failed to read AMIQUERY_RATE_LIMIT: strconv.ParseFloat: parsing "foo": invalid syntax`),
+		},
+		{
+			name: "bad_rate_limit_burst",
+			vars: map[string]string{
+				"AMIQUERY_ROLE_NAME":        "foo",
+				"AMIQUERY_OWNER_IDS":        "123456789012,123456789013",
+				"AMIQUERY_RATE_LIMIT_BURST": "0",
+			},
+			want: nil,
+			err:  errors.New("failed to read AMIQUERY_RATE_LIMIT_BURST: must be at least 1"),
+		},
+		{
+			name: "bad_rate_limit_quotas_file",
+			vars: map[string]string{
+				"AMIQUERY_ROLE_NAME":              "foo",
+				"AMIQUERY_OWNER_IDS":              "123456789012,123456789013",
+				"AMIQUERY_API_KEYS_FILE":          "testdata/api_keys.json",
+				"AMIQUERY_RATE_LIMIT_QUOTAS_FILE": "testdata/rate_limit_quotas_bad_burst.json",
+			},
+			want: nil,
+			err:  errors.New("failed to read AMIQUERY_RATE_LIMIT_QUOTAS_FILE: quota ci: burst must be at least 1"),
+		},
 		{
 			name: "bad_collect_launch_permissions_value",
 			vars: map[string]string{
@@ -159,14 +562,49 @@ func clearVars() error {
 		"AMIQUERY_STATE_TAG",
 		"AMIQUERY_OWNER_IDS",
 		"AMIQUERY_REGIONS",
+		"AMIQUERY_DISCOVER_REGIONS",
+		"AMIQUERY_REGION_DISCOVERY_TTL",
+		"AMIQUERY_DISCOVERY_REGION",
 		"AMIQUERY_CACHE_TTL",
+		"AMIQUERY_CACHE_PERMISSION_TTL",
 		"AMIQUERY_CACHE_MAX_CONCURRENT_REQUESTS",
 		"AMIQUERY_CACHE_MAX_REQUEST_RETRIES",
+		"AMIQUERY_CACHE_REQUEST_RATE",
+		"AMIQUERY_CACHE_REQUEST_BURST",
 		"AMIQUERY_APP_LOGFILE",
 		"AMIQUERY_HTTP_LOGFILE",
+		"AMIQUERY_HTTP_MAX_AGE",
 		"AMIQUERY_CORS_ALLOWED_ORIGINS",
+		"AMIQUERY_COLLECT_LAUNCH_PERMISSIONS",
 		"SSL_CERTIFICATE_FILE",
 		"SSL_KEY_FILE",
+		"AMIQUERY_ADMIN_TOKEN",
+		"AMIQUERY_ADMIN_REFRESH_COOLDOWN",
+		"AMIQUERY_EVENT_QUEUE_URL",
+		"AMIQUERY_WEBHOOKS_FILE",
+		"AMIQUERY_WEBHOOK_QUEUE_DIR",
+		"AMIQUERY_HISTORY_FILE",
+		"AMIQUERY_HISTORY_RETENTION",
+		"AMIQUERY_CATALOG_FILE",
+		"AMIQUERY_SOURCES_FILE",
+		"AMIQUERY_STS_ENDPOINT",
+		"AMIQUERY_EC2_ENDPOINT",
+		"AMIQUERY_EC2_REGION_ENDPOINTS",
+		"AMIQUERY_API_KEYS_FILE",
+		"AMIQUERY_JWKS_FILE",
+		"AMIQUERY_JWT_ISSUER",
+		"AMIQUERY_JWT_AUDIENCE",
+		"AMIQUERY_AUDIT_LOGFILE",
+		"AMIQUERY_TLS_CLIENT_CA_FILE",
+		"AMIQUERY_TLS_CLIENT_AUTH",
+		"AMIQUERY_TLS_CLIENT_PRINCIPALS_FILE",
+		"AMIQUERY_TLS_MIN_VERSION",
+		"AMIQUERY_TLS_CIPHER_SUITES",
+		"AMIQUERY_TLS_RELOAD_INTERVAL",
+		"AMIQUERY_POLICY_FILE",
+		"AMIQUERY_RATE_LIMIT",
+		"AMIQUERY_RATE_LIMIT_BURST",
+		"AMIQUERY_RATE_LIMIT_QUOTAS_FILE",
 	}
 	for _, v := range vars {
 		if err := os.Unsetenv(v); err != nil {
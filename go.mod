@@ -14,4 +14,5 @@ require (
 	github.com/oklog/oklog v0.2.2
 	github.com/stretchr/testify v1.4.0 // indirect
 	golang.org/x/net v0.0.0-20191014212845-da9a3fd4c582 // indirect
+	gopkg.in/yaml.v2 v2.2.2
 )
@@ -0,0 +1,436 @@
+// Copyright 2020 Intuit, Inc.  All rights reserved.
+// Use of this source code is governed the MIT license
+// that can be found in the LICENSE file.
+
+// Package history records the changes made to the images cached by an
+// amicache.Cache so the catalog can be queried at a point in time.
+package history
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/intuit/ami-query/amicache"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// The time between removals of the versions older than the retention window.
+const pruneInterval = time.Hour
+
+// ErrOutOfRange is returned when the history doesn't cover the requested
+// time.
+var ErrOutOfRange = errors.New("time is outside of the recorded history")
+
+// Snapshot is the recorded version of an image.
+type Snapshot struct {
+	ID                 string            `json:"id"`
+	OwnerID            string            `json:"owner_id"`
+	Region             string            `json:"region"`
+	Name               string            `json:"name"`
+	Description        string            `json:"description"`
+	VirtualizationType string            `json:"virtualizationtype"`
+	CreationDate       string            `json:"creationdate"`
+	Tags               map[string]string `json:"tags"`
+	LaunchPermissions  []string          `json:"launch_permissions,omitempty"`
+}
+
+// Returns the snapshot of a cached image.
+func newSnapshot(image amicache.Image) Snapshot {
+	s := Snapshot{
+		ID:                 aws.StringValue(image.Image.ImageId),
+		OwnerID:            image.OwnerID,
+		Region:             image.Region,
+		Name:               aws.StringValue(image.Image.Name),
+		Description:        aws.StringValue(image.Image.Description),
+		VirtualizationType: aws.StringValue(image.Image.VirtualizationType),
+		CreationDate:       aws.StringValue(image.Image.CreationDate),
+		Tags:               image.Tags(),
+	}
+	if perms := image.LaunchPermissions(); len(perms) > 0 {
+		s.LaunchPermissions = perms
+	}
+	return s
+}
+
+// Image returns the snapshot as an amicache.Image.
+func (s Snapshot) Image() amicache.Image {
+	image := &ec2.Image{
+		ImageId:            aws.String(s.ID),
+		Name:               aws.String(s.Name),
+		Description:        aws.String(s.Description),
+		VirtualizationType: aws.String(s.VirtualizationType),
+		CreationDate:       aws.String(s.CreationDate),
+	}
+
+	keys := []string{}
+	for key := range s.Tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		image.Tags = append(image.Tags, &ec2.Tag{
+			Key:   aws.String(key),
+			Value: aws.String(s.Tags[key]),
+		})
+	}
+
+	return amicache.NewImage(image, s.OwnerID, s.Region, s.LaunchPermissions)
+}
+
+// A version of an image, valid from From until To. A zero To means it's the
+// current version.
+type version struct {
+	From     time.Time
+	To       time.Time
+	Snapshot Snapshot
+}
+
+// The operations stored in the history file.
+const (
+	opPut    = "put"
+	opDelete = "delete"
+)
+
+// A record in the history file. Put records start a new version of an image
+// and delete records end the current version.
+type record struct {
+	Op       string    `json:"op"`
+	Time     time.Time `json:"time"`
+	ID       string    `json:"id"`
+	Snapshot *Snapshot `json:"image,omitempty"`
+}
+
+// Store is an embedded store of image versions. It's kept in memory and
+// persisted to an append-only file that is compacted as versions expire.
+type Store struct {
+	file      string
+	retention time.Duration
+	started   time.Time            // When the recorded history starts
+	versions  map[string][]version // Image versions by image ID, oldest first
+	w         *os.File
+	logger    log.Logger
+	mu        sync.RWMutex // guards started, versions and w
+}
+
+// Open opens or creates the history file. Versions that ended before the
+// retention window are discarded.
+func Open(file string, retention time.Duration, logger log.Logger) (*Store, error) {
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+
+	s := &Store{
+		file:      file,
+		retention: retention,
+		versions:  map[string][]version{},
+		logger:    logger,
+	}
+
+	if err := s.load(); err != nil {
+		return nil, fmt.Errorf("failed to load history: %v", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.compact(time.Now()); err != nil {
+		return nil, fmt.Errorf("failed to compact history: %v", err)
+	}
+
+	return s, nil
+}
+
+// Close closes the history file.
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Close()
+}
+
+// Run records the changes made to the cache until the context is done. The
+// cache should be warm before it's called. The history is first synced with
+// the cached images, which ends the versions of images removed while it
+// wasn't running.
+func (s *Store) Run(ctx context.Context, cache *amicache.Cache) error {
+	return s.run(ctx, cache)
+}
+
+func (s *Store) run(ctx context.Context, cache source) error {
+	generation := cache.Generation()
+
+	images := []amicache.Image{}
+	for _, region := range cache.Regions() {
+		regionImages, err := cache.Images(region)
+		if err != nil {
+			return err
+		}
+		images = append(images, regionImages...)
+	}
+
+	if err := s.sync(time.Now(), images); err != nil {
+		level.Error(s.logger).Log("history", "sync_failed", "error", err)
+	}
+
+	prune := time.NewTicker(pruneInterval)
+	defer prune.Stop()
+
+	for {
+		sets, complete, changed := cache.ChangesSince(generation)
+		if !complete {
+			level.Warn(s.logger).Log("history", "changes_missed", "generation", generation)
+			generation = cache.Generation()
+		}
+
+		for _, set := range sets {
+			generation = set.Generation
+			if err := s.record(set); err != nil {
+				level.Error(s.logger).Log("history", "record_failed", "generation", set.Generation, "error", err)
+			}
+		}
+
+		select {
+		case <-changed:
+		case <-prune.C:
+			s.mu.Lock()
+			if err := s.compact(time.Now()); err != nil {
+				level.Error(s.logger).Log("history", "compact_failed", "error", err)
+			}
+			s.mu.Unlock()
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Images returns the images that were cached at the provided time. It returns
+// ErrOutOfRange if the time is before the start of the history or in the
+// future.
+func (s *Store) Images(t time.Time) ([]amicache.Image, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.started.IsZero() || t.Before(s.started) || t.After(time.Now()) {
+		return nil, ErrOutOfRange
+	}
+
+	images := []amicache.Image{}
+	for _, versions := range s.versions {
+		for _, v := range versions {
+			if !v.From.After(t) && (v.To.IsZero() || v.To.After(t)) {
+				images = append(images, v.Snapshot.Image())
+				break
+			}
+		}
+	}
+
+	return images, nil
+}
+
+// Records the changes in a change set.
+func (s *Store) record(set amicache.ChangeSet) error {
+	records := []record{}
+	for _, change := range set.Changes {
+		id := aws.StringValue(change.Image.Image.ImageId)
+		if change.Type == amicache.ImageRemoved {
+			records = append(records, record{Op: opDelete, Time: set.Time, ID: id})
+			continue
+		}
+		snapshot := newSnapshot(change.Image)
+		records = append(records, record{Op: opPut, Time: set.Time, ID: id, Snapshot: &snapshot})
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.write(records)
+}
+
+// Puts the current images and deletes any others.
+func (s *Store) sync(t time.Time, images []amicache.Image) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current := map[string]struct{}{}
+	records := []record{}
+	for _, image := range images {
+		snapshot := newSnapshot(image)
+		current[snapshot.ID] = struct{}{}
+		records = append(records, record{Op: opPut, Time: t, ID: snapshot.ID, Snapshot: &snapshot})
+	}
+
+	for id := range s.versions {
+		if _, ok := current[id]; !ok {
+			records = append(records, record{Op: opDelete, Time: t, ID: id})
+		}
+	}
+
+	return s.write(records)
+}
+
+// Applies the records and appends the ones that changed the history to the
+// file. The caller must hold s.mu.
+func (s *Store) write(records []record) error {
+	enc := json.NewEncoder(s.w)
+	for _, r := range records {
+		if !s.apply(r) {
+			continue
+		}
+		if err := enc.Encode(r); err != nil {
+			return err
+		}
+	}
+	return s.w.Sync()
+}
+
+// Applies a record to the versions. It returns false if the record doesn't
+// change the history. The caller must hold s.mu.
+func (s *Store) apply(r record) bool {
+	versions := s.versions[r.ID]
+
+	var current *version
+	if n := len(versions); n > 0 && versions[n-1].To.IsZero() {
+		current = &versions[n-1]
+	}
+
+	switch r.Op {
+	case opPut:
+		if r.Snapshot == nil {
+			return false
+		}
+		if current != nil {
+			if reflect.DeepEqual(current.Snapshot, *r.Snapshot) {
+				return false
+			}
+			current.To = r.Time
+		}
+		s.versions[r.ID] = append(versions, version{From: r.Time, Snapshot: *r.Snapshot})
+	case opDelete:
+		if current == nil {
+			return false
+		}
+		current.To = r.Time
+	default:
+		return false
+	}
+
+	if s.started.IsZero() || r.Time.Before(s.started) {
+		s.started = r.Time
+	}
+
+	return true
+}
+
+// Loads the versions from the history file.
+func (s *Store) load() error {
+	f, err := os.Open(s.file)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	for scanner.Scan() {
+		var r record
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			// A partially written record is skipped.
+			level.Warn(s.logger).Log("history", "invalid_record", "error", err)
+			continue
+		}
+		s.apply(r)
+	}
+
+	return scanner.Err()
+}
+
+// Discards the versions that ended before the retention window and rewrites
+// the history file. The caller must hold s.mu.
+func (s *Store) compact(now time.Time) error {
+	cutoff := now.Add(-s.retention)
+
+	records := []record{}
+	for id, versions := range s.versions {
+		kept := []version{}
+		for _, v := range versions {
+			if !v.To.IsZero() && v.To.Before(cutoff) {
+				continue
+			}
+			kept = append(kept, v)
+			snapshot := v.Snapshot
+			records = append(records, record{Op: opPut, Time: v.From, ID: id, Snapshot: &snapshot})
+			if !v.To.IsZero() {
+				records = append(records, record{Op: opDelete, Time: v.To, ID: id})
+			}
+		}
+		if len(kept) == 0 {
+			delete(s.versions, id)
+			continue
+		}
+		s.versions[id] = kept
+	}
+
+	// Versions can only be looked up within the retention window.
+	if !s.started.IsZero() && s.started.Before(cutoff) {
+		s.started = cutoff
+	}
+
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Time.Before(records[j].Time)
+	})
+
+	tmp := s.file + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(f)
+	for _, r := range records {
+		if err := enc.Encode(r); err != nil {
+			f.Close()
+			return err
+		}
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := os.Rename(tmp, filepath.Clean(s.file)); err != nil {
+		f.Close()
+		return err
+	}
+
+	if s.w != nil {
+		s.w.Close()
+	}
+	s.w = f
+
+	return nil
+}
+
+// source is used to represent an amicache.Cache. Used to mock the cache in
+// tests.
+type source interface {
+	Generation() uint64
+	ChangesSince(uint64) ([]amicache.ChangeSet, bool, <-chan struct{})
+	Regions() []string
+	Images(string) ([]amicache.Image, error)
+}
@@ -0,0 +1,291 @@
+// Copyright 2020 Intuit, Inc.  All rights reserved.
+// Use of this source code is governed the MIT license
+// that can be found in the LICENSE file.
+
+package history
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/intuit/ami-query/amicache"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+type mockCache struct {
+	mu      sync.Mutex
+	images  []amicache.Image
+	sets    []amicache.ChangeSet
+	changed chan struct{}
+}
+
+func (m *mockCache) Generation() uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return uint64(len(m.sets))
+}
+
+func (m *mockCache) ChangesSince(generation uint64) ([]amicache.ChangeSet, bool, <-chan struct{}) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]amicache.ChangeSet{}, m.sets[generation:]...), true, m.changed
+}
+
+func (m *mockCache) Regions() []string { return []string{"us-west-2"} }
+
+func (m *mockCache) Images(string) ([]amicache.Image, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.images, nil
+}
+
+// Records a change set at the provided time.
+func (m *mockCache) record(t time.Time, changes ...amicache.Change) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sets = append(m.sets, amicache.ChangeSet{
+		Generation: uint64(len(m.sets) + 1),
+		Time:       t,
+		Changes:    changes,
+	})
+	close(m.changed)
+	m.changed = make(chan struct{})
+}
+
+// Returns a cached image in the provided state.
+func newImage(id, state string) amicache.Image {
+	return amicache.NewImage(&ec2.Image{
+		ImageId: aws.String(id),
+		Name:    aws.String(id),
+		Tags: []*ec2.Tag{{
+			Key:   aws.String(amicache.DefaultStateTag),
+			Value: aws.String(state),
+		}},
+	}, "123456789012", "us-west-2", []string{"123456789013"})
+}
+
+// Returns the ID and state of the images, sorted by ID.
+func states(images []amicache.Image) []string {
+	got := []string{}
+	for _, image := range images {
+		got = append(got, *image.Image.ImageId+":"+image.Tag(amicache.DefaultStateTag))
+	}
+	sort.Strings(got)
+	return got
+}
+
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "history.jsonl")
+
+	s, err := Open(file, 24*time.Hour, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Images(time.Now()); err != ErrOutOfRange {
+		t.Errorf("want: %v, got: %v", ErrOutOfRange, err)
+	}
+
+	var (
+		start = time.Now().Add(-time.Hour)
+		t1    = start.Add(10 * time.Minute)
+		t2    = start.Add(20 * time.Minute)
+	)
+
+	// Records the history directly to control the times of the changes.
+	if err := s.sync(start, []amicache.Image{newImage("ami-1", "available"), newImage("ami-2", "available")}); err != nil {
+		t.Fatal(err)
+	}
+
+	available := newImage("ami-1", "available")
+	if err := s.record(amicache.ChangeSet{Time: t1, Changes: []amicache.Change{
+		{Type: amicache.ImageStateChanged, Image: newImage("ami-1", "deprecated"), Previous: &available},
+		{Type: amicache.ImageAdded, Image: newImage("ami-3", "available")},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.record(amicache.ChangeSet{Time: t2, Changes: []amicache.Change{
+		{Type: amicache.ImageRemoved, Image: newImage("ami-2", "available")},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		t    time.Time
+		want []string
+		err  error
+	}{
+		{"start", start, []string{"ami-1:available", "ami-2:available"}, nil},
+		{"before_t1", t1.Add(-time.Second), []string{"ami-1:available", "ami-2:available"}, nil},
+		{"t1", t1, []string{"ami-1:deprecated", "ami-2:available", "ami-3:available"}, nil},
+		{"after_t2", t2.Add(time.Second), []string{"ami-1:deprecated", "ami-3:available"}, nil},
+		{"before_start", start.Add(-time.Second), nil, ErrOutOfRange},
+		{"future", time.Now().Add(time.Hour), nil, ErrOutOfRange},
+	}
+
+	check := func(t *testing.T, s *Store) {
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				images, err := s.Images(tt.t)
+				if tt.err != err {
+					t.Fatalf("want: %v, got: %v", tt.err, err)
+				}
+				if tt.err != nil {
+					return
+				}
+				got := states(images)
+				if len(tt.want) != len(got) {
+					t.Fatalf("want: %v, got: %v", tt.want, got)
+				}
+				for i := range tt.want {
+					if tt.want[i] != got[i] {
+						t.Errorf("want: %v, got: %v", tt.want, got)
+					}
+				}
+			})
+		}
+	}
+
+	check(t, s)
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The history is loaded when the store is reopened.
+	if s, err = Open(file, 24*time.Hour, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	check(t, s)
+
+	images, _ := s.Images(t2)
+	for _, image := range images {
+		if perms := image.LaunchPermissions(); len(perms) != 1 {
+			t.Errorf("want: 1 launch permission, got: %v", perms)
+		}
+	}
+}
+
+func TestStoreRetention(t *testing.T) {
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "history.jsonl")
+
+	s, err := Open(file, 24*time.Hour, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now().Add(-72 * time.Hour)
+	if err := s.sync(start, []amicache.Image{newImage("ami-1", "available"), newImage("ami-2", "available")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.sync(start.Add(time.Hour), []amicache.Image{newImage("ami-1", "available")}); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	// ami-2 was removed before the retention window.
+	if s, err = Open(file, 24*time.Hour, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if _, ok := s.versions["ami-2"]; ok {
+		t.Error("want: ami-2 discarded")
+	}
+
+	if _, err := s.Images(start.Add(2 * time.Hour)); err != ErrOutOfRange {
+		t.Errorf("want: %v, got: %v", ErrOutOfRange, err)
+	}
+
+	images, err := s.Images(time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := []string{"ami-1:available"}, states(images); len(got) != 1 || want[0] != got[0] {
+		t.Errorf("want: %v, got: %v", want, got)
+	}
+}
+
+func TestStoreRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := Open(filepath.Join(dir, "history.jsonl"), 24*time.Hour, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// ami-2 was removed while the store wasn't running.
+	if err := s.sync(time.Now().Add(-time.Hour), []amicache.Image{newImage("ami-1", "available"), newImage("ami-2", "available")}); err != nil {
+		t.Fatal(err)
+	}
+
+	cache := &mockCache{
+		images:  []amicache.Image{newImage("ami-1", "available")},
+		changed: make(chan struct{}),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error)
+	go func() { errCh <- s.run(ctx, cache) }()
+
+	// Waits for the current images to match want.
+	waitFor := func(want ...string) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			images, err := s.Images(time.Now())
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := states(images)
+			if reflect.DeepEqual(want, got) {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("want: %v, got: %v", want, got)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	waitFor("ami-1:available")
+
+	cache.record(time.Now(), amicache.Change{Type: amicache.ImageAdded, Image: newImage("ami-3", "available")})
+
+	waitFor("ami-1:available", "ami-3:available")
+
+	cancel()
+	if want, got := context.Canceled, <-errCh; want != got {
+		t.Errorf("want: %v, got: %v", want, got)
+	}
+}
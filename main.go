@@ -12,17 +12,26 @@ import (
 	stdlog "log"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/intuit/ami-query/amicache"
+	"github.com/intuit/ami-query/api/admin"
+	"github.com/intuit/ami-query/api/auth"
 	"github.com/intuit/ami-query/api/query"
+	"github.com/intuit/ami-query/api/ratelimit"
+	"github.com/intuit/ami-query/history"
+	"github.com/intuit/ami-query/webhook"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sqs"
 	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/aws/aws-sdk-go/service/sts/stsiface"
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 	"github.com/gorilla/handlers"
@@ -54,6 +63,12 @@ func main() {
 	)
 
 	stdlog.SetFlags(0)
+
+	// The query subcommand is a client for a remote instance.
+	if len(os.Args) > 1 && os.Args[1] == "query" {
+		os.Exit(runQuery(os.Args[2:], os.Stdout, os.Stderr))
+	}
+
 	flag.Parse()
 
 	if *printVersion {
@@ -71,20 +86,28 @@ func main() {
 		stdlog.Fatalf("failed to parse configuration: %v", err)
 	}
 
+	if err := run(context.Background(), cfg, sess, *debug); err != nil {
+		stdlog.Fatal(err)
+	}
+}
+
+// Runs the service until the context is done or it fails. The AWS clients use
+// the session's HTTP client.
+func run(parent context.Context, cfg *Config, sess *session.Session, debug bool) error {
 	appLogger, err := setLogger(cfg.AppLog)
 	if err != nil {
-		stdlog.Fatalf("failed to set application logging output: %v", err)
+		return fmt.Errorf("failed to set application logging output: %v", err)
 	}
 
 	httpLogger, err := setLogger(cfg.HTTPLog)
 	if err != nil {
-		stdlog.Fatalf("failed to set HTTP logging output: %v", err)
+		return fmt.Errorf("failed to set HTTP logging output: %v", err)
 	}
 
 	// Setup go-kit logger.
 	logger := log.NewLogfmtLogger(log.NewSyncWriter(appLogger))
 	logger = log.With(logger, "ts", log.TimestampFormat(time.Now, "2006-01-02T15:04:05.000"))
-	if *debug {
+	if debug {
 		logger = level.NewFilter(logger, level.AllowAll())
 	} else {
 		logger = level.NewFilter(logger, level.AllowInfo())
@@ -93,53 +116,216 @@ func main() {
 	// Redirect anything using stdlib log to go-kit log.
 	stdlog.SetOutput(log.NewStdlibAdapter(logger))
 
+	// Errors for unknown routes use the same JSON format as the APIs.
 	router := mux.NewRouter()
+	router.NotFoundHandler = http.HandlerFunc(query.NotFound)
+	router.MethodNotAllowedHandler = http.HandlerFunc(query.MethodNotAllowed)
+
 	server := http.Server{
 		Addr:    cfg.ListenAddr,
-		Handler: router,
+		Handler: query.RequestID(router),
 		// TODO: make these configurable?
 		WriteTimeout: 15 * time.Second,
 		ReadTimeout:  15 * time.Second,
 	}
 
-	cache := amicache.New(
-		sts.New(sess),
-		cfg.RoleName,
-		cfg.OwnerIDs,
+	// Load the TLS certificates if HTTPS is enabled. They're reloaded when
+	// they're rotated.
+	var certs *certReloader
+	if cfg.SSLCert != "" && cfg.SSLKey != "" {
+		if certs, err = newCertReloader(cfg.SSLCert, cfg.SSLKey, cfg.TLSClientCAFile); err != nil {
+			return fmt.Errorf("failed to load TLS certificates: %v", err)
+		}
+		server.TLSConfig = newTLSConfig(cfg, certs)
+	}
+
+	cacheOptions := []amicache.Option{
+		amicache.OwnerAliases(cfg.OwnerAliases),
 		amicache.TagFilter(cfg.TagFilter),
 		amicache.StateTag(cfg.StateTag),
 		amicache.Regions(cfg.Regions...),
+		amicache.DiscoverRegions(cfg.DiscoverRegions),
+		amicache.RegionDiscoveryTTL(cfg.RegionDiscoveryTTL),
+		amicache.DiscoveryRegion(cfg.DiscoveryRegion),
 		amicache.TTL(cfg.CacheTTL),
 		amicache.MaxConcurrentRequests(cfg.CacheMaxConcurrentRequests),
 		amicache.MaxRequestRetries(cfg.CacheMaxRequestRetries),
+		amicache.RequestRate(cfg.CacheRequestRate),
+		amicache.RequestBurst(cfg.CacheRequestBurst),
 		amicache.CollectLaunchPermissions(cfg.CollectLaunchPermissions),
-		amicache.HTTPClient(httpClient),
+		amicache.PermissionTTL(cfg.CachePermissionTTL),
+		amicache.RefreshCooldown(cfg.AdminRefreshCooldown),
+		amicache.HTTPClient(sess.Config.HTTPClient),
+		amicache.EC2Endpoint(cfg.EC2Endpoint),
+		amicache.EC2RegionEndpoints(cfg.EC2RegionEndpoints),
 		amicache.Logger(logger),
-	)
+	}
 
-	// Create the query endpoint and use Apache Combined log format and
-	// compression.
-	api := handlers.CombinedLoggingHandler(
-		httpLogger,
-		handlers.CompressHandler(query.NewAPI(cache)),
-	)
+	for _, source := range cfg.Sources {
+		var src amicache.ImageSource
+		if source.File != "" {
+			src = amicache.NewFileSource(source.File)
+		} else {
+			src = amicache.NewURLSource(source.URL, sess.Config.HTTPClient)
+		}
+		cacheOptions = append(cacheOptions, amicache.AddSource(source.Name, src, source.TTL))
+	}
 
-	// Optionally add CORS support for allowed Origins.
-	if len(cfg.CorsAllowedOrigins) > 0 {
-		api = handlers.CORS(
-			handlers.AllowedMethods([]string{"GET"}),
-			handlers.AllowedOrigins(cfg.CorsAllowedOrigins),
-		)(api)
+	// In offline mode, the images are read from a catalog file instead of EC2.
+	var stsSvc stsiface.STSAPI = sts.New(sess, stsConfig(sess, cfg.STSEndpoint))
+	if cfg.CatalogFile != "" {
+		stsSvc = nil
+		catalog := amicache.NewFileSource(cfg.CatalogFile)
+		if cfg.OwnerIDs, err = catalogOwners(parent, catalog, cfg.OwnerIDs); err != nil {
+			return err
+		}
+		cacheOptions = append(cacheOptions, amicache.AddSource("catalog", catalog, 0))
 	}
 
-	// Register the route.
-	router.Handle(query.APIPathQuery, api).
+	cache := amicache.New(stsSvc, cfg.RoleName, cfg.OwnerIDs, cacheOptions...)
+
+	// Optionally require authentication for the query APIs.
+	authenticator, err := newAuthenticator(cfg)
+	if err != nil {
+		return err
+	}
+
+	// Optionally limit the images principals can see.
+	var policy *auth.Policy
+	if cfg.Policy != nil {
+		policy = auth.NewPolicy(cfg.Policy)
+	}
+
+	// Optionally limit the rate of requests of each client.
+	var limiter *ratelimit.Limiter
+	if cfg.RateLimit > 0 || len(cfg.RateLimitQuotas) > 0 {
+		limiter = ratelimit.New(
+			ratelimit.Limit{Rate: cfg.RateLimit, Burst: cfg.RateLimitBurst},
+			ratelimit.Quotas(cfg.RateLimitQuotas),
+		)
+	}
+
+	// Wraps the API endpoints to use authentication, rate limiting,
+	// authorization, Apache Combined log format and compression.
+	wrap := func(h http.Handler) http.Handler {
+		if policy != nil {
+			h = policy.Wrap(h)
+		}
+		if limiter != nil {
+			h = limiter.Wrap(h)
+		}
+		if authenticator != nil {
+			h = authenticator.Wrap(h)
+		}
+
+		h = handlers.CombinedLoggingHandler(httpLogger, handlers.CompressHandler(h))
+
+		// Optionally add CORS support for allowed Origins.
+		if len(cfg.CorsAllowedOrigins) > 0 {
+			corsOptions := []handlers.CORSOption{
+				handlers.AllowedMethods([]string{"GET"}),
+				handlers.AllowedOrigins(cfg.CorsAllowedOrigins),
+			}
+			if authenticator != nil {
+				corsOptions = append(corsOptions, handlers.AllowedHeaders([]string{"Authorization", auth.HeaderAPIKey}))
+			}
+			h = handlers.CORS(corsOptions...)(h)
+		}
+
+		return h
+	}
+
+	// Open the history store if it's enabled.
+	var store *history.Store
+	if cfg.HistoryFile != "" {
+		if store, err = history.Open(cfg.HistoryFile, cfg.HistoryRetention, logger); err != nil {
+			return err
+		}
+	}
+
+	// Register the routes.
+	queryOptions := []query.Option{query.History(store), query.MaxAge(cfg.HTTPMaxAge)}
+	queryAPI := wrap(query.NewAPI(cache, queryOptions...))
+	queryV2API := wrap(query.NewAPIV2(cache, queryOptions...))
+
+	// The v2 media type is matched first since it's only sent by v2 clients.
+	router.Handle(query.APIPathQuery, queryV2API).
+		HeadersRegexp("Accept", `application/vnd\.ami-query-v2\+json`).
+		Methods("GET")
+
+	router.Handle(query.APIPathQuery, queryAPI).
 		HeadersRegexp("Accept", `(application/vnd\.ami-query-v1\+json|\*/\*)`).
 		Methods("GET")
 
+	router.Handle(query.APIPathQuery, queryAPI).
+		HeadersRegexp("Accept", `(text/csv|application/x-ndjson|application/x-yaml)`).
+		Methods("GET")
+
+	router.Handle(query.APIPathQueryV2, queryV2API).
+		Methods("GET")
+
+	router.Handle(query.APIPathRegions, wrap(query.NewRegionsAPI(cache))).
+		Methods("GET")
+
+	router.Handle(query.APIPathOwners, wrap(query.NewOwnersAPI(cache))).
+		Methods("GET")
+
+	// Event streams are closed before the server's write timeout, after which
+	// clients reconnect and resume from their Last-Event-ID. Idle streams get
+	// heartbeats before they're closed.
+	router.Handle(query.APIPathEvents, wrap(query.NewEventsAPI(cache, server.WriteTimeout-time.Second))).
+		Methods("GET")
+
+	router.Handle(query.APIPathFeed, wrap(query.NewFeedAPI(cache))).
+		Methods("GET")
+
+	// The health API doesn't require authentication.
+	router.Handle(query.APIPathHealth, handlers.CombinedLoggingHandler(httpLogger, query.NewHealthAPI(cache))).
+		Methods("GET")
+
+	// Create the webhook dispatcher if any webhooks are configured.
+	var dispatcher *webhook.Dispatcher
+	if len(cfg.Webhooks) > 0 {
+		hooks := []webhook.Hook{}
+		for _, h := range cfg.Webhooks {
+			filter, err := query.NewFilter(cache, h.Filter)
+			if err != nil {
+				return fmt.Errorf("invalid filter for webhook %s: %v", h.URL, err)
+			}
+			hooks = append(hooks, webhook.Hook{ID: h.ID, URL: h.URL, Secret: h.Secret, Filter: filter})
+		}
+
+		dispatcher, err = webhook.New(
+			cache,
+			hooks,
+			webhook.QueueDir(cfg.WebhookQueueDir),
+			webhook.Logger(logger),
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Register the admin routes if they are enabled.
+	if cfg.AdminToken != "" {
+		refreshAPI := handlers.CombinedLoggingHandler(httpLogger, admin.NewRefreshAPI(cache, cfg.AdminToken))
+		router.Handle(admin.APIPathRefresh, refreshAPI).Methods("POST")
+		router.Handle(admin.APIPathRefresh+"/{id}", refreshAPI).Methods("GET")
+
+		if dispatcher != nil {
+			webhooksAPI := handlers.CombinedLoggingHandler(httpLogger, admin.NewWebhooksAPI(dispatcher, cfg.AdminToken))
+			router.Handle(admin.APIPathWebhookDeliveries, webhooksAPI).Methods("GET")
+		}
+
+		if limiter != nil {
+			rateLimitAPI := handlers.CombinedLoggingHandler(httpLogger, admin.NewRateLimitAPI(limiter, cfg.AdminToken))
+			router.Handle(admin.APIPathRateLimit, rateLimitAPI).Methods("GET")
+		}
+	}
+
 	// Create a group and context for running the services.
 	g := group.Group{}
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(parent)
 
 	// Used to block on waiting for the cache to warm.
 	warmed := make(chan struct{})
@@ -157,8 +343,8 @@ func main() {
 	// Add the http server.
 	g.Add(func() error {
 		<-warmed // Wait for the cache
-		if cfg.SSLCert != "" && cfg.SSLKey != "" {
-			return server.ListenAndServeTLS(cfg.SSLCert, cfg.SSLKey)
+		if certs != nil {
+			return server.ListenAndServeTLS("", "")
 		}
 		return server.ListenAndServe()
 	}, func(error) {
@@ -172,6 +358,15 @@ func main() {
 		level.Info(logger).Log("msg", "http server shutdown")
 	})
 
+	// Add the certificate reloader.
+	if certs != nil {
+		g.Add(func() error {
+			return certs.run(ctx, cfg.TLSReloadInterval, logger)
+		}, func(error) {
+			cancel()
+		})
+	}
+
 	// Add the signal trapper.
 	g.Add(func() error {
 		ch := make(chan os.Signal, 1)
@@ -182,11 +377,62 @@ func main() {
 		cancel()
 	})
 
-	// Start the service.
-	if err = g.Run(); err != nil {
-		level.Info(logger).Log("service", err)
-		os.Exit(1)
+	// Add the refresh trapper.
+	g.Add(func() error {
+		ch := make(chan os.Signal, 1)
+		signal.Notify(ch, syscall.SIGHUP)
+		defer signal.Stop(ch)
+		return refreshTrapper(ctx, ch, func() {
+			id, err := cache.Refresh(amicache.RefreshScope{Full: true})
+			if err != nil {
+				level.Warn(logger).Log("msg", "failed to force full cache refresh", "error", err)
+				return
+			}
+			level.Info(logger).Log("msg", "forcing full cache refresh", "refresh_id", id)
+		})
+	}, func(error) {
+		cancel()
+	})
+
+	// Add the event consumer if a queue is configured. It's unused in offline
+	// mode, since the events are about images in EC2.
+	if cfg.EventQueueURL != "" && cfg.CatalogFile == "" {
+		events := amicache.NewEventConsumer(
+			cache,
+			sqs.New(sess, queueConfig(cfg.EventQueueURL)),
+			cfg.EventQueueURL,
+		)
+		g.Add(func() error {
+			<-warmed // Wait for the cache
+			level.Info(logger).Log("msg", "consuming image events", "queue_url", cfg.EventQueueURL)
+			return events.Run(ctx)
+		}, func(error) {
+			cancel()
+		})
+	}
+
+	// Add the history recorder.
+	if store != nil {
+		g.Add(func() error {
+			defer store.Close()
+			<-warmed // Wait for the cache
+			return store.Run(ctx, cache)
+		}, func(error) {
+			cancel()
+		})
 	}
+
+	// Add the webhook dispatcher.
+	if dispatcher != nil {
+		g.Add(func() error {
+			return dispatcher.Run(ctx)
+		}, func(error) {
+			cancel()
+		})
+	}
+
+	// Start the service.
+	return g.Run()
 }
 
 // Signal trapper. It closes setup once it registers the signals.
@@ -199,6 +445,132 @@ func sigTrapper(ctx context.Context, ch <-chan os.Signal) error {
 	}
 }
 
+// Refresh trapper. It calls refresh every time a signal is received.
+func refreshTrapper(ctx context.Context, ch <-chan os.Signal, refresh func()) error {
+	for {
+		select {
+		case <-ch:
+			refresh()
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Returns the authentication middleware of the query APIs, which is nil if
+// neither API keys, a JWKS file nor a client CA bundle are configured. Its
+// audit entries are written to the audit log.
+func newAuthenticator(cfg *Config) (*auth.Middleware, error) {
+	authenticators := []auth.Authenticator{}
+
+	// Client certificates are verified by the server.
+	if cfg.TLSClientCAFile != "" {
+		authenticators = append(authenticators, auth.NewClientCertificates(cfg.TLSClientPrincipals))
+	}
+
+	if len(cfg.APIKeys) > 0 {
+		hashes := map[string]string{}
+		for _, key := range cfg.APIKeys {
+			hashes[key.Name] = key.SHA256
+		}
+		keys, err := auth.NewAPIKeys(hashes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load API keys: %v", err)
+		}
+		authenticators = append(authenticators, keys)
+	}
+
+	if cfg.JWKSFile != "" {
+		jwt, err := auth.NewJWT(cfg.JWKSFile, cfg.JWTIssuer, cfg.JWTAudience)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load JWKS: %v", err)
+		}
+		authenticators = append(authenticators, jwt)
+	}
+
+	if len(authenticators) == 0 {
+		return nil, nil
+	}
+
+	auditLog, err := setLogger(cfg.AuditLog)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set audit logging output: %v", err)
+	}
+	auditLogger := log.NewLogfmtLogger(log.NewSyncWriter(auditLog))
+	auditLogger = log.With(auditLogger, "ts", log.TimestampFormat(time.Now, "2006-01-02T15:04:05.000"))
+
+	return auth.New(authenticators, auth.AuditLogger(auditLogger)), nil
+}
+
+// Returns the AWS config of the STS client for an endpoint URL, which is empty
+// for the default endpoint. Requests to a custom endpoint are signed for
+// us-east-1 unless the session has a region.
+func stsConfig(sess *session.Session, endpoint string) *aws.Config {
+	cfg := aws.NewConfig()
+	if endpoint == "" {
+		return cfg
+	}
+	cfg = cfg.WithEndpoint(endpoint)
+	if aws.StringValue(sess.Config.Region) == "" {
+		cfg = cfg.WithRegion("us-east-1")
+	}
+	return cfg
+}
+
+// Returns the AWS config for an SQS queue URL. The region is taken from AWS
+// queue URLs, e.g. https://sqs.us-west-2.amazonaws.com/123456789012/queue.
+// Any other URL, such as a local SQS stand-in, is used as the endpoint.
+func queueConfig(queueURL string) *aws.Config {
+	cfg := aws.NewConfig().WithRegion("us-east-1")
+	u, err := url.Parse(queueURL)
+	if err != nil || u.Host == "" {
+		return cfg
+	}
+	if !strings.HasSuffix(u.Hostname(), ".amazonaws.com") {
+		return cfg.WithEndpoint(u.Scheme + "://" + u.Host)
+	}
+	parts := strings.Split(u.Hostname(), ".")
+	switch {
+	case len(parts) > 3 && parts[0] == "sqs":
+		cfg.Region = aws.String(parts[1])
+	case len(parts) > 3 && parts[1] == "queue":
+		cfg.Region = aws.String(parts[0])
+	}
+	return cfg
+}
+
+// Returns the owner IDs to cache in offline mode. They're the owners of the
+// catalog's images if ownerIDs is empty, otherwise the catalog must not have
+// images of other owners, which would never be cached.
+func catalogOwners(ctx context.Context, catalog amicache.ImageSource, ownerIDs []string) ([]string, error) {
+	partitions, err := catalog.Partitions(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read AMIQUERY_CATALOG_FILE: %v", err)
+	}
+
+	configured := map[string]bool{}
+	for _, owner := range ownerIDs {
+		configured[owner] = true
+	}
+
+	owners := []string{}
+	for _, p := range partitions {
+		if configured[p.OwnerID] {
+			continue
+		}
+		if len(ownerIDs) > 0 {
+			return nil, fmt.Errorf("AMIQUERY_CATALOG_FILE has AMIs of owner %s, which isn't in AMIQUERY_OWNER_IDS", p.OwnerID)
+		}
+		configured[p.OwnerID] = true
+		owners = append(owners, p.OwnerID)
+	}
+
+	if len(ownerIDs) > 0 {
+		return ownerIDs, nil
+	}
+	return owners, nil
+}
+
 // Creates a log file or returns os.Stderr if none is provided.
 func setLogger(file string) (io.Writer, error) {
 	logger := os.Stderr
@@ -6,11 +6,31 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"syscall"
 	"testing"
+	"time"
+
+	"github.com/intuit/ami-query/amicache"
+	"github.com/intuit/ami-query/api/auth"
+	"github.com/intuit/ami-query/api/query"
+	"github.com/intuit/ami-query/api/ratelimit"
+	"github.com/intuit/ami-query/awstest"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
 )
 
 func TestSigTrapper(t *testing.T) {
@@ -40,6 +60,103 @@ func TestSigTrapper(t *testing.T) {
 	}
 }
 
+func TestRefreshTrapper(t *testing.T) {
+	var (
+		errCh       = make(chan error)
+		sigCh       = make(chan os.Signal)
+		refreshed   = make(chan struct{})
+		ctx, cancel = context.WithCancel(context.Background())
+	)
+
+	go func() {
+		errCh <- refreshTrapper(ctx, sigCh, func() { refreshed <- struct{}{} })
+	}()
+
+	sigCh <- syscall.SIGHUP
+	<-refreshed
+	cancel()
+
+	if want, got := context.Canceled, <-errCh; want != got {
+		t.Errorf("want: %v, got: %v", want, got)
+	}
+}
+
+func TestQueueConfig(t *testing.T) {
+	tests := []struct {
+		url      string
+		region   string
+		endpoint string
+	}{
+		{"https://sqs.us-west-2.amazonaws.com/123456789012/foo", "us-west-2", ""},
+		{"https://eu-west-1.queue.amazonaws.com/123456789012/foo", "eu-west-1", ""},
+		{"http://localhost:9324/queue/foo", "us-east-1", "http://localhost:9324"},
+		{"%", "us-east-1", ""},
+	}
+	for _, tt := range tests {
+		cfg := queueConfig(tt.url)
+		if want, got := tt.region, aws.StringValue(cfg.Region); want != got {
+			t.Errorf("%s: want: %s, got: %s", tt.url, want, got)
+		}
+		if want, got := tt.endpoint, aws.StringValue(cfg.Endpoint); want != got {
+			t.Errorf("%s: want: %s, got: %s", tt.url, want, got)
+		}
+	}
+}
+
+func TestCatalogOwners(t *testing.T) {
+	tests := []struct {
+		name     string
+		file     string
+		ownerIDs []string
+		want     []string
+		err      error
+	}{
+		{"from_catalog", "testdata/catalog.yaml", nil, []string{"123456789012"}, nil},
+		{"configured", "testdata/catalog.yaml", []string{"123456789012", "210987654321"}, []string{"123456789012", "210987654321"}, nil},
+		{"unconfigured_owner", "testdata/catalog.yaml", []string{"210987654321"}, nil, errors.New("AMIQUERY_CATALOG_FILE has AMIs of owner 123456789012, which isn't in AMIQUERY_OWNER_IDS")},
+		{"missing_file", "testdata/missing.yaml", nil, nil, errors.New("failed to read AMIQUERY_CATALOG_FILE: open testdata/missing.yaml: no such file or directory")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := catalogOwners(context.Background(), amicache.NewFileSource(tt.file), tt.ownerIDs)
+			if !reflect.DeepEqual(tt.err, err) {
+				t.Fatalf("want: %v, got: %v", tt.err, err)
+			}
+			if !reflect.DeepEqual(tt.want, got) {
+				t.Errorf("want: %v, got: %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestSTSConfig(t *testing.T) {
+	tests := []struct {
+		name          string
+		sessionRegion string
+		endpoint      string
+		region        string
+	}{
+		{"default", "", "", ""},
+		{"endpoint", "", "https://sts.example.com", "us-east-1"},
+		{"endpoint_with_region", "us-west-2", "https://sts.example.com", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sess, err := session.NewSession(aws.NewConfig().WithRegion(tt.sessionRegion))
+			if err != nil {
+				t.Fatal(err)
+			}
+			cfg := stsConfig(sess, tt.endpoint)
+			if want, got := tt.endpoint, aws.StringValue(cfg.Endpoint); want != got {
+				t.Errorf("want: %s, got: %s", want, got)
+			}
+			if want, got := tt.region, aws.StringValue(cfg.Region); want != got {
+				t.Errorf("want: %s, got: %s", want, got)
+			}
+		})
+	}
+}
+
 func TestSetLoggerStderr(t *testing.T) {
 	logger, err := setLogger("")
 	if err != nil {
@@ -64,3 +181,280 @@ func TestSetLoggerBadFile(t *testing.T) {
 		t.Errorf("want: %s, got: %s", want, got)
 	}
 }
+
+// Returns a free local address to listen on.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// Gets a URL with an optional API key and decodes its JSON response into v.
+func getJSON(t *testing.T, url, apiKey string, v interface{}) {
+	t.Helper()
+	if want, got := http.StatusOK, get(t, url, apiKey, v); want != got {
+		t.Fatalf("want: status %d, got: status %d", want, got)
+	}
+}
+
+// Gets a url with an optional API key, decodes the JSON response into v and
+// returns its status.
+func get(t *testing.T, url, apiKey string, v interface{}) int {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", "*/*")
+	if apiKey != "" {
+		req.Header.Set(auth.HeaderAPIKey, apiKey)
+	}
+	rsp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rsp.Body.Close()
+	if err := json.NewDecoder(rsp.Body).Decode(v); err != nil {
+		t.Fatal(err)
+	}
+	return rsp.StatusCode
+}
+
+func TestRun(t *testing.T) {
+	srv := awstest.NewServer()
+	defer srv.Close()
+
+	srv.AddImage("us-west-2", awstest.Image{
+		ID:                "ami-1",
+		OwnerID:           "123456789012",
+		Name:              "rhel-1",
+		CreationDate:      "2020-06-01T00:00:00.000Z",
+		Tags:              map[string]string{"state": "available"},
+		LaunchPermissions: []string{"111111111111"},
+	})
+	srv.AddImage("us-west-2", awstest.Image{
+		ID:           "ami-2",
+		OwnerID:      "123456789012",
+		Name:         "rhel-2",
+		CreationDate: "2020-06-02T00:00:00.000Z",
+		Tags:         map[string]string{"state": "available"},
+	})
+	srv.AddImage("us-east-1", awstest.Image{ID: "ami-3", OwnerID: "123456789012"})
+	srv.AddImage("us-west-2", awstest.Image{ID: "ami-4", OwnerID: "210987654321"})
+	srv.DenyRole("210987654321")
+	srv.Throttle(awstest.ActionDescribeImageAttribute, 2)
+	srv.SetLatency(10 * time.Millisecond)
+
+	dir, err := ioutil.TempDir("", "ami-query")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := &Config{
+		ListenAddr:                 freeAddr(t),
+		RoleName:                   "ami-query",
+		OwnerIDs:                   []string{"123456789012", "210987654321"},
+		Regions:                    []string{"us-west-2", "us-east-1"},
+		CacheTTL:                   time.Hour,
+		CachePermissionTTL:         time.Hour,
+		CacheMaxConcurrentRequests: 2,
+		CacheMaxRequestRetries:     5,
+		CacheRequestRate:           100,
+		CacheRequestBurst:          10,
+		CollectLaunchPermissions:   true,
+		AdminRefreshCooldown:       time.Minute,
+		AppLog:                     filepath.Join(dir, "app.log"),
+		HTTPLog:                    filepath.Join(dir, "http.log"),
+		AuditLog:                   filepath.Join(dir, "audit.log"),
+		APIKeys: []APIKeyConfig{
+			{Name: "ci", SHA256: auth.HashAPIKey("ci-key")},
+			{Name: "team", SHA256: auth.HashAPIKey("team-key")},
+		},
+		Policy: map[string]auth.Rule{
+			"ci":   {},
+			"team": {Regions: []string{"us-east-1"}},
+		},
+		RateLimitQuotas: map[string]ratelimit.Limit{
+			"team": {Rate: 0.001, Burst: 1},
+		},
+	}
+
+	// The stand-in is used as the endpoint of both APIs, so the requests
+	// can't reach AWS.
+	cfg.STSEndpoint = srv.URL
+	cfg.EC2Endpoint = srv.URL
+	cfg.EventQueueURL = srv.URL + "/123456789012/ami-events"
+
+	sess, err := session.NewSession(aws.NewConfig().
+		WithHTTPClient(&http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}}).
+		WithCredentials(credentials.NewStaticCredentials("id", "secret", "")),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- run(ctx, cfg, sess, false) }()
+
+	// The server starts once the cache is warmed.
+	baseURL := "http://" + cfg.ListenAddr
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		rsp, err := http.Get(baseURL + query.APIPathHealth)
+		if err == nil {
+			rsp.Body.Close()
+			break
+		}
+		select {
+		case err := <-errCh:
+			t.Fatalf("run failed: %v", err)
+		default:
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the server")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	tests := []struct {
+		name  string
+		query string
+		want  []string
+	}{
+		{"region", "?region=us-west-2", []string{"ami-2", "ami-1"}},
+		{"regions", "?region=us-west-2&region=us-east-1", []string{"ami-2", "ami-1", "ami-3"}},
+		{"launch_permission", "?region=us-west-2&launch_permission=111111111111", []string{"ami-1"}},
+		{"denied_owner", "?region=us-west-2&owner_id=210987654321", []string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			results := []query.Result{}
+			getJSON(t, baseURL+query.APIPathQuery+tt.query, "ci-key", &results)
+			got := []string{}
+			for _, result := range results {
+				got = append(got, result.ID)
+			}
+			if !reflect.DeepEqual(tt.want, got) {
+				t.Errorf("want: %v, got: %v", tt.want, got)
+			}
+		})
+	}
+
+	// The team's results are limited to the region of its rule.
+	results := []query.Result{}
+	getJSON(t, baseURL+query.APIPathQuery+"?region=us-west-2&region=us-east-1", "team-key", &results)
+	if len(results) != 1 || results[0].ID != "ami-3" {
+		t.Errorf("want: [ami-3], got: %+v", results)
+	}
+
+	// The team's quota only allows one request, while the other clients
+	// aren't limited.
+	limitErr := query.Error{}
+	if want, got := http.StatusTooManyRequests, get(t, baseURL+query.APIPathQuery, "team-key", &limitErr); want != got {
+		t.Errorf("want: status %d, got: status %d", want, got)
+	}
+	if want, got := query.CodeRateLimited, limitErr.Code; want != got {
+		t.Errorf("want: %s, got: %s", want, got)
+	}
+
+	// The throttled launch permission requests were retried, and the denied
+	// owner is reported.
+	owners := []query.Owner{}
+	getJSON(t, baseURL+query.APIPathOwners, "ci-key", &owners)
+	if want, got := 2, len(owners); want != got {
+		t.Fatalf("want: %d owners, got: %d owners", want, got)
+	}
+	if want, got := 2, owners[0].Throttles; want != got {
+		t.Errorf("want: %d throttles, got: %d throttles", want, got)
+	}
+	if want, got := 3, owners[0].ImageCount; want != got {
+		t.Errorf("want: %d images, got: %d images", want, got)
+	}
+	if len(owners[0].Errors) != 0 || len(owners[1].Errors) == 0 {
+		t.Errorf("want: errors for %s only, got: %+v", owners[1].ID, owners)
+	}
+	if want, got := 2, srv.Calls(awstest.ActionAssumeRole); want > got {
+		t.Errorf("want: at least %d calls, got: %d calls", want, got)
+	}
+
+	// An image created after the cache was warmed is cached from its event,
+	// which is deleted from the queue.
+	srv.AddImage("us-east-1", awstest.Image{ID: "ami-5", OwnerID: "123456789012"})
+	srv.SendMessage(`{
+		"detail-type": "AWS API Call via CloudTrail",
+		"source": "aws.ec2",
+		"account": "123456789012",
+		"region": "us-east-1",
+		"detail": {"eventName": "CreateImage", "responseElements": {"imageId": "ami-5"}}
+	}`)
+	deadline = time.Now().Add(10 * time.Second)
+	for {
+		results := []query.Result{}
+		getJSON(t, baseURL+query.APIPathQuery+"?region=us-east-1", "ci-key", &results)
+		if len(results) == 2 && srv.Messages() == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("want: [ami-5 ami-3] and no messages, got: %+v and %d message(s)", results, srv.Messages())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Requests without a valid API key are rejected and audited, except for
+	// health checks.
+	apiErr := query.Error{}
+	if want, got := http.StatusUnauthorized, get(t, baseURL+query.APIPathQuery, "", &apiErr); want != got {
+		t.Errorf("want: status %d, got: status %d", want, got)
+	}
+	if want, got := query.CodeUnauthorized, apiErr.Code; want != got {
+		t.Errorf("want: %s, got: %s", want, got)
+	}
+	if want, got := http.StatusUnauthorized, get(t, baseURL+query.APIPathOwners, "bad-key", &apiErr); want != got {
+		t.Errorf("want: status %d, got: status %d", want, got)
+	}
+	health := query.Health{}
+	getJSON(t, baseURL+query.APIPathHealth, "", &health)
+	if want, got := "ok", health.Status; want != got {
+		t.Errorf("want: %s, got: %s", want, got)
+	}
+
+	audit, err := ioutil.ReadFile(cfg.AuditLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"principal=ci auth_method=api_key",
+		`path=/amis query="region=us-west-2&launch_permission=111111111111" status=200`,
+		`principal= auth_method= remote_addr=`,
+		`error="invalid api key"`,
+	} {
+		if !strings.Contains(string(audit), want) {
+			t.Errorf("want: %s in audit log, got: %s", want, audit)
+		}
+	}
+
+	// Connections the client dialed but didn't use would delay the server's
+	// shutdown.
+	http.DefaultClient.CloseIdleConnections()
+
+	cancel()
+	select {
+	case err := <-errCh:
+		if err != context.Canceled {
+			t.Errorf("want: %v, got: %v", context.Canceled, err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for run to return")
+	}
+}
@@ -0,0 +1,183 @@
+// Copyright 2020 Intuit, Inc.  All rights reserved.
+// Use of this source code is governed the MIT license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/intuit/ami-query/api/query"
+	"github.com/intuit/ami-query/client"
+)
+
+// The exit codes of the query subcommand. Like grep, no matches are
+// distinguished from errors.
+const (
+	exitMatch   = 0
+	exitNoMatch = 1
+	exitError   = 2
+)
+
+// The output formats of the query subcommand.
+const (
+	outputTable = "table"
+	outputJSON  = "json"
+	outputCSV   = "csv"
+)
+
+// stringsFlag is a flag that can be repeated.
+type stringsFlag []string
+
+func (s *stringsFlag) String() string { return strings.Join(*s, ",") }
+
+func (s *stringsFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// Runs the query subcommand, which queries a remote ami-query instance, and
+// returns its exit code.
+func runQuery(args []string, stdout, stderr io.Writer) int {
+	var (
+		fs      = flag.NewFlagSet("query", flag.ContinueOnError)
+		baseURL = fs.String("url", "http://localhost:8080", "The `url` of the ami-query instance")
+		owner   = fs.String("owner", "", "Only return AMIs owned by the `account`")
+		perm    = fs.String("launch-permission", "", "Only return AMIs the `account` can launch")
+		asOf    = fs.String("as-of", "", "Return the AMIs that were cached at the `time`, as an RFC 3339 timestamp or a date")
+		output  = fs.String("output", outputTable, "The output `format`: table, json or csv")
+		latest  = fs.Bool("latest", false, "Only return the newest matching AMI")
+		idOnly  = fs.Bool("id-only", false, "Only print the AMI IDs, one per line")
+		timeout = fs.Duration("timeout", 30*time.Second, "The `duration` to wait for results, including retries")
+		regions stringsFlag
+		images  stringsFlag
+		tags    stringsFlag
+		states  stringsFlag
+		fail    = func(format string, a ...interface{}) int {
+			fmt.Fprintf(stderr, "ami-query query: "+format+"\n", a...)
+			return exitError
+		}
+	)
+
+	fs.Var(&regions, "region", "Only return AMIs in the `region` (repeatable)")
+	fs.Var(&images, "ami", "Only return the AMI with the `id` (repeatable)")
+	fs.Var(&tags, "tag", "Only return AMIs with the tag set to the value, as `key:value` (repeatable)")
+	fs.Var(&states, "state", "Only return AMIs in the `state` (repeatable)")
+	fs.SetOutput(stderr)
+
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return exitMatch
+		}
+		return exitError
+	}
+	if fs.NArg() > 0 {
+		return fail("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+
+	switch *output {
+	case outputTable, outputJSON, outputCSV:
+	default:
+		return fail("invalid output format: %s", *output)
+	}
+
+	filter := client.NewFilter().
+		Region(regions...).
+		Image(images...).
+		State(states...)
+	for _, tag := range tags {
+		i := strings.Index(tag, ":")
+		if i < 1 {
+			return fail("invalid tag, want key:value: %s", tag)
+		}
+		filter.Tag(tag[:i], tag[i+1:])
+	}
+	if *owner != "" {
+		filter.Owner(*owner)
+	}
+	if *perm != "" {
+		filter.LaunchPermission(*perm)
+	}
+	if *asOf != "" {
+		t, err := query.ParseTime(*asOf)
+		if err != nil {
+			return fail("invalid as-of time: %s", *asOf)
+		}
+		filter.AsOf(t)
+	}
+
+	// Credentials are read from the environment rather than flags, so they
+	// aren't visible in the process list.
+	options := []client.Option{client.UserAgent("ami-query/" + version)}
+	if key := os.Getenv("AMIQUERY_API_KEY"); key != "" {
+		options = append(options, client.APIKey(key))
+	}
+	if token := os.Getenv("AMIQUERY_TOKEN"); token != "" {
+		options = append(options, client.BearerToken(token))
+	}
+
+	c, err := client.New(*baseURL, options...)
+	if err != nil {
+		return fail("%v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	var results []query.Result
+	if *latest {
+		result, err := c.Latest(ctx, filter)
+		if errors.Is(err, client.ErrNoMatch) {
+			return exitNoMatch
+		} else if err != nil {
+			return fail("%v", err)
+		}
+		results = []query.Result{result}
+	} else if results, err = c.Images(ctx, filter); err != nil {
+		return fail("%v", err)
+	}
+
+	if len(results) == 0 {
+		return exitNoMatch
+	}
+
+	switch {
+	case *idOnly:
+		for _, result := range results {
+			fmt.Fprintln(stdout, result.ID)
+		}
+	case *output == outputJSON:
+		enc := json.NewEncoder(stdout)
+		enc.SetEscapeHTML(false)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(results)
+	case *output == outputCSV:
+		err = query.WriteCSV(stdout, results, nil)
+	default:
+		err = writeTable(stdout, results)
+	}
+	if err != nil {
+		return fail("%v", err)
+	}
+
+	return exitMatch
+}
+
+// Writes the results as a table with a row per AMI. Tags are omitted.
+func writeTable(w io.Writer, results []query.Result) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tOWNER_ID\tREGION\tNAME\tCREATIONDATE")
+	for _, r := range results {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", r.ID, r.OwnerID, r.Region, r.Name, r.CreationDate)
+	}
+	return tw.Flush()
+}
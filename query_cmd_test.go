@@ -0,0 +1,217 @@
+// Copyright 2020 Intuit, Inc.  All rights reserved.
+// Use of this source code is governed the MIT license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/intuit/ami-query/api/auth"
+	"github.com/intuit/ami-query/api/query"
+)
+
+func TestRunQuery(t *testing.T) {
+	results := []query.Result{
+		{
+			ID:                 "ami-2",
+			OwnerID:            "123456789012",
+			Region:             "us-west-2",
+			Name:               "rhel-2",
+			VirtualizationType: "hvm",
+			CreationDate:       "2020-06-02T00:00:00.000Z",
+			Tags:               map[string]string{"state": "available", "os": "rhel"},
+		},
+		{
+			ID:                 "ami-1",
+			OwnerID:            "123456789012",
+			Region:             "us-west-2",
+			Name:               "rhel-1",
+			Description:        "RHEL, first build",
+			VirtualizationType: "hvm",
+			CreationDate:       "2020-06-01T00:00:00.000Z",
+			Tags:               map[string]string{"state": "available"},
+		},
+	}
+
+	// The query string of the last request.
+	var rawQuery string
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rawQuery = r.URL.RawQuery
+		q := r.URL.Query()
+		switch {
+		case q.Get("region") == "us-foo-1":
+			query.WriteError(w, r, query.NewError(http.StatusBadRequest, query.CodeUnknownRegion, "region",
+				"unknown or unsupported region: us-foo-1"))
+		case q.Get("tag") == "os:windows":
+			w.Write([]byte("[]\n"))
+		case q.Get("first") == "true":
+			json.NewEncoder(w).Encode(results[:1])
+		default:
+			json.NewEncoder(w).Encode(results)
+		}
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		name      string
+		args      []string
+		exitCode  int
+		rawQuery  string
+		stdout    string
+		stderrHas string
+	}{
+		{
+			name:     "table",
+			args:     []string{"-region", "us-west-2", "-region", "us-east-1", "-state", "available"},
+			exitCode: exitMatch,
+			rawQuery: "region=us-west-2&region=us-east-1&state=available",
+			stdout: "ID     OWNER_ID      REGION     NAME    CREATIONDATE\n" +
+				"ami-2  123456789012  us-west-2  rhel-2  2020-06-02T00:00:00.000Z\n" +
+				"ami-1  123456789012  us-west-2  rhel-1  2020-06-01T00:00:00.000Z\n",
+		},
+		{
+			name:     "csv",
+			args:     []string{"-output", "csv", "-tag", "os:rhel", "-owner", "123456789012"},
+			exitCode: exitMatch,
+			rawQuery: "owner_id=123456789012&tag=os%3Arhel",
+			stdout: "id,owner_id,region,name,description,virtualizationtype,creationdate,tag:os,tag:state\n" +
+				"ami-2,123456789012,us-west-2,rhel-2,,hvm,2020-06-02T00:00:00.000Z,rhel,available\n" +
+				"ami-1,123456789012,us-west-2,rhel-1,\"RHEL, first build\",hvm,2020-06-01T00:00:00.000Z,,available\n",
+		},
+		{
+			name:     "json",
+			args:     []string{"-output", "json", "-latest"},
+			exitCode: exitMatch,
+			rawQuery: "first=true",
+			stdout: "[\n  {\n" +
+				"    \"id\": \"ami-2\",\n" +
+				"    \"owner_id\": \"123456789012\",\n" +
+				"    \"region\": \"us-west-2\",\n" +
+				"    \"name\": \"rhel-2\",\n" +
+				"    \"description\": \"\",\n" +
+				"    \"virtualizationtype\": \"hvm\",\n" +
+				"    \"creationdate\": \"2020-06-02T00:00:00.000Z\",\n" +
+				"    \"tags\": {\n" +
+				"      \"os\": \"rhel\",\n" +
+				"      \"state\": \"available\"\n" +
+				"    }\n" +
+				"  }\n]\n",
+		},
+		{
+			name:     "id_only",
+			args:     []string{"-id-only", "-launch-permission", "111111111111", "-as-of", "2020-06-01"},
+			exitCode: exitMatch,
+			rawQuery: "as_of=2020-06-01T00%3A00%3A00Z&launch_permission=111111111111",
+			stdout:   "ami-2\nami-1\n",
+		},
+		{
+			name:     "latest_id_only",
+			args:     []string{"-latest", "-id-only", "-ami", "ami-1", "-ami", "ami-2"},
+			exitCode: exitMatch,
+			rawQuery: "ami=ami-1&ami=ami-2&first=true",
+			stdout:   "ami-2\n",
+		},
+		{
+			name:     "no_match",
+			args:     []string{"-tag", "os:windows"},
+			exitCode: exitNoMatch,
+			rawQuery: "tag=os%3Awindows",
+		},
+		{
+			name:     "latest_no_match",
+			args:     []string{"-latest", "-tag", "os:windows"},
+			exitCode: exitNoMatch,
+			rawQuery: "first=true&tag=os%3Awindows",
+		},
+		{
+			name:      "api_error",
+			args:      []string{"-region", "us-foo-1"},
+			exitCode:  exitError,
+			rawQuery:  "region=us-foo-1",
+			stderrHas: "unknown or unsupported region: us-foo-1",
+		},
+		{
+			name:      "bad_tag",
+			args:      []string{"-tag", "os"},
+			exitCode:  exitError,
+			stderrHas: "invalid tag",
+		},
+		{
+			name:      "bad_output",
+			args:      []string{"-output", "xml"},
+			exitCode:  exitError,
+			stderrHas: "invalid output format",
+		},
+		{
+			name:      "bad_as_of",
+			args:      []string{"-as-of", "yesterday"},
+			exitCode:  exitError,
+			stderrHas: "invalid as-of time",
+		},
+		{
+			name:      "bad_flag",
+			args:      []string{"-foo"},
+			exitCode:  exitError,
+			stderrHas: "flag provided but not defined",
+		},
+		{
+			name:      "extra_args",
+			args:      []string{"foo"},
+			exitCode:  exitError,
+			stderrHas: "unexpected arguments: foo",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rawQuery = ""
+			stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+
+			exitCode := runQuery(append([]string{"-url", ts.URL}, tt.args...), stdout, stderr)
+
+			if tt.exitCode != exitCode {
+				t.Errorf("want: exit %d, got: exit %d (%s)", tt.exitCode, exitCode, stderr)
+			}
+			if tt.rawQuery != rawQuery {
+				t.Errorf("want: %s, got: %s", tt.rawQuery, rawQuery)
+			}
+			if got := stdout.String(); tt.stdout != got {
+				t.Errorf("\n\twant: %q\n\t got: %q", tt.stdout, got)
+			}
+			if !strings.Contains(stderr.String(), tt.stderrHas) {
+				t.Errorf("want: %q in stderr, got: %q", tt.stderrHas, stderr)
+			}
+		})
+	}
+}
+
+func TestRunQueryCredentials(t *testing.T) {
+	var header http.Header
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+		w.Write([]byte("[]\n"))
+	}))
+	defer ts.Close()
+
+	defer os.Unsetenv("AMIQUERY_API_KEY")
+	defer os.Unsetenv("AMIQUERY_TOKEN")
+	os.Setenv("AMIQUERY_API_KEY", "ci-key")
+	os.Setenv("AMIQUERY_TOKEN", "token")
+
+	runQuery([]string{"-url", ts.URL}, &bytes.Buffer{}, &bytes.Buffer{})
+
+	if want, got := "ci-key", header.Get(auth.HeaderAPIKey); want != got {
+		t.Errorf("want: %s, got: %s", want, got)
+	}
+	if want, got := "Bearer token", header.Get("Authorization"); want != got {
+		t.Errorf("want: %s, got: %s", want, got)
+	}
+}
@@ -0,0 +1,162 @@
+// Copyright 2020 Intuit, Inc.  All rights reserved.
+// Use of this source code is governed the MIT license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// certReloader holds the server certificate and the client CA bundle, and
+// reloads them when their files change, so rotated certificates are used
+// without a restart.
+type certReloader struct {
+	certFile string
+	keyFile  string
+	caFile   string // optional
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	modTimes  map[string]time.Time // of the loaded files
+}
+
+// Returns a certReloader with the certificate and CA bundle loaded.
+func newCertReloader(certFile, keyFile, caFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile, caFile: caFile}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Loads the files. Nothing is replaced if any of them fails to load, e.g. if
+// the certificate was rotated but not its key yet.
+func (c *certReloader) load() error {
+	modTimes := c.stat()
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+
+	var pool *x509.CertPool
+	if c.caFile != "" {
+		data, err := ioutil.ReadFile(c.caFile)
+		if err != nil {
+			return err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return fmt.Errorf("%s: no certificates found", c.caFile)
+		}
+	}
+
+	c.mu.Lock()
+	c.cert = &cert
+	c.clientCAs = pool
+	c.modTimes = modTimes
+	c.mu.Unlock()
+
+	return nil
+}
+
+// Returns the modification times of the files. Files that can't be read have
+// a zero time.
+func (c *certReloader) stat() map[string]time.Time {
+	modTimes := map[string]time.Time{}
+	for _, file := range []string{c.certFile, c.keyFile, c.caFile} {
+		if file == "" {
+			continue
+		}
+		if info, err := os.Stat(file); err == nil {
+			modTimes[file] = info.ModTime()
+		} else {
+			modTimes[file] = time.Time{}
+		}
+	}
+	return modTimes
+}
+
+// Returns true if any of the files changed since they were loaded.
+func (c *certReloader) changed() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for file, modTime := range c.stat() {
+		if !modTime.Equal(c.modTimes[file]) {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks the files for changes every interval and reloads them, until the
+// context is done. Failed reloads are retried at the next interval.
+func (c *certReloader) run(ctx context.Context, interval time.Duration, logger log.Logger) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if !c.changed() {
+				continue
+			}
+			if err := c.load(); err != nil {
+				level.Warn(logger).Log("msg", "failed to reload tls certificates", "error", err)
+				continue
+			}
+			level.Info(logger).Log("msg", "reloaded tls certificates", "cert_file", c.certFile)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Returns the current server certificate. It's used as the GetCertificate
+// function of a tls.Config.
+func (c *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.cert == nil {
+		return nil, errors.New("no server certificate")
+	}
+	return c.cert, nil
+}
+
+// Returns the TLS configuration of the server. The certificate and client CAs
+// are taken from the reloader for every connection.
+func newTLSConfig(cfg *Config, certs *certReloader) *tls.Config {
+	tlsConfig := &tls.Config{
+		MinVersion:     cfg.TLSMinVersion,
+		CipherSuites:   cfg.TLSCipherSuites,
+		ClientAuth:     cfg.TLSClientAuth,
+		NextProtos:     []string{"h2", "http/1.1"},
+		GetCertificate: certs.getCertificate,
+	}
+
+	if cfg.TLSClientCAFile != "" {
+		base := tlsConfig.Clone()
+		tlsConfig.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			certs.mu.RLock()
+			defer certs.mu.RUnlock()
+			config := base.Clone()
+			config.ClientCAs = certs.clientCAs
+			return config, nil
+		}
+	}
+
+	return tlsConfig
+}
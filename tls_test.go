@@ -0,0 +1,300 @@
+// Copyright 2020 Intuit, Inc.  All rights reserved.
+// Use of this source code is governed the MIT license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+// testCert is a certificate and its key.
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+// Returns a certificate with the common name signed by the CA, or a
+// self-signed CA if ca is nil.
+func newTestCert(t *testing.T, ca *testCert, cn string) *testCert {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn, Organization: []string{"Example"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	parent, parentKey := tmpl, key
+	if ca == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		parent, parentKey = ca.cert, ca.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testCert{
+		cert: cert,
+		key:  key,
+		pem:  pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	}
+}
+
+// Returns the certificate and key for a TLS client.
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.cert.Raw}, PrivateKey: c.key}
+}
+
+// Writes the certificate and key files, and sets their modification time so
+// the change is detected regardless of the file system's precision.
+func (c *testCert) write(t *testing.T, certFile, keyFile string, modTime time.Time) {
+	t.Helper()
+
+	der, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+
+	for file, data := range map[string][]byte{certFile: c.pem, keyFile: keyPEM} {
+		if err := ioutil.WriteFile(file, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(file, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Returns a client that trusts the CA and presents the certificate, if any,
+// even if it isn't issued by a CA the server accepts.
+func newTLSClient(t *testing.T, ca *testCert, cert *testCert, maxVersion uint16) *http.Client {
+	t.Helper()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	config := &tls.Config{RootCAs: roots, MaxVersion: maxVersion}
+	if cert != nil {
+		clientCert := cert.tlsCertificate()
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return &clientCert, nil
+		}
+	}
+
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+}
+
+func TestTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ami-query")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var (
+		certFile = filepath.Join(dir, "server.crt")
+		keyFile  = filepath.Join(dir, "server.key")
+		caFile   = filepath.Join(dir, "client_ca.pem")
+		serverCA = newTestCert(t, nil, "server-ca")
+		clientCA = newTestCert(t, nil, "client-ca")
+		client   = newTestCert(t, clientCA, "client")
+		otherCA  = newTestCert(t, nil, "other-ca")
+		other    = newTestCert(t, otherCA, "other")
+		start    = time.Now().Add(-time.Hour)
+	)
+
+	newTestCert(t, serverCA, "server-1").write(t, certFile, keyFile, start)
+	if err := ioutil.WriteFile(caFile, clientCA.pem, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	certs, err := newCertReloader(certFile, keyFile, caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &Config{
+		TLSClientCAFile: caFile,
+		TLSClientAuth:   tls.VerifyClientCertIfGiven,
+		TLSMinVersion:   tls.VersionTLS12,
+	}
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", newTLSConfig(cfg, certs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// The handler responds with the common name of the client certificate.
+	go http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.VerifiedChains) > 0 {
+			w.Write([]byte(r.TLS.VerifiedChains[0][0].Subject.CommonName))
+		}
+	}))
+
+	url := "https://" + l.Addr().String()
+
+	// Returns the common names of the server and client certificates of a
+	// request.
+	get := func(c *http.Client) (string, string, error) {
+		rsp, err := c.Get(url)
+		if err != nil {
+			return "", "", err
+		}
+		defer rsp.Body.Close()
+		body, err := ioutil.ReadAll(rsp.Body)
+		if err != nil {
+			return "", "", err
+		}
+		return rsp.TLS.PeerCertificates[0].Subject.CommonName, string(body), nil
+	}
+
+	tests := []struct {
+		name       string
+		client     *http.Client
+		wantServer string
+		wantClient string
+		wantErr    bool
+	}{
+		{"client_cert", newTLSClient(t, serverCA, client, 0), "server-1", "client", false},
+		{"no_client_cert", newTLSClient(t, serverCA, nil, 0), "server-1", "", false},
+		{"untrusted_client_cert", newTLSClient(t, serverCA, other, 0), "", "", true},
+		{"old_tls_version", newTLSClient(t, serverCA, client, tls.VersionTLS11), "", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, client, err := get(tt.client)
+			if tt.wantErr != (err != nil) {
+				t.Fatalf("want: error %t, got: %v", tt.wantErr, err)
+			}
+			if tt.wantServer != server || tt.wantClient != client {
+				t.Errorf("want: %s %s, got: %s %s", tt.wantServer, tt.wantClient, server, client)
+			}
+		})
+	}
+
+	// The rotated server certificate and client CA bundle are used by new
+	// connections once they're reloaded, so the other client is trusted.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go certs.run(ctx, 10*time.Millisecond, log.NewNopLogger())
+
+	newTestCert(t, serverCA, "server-2").write(t, certFile, keyFile, start.Add(time.Minute))
+	if err := ioutil.WriteFile(caFile, append(clientCA.pem, otherCA.pem...), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(caFile, start.Add(time.Minute), start.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c := newTLSClient(t, serverCA, other, 0)
+		c.Transport.(*http.Transport).DisableKeepAlives = true
+		server, client, err := get(c)
+		if err == nil && server == "server-2" && client == "other" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for reload, got: %s %s %v", server, client, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCertReloaderErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ami-query")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var (
+		certFile = filepath.Join(dir, "server.crt")
+		keyFile  = filepath.Join(dir, "server.key")
+		caFile   = filepath.Join(dir, "client_ca.pem")
+		ca       = newTestCert(t, nil, "ca")
+		start    = time.Now().Add(-time.Hour)
+	)
+
+	newTestCert(t, ca, "server-1").write(t, certFile, keyFile, start)
+	if err := ioutil.WriteFile(caFile, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := newCertReloader(certFile, keyFile, caFile); err == nil {
+		t.Error("want: error, got: nil")
+	}
+
+	certs, err := newCertReloader(certFile, keyFile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A certificate rotated without its key isn't loaded, and the previous
+	// one is kept.
+	if err := ioutil.WriteFile(certFile, newTestCert(t, ca, "server-2").pem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if !certs.changed() {
+		t.Error("want: changed, got: unchanged")
+	}
+	if err := certs.load(); err == nil {
+		t.Error("want: error, got: nil")
+	}
+	cert, err := certs.getCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := "server-1", leaf.Subject.CommonName; want != got {
+		t.Errorf("want: %s, got: %s", want, got)
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright 2020 Intuit, Inc.  All rights reserved.
+// Use of this source code is governed the MIT license
+// that can be found in the LICENSE file.
+
+package webhook
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// queue holds the pending deliveries. If dir is set, each delivery is also
+// stored in its own file so pending deliveries survive restarts.
+type queue struct {
+	dir     string
+	pending map[string]Delivery
+	mu      sync.Mutex // guards pending
+}
+
+// Opens the queue, loading any deliveries stored in dir.
+func openQueue(dir string) (*queue, error) {
+	q := &queue{dir: dir, pending: map[string]Delivery{}}
+	if dir == "" {
+		return q, nil
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		var delivery Delivery
+		if err := json.Unmarshal(data, &delivery); err != nil {
+			return nil, err
+		}
+		q.pending[delivery.ID] = delivery
+	}
+
+	return q, nil
+}
+
+// Adds or replaces a delivery.
+func (q *queue) put(delivery Delivery) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.dir != "" {
+		data, err := json.Marshal(delivery)
+		if err != nil {
+			return err
+		}
+		// Write to a temporary file first so a delivery is never partially
+		// written.
+		tmp := q.path(delivery.ID) + ".tmp"
+		if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, q.path(delivery.ID)); err != nil {
+			return err
+		}
+	}
+
+	q.pending[delivery.ID] = delivery
+	return nil
+}
+
+// Removes a delivery.
+func (q *queue) remove(id string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	delete(q.pending, id)
+
+	if q.dir != "" {
+		if err := os.Remove(q.path(id)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Returns the deliveries due to be attempted.
+func (q *queue) due(now time.Time) []Delivery {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	deliveries := []Delivery{}
+	for _, delivery := range q.pending {
+		if !delivery.NextAttempt.After(now) {
+			deliveries = append(deliveries, delivery)
+		}
+	}
+	return deliveries
+}
+
+// Returns the time of the next attempt, if there are pending deliveries.
+func (q *queue) nextAttempt() (time.Time, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var next time.Time
+	for _, delivery := range q.pending {
+		if next.IsZero() || delivery.NextAttempt.Before(next) {
+			next = delivery.NextAttempt
+		}
+	}
+	return next, !next.IsZero()
+}
+
+// Returns every pending delivery.
+func (q *queue) all() []Delivery {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	deliveries := []Delivery{}
+	for _, delivery := range q.pending {
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries
+}
+
+// Returns the file a delivery is stored in. IDs are hex encoded, but any path
+// separators are replaced to keep the file in the queue directory.
+func (q *queue) path(id string) string {
+	return filepath.Join(q.dir, strings.Replace(id, string(filepath.Separator), "_", -1)+".json")
+}
@@ -0,0 +1,481 @@
+// Copyright 2020 Intuit, Inc.  All rights reserved.
+// Use of this source code is governed the MIT license
+// that can be found in the LICENSE file.
+
+// Package webhook notifies HTTP endpoints of AMI state transitions and
+// deregistrations detected by an amicache.Cache.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/intuit/ami-query/amicache"
+	"github.com/intuit/ami-query/api/query"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// The headers sent with each delivery.
+const (
+	HeaderDelivery  = "X-Ami-Query-Delivery"
+	HeaderEvent     = "X-Ami-Query-Event"
+	HeaderSignature = "X-Ami-Query-Signature"
+	HeaderTimestamp = "X-Ami-Query-Timestamp"
+)
+
+// The maximum number of completed deliveries kept in the delivery log.
+const maxLoggedDeliveries = 100
+
+// Option is the option interface. It has private methods to prevent its use
+// from outside of this package.
+type Option interface {
+	set(*Dispatcher)
+}
+
+// optionFunc is a function adapter that implements the Option interface.
+type optionFunc func(*Dispatcher)
+
+func (fn optionFunc) set(d *Dispatcher) { fn(d) }
+
+// QueueDir sets the directory used to persist pending deliveries. Pending
+// deliveries are only kept in memory if it isn't set.
+func QueueDir(dir string) Option {
+	return optionFunc(func(d *Dispatcher) {
+		d.queueDir = dir
+	})
+}
+
+// MaxAttempts sets the maximum number of attempts made for a delivery.
+func MaxAttempts(max int) Option {
+	return optionFunc(func(d *Dispatcher) {
+		if max > 0 {
+			d.maxAttempts = max
+		}
+	})
+}
+
+// Workers sets the maximum number of deliveries attempted at once.
+func Workers(n int) Option {
+	return optionFunc(func(d *Dispatcher) {
+		if n > 0 {
+			d.workers = n
+		}
+	})
+}
+
+// HTTPClient sets the HTTP client used to make deliveries.
+func HTTPClient(client *http.Client) Option {
+	return optionFunc(func(d *Dispatcher) {
+		if client != nil {
+			d.client = client
+		}
+	})
+}
+
+// Logger sets the logger.
+func Logger(logger log.Logger) Option {
+	return optionFunc(func(d *Dispatcher) {
+		if logger != nil {
+			d.logger = logger
+		}
+	})
+}
+
+// Hook is a webhook target. Secret is used to sign the payloads sent to URL.
+// Only changes to images matching Filter, before or after the change, are
+// sent. A nil Filter matches every image. ID identifies the hook of queued
+// deliveries, and defaults to the hook's index.
+type Hook struct {
+	ID     string
+	URL    string
+	Secret string
+	Filter *amicache.Filter
+}
+
+// DeliveryState is the state of a delivery.
+type DeliveryState string
+
+// The states of a delivery.
+const (
+	DeliveryPending   DeliveryState = "pending"
+	DeliveryDelivered DeliveryState = "delivered"
+	DeliveryFailed    DeliveryState = "failed"
+)
+
+// Delivery is a payload sent, or to be sent, to a webhook.
+type Delivery struct {
+	ID          string          `json:"id"`
+	HookID      string          `json:"hook_id"`
+	URL         string          `json:"url"`
+	Event       string          `json:"event"`
+	ImageID     string          `json:"image_id"`
+	State       DeliveryState   `json:"state"`
+	Attempts    int             `json:"attempts"`
+	StatusCode  int             `json:"status_code,omitempty"`
+	Error       string          `json:"error,omitempty"`
+	Created     time.Time       `json:"created"`
+	Updated     time.Time       `json:"updated"`
+	NextAttempt time.Time       `json:"next_attempt"`
+	Payload     json.RawMessage `json:"payload"`
+}
+
+// Payload is the JSON body POSTed to a webhook.
+type Payload struct {
+	ID         string    `json:"id"`
+	Generation uint64    `json:"generation"`
+	Time       time.Time `json:"time"`
+	query.Change
+}
+
+// Dispatcher sends the state transitions and deregistrations of cached images
+// to webhooks.
+type Dispatcher struct {
+	cache       changer
+	generation  uint64 // The last cache generation queued
+	hooks       []Hook
+	queue       *queue
+	queueDir    string
+	maxAttempts int
+	workers     int
+	backoffBase time.Duration
+	backoffMax  time.Duration
+	client      *http.Client
+	logger      log.Logger
+	completed   []Delivery // Recently completed deliveries, oldest first
+	completedMu sync.Mutex // guards completed
+}
+
+// New returns a Dispatcher for the hooks, which must have unique IDs.
+// Deliveries pending in the queue directory are loaded and sent to the hook
+// with the same ID once it's running.
+func New(cache *amicache.Cache, hooks []Hook, options ...Option) (*Dispatcher, error) {
+	return newDispatcher(cache, hooks, options...)
+}
+
+func newDispatcher(cache changer, hooks []Hook, options ...Option) (*Dispatcher, error) {
+	d := Dispatcher{
+		cache:       cache,
+		generation:  cache.Generation(),
+		hooks:       make([]Hook, len(hooks)),
+		maxAttempts: 10,
+		workers:     10,
+		backoffBase: 5 * time.Second,
+		backoffMax:  time.Hour,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		logger:      log.NewNopLogger(),
+	}
+
+	for _, opt := range options {
+		opt.set(&d)
+	}
+
+	ids := map[string]struct{}{}
+	for i, hook := range hooks {
+		if hook.ID == "" {
+			hook.ID = strconv.Itoa(i)
+		}
+		if _, ok := ids[hook.ID]; ok {
+			return nil, fmt.Errorf("duplicate webhook id: %s", hook.ID)
+		}
+		ids[hook.ID] = struct{}{}
+		d.hooks[i] = hook
+	}
+
+	var err error
+	if d.queue, err = openQueue(d.queueDir); err != nil {
+		return nil, fmt.Errorf("failed to open webhook queue: %v", err)
+	}
+
+	return &d, nil
+}
+
+// Run queues a delivery for every matching change made to the cache since the
+// Dispatcher was created, and sends the pending deliveries, until the context
+// is done.
+func (d *Dispatcher) Run(ctx context.Context) error {
+	for {
+		sets, complete, changed := d.cache.ChangesSince(d.generation)
+		if !complete {
+			level.Warn(d.logger).Log("webhook", "changes_missed", "generation", d.generation)
+			d.generation = d.cache.Generation()
+		}
+
+		for _, set := range sets {
+			d.generation = set.Generation
+			d.enqueue(set)
+		}
+
+		d.deliver(ctx)
+
+		var (
+			timer *time.Timer
+			next  <-chan time.Time
+		)
+		if due, ok := d.queue.nextAttempt(); ok {
+			timer = time.NewTimer(time.Until(due))
+			next = timer.C
+		}
+
+		select {
+		case <-changed:
+		case <-next:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// Deliveries returns the pending and recently completed deliveries, newest
+// first.
+func (d *Dispatcher) Deliveries() []Delivery {
+	deliveries := d.queue.all()
+
+	d.completedMu.Lock()
+	deliveries = append(deliveries, d.completed...)
+	d.completedMu.Unlock()
+
+	sort.SliceStable(deliveries, func(i, j int) bool {
+		return deliveries[i].Created.After(deliveries[j].Created)
+	})
+
+	return deliveries
+}
+
+// Queues a delivery to every hook matching a state change or removal.
+func (d *Dispatcher) enqueue(set amicache.ChangeSet) {
+	for _, change := range set.Changes {
+		if change.Type != amicache.ImageStateChanged && change.Type != amicache.ImageRemoved {
+			continue
+		}
+
+		for _, hook := range d.hooks {
+			if hook.Filter != nil && !query.MatchChange(hook.Filter, change) {
+				continue
+			}
+
+			id, err := newID()
+			if err != nil {
+				level.Error(d.logger).Log("webhook", "failed", "url", hook.URL, "error", err)
+				continue
+			}
+
+			payload, err := json.Marshal(Payload{
+				ID:         id,
+				Generation: set.Generation,
+				Time:       set.Time,
+				Change:     query.NewChange(change),
+			})
+			if err != nil {
+				level.Error(d.logger).Log("webhook", "failed", "url", hook.URL, "error", err)
+				continue
+			}
+
+			now := time.Now()
+			delivery := Delivery{
+				ID:          id,
+				HookID:      hook.ID,
+				URL:         hook.URL,
+				Event:       string(change.Type),
+				ImageID:     *change.Image.Image.ImageId,
+				State:       DeliveryPending,
+				Created:     now,
+				Updated:     now,
+				NextAttempt: now,
+				Payload:     payload,
+			}
+
+			if err := d.queue.put(delivery); err != nil {
+				level.Error(d.logger).Log("webhook", "failed", "url", hook.URL, "delivery", id, "error", err)
+			}
+		}
+	}
+}
+
+// Attempts every delivery that is due, using up to d.workers at once.
+func (d *Dispatcher) deliver(ctx context.Context) {
+	var (
+		due        = d.queue.due(time.Now())
+		deliveries = make(chan Delivery)
+		wg         = sync.WaitGroup{}
+	)
+
+	for i := 0; i < d.workers && i < len(due); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for delivery := range deliveries {
+				d.attempt(ctx, delivery)
+			}
+		}()
+	}
+
+	for _, delivery := range due {
+		deliveries <- delivery
+	}
+	close(deliveries)
+	wg.Wait()
+}
+
+// Makes a delivery attempt and updates the queue with the result.
+func (d *Dispatcher) attempt(ctx context.Context, delivery Delivery) {
+	logger := log.With(d.logger, "hook", delivery.HookID, "delivery", delivery.ID)
+
+	hook, ok := d.hook(delivery.HookID)
+	if !ok {
+		delivery.Error = "webhook is no longer configured"
+		d.complete(logger, delivery, DeliveryFailed)
+		return
+	}
+
+	logger = log.With(logger, "url", hook.URL)
+	delivery.URL = hook.URL
+	delivery.Attempts++
+	delivery.Updated = time.Now()
+	delivery.StatusCode, delivery.Error = 0, ""
+
+	statusCode, err := d.post(ctx, hook, delivery)
+	if ctx.Err() != nil {
+		return // Try again the next time it's running.
+	}
+
+	delivery.StatusCode = statusCode
+
+	if err == nil {
+		d.complete(logger, delivery, DeliveryDelivered)
+		return
+	}
+
+	delivery.Error = err.Error()
+	if delivery.Attempts >= d.maxAttempts {
+		d.complete(logger, delivery, DeliveryFailed)
+		return
+	}
+
+	delivery.NextAttempt = time.Now().Add(backoff(delivery.Attempts-1, d.backoffBase, d.backoffMax))
+	level.Warn(logger).Log("webhook", "retrying", "attempts", delivery.Attempts, "error", err)
+
+	if err := d.queue.put(delivery); err != nil {
+		level.Error(logger).Log("webhook", "failed", "error", err)
+	}
+}
+
+// Sends the delivery to the hook. It returns an error for non-2xx responses.
+func (d *Dispatcher) post(ctx context.Context, hook Hook, delivery Delivery) (int, error) {
+	req, err := http.NewRequest("POST", hook.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+
+	timestamp := time.Now().Unix()
+
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderDelivery, delivery.ID)
+	req.Header.Set(HeaderEvent, delivery.Event)
+	req.Header.Set(HeaderTimestamp, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(HeaderSignature, Sign(hook.Secret, timestamp, delivery.Payload))
+
+	rsp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer rsp.Body.Close()
+	io.Copy(ioutil.Discard, rsp.Body)
+
+	if rsp.StatusCode < 200 || rsp.StatusCode > 299 {
+		return rsp.StatusCode, fmt.Errorf("unexpected response: %s", rsp.Status)
+	}
+
+	return rsp.StatusCode, nil
+}
+
+// Removes a delivery from the queue and adds it to the delivery log.
+func (d *Dispatcher) complete(logger log.Logger, delivery Delivery, state DeliveryState) {
+	delivery.State = state
+	delivery.NextAttempt = time.Time{}
+
+	if err := d.queue.remove(delivery.ID); err != nil {
+		level.Error(logger).Log("webhook", "failed", "error", err)
+	}
+
+	d.completedMu.Lock()
+	d.completed = append(d.completed, delivery)
+	if len(d.completed) > maxLoggedDeliveries {
+		d.completed = append([]Delivery{}, d.completed[len(d.completed)-maxLoggedDeliveries:]...)
+	}
+	d.completedMu.Unlock()
+
+	if state == DeliveryDelivered {
+		level.Info(logger).Log("webhook", state, "attempts", delivery.Attempts, "status_code", delivery.StatusCode)
+	} else {
+		level.Warn(logger).Log("webhook", state, "attempts", delivery.Attempts, "error", delivery.Error)
+	}
+}
+
+// Returns the hook with the provided ID.
+func (d *Dispatcher) hook(id string) (Hook, bool) {
+	for _, hook := range d.hooks {
+		if hook.ID == id {
+			return hook, true
+		}
+	}
+	return Hook{}, false
+}
+
+// Sign returns the signature of a payload sent at timestamp, in seconds since
+// the Unix epoch. It's the hex encoded HMAC-SHA256 of the timestamp, a period
+// and the payload, prefixed with "sha256=". Signing the timestamp allows
+// receivers to reject replayed deliveries.
+func Sign(secret string, timestamp int64, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10) + "."))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Returns a random delivery ID.
+func newID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Returns the delay before the next attempt, doubling from base up to max.
+func backoff(attempt int, base, max time.Duration) time.Duration {
+	delay := base
+	for i := 0; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
+
+// changer is used to represent an amicache.Cache. Used to mock the cache in
+// tests.
+type changer interface {
+	Generation() uint64
+	ChangesSince(uint64) ([]amicache.ChangeSet, bool, <-chan struct{})
+}
@@ -0,0 +1,361 @@
+// Copyright 2020 Intuit, Inc.  All rights reserved.
+// Use of this source code is governed the MIT license
+// that can be found in the LICENSE file.
+
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/intuit/ami-query/amicache"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+type mockCache struct {
+	mu      sync.Mutex
+	sets    []amicache.ChangeSet
+	changed chan struct{}
+}
+
+func newMockCache() *mockCache {
+	return &mockCache{changed: make(chan struct{})}
+}
+
+func (m *mockCache) Generation() uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return uint64(len(m.sets))
+}
+
+func (m *mockCache) ChangesSince(generation uint64) ([]amicache.ChangeSet, bool, <-chan struct{}) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]amicache.ChangeSet{}, m.sets[generation:]...), true, m.changed
+}
+
+// Records a change set with the provided changes.
+func (m *mockCache) record(changes ...amicache.Change) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sets = append(m.sets, amicache.ChangeSet{
+		Generation: uint64(len(m.sets) + 1),
+		Time:       time.Now(),
+		Changes:    changes,
+	})
+	close(m.changed)
+	m.changed = make(chan struct{})
+}
+
+// Returns a cached image in the provided state.
+func newImage(id, state string) amicache.Image {
+	return amicache.Image{
+		OwnerID: "123456789012",
+		Region:  "us-west-2",
+		Image: &ec2.Image{
+			ImageId: aws.String(id),
+			Tags: []*ec2.Tag{{
+				Key:   aws.String(amicache.DefaultStateTag),
+				Value: aws.String(state),
+			}},
+		},
+	}
+}
+
+// Waits for the dispatcher to have the expected number of deliveries in the
+// provided state.
+func waitForDeliveries(t *testing.T, d *Dispatcher, state DeliveryState, want int) []Delivery {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		deliveries := []Delivery{}
+		for _, delivery := range d.Deliveries() {
+			if delivery.State == state {
+				deliveries = append(deliveries, delivery)
+			}
+		}
+		if len(deliveries) == want {
+			return deliveries
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("want: %d %s deliveries, got: %d", want, state, len(deliveries))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDispatcher(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		received = []Payload{}
+		failures = 1
+	)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		timestamp, err := strconv.ParseInt(r.Header.Get(HeaderTimestamp), 10, 64)
+		if err != nil {
+			t.Error(err)
+		}
+		if want, got := Sign("secret", timestamp, body), r.Header.Get(HeaderSignature); want != got {
+			t.Errorf("want: %s, got: %s", want, got)
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		// Fail the first delivery to test retries.
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		var payload Payload
+		if err := json.Unmarshal(body, &payload); err != nil {
+			t.Error(err)
+		}
+		if want, got := payload.ID, r.Header.Get(HeaderDelivery); want != got {
+			t.Errorf("want: %s, got: %s", want, got)
+		}
+		received = append(received, payload)
+	}))
+	defer ts.Close()
+
+	var (
+		cache = newMockCache()
+		hooks = []Hook{{
+			URL:    ts.URL,
+			Secret: "secret",
+			Filter: amicache.NewFilter(amicache.FilterByTags(map[string][]string{
+				amicache.DefaultStateTag: {"available"},
+			})),
+		}}
+	)
+
+	d, err := newDispatcher(cache, hooks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.backoffBase = 10 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error)
+	go func() { errCh <- d.Run(ctx) }()
+
+	available := newImage("ami-1", "available")
+	cache.record(
+		amicache.Change{Type: amicache.ImageAdded, Image: newImage("ami-2", "available")},
+		amicache.Change{Type: amicache.ImageStateChanged, Image: newImage("ami-1", "deprecated"), Previous: &available},
+		amicache.Change{Type: amicache.ImageRemoved, Image: newImage("ami-3", "available")},
+		amicache.Change{Type: amicache.ImageRemoved, Image: newImage("ami-4", "development")},
+	)
+
+	deliveries := waitForDeliveries(t, d, DeliveryDelivered, 2)
+
+	cancel()
+	if want, got := context.Canceled, <-errCh; want != got {
+		t.Errorf("want: %v, got: %v", want, got)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	got := map[string]string{}
+	for _, payload := range received {
+		got[payload.Image.ID] = string(payload.Type)
+	}
+
+	want := map[string]string{"ami-1": "state_changed", "ami-3": "removed"}
+	if len(want) != len(got) || want["ami-1"] != got["ami-1"] || want["ami-3"] != got["ami-3"] {
+		t.Errorf("want: %v, got: %v", want, got)
+	}
+
+	attempts := 0
+	for _, delivery := range deliveries {
+		attempts += delivery.Attempts
+	}
+	if want, got := 3, attempts; want != got {
+		t.Errorf("want: %d attempts, got: %d attempts", want, got)
+	}
+}
+
+func TestDispatcherFailed(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+
+	cache := newMockCache()
+	d, err := newDispatcher(cache, []Hook{{URL: ts.URL}}, MaxAttempts(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.backoffBase = 10 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go d.Run(ctx)
+
+	cache.record(amicache.Change{Type: amicache.ImageRemoved, Image: newImage("ami-1", "available")})
+
+	delivery := waitForDeliveries(t, d, DeliveryFailed, 1)[0]
+	if want, got := 2, delivery.Attempts; want != got {
+		t.Errorf("want: %d attempts, got: %d attempts", want, got)
+	}
+	if want, got := http.StatusInternalServerError, delivery.StatusCode; want != got {
+		t.Errorf("want: %d, got: %d", want, got)
+	}
+}
+
+func TestDispatcherPersistentQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webhook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Queue a delivery without running the dispatcher.
+	cache := newMockCache()
+	d, err := newDispatcher(cache, []Hook{{URL: "http://localhost/hook"}}, QueueDir(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.record(amicache.Change{Type: amicache.ImageRemoved, Image: newImage("ami-1", "available")})
+	sets, _, _ := cache.ChangesSince(0)
+	d.enqueue(sets[0])
+
+	// The delivery is loaded by a new dispatcher and sent once it's running.
+	received := make(chan string, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header.Get(HeaderEvent)
+	}))
+	defer ts.Close()
+
+	d, err = newDispatcher(newMockCache(), []Hook{{URL: ts.URL}}, QueueDir(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitForDeliveries(t, d, DeliveryPending, 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go d.Run(ctx)
+
+	if want, got := "removed", <-received; want != got {
+		t.Errorf("want: %s, got: %s", want, got)
+	}
+
+	// The delivery is sent to the hook's current URL.
+	if want, got := ts.URL, waitForDeliveries(t, d, DeliveryDelivered, 1)[0].URL; want != got {
+		t.Errorf("want: %s, got: %s", want, got)
+	}
+
+	if q, err := openQueue(dir); err != nil {
+		t.Fatal(err)
+	} else if len(q.all()) != 0 {
+		t.Errorf("want: empty queue, got: %v", q.all())
+	}
+}
+
+func TestDispatcherWorkers(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		active  int
+		maxSeen int
+	)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		active++
+		if active > maxSeen {
+			maxSeen = active
+		}
+		mu.Unlock()
+
+		time.Sleep(20 * time.Millisecond)
+
+		mu.Lock()
+		active--
+		mu.Unlock()
+	}))
+	defer ts.Close()
+
+	cache := newMockCache()
+	d, err := newDispatcher(cache, []Hook{{URL: ts.URL}}, Workers(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	changes := []amicache.Change{}
+	for _, id := range []string{"ami-1", "ami-2", "ami-3", "ami-4", "ami-5"} {
+		changes = append(changes, amicache.Change{Type: amicache.ImageRemoved, Image: newImage(id, "available")})
+	}
+	cache.record(changes...)
+	go d.Run(ctx)
+
+	waitForDeliveries(t, d, DeliveryDelivered, 5)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if maxSeen > 2 {
+		t.Errorf("want: at most 2 concurrent deliveries, got: %d", maxSeen)
+	}
+}
+
+func TestDispatcherHookIDs(t *testing.T) {
+	// Hooks with the same URL are kept apart by their IDs.
+	hooks := []Hook{{URL: "http://localhost/hook"}, {URL: "http://localhost/hook"}, {ID: "foo", URL: "http://localhost/hook"}}
+	d, err := newDispatcher(newMockCache(), hooks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"0", "1", "foo"} {
+		if _, ok := d.hook(id); !ok {
+			t.Errorf("want: hook %s, got: none", id)
+		}
+	}
+
+	hooks = append(hooks, Hook{ID: "1", URL: "http://localhost/other"})
+	if _, err := newDispatcher(newMockCache(), hooks); err == nil {
+		t.Error("want: duplicate webhook id error, got: <nil>")
+	}
+}
+
+func TestSign(t *testing.T) {
+	want := "sha256=b93d9737abdf4b0245575697b852a4dc0b9517897fd7f7955f72eaf90b53673b"
+	if got := Sign("key", 1591012800, []byte("The quick brown fox jumps over the lazy dog")); want != got {
+		t.Errorf("want: %s, got: %s", want, got)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{0, time.Second},
+		{1, 2 * time.Second},
+		{3, 8 * time.Second},
+		{10, time.Minute},
+	}
+	for _, tt := range tests {
+		if got := backoff(tt.attempt, time.Second, time.Minute); tt.want != got {
+			t.Errorf("attempt %d: want: %s, got: %s", tt.attempt, tt.want, got)
+		}
+	}
+}